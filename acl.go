@@ -5,6 +5,18 @@
 
 package main
 
+import (
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/config"
+)
+
 type AccessMode int
 
 const (
@@ -12,75 +24,321 @@ const (
 	AccessModeFull         = AccessMode(0)
 	AccessModeLimited      = AccessMode(1)
 	AccessModeMinimal      = AccessMode(2)
+	AccessModeAdmin        = AccessMode(3)
 )
 
-var (
-	fullAccessCommandAllowList = map[string]bool{
-		"bind":                true,
-		"bind_ack":            true,
-		"bitcoind":            true,
-		"create_wallet":       true,
-		"finish_psbt":         true,
-		"set_member":          true,
-		"remove_member":       true,
-		"start_bitcoind":      true,
-		"stop_bitcoind":       true,
-		"get_bitcoind_status": true,
-	}
-	limitedAccessCommandAllowList = map[string]bool{
-		"bind":                true,
-		"bind_ack":            true,
-		"bitcoind":            true,
-		"get_bitcoind_status": true,
-	}
-	minimalAccessCommandAllowList = map[string]bool{
-		"bind":                true,
-		"bind_ack":            true,
-		"bitcoind":            true,
-		"get_bitcoind_status": true,
-	}
-
-	commandAllowList = map[AccessMode]map[string]bool{
-		AccessModeFull:    fullAccessCommandAllowList,
-		AccessModeLimited: limitedAccessCommandAllowList,
-		AccessModeMinimal: minimalAccessCommandAllowList,
+// accessModeRoles maps access modes to roles of the ACL policy
+var accessModeRoles = map[AccessMode]string{
+	AccessModeFull:    "full",
+	AccessModeAdmin:   "admin",
+	AccessModeLimited: "limited",
+	AccessModeMinimal: "minimal",
+}
+
+// optionalRoles are roles which are allowed to be absent from the ACL policy.
+// An absent role is allowed to use nothing.
+var optionalRoles = map[string]bool{
+	"admin": true,
+}
+
+// accessModeRanks orders access modes by their privileges
+var accessModeRanks = map[AccessMode]int{
+	AccessModeNotApplicant: 0,
+	AccessModeMinimal:      1,
+	AccessModeLimited:      2,
+	AccessModeAdmin:        3,
+	AccessModeFull:         4,
+}
+
+// adminForbiddenCommands are commands which are never granted to admins
+var adminForbiddenCommands = map[string]bool{
+	"create_wallet": true,
+	"finish_psbt":   true,
+}
+
+// IsMemberAccessMode returns whether an access mode could be granted to a member
+func (m AccessMode) IsMemberAccessMode() bool {
+	_, ok := accessModeRoles[m]
+	return ok
+}
+
+// Rank returns the privilege rank of an access mode. Invalid access modes are ranked as not applicant.
+func (m AccessMode) Rank() int {
+	return accessModeRanks[m]
+}
+
+// CanGrantAccessMode returns whether a DID of the granter access mode is allowed to
+// grant the target access mode to a member, or to update or remove a member of it.
+// Full access is allowed to grant any access mode. Admins are only allowed to grant
+// access modes ranked below admin. Others are not allowed to grant anything.
+func CanGrantAccessMode(granter, target AccessMode) bool {
+	switch granter {
+	case AccessModeFull:
+		return true
+	case AccessModeAdmin:
+		return target.Rank() < AccessModeAdmin.Rank()
+	default:
+		return false
 	}
-)
+}
+
+// supportedCommands are commands that are able to be granted by the ACL policy
+var supportedCommands = map[string]bool{
+	"bind":                   true,
+	"bind_ack":               true,
+	"unbind":                 true,
+	"revoke_binding":         true,
+	"list_bindings":          true,
+	"bitcoind":               true,
+	"create_wallet":          true,
+	"finish_psbt":            true,
+	"set_member":             true,
+	"remove_member":          true,
+	"list_members":           true,
+	"set_member_profile":     true,
+	"start_bitcoind":         true,
+	"stop_bitcoind":          true,
+	"get_bitcoind_status":    true,
+	"set_member_rpc_policy":  true,
+	"get_member_rpc_policy":  true,
+	"set_spending_limit":     true,
+	"get_spending_limit":     true,
+	"add_trusted_address":    true,
+	"remove_trusted_address": true,
+	"list_trusted_addresses": true,
+	"approve_psbt":           true,
+	"reject_psbt":            true,
+	"list_pending_psbts":     true,
+	"cancel_pending_tx":      true,
+	"list_pending_txs":       true,
+	"transfer_ownership":     true,
+	"get_ownership_history":  true,
+	"get_audit_log":          true,
+	"verify_audit_log":       true,
+	"export_backup":          true,
+	"import_backup":          true,
+	"rotate_identity":        true,
+	"get_identity_rotations": true,
+	"create_invite":          true,
+	"revoke_invite":          true,
+	"list_invites":           true,
+}
+
+//go:embed acl_policy.yaml
+var defaultACLPolicy []byte
+
+// ACLPolicy defines commands and bitcoind RPCs each role is allowed to use
+// along with the argument constraints of bitcoind RPCs
+type ACLPolicy struct {
+	Roles          map[string]*RolePolicy          `yaml:"roles"`
+	RPCConstraints map[string][]ArgumentConstraint `yaml:"rpc_constraints"`
+}
+
+// RolePolicy is the allow lists of a role
+type RolePolicy struct {
+	Commands     []string `yaml:"commands"`
+	BitcoindRPCs []string `yaml:"bitcoind_rpcs"`
+
+	commandAllowList    map[string]bool
+	bitcoinRPCAllowList map[string]bool
+}
+
+// ArgumentConstraint is a rule for a named parameter of a bitcoind RPC
+type ArgumentConstraint struct {
+	Param     string      `yaml:"param"`
+	Max       *float64    `yaml:"max"`
+	Equals    interface{} `yaml:"equals"`
+	Force     interface{} `yaml:"force"`
+	Forbidden bool        `yaml:"forbidden"`
+}
 
 var (
-	fullAccessBitcoinRPCAllowList = map[string]bool{
-		"getbalances":            true,
-		"getblockchaininfo":      true,
-		"getmininginfo":          true,
-		"getnettotals":           true,
-		"getnetworkinfo":         true,
-		"getnewaddress":          true,
-		"getreceivedbyaddress":   true,
-		"gettransaction":         true,
-		"getwalletinfo":          true,
-		"listtransactions":       true,
-		"walletcreatefundedpsbt": true,
-	}
-	limitedAccessBitcoinRPCAllowList = map[string]bool{}
-	minimalAccessBitcoinRPCAllowList = map[string]bool{}
-
-	bitcoinRPCAllowList = map[AccessMode]map[string]bool{
-		AccessModeFull:    fullAccessBitcoinRPCAllowList,
-		AccessModeLimited: limitedAccessBitcoinRPCAllowList,
-		AccessModeMinimal: minimalAccessBitcoinRPCAllowList,
-	}
+	aclPolicyLock sync.RWMutex
+	aclPolicy     *ACLPolicy
 )
 
+func init() {
+	p, err := ParseACLPolicy(defaultACLPolicy)
+	if err != nil {
+		panic(fmt.Errorf("invalid default acl policy: %s", err))
+	}
+	SetACLPolicy(p)
+
+	config.RegisterFile("acl_policy_file", LoadACLPolicyFile)
+}
+
+// ParseACLPolicy parses and validates an ACL policy in YAML or JSON
+func ParseACLPolicy(b []byte) (*ACLPolicy, error) {
+	var p ACLPolicy
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return nil, err
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// validate checks the policy and builds allow lists for lookup
+func (p *ACLPolicy) validate() error {
+	if p.Roles == nil {
+		p.Roles = make(map[string]*RolePolicy)
+	}
+	for _, role := range accessModeRoles {
+		if _, ok := p.Roles[role]; !ok {
+			if !optionalRoles[role] {
+				return fmt.Errorf("role %s is not defined", role)
+			}
+			p.Roles[role] = &RolePolicy{}
+		}
+	}
+
+	for name, role := range p.Roles {
+		if !isKnownRole(name) {
+			return fmt.Errorf("unknown role: %s", name)
+		}
+		if role == nil {
+			return fmt.Errorf("role %s is empty", name)
+		}
+
+		role.commandAllowList = make(map[string]bool)
+		for _, command := range role.Commands {
+			if !supportedCommands[command] {
+				return fmt.Errorf("unsupported command in role %s: %s", name, command)
+			}
+			if name == accessModeRoles[AccessModeAdmin] && adminForbiddenCommands[command] {
+				return fmt.Errorf("command %s is never allowed for role %s", command, name)
+			}
+			role.commandAllowList[command] = true
+		}
+
+		role.bitcoinRPCAllowList = make(map[string]bool)
+		for _, method := range role.BitcoindRPCs {
+			if method == "" {
+				return fmt.Errorf("empty bitcoind rpc in role %s", name)
+			}
+			role.bitcoinRPCAllowList[method] = true
+		}
+	}
+
+	for method, constraints := range p.RPCConstraints {
+		for _, constraint := range constraints {
+			if err := constraint.validate(method); err != nil {
+				return fmt.Errorf("invalid constraint of %s: %s", method, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isKnownRole returns whether a role name maps to an access mode
+func isKnownRole(name string) bool {
+	for _, role := range accessModeRoles {
+		if role == name {
+			return true
+		}
+	}
+	return false
+}
+
+// role returns the role policy of an access mode
+func (p *ACLPolicy) role(mode AccessMode) *RolePolicy {
+	name, ok := accessModeRoles[mode]
+	if !ok {
+		return nil
+	}
+	return p.Roles[name]
+}
+
+// SetACLPolicy replaces the ACL policy in use
+func SetACLPolicy(p *ACLPolicy) {
+	aclPolicyLock.Lock()
+	defer aclPolicyLock.Unlock()
+	aclPolicy = p
+}
+
+// currentACLPolicy returns the ACL policy in use
+func currentACLPolicy() *ACLPolicy {
+	aclPolicyLock.RLock()
+	defer aclPolicyLock.RUnlock()
+	return aclPolicy
+}
+
+// LoadACLPolicyFile loads the ACL policy from a file. The default policy
+// is used if the file is not given.
+func LoadACLPolicyFile(file string) error {
+	b := defaultACLPolicy
+	if file != "" {
+		var err error
+		if b, err = ioutil.ReadFile(file); err != nil {
+			return err
+		}
+	}
+
+	p, err := ParseACLPolicy(b)
+	if err != nil {
+		return err
+	}
+	SetACLPolicy(p)
+	return nil
+}
+
 func HasCommandAccess(command string, mode AccessMode) bool {
-	_, ok := commandAllowList[mode][command]
-	return ok
+	role := currentACLPolicy().role(mode)
+	if role == nil {
+		return false
+	}
+	return role.commandAllowList[command]
+}
+
+// IsBitcoinRPCAllowListed returns whether a RPC method could ever be granted to a client.
+func IsBitcoinRPCAllowListed(rpcCommand string) bool {
+	return currentACLPolicy().role(AccessModeFull).bitcoinRPCAllowList[rpcCommand]
+}
+
+// BitcoinRPCAllowList returns the bitcoind RPC methods allowed for an access mode
+func BitcoinRPCAllowList(mode AccessMode) []string {
+	role := currentACLPolicy().role(mode)
+	if role == nil {
+		return []string{}
+	}
+
+	methods := make([]string, 0, len(role.bitcoinRPCAllowList))
+	for m := range role.bitcoinRPCAllowList {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
 }
 
+// HasBitcoinRPCAccess checks whether a RPC method is allowed for the given access mode.
+// A non-nil memberAllowList is the custom allow list of a member and it takes
+// precedence over the default allow list of the access mode. Methods which are not
+// in the full access allow list are never allowed.
+//
 // TODO: this method could be integrated in to `HasRPCAccess`
-func HasBitcoinRPCAccess(rpcCommand string, mode AccessMode) bool {
+func HasBitcoinRPCAccess(rpcCommand string, mode AccessMode, memberAllowList []string) bool {
 	if mode == AccessModeNotApplicant {
 		return false
 	}
-	_, allowed := bitcoinRPCAllowList[mode][rpcCommand]
-	return allowed
+
+	if memberAllowList != nil {
+		if !IsBitcoinRPCAllowListed(rpcCommand) {
+			return false
+		}
+		for _, m := range memberAllowList {
+			if m == rpcCommand {
+				return true
+			}
+		}
+		return false
+	}
+
+	role := currentACLPolicy().role(mode)
+	if role == nil {
+		return false
+	}
+	return role.bitcoinRPCAllowList[rpcCommand]
 }
@@ -6,9 +6,16 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/config"
 )
 
 type ACLTestSuite struct {
@@ -17,19 +24,54 @@ type ACLTestSuite struct {
 
 func (suite *ACLTestSuite) TestHasCommandAccess() {
 	access := map[string]map[AccessMode]bool{
-		"bind":                {AccessModeFull: true, AccessModeLimited: true, AccessModeMinimal: true},
-		"bind_ack":            {AccessModeFull: true, AccessModeLimited: true, AccessModeMinimal: true},
-		"bitcoind":            {AccessModeFull: true, AccessModeLimited: true, AccessModeMinimal: true},
-		"get_bitcoind_status": {AccessModeFull: true, AccessModeLimited: true, AccessModeMinimal: true},
+		"bind":                {AccessModeFull: true, AccessModeAdmin: true, AccessModeLimited: true, AccessModeMinimal: true},
+		"bind_ack":            {AccessModeFull: true, AccessModeAdmin: true, AccessModeLimited: true, AccessModeMinimal: true},
+		"bitcoind":            {AccessModeFull: true, AccessModeAdmin: true, AccessModeLimited: true, AccessModeMinimal: true},
+		"get_bitcoind_status": {AccessModeFull: true, AccessModeAdmin: true, AccessModeLimited: true, AccessModeMinimal: true},
 		"create_wallet":       {AccessModeFull: true},
 		"finish_psbt":         {AccessModeFull: true},
-		"set_member":          {AccessModeFull: true},
-		"remove_member":       {AccessModeFull: true},
-		"start_bitcoind":      {AccessModeFull: true},
-		"stop_bitcoind":       {AccessModeFull: true},
+		"set_member":          {AccessModeFull: true, AccessModeAdmin: true},
+		"remove_member":       {AccessModeFull: true, AccessModeAdmin: true},
+		"list_members":        {AccessModeFull: true},
+		"set_member_profile":  {AccessModeFull: true},
+		"start_bitcoind":      {AccessModeFull: true, AccessModeAdmin: true},
+		"stop_bitcoind":       {AccessModeFull: true, AccessModeAdmin: true},
+
+		"set_member_rpc_policy": {AccessModeFull: true},
+		"get_member_rpc_policy": {AccessModeFull: true},
+		"set_spending_limit":    {AccessModeFull: true},
+		"get_spending_limit":    {AccessModeFull: true},
+
+		"add_trusted_address":    {AccessModeFull: true},
+		"remove_trusted_address": {AccessModeFull: true},
+		"list_trusted_addresses": {AccessModeFull: true},
+
+		"approve_psbt":       {AccessModeFull: true, AccessModeLimited: true},
+		"reject_psbt":        {AccessModeFull: true, AccessModeLimited: true},
+		"list_pending_psbts": {AccessModeFull: true, AccessModeLimited: true},
+		"cancel_pending_tx":  {AccessModeFull: true},
+		"list_pending_txs":   {AccessModeFull: true},
+
+		"transfer_ownership":    {AccessModeFull: true},
+		"get_ownership_history": {AccessModeFull: true},
+		"accept_ownership":      {},
+
+		"get_audit_log":    {AccessModeFull: true},
+		"verify_audit_log": {AccessModeFull: true},
+
+		"export_backup": {AccessModeFull: true},
+		"import_backup": {AccessModeFull: true},
+
+		"rotate_identity":        {AccessModeFull: true},
+		"get_identity_rotations": {AccessModeFull: true, AccessModeAdmin: true, AccessModeLimited: true, AccessModeMinimal: true},
+
+		"create_invite": {AccessModeFull: true},
+		"revoke_invite": {AccessModeFull: true},
+		"list_invites":  {AccessModeFull: true},
+		"redeem_invite": {},
 	}
 	for command, access := range access {
-		for _, mode := range []AccessMode{AccessModeNotApplicant, AccessModeFull, AccessModeLimited, AccessModeMinimal} {
+		for _, mode := range []AccessMode{AccessModeNotApplicant, AccessModeFull, AccessModeAdmin, AccessModeLimited, AccessModeMinimal} {
 			suite.Equal(access[mode], HasCommandAccess(command, mode))
 		}
 	}
@@ -50,6 +92,19 @@ func (suite *ACLTestSuite) TestHasBitcoinRPCAccess() {
 			"listtransactions":       true,
 			"walletcreatefundedpsbt": true,
 		},
+		AccessModeAdmin: {
+			"getbalances":            false,
+			"getblockchaininfo":      false,
+			"getmininginfo":          false,
+			"getnettotals":           false,
+			"getnetworkinfo":         false,
+			"getnewaddress":          false,
+			"getreceivedbyaddress":   false,
+			"gettransaction":         false,
+			"getwalletinfo":          false,
+			"listtransactions":       false,
+			"walletcreatefundedpsbt": false,
+		},
 		AccessModeLimited: {
 			"getbalances":            false,
 			"getblockchaininfo":      false,
@@ -92,11 +147,360 @@ func (suite *ACLTestSuite) TestHasBitcoinRPCAccess() {
 	}
 	for mode, access := range access {
 		for rpc, allowed := range access {
-			suite.Equal(allowed, HasBitcoinRPCAccess(rpc, mode))
+			suite.Equal(allowed, HasBitcoinRPCAccess(rpc, mode, nil))
 		}
 	}
 }
 
+func (suite *ACLTestSuite) TestHasBitcoinRPCAccessWithMemberAllowList() {
+	memberAllowList := []string{"getbalances", "getnewaddress", "dumpprivkey"}
+
+	suite.True(HasBitcoinRPCAccess("getbalances", AccessModeMinimal, memberAllowList))
+	suite.True(HasBitcoinRPCAccess("getnewaddress", AccessModeLimited, memberAllowList))
+	suite.False(HasBitcoinRPCAccess("listtransactions", AccessModeFull, memberAllowList))
+	suite.False(HasBitcoinRPCAccess("getbalances", AccessModeNotApplicant, memberAllowList))
+
+	// methods out of the full access allow list are never allowed
+	suite.False(HasBitcoinRPCAccess("dumpprivkey", AccessModeFull, memberAllowList))
+
+	// an empty allow list forbids every method
+	suite.False(HasBitcoinRPCAccess("getbalances", AccessModeFull, []string{}))
+}
+
+func (suite *ACLTestSuite) TestCanGrantAccessMode() {
+	modes := []AccessMode{AccessModeNotApplicant, AccessModeFull, AccessModeAdmin, AccessModeLimited, AccessModeMinimal}
+	for _, target := range modes {
+		suite.True(CanGrantAccessMode(AccessModeFull, target))
+		suite.False(CanGrantAccessMode(AccessModeLimited, target))
+		suite.False(CanGrantAccessMode(AccessModeMinimal, target))
+		suite.False(CanGrantAccessMode(AccessModeNotApplicant, target))
+	}
+
+	suite.False(CanGrantAccessMode(AccessModeAdmin, AccessModeFull))
+	suite.False(CanGrantAccessMode(AccessModeAdmin, AccessModeAdmin))
+	suite.True(CanGrantAccessMode(AccessModeAdmin, AccessModeLimited))
+	suite.True(CanGrantAccessMode(AccessModeAdmin, AccessModeMinimal))
+	suite.True(CanGrantAccessMode(AccessModeAdmin, AccessModeNotApplicant))
+}
+
+func (suite *ACLTestSuite) TestAccessModeRank() {
+	suite.Greater(AccessModeFull.Rank(), AccessModeAdmin.Rank())
+	suite.Greater(AccessModeAdmin.Rank(), AccessModeLimited.Rank())
+	suite.Greater(AccessModeLimited.Rank(), AccessModeMinimal.Rank())
+	suite.Greater(AccessModeMinimal.Rank(), AccessModeNotApplicant.Rank())
+	suite.Equal(AccessModeNotApplicant.Rank(), AccessMode(10).Rank())
+
+	suite.True(AccessModeAdmin.IsMemberAccessMode())
+	suite.False(AccessModeNotApplicant.IsMemberAccessMode())
+	suite.False(AccessMode(10).IsMemberAccessMode())
+}
+
+func (suite *ACLTestSuite) TearDownTest() {
+	suite.NoError(LoadACLPolicyFile(""))
+}
+
+func (suite *ACLTestSuite) TestParseACLPolicy() {
+	p, err := ParseACLPolicy([]byte(`
+roles:
+  full:
+    commands: [bind, bitcoind]
+    bitcoind_rpcs: [getbalances]
+  limited:
+    commands: [bind]
+  minimal:
+    commands: []
+rpc_constraints:
+  listtransactions:
+    - param: count
+      max: 10
+`))
+	suite.NoError(err)
+	SetACLPolicy(p)
+
+	suite.True(HasCommandAccess("bitcoind", AccessModeFull))
+	suite.False(HasCommandAccess("finish_psbt", AccessModeFull))
+	suite.False(HasCommandAccess("bitcoind", AccessModeLimited))
+	suite.True(HasBitcoinRPCAccess("getbalances", AccessModeFull, nil))
+	suite.False(HasBitcoinRPCAccess("getnewaddress", AccessModeFull, nil))
+	suite.Equal([]string{"getbalances"}, BitcoinRPCAllowList(AccessModeFull))
+	suite.Equal([]string{}, BitcoinRPCAllowList(AccessModeLimited))
+
+	// the admin role is optional
+	suite.False(HasCommandAccess("bind", AccessModeAdmin))
+}
+
+func (suite *ACLTestSuite) TestParseACLPolicyInJSON() {
+	_, err := ParseACLPolicy([]byte(`{
+		"roles": {
+			"full": {"commands": ["bind"], "bitcoind_rpcs": ["getbalances"]},
+			"limited": {"commands": ["bind"]},
+			"minimal": {"commands": ["bind"]}
+		}
+	}`))
+	suite.NoError(err)
+}
+
+func (suite *ACLTestSuite) TestParseInvalidACLPolicy() {
+	policies := map[string]string{
+		"missing role": `
+roles:
+  full:
+    commands: [bind]
+  limited:
+    commands: [bind]
+`,
+		"unknown role": `
+roles:
+  full: {}
+  limited: {}
+  minimal: {}
+  guest: {}
+`,
+		"unsupported command": `
+roles:
+  full:
+    commands: [dump_wallet]
+  limited: {}
+  minimal: {}
+`,
+		"admin with finish_psbt": `
+roles:
+  full: {}
+  admin:
+    commands: [set_member, finish_psbt]
+  limited: {}
+  minimal: {}
+`,
+		"unknown field": `
+roles:
+  full:
+    command: [bind]
+  limited: {}
+  minimal: {}
+`,
+		"unknown constraint param": `
+roles:
+  full: {}
+  limited: {}
+  minimal: {}
+rpc_constraints:
+  listtransactions:
+    - param: limit
+      max: 10
+`,
+		"unknown nested param": `
+roles:
+  full: {}
+  limited: {}
+  minimal: {}
+rpc_constraints:
+  walletcreatefundedpsbt:
+    - param: option.replaceable
+      equals: true
+`,
+		"constraint with two rules": `
+roles:
+  full: {}
+  limited: {}
+  minimal: {}
+rpc_constraints:
+  getnewaddress:
+    - param: address_type
+      equals: bech32
+      force: bech32
+`,
+		"constraint without rule": `
+roles:
+  full: {}
+  limited: {}
+  minimal: {}
+rpc_constraints:
+  listtransactions:
+    - param: count
+`,
+	}
+
+	for name, policy := range policies {
+		_, err := ParseACLPolicy([]byte(policy))
+		suite.Error(err, name)
+	}
+}
+
+func (suite *ACLTestSuite) TestLoadACLPolicyFileKeepsPolicyOnError() {
+	dir, err := ioutil.TempDir("", "acl")
+	suite.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "acl_policy.yaml")
+	suite.NoError(ioutil.WriteFile(file, []byte(`
+roles:
+  full:
+    commands: [bind]
+  limited: {}
+  minimal: {}
+`), 0600))
+	suite.NoError(LoadACLPolicyFile(file))
+	suite.False(HasCommandAccess("bitcoind", AccessModeFull))
+
+	suite.NoError(ioutil.WriteFile(file, []byte("roles: {}"), 0600))
+	suite.Error(LoadACLPolicyFile(file))
+	suite.True(HasCommandAccess("bind", AccessModeFull))
+	suite.False(HasCommandAccess("bitcoind", AccessModeFull))
+}
+
+func (suite *ACLTestSuite) TestLoadConfigLoadsACLPolicyFile() {
+	dir, err := ioutil.TempDir("", "acl")
+	suite.NoError(err)
+	defer os.RemoveAll(dir)
+	// a nil override falls back to the value in the config file
+	viper.Set("acl_policy_file", nil)
+	defer func() {
+		viper.Set("acl_policy_file", nil)
+		suite.NoError(LoadACLPolicyFile(""))
+	}()
+
+	file := filepath.Join(dir, "acl_policy.yaml")
+	suite.NoError(ioutil.WriteFile(file, []byte(`
+roles:
+  full:
+    commands: [bind]
+  limited: {}
+  minimal: {}
+`), 0600))
+	configFile := filepath.Join(dir, "config.yaml")
+	suite.NoError(ioutil.WriteFile(configFile, []byte("acl_policy_file: "+file+"\n"), 0600))
+
+	suite.NoError(config.LoadConfig(configFile))
+	suite.True(HasCommandAccess("bind", AccessModeFull))
+	suite.False(HasCommandAccess("bitcoind", AccessModeFull))
+
+	// the policy is reloaded once the file is changed
+	suite.NoError(ioutil.WriteFile(file, []byte(`
+roles:
+  full:
+    commands: [bind, bitcoind]
+  limited: {}
+  minimal: {}
+`), 0600))
+	suite.Eventually(func() bool {
+		return HasCommandAccess("bitcoind", AccessModeFull)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a bad policy is refused at load time
+	suite.NoError(ioutil.WriteFile(file, []byte("roles: {}"), 0600))
+	suite.Error(config.LoadConfig(configFile))
+}
+
+func (suite *ACLTestSuite) TestApplyBitcoinRPCConstraints() {
+	p, err := ParseACLPolicy([]byte(`
+roles:
+  full: {}
+  limited: {}
+  minimal: {}
+rpc_constraints:
+  listtransactions:
+    - param: count
+      max: 100
+  getnewaddress:
+    - param: address_type
+      equals: bech32
+  gettransaction:
+    - param: verbose
+      forbidden: true
+`))
+	suite.NoError(err)
+	SetACLPolicy(p)
+
+	for method, params := range map[string][]interface{}{
+		"listtransactions": {"*", float64(100)},
+		"getnewaddress":    {"", "bech32"},
+		"gettransaction":   {"txid"},
+		"getbalances":      {},
+	} {
+		applied, err := ApplyBitcoinRPCConstraints(method, params)
+		suite.NoError(err)
+		suite.Equal(params, applied)
+	}
+
+	// parameters which are not given are not checked
+	_, err = ApplyBitcoinRPCConstraints("listtransactions", []interface{}{})
+	suite.NoError(err)
+
+	_, err = ApplyBitcoinRPCConstraints("listtransactions", []interface{}{"*", float64(101)})
+	suite.Equal(&ArgumentConstraintError{Method: "listtransactions", Param: "count", Rule: "max"}, err)
+
+	_, err = ApplyBitcoinRPCConstraints("getnewaddress", []interface{}{"", "legacy"})
+	suite.Equal(&ArgumentConstraintError{Method: "getnewaddress", Param: "address_type", Rule: "equals"}, err)
+
+	_, err = ApplyBitcoinRPCConstraints("gettransaction", []interface{}{"txid", false, true})
+	suite.Equal(&ArgumentConstraintError{Method: "gettransaction", Param: "verbose", Rule: "forbidden"}, err)
+	suite.EqualError(err, "parameter verbose of gettransaction breaks the forbidden constraint")
+}
+
+func (suite *ACLTestSuite) TestDefaultBitcoinRPCConstraints() {
+	_, err := ApplyBitcoinRPCConstraints("listtransactions", []interface{}{"*", float64(100)})
+	suite.NoError(err)
+	_, err = ApplyBitcoinRPCConstraints("listtransactions", []interface{}{"*", float64(1000)})
+	suite.Equal(&ArgumentConstraintError{Method: "listtransactions", Param: "count", Rule: "max"}, err)
+
+	// address_type of getnewaddress is forced to bech32
+	params, err := ApplyBitcoinRPCConstraints("getnewaddress", []interface{}{})
+	suite.NoError(err)
+	suite.Equal([]interface{}{nil, "bech32"}, params)
+	params, err = ApplyBitcoinRPCConstraints("getnewaddress", []interface{}{"savings", "bech32"})
+	suite.NoError(err)
+	suite.Equal([]interface{}{"savings", "bech32"}, params)
+	_, err = ApplyBitcoinRPCConstraints("getnewaddress", []interface{}{"savings", "p2sh-segwit"})
+	suite.Equal(&ArgumentConstraintError{Method: "getnewaddress", Param: "address_type", Rule: "force"}, err)
+
+	outputs := []interface{}{map[string]interface{}{"tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh": 0.001}}
+	_, err = ApplyBitcoinRPCConstraints("walletcreatefundedpsbt", []interface{}{[]interface{}{}, outputs, 0,
+		map[string]interface{}{"replaceable": true}})
+	suite.NoError(err)
+
+	// RBF is turned on if it is omitted
+	params, err = ApplyBitcoinRPCConstraints("walletcreatefundedpsbt", []interface{}{[]interface{}{}, outputs})
+	suite.NoError(err)
+	suite.Equal([]interface{}{[]interface{}{}, outputs, nil, map[string]interface{}{"replaceable": true}}, params)
+
+	params, err = ApplyBitcoinRPCConstraints("walletcreatefundedpsbt", []interface{}{[]interface{}{}, outputs, 0,
+		map[string]interface{}{"feeRate": 0.0001}})
+	suite.NoError(err)
+	suite.Equal(map[string]interface{}{"feeRate": 0.0001, "replaceable": true}, params[3])
+
+	_, err = ApplyBitcoinRPCConstraints("walletcreatefundedpsbt", []interface{}{[]interface{}{}, outputs, 0,
+		map[string]interface{}{"replaceable": false}})
+	suite.Equal(&ArgumentConstraintError{Method: "walletcreatefundedpsbt", Param: "options.replaceable", Rule: "force"}, err)
+
+	_, err = ApplyBitcoinRPCConstraints("walletcreatefundedpsbt", []interface{}{[]interface{}{}, outputs, 0,
+		map[string]interface{}{"subtractFeeFromOutputs": []interface{}{0}}})
+	suite.Equal(&ArgumentConstraintError{Method: "walletcreatefundedpsbt", Param: "options.subtractFeeFromOutputs", Rule: "forbidden"}, err)
+}
+
+func (suite *ACLTestSuite) TestForceNestedParameter() {
+	p, err := ParseACLPolicy([]byte(`
+roles:
+  full: {}
+  limited: {}
+  minimal: {}
+rpc_constraints:
+  walletcreatefundedpsbt:
+    - param: options.replaceable
+      force: true
+`))
+	suite.NoError(err)
+	SetACLPolicy(p)
+
+	params, err := ApplyBitcoinRPCConstraints("walletcreatefundedpsbt", []interface{}{[]interface{}{}, []interface{}{}})
+	suite.NoError(err)
+	suite.Equal([]interface{}{[]interface{}{}, []interface{}{}, nil, map[string]interface{}{"replaceable": true}}, params)
+
+	params, err = ApplyBitcoinRPCConstraints("walletcreatefundedpsbt", []interface{}{[]interface{}{}, []interface{}{}, 0,
+		map[string]interface{}{"feeRate": 0.0001}})
+	suite.NoError(err)
+	suite.Equal(map[string]interface{}{"feeRate": 0.0001, "replaceable": true}, params[3])
+}
+
 func TestACLTestSuite(t *testing.T) {
 	suite.Run(t, &ACLTestSuite{})
 }
@@ -0,0 +1,309 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/bitcoind"
+	"github.com/bitmark-inc/autonomy-pod-controller/utils"
+)
+
+// approvalDefaultExpiry is how long a PSBT waits for approvals if
+// psbt_approval.expiry is not set
+const approvalDefaultExpiry = 24 * time.Hour
+
+// PendingApproval is a submitted PSBT which is waiting for approvals from members
+type PendingApproval struct {
+	TxID       string    `json:"txid"`
+	PSBT       string    `json:"psbt"`
+	Submitter  string    `json:"submitter"`
+	Payments   []Payment `json:"payments"`
+	Approvals  []string  `json:"approvals"`
+	Rejections []string  `json:"rejections"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	// AllowUntrustedAddresses is set if the owner submits the PSBT with payments
+	// to addresses which are not in the address book
+	AllowUntrustedAddresses bool `json:"allow_untrusted_addresses"`
+}
+
+// Amount returns the total amount leaving the wallet
+func (p *PendingApproval) Amount() int64 {
+	return totalAmount(p.Payments)
+}
+
+// expired returns whether the PSBT has waited for approvals too long
+func (p *PendingApproval) expired(now time.Time) bool {
+	return !now.Before(p.ExpiresAt)
+}
+
+// hasVoted returns whether a DID has approved or rejected the PSBT
+func (p *PendingApproval) hasVoted(did string) bool {
+	for _, d := range p.Approvals {
+		if d == did {
+			return true
+		}
+	}
+	for _, d := range p.Rejections {
+		if d == did {
+			return true
+		}
+	}
+	return false
+}
+
+// withdrawVotes removes approvals and rejections of a DID. It returns whether
+// there is any vote removed.
+func (p *PendingApproval) withdrawVotes(did string) bool {
+	withdrawn := false
+	filter := func(dids []string) []string {
+		kept := make([]string, 0, len(dids))
+		for _, d := range dids {
+			if d == did {
+				withdrawn = true
+				continue
+			}
+			kept = append(kept, d)
+		}
+		return kept
+	}
+
+	p.Approvals = filter(p.Approvals)
+	p.Rejections = filter(p.Rejections)
+	return withdrawn
+}
+
+// approvalQuorum returns the number of approvals required to sign a PSBT
+func approvalQuorum() int {
+	return viper.GetInt("psbt_approval.quorum")
+}
+
+// rejectionThreshold returns the number of rejections which cancels a PSBT.
+// It is the quorum unless psbt_approval.rejections is set.
+func rejectionThreshold() int {
+	if n := viper.GetInt("psbt_approval.rejections"); n > 0 {
+		return n
+	}
+	return approvalQuorum()
+}
+
+// approvalExpiry returns how long a PSBT waits for approvals
+func approvalExpiry() time.Duration {
+	if minutes := viper.GetInt("psbt_approval.expiry"); minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return approvalDefaultExpiry
+}
+
+// submitPSBTForApproval keeps a PSBT until it gets enough approvals. The submitter
+// is counted as the first approval.
+func (c *Controller) submitPSBTForApproval(did, psbt, txID string, payments []Payment, allowUntrustedAddresses bool) (map[string]string, error) {
+	c.approvalLock.Lock()
+	defer c.approvalLock.Unlock()
+
+	if c.store.PendingApproval(txID) != nil {
+		return nil, fmt.Errorf("psbt is already waiting for approvals")
+	}
+
+	now := c.now()
+	if err := c.store.SavePendingApproval(PendingApproval{
+		TxID:                    txID,
+		PSBT:                    psbt,
+		Submitter:               did,
+		Payments:                payments,
+		Approvals:               []string{did},
+		Rejections:              []string{},
+		CreatedAt:               now,
+		ExpiresAt:               now.Add(approvalExpiry()),
+		AllowUntrustedAddresses: allowUntrustedAddresses,
+	}); err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"status": txStatusPending, "txid": txID}, nil
+}
+
+// votablePSBT returns a pending PSBT which a DID is able to vote for. An expired
+// PSBT is removed and the submitter gets notified. The caller must hold approvalLock.
+func (c *Controller) votablePSBT(did, txID string) (*PendingApproval, error) {
+	approval := c.store.PendingApproval(txID)
+	if approval == nil {
+		return nil, fmt.Errorf("pending psbt not found")
+	}
+	if approval.expired(c.now()) {
+		c.expirePSBT(approval)
+		return nil, fmt.Errorf("pending psbt expired")
+	}
+	if approval.hasVoted(did) {
+		return nil, fmt.Errorf("already voted")
+	}
+	return approval, nil
+}
+
+// approvePSBT adds an approval to a pending PSBT. The PSBT is signed and
+// broadcast once the quorum is reached.
+func (c *Controller) approvePSBT(did, txID string) (map[string]string, error) {
+	c.approvalLock.Lock()
+	defer c.approvalLock.Unlock()
+
+	approval, err := c.votablePSBT(did, txID)
+	if err != nil {
+		return nil, err
+	}
+
+	approval.Approvals = append(approval.Approvals, did)
+	if len(approval.Approvals) < approvalQuorum() {
+		if err := c.store.SavePendingApproval(*approval); err != nil {
+			return nil, err
+		}
+		return map[string]string{"status": txStatusPending, "txid": txID}, nil
+	}
+
+	if err := c.store.RemovePendingApproval(txID); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.executeApprovedPSBT(approval)
+	if err != nil {
+		c.notifyApprovalOutcome(approval, txStatusFailed, err)
+		return nil, err
+	}
+	c.notifyApprovalOutcome(approval, resp["status"], nil)
+
+	return resp, nil
+}
+
+// rejectPSBT adds a rejection to a pending PSBT. The PSBT is cancelled once the
+// rejections reach the threshold.
+func (c *Controller) rejectPSBT(did, txID string) (map[string]string, error) {
+	c.approvalLock.Lock()
+	defer c.approvalLock.Unlock()
+
+	approval, err := c.votablePSBT(did, txID)
+	if err != nil {
+		return nil, err
+	}
+
+	approval.Rejections = append(approval.Rejections, did)
+	if len(approval.Rejections) < rejectionThreshold() {
+		if err := c.store.SavePendingApproval(*approval); err != nil {
+			return nil, err
+		}
+		return map[string]string{"status": txStatusPending, "txid": txID}, nil
+	}
+
+	if err := c.store.RemovePendingApproval(txID); err != nil {
+		return nil, err
+	}
+	c.notifyApprovalOutcome(approval, txStatusRejected, nil)
+
+	return map[string]string{"status": txStatusRejected, "txid": txID}, nil
+}
+
+// listPendingPSBTs returns PSBTs which are waiting for approvals
+func (c *Controller) listPendingPSBTs() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"quorum":      approvalQuorum(),
+		"rejections":  rejectionThreshold(),
+		"pending_txs": c.store.PendingApprovals(),
+	}, nil
+}
+
+// sweepExpiredPSBTs removes PSBTs which have waited for approvals too long
+func (c *Controller) sweepExpiredPSBTs(now time.Time) {
+	c.approvalLock.Lock()
+	defer c.approvalLock.Unlock()
+
+	for _, approval := range c.store.PendingApprovals() {
+		if approval.expired(now) {
+			c.expirePSBT(&approval)
+		}
+	}
+}
+
+// expirePSBT removes an expired PSBT and notifies the submitter. The caller must
+// hold approvalLock.
+func (c *Controller) expirePSBT(approval *PendingApproval) {
+	if err := c.store.RemovePendingApproval(approval.TxID); err != nil {
+		log.WithError(err).WithField("txid", approval.TxID).Error("fail to remove an expired psbt")
+		return
+	}
+	log.WithField("txid", approval.TxID).WithField("expires_at", approval.ExpiresAt).Info("expired psbt removed")
+	c.notifyApprovalOutcome(approval, txStatusExpired, nil)
+}
+
+// executeApprovedPSBT signs and releases an approved PSBT. The payments and the
+// amount are derived from the PSBT again and checked against the address book and
+// the spending limit of the submitter since they may have changed while waiting.
+func (c *Controller) executeApprovedPSBT(approval *PendingApproval) (map[string]string, error) {
+	unsignedTx, err := utils.DecodePSBTUnsignedTx(approval.PSBT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid psbt: %s", err)
+	}
+
+	client, err := bitcoind.NewBtcdRPCClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Shutdown()
+
+	chain, err := walletChainParams(client)
+	if err != nil {
+		return nil, err
+	}
+	isChange := walletChangeChecker(client, chain)
+	payments, err := outgoingPayments(unsignedTx, chain, isChange)
+	if err != nil {
+		return nil, err
+	}
+	if !approval.AllowUntrustedAddresses {
+		if err := c.checkTrustedAddresses(payments); err != nil {
+			return nil, err
+		}
+	}
+	amount, err := outgoingAmount(unsignedTx, isChange)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkSpendingLimit(approval.Submitter, amount, c.now()); err != nil {
+		return nil, err
+	}
+
+	txHex, err := c.signPSBT(client, approval.PSBT)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.releaseTransaction(client, approval.Submitter, txHex, amount)
+}
+
+// notifyApprovalOutcome notifies the submitter about the result of a pending PSBT
+func (c *Controller) notifyApprovalOutcome(approval *PendingApproval, status string, outcomeErr error) {
+	data := map[string]interface{}{
+		"event":      "psbt_approval",
+		"txid":       approval.TxID,
+		"status":     status,
+		"approvals":  approval.Approvals,
+		"rejections": approval.Rejections,
+	}
+	if outcomeErr != nil {
+		data["error"] = outcomeErr.Error()
+	}
+
+	contents := map[string]string{
+		"en": fmt.Sprintf("Transaction %s", status),
+	}
+
+	if err := c.sendNotification(approval.Submitter, contents, data); err != nil {
+		log.WithError(err).WithField("txid", approval.TxID).Error("fail to notify the approval outcome")
+	}
+}
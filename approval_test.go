@@ -0,0 +1,298 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+)
+
+// slowApprovalStore widens the window between reading and saving a pending PSBT
+type slowApprovalStore struct {
+	*MemoryStore
+}
+
+func (s slowApprovalStore) PendingApproval(txID string) *PendingApproval {
+	approval := s.MemoryStore.PendingApproval(txID)
+	time.Sleep(10 * time.Millisecond)
+	return approval
+}
+
+type ApprovalTestSuite struct {
+	suite.Suite
+	Identity      *PodIdentity
+	notifications []map[string]interface{}
+	server        *httptest.Server
+}
+
+func (s *ApprovalTestSuite) SetupTest() {
+	s.notifications = nil
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&n)
+		s.notifications = append(s.notifications, n)
+	}))
+	viper.Set("notification_url", s.server.URL)
+	viper.Set("psbt_approval.quorum", 2)
+}
+
+func (s *ApprovalTestSuite) TearDownTest() {
+	s.server.Close()
+	viper.Set("notification_url", "")
+	viper.Set("psbt_approval.quorum", 0)
+	viper.Set("psbt_approval.rejections", 0)
+	viper.Set("psbt_approval.expiry", 0)
+}
+
+func (s *ApprovalTestSuite) TestSubmitPSBTForApproval() {
+	submitterDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	payments := []Payment{{Address: "tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh", Amount: 1000}}
+	now := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	mockCtl := gomock.NewController(s.T())
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().PendingApproval("txid").Times(1).Return(nil)
+	mockedStore.EXPECT().SavePendingApproval(gomock.Any()).Times(1).DoAndReturn(func(a PendingApproval) error {
+		s.Equal("txid", a.TxID)
+		s.Equal("psbt", a.PSBT)
+		s.Equal(submitterDID, a.Submitter)
+		s.Equal([]string{submitterDID}, a.Approvals)
+		s.Equal(int64(1000), a.Amount())
+		s.Equal(now.Add(approvalDefaultExpiry), a.ExpiresAt)
+		s.True(a.AllowUntrustedAddresses)
+		return nil
+	})
+	mockedStore.EXPECT().PendingApproval("existing-txid").Times(1).Return(&PendingApproval{TxID: "existing-txid"})
+
+	c := Controller{store: mockedStore, clock: func() time.Time { return now }}
+
+	r, err := c.submitPSBTForApproval(submitterDID, "psbt", "txid", payments, true)
+	s.NoError(err)
+	s.Equal(map[string]string{"status": "pending", "txid": "txid"}, r)
+
+	_, err = c.submitPSBTForApproval(submitterDID, "psbt", "existing-txid", payments, false)
+	s.EqualError(err, "psbt is already waiting for approvals")
+}
+
+func (s *ApprovalTestSuite) TestApprovePSBTBelowQuorum() {
+	viper.Set("psbt_approval.quorum", 3)
+
+	submitterDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	approverDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	mockCtl := gomock.NewController(s.T())
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().PendingApproval("txid").AnyTimes().Return(&PendingApproval{
+		TxID:      "txid",
+		Submitter: submitterDID,
+		Approvals: []string{submitterDID},
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	mockedStore.EXPECT().PendingApproval("unknown-txid").AnyTimes().Return(nil)
+	mockedStore.EXPECT().SavePendingApproval(gomock.Any()).Times(1).DoAndReturn(func(a PendingApproval) error {
+		s.Equal([]string{submitterDID, approverDID}, a.Approvals)
+		return nil
+	})
+
+	c := Controller{store: mockedStore}
+
+	r, err := c.approvePSBT(approverDID, "txid")
+	s.NoError(err)
+	s.Equal(map[string]string{"status": "pending", "txid": "txid"}, r)
+
+	_, err = c.approvePSBT(submitterDID, "txid")
+	s.EqualError(err, "already voted")
+
+	_, err = c.approvePSBT(approverDID, "unknown-txid")
+	s.EqualError(err, "pending psbt not found")
+	s.Empty(s.notifications)
+}
+
+func (s *ApprovalTestSuite) TestRejectPSBT() {
+	submitterDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	rejecterDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	anotherRejecterDID := "did:key:zQ3shk5bp53SwcW4685TwY1BuieKLTLEPLSJRG8Qknu9oddRj"
+
+	mockCtl := gomock.NewController(s.T())
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	approval := PendingApproval{
+		TxID:      "txid",
+		Submitter: submitterDID,
+		Approvals: []string{submitterDID},
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	mockedStore.EXPECT().PendingApproval("txid").Times(3).DoAndReturn(func(string) *PendingApproval {
+		a := approval
+		return &a
+	})
+	mockedStore.EXPECT().SavePendingApproval(gomock.Any()).Times(1).DoAndReturn(func(a PendingApproval) error {
+		approval = a
+		return nil
+	})
+	mockedStore.EXPECT().RemovePendingApproval("txid").Times(1).Return(nil)
+
+	c := Controller{store: mockedStore, Identity: s.Identity, httpClient: http.DefaultClient}
+
+	// a single rejection does not cancel the PSBT below the threshold
+	r, err := c.rejectPSBT(rejecterDID, "txid")
+	s.NoError(err)
+	s.Equal(map[string]string{"status": "pending", "txid": "txid"}, r)
+	s.Equal([]string{rejecterDID}, approval.Rejections)
+	s.Empty(s.notifications)
+
+	_, err = c.rejectPSBT(rejecterDID, "txid")
+	s.EqualError(err, "already voted")
+
+	r, err = c.rejectPSBT(anotherRejecterDID, "txid")
+	s.NoError(err)
+	s.Equal(map[string]string{"status": "rejected", "txid": "txid"}, r)
+
+	s.Len(s.notifications, 1)
+	s.Equal(submitterDID, s.notifications[0]["AccountID"])
+	data := s.notifications[0]["Data"].(map[string]interface{})
+	s.Equal("psbt_approval", data["event"])
+	s.Equal("rejected", data["status"])
+	s.Equal([]interface{}{rejecterDID, anotherRejecterDID}, data["rejections"])
+}
+
+func (s *ApprovalTestSuite) TestRejectPSBTWithThreshold() {
+	viper.Set("psbt_approval.rejections", 1)
+
+	submitterDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	rejecterDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	mockCtl := gomock.NewController(s.T())
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().PendingApproval("txid").Times(1).Return(&PendingApproval{
+		TxID:      "txid",
+		Submitter: submitterDID,
+		Approvals: []string{submitterDID},
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	mockedStore.EXPECT().RemovePendingApproval("txid").Times(1).Return(nil)
+
+	c := Controller{store: mockedStore, Identity: s.Identity, httpClient: http.DefaultClient}
+
+	r, err := c.rejectPSBT(rejecterDID, "txid")
+	s.NoError(err)
+	s.Equal(map[string]string{"status": "rejected", "txid": "txid"}, r)
+	s.Len(s.notifications, 1)
+}
+
+func (s *ApprovalTestSuite) TestExpiredPSBT() {
+	viper.Set("psbt_approval.expiry", 60)
+
+	submitterDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	approverDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	now := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	mockCtl := gomock.NewController(s.T())
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	expiring := PendingApproval{
+		TxID:      "expiring-txid",
+		Submitter: submitterDID,
+		Approvals: []string{submitterDID},
+		ExpiresAt: now.Add(time.Hour),
+	}
+	mockedStore.EXPECT().PendingApproval("expiring-txid").Times(1).Return(&expiring)
+	mockedStore.EXPECT().RemovePendingApproval("expiring-txid").Times(1).Return(nil)
+	mockedStore.EXPECT().PendingApprovals().Times(2).Return([]PendingApproval{{
+		TxID:      "txid",
+		Submitter: submitterDID,
+		Approvals: []string{submitterDID},
+		ExpiresAt: now.Add(2 * time.Hour),
+	}})
+	mockedStore.EXPECT().RemovePendingApproval("txid").Times(1).Return(nil)
+
+	c := Controller{store: mockedStore, Identity: s.Identity, httpClient: http.DefaultClient}
+	c.clock = func() time.Time { return now.Add(time.Hour) }
+
+	// a vote for an expired PSBT is refused and the PSBT is removed
+	_, err := c.approvePSBT(approverDID, "expiring-txid")
+	s.EqualError(err, "pending psbt expired")
+
+	c.sweepExpiredPSBTs(now.Add(time.Hour))
+	c.sweepExpiredPSBTs(now.Add(2 * time.Hour))
+
+	s.Len(s.notifications, 2)
+	for i, txID := range []string{"expiring-txid", "txid"} {
+		s.Equal(submitterDID, s.notifications[i]["AccountID"])
+		data := s.notifications[i]["Data"].(map[string]interface{})
+		s.Equal(txID, data["txid"])
+		s.Equal("expired", data["status"])
+	}
+}
+
+func (s *ApprovalTestSuite) TestConcurrentApprovals() {
+	const approvers = 8
+
+	submitterDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	store := slowApprovalStore{NewMemoryStore()}
+	s.NoError(store.SavePendingApproval(PendingApproval{
+		TxID:      "txid",
+		PSBT:      "invalid",
+		Submitter: submitterDID,
+		Approvals: []string{submitterDID},
+		ExpiresAt: time.Now().Add(time.Hour),
+	}))
+
+	c := Controller{store: store, Identity: s.Identity, httpClient: http.DefaultClient}
+
+	// the quorum is reached by every approver but the PSBT is released only once
+	var wg sync.WaitGroup
+	errs := make([]error, approvers)
+	for i := 0; i < approvers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.approvePSBT(fmt.Sprintf("did:key:approver-%d", i), "txid")
+		}(i)
+	}
+	wg.Wait()
+
+	released := 0
+	for _, err := range errs {
+		if strings.HasPrefix(err.Error(), "invalid psbt") {
+			released++
+			continue
+		}
+		s.EqualError(err, "pending psbt not found")
+	}
+	s.Equal(1, released)
+	s.Len(s.notifications, 1)
+}
+
+func (s *ApprovalTestSuite) TestExecuteApprovedPSBTWithInvalidPSBT() {
+	c := Controller{}
+	_, err := c.executeApprovedPSBT(&PendingApproval{TxID: "txid", PSBT: "invalid"})
+	s.Error(err)
+	s.Contains(err.Error(), "invalid psbt")
+}
+
+func TestApprovalTestSuite(t *testing.T) {
+	i, err := NewPodIdentity()
+	if err != nil {
+		t.Fatal("unable to create test key file")
+	}
+	suite.Run(t, &ApprovalTestSuite{
+		Identity: i,
+	})
+}
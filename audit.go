@@ -0,0 +1,347 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+const (
+	auditResultOK    = "ok"
+	auditResultError = "error"
+
+	defaultAuditLogPageSize = 50
+	maxAuditLogPageSize     = 500
+
+	// auditArgMaxLen is the max length of an argument kept as it is in an audit entry.
+	// Longer arguments are replaced by their hashes.
+	auditArgMaxLen = 64
+
+	defaultAuditLogMaxEntries = 100000
+)
+
+// auditRedactedArgs are arguments which are never kept in audit entries
+var auditRedactedArgs = map[string]bool{
+	"signature":    true,
+	"pairing_code": true,
+}
+
+// AuditEntry is a record of the audit log. Each entry is chained to the previous one
+// by its hash and the hash is signed by the pod identity.
+type AuditEntry struct {
+	Seq      uint64            `json:"seq"`
+	DID      string            `json:"did"`
+	Device   uint32            `json:"device"`
+	Command  string            `json:"command"`
+	Args     map[string]string `json:"args,omitempty"`
+	Result   string            `json:"result"`
+	Error    string            `json:"error,omitempty"`
+	At       time.Time         `json:"at"`
+	PrevHash string            `json:"prev_hash"`
+	Signer   string            `json:"signer"`
+
+	Hash      string `json:"hash,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// AuditAnchor is the last entry removed from the audit log by the retention. The
+// first remaining entry is chained to it.
+type AuditAnchor struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// AuditHead is the last entry appended to the audit log. It is kept out of the log
+// along with the signature of the entry, so that entries removed from the tail of
+// the log are detected.
+type AuditHead struct {
+	Seq       uint64 `json:"seq"`
+	Hash      string `json:"hash"`
+	Signer    string `json:"signer"`
+	Signature string `json:"signature"`
+}
+
+// AuditQuery filters and pages audit entries. Entries are returned in the order of
+// their sequence numbers starting after AfterSeq. A zero limit returns all entries.
+type AuditQuery struct {
+	AfterSeq uint64     `json:"after_seq"`
+	Limit    int        `json:"limit"`
+	DID      string     `json:"did"`
+	Command  string     `json:"command"`
+	Since    *time.Time `json:"since"`
+	Until    *time.Time `json:"until"`
+}
+
+// Match returns whether an entry matches the filters of a query
+func (q AuditQuery) Match(e AuditEntry) bool {
+	if q.DID != "" && e.DID != q.DID {
+		return false
+	}
+	if q.Command != "" && e.Command != q.Command {
+		return false
+	}
+	if q.Since != nil && e.At.Before(*q.Since) {
+		return false
+	}
+	if q.Until != nil && !e.At.Before(*q.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditVerificationError is returned if the audit log is tampered
+type AuditVerificationError struct {
+	Seq    uint64
+	Reason string
+}
+
+func (e *AuditVerificationError) Error() string {
+	return fmt.Sprintf("audit entry %d is tampered: %s", e.Seq, e.Reason)
+}
+
+func (e *AuditVerificationError) Code() string {
+	return "audit_log_tampered"
+}
+
+func (e *AuditVerificationError) Details() interface{} {
+	return map[string]interface{}{
+		"seq":    e.Seq,
+		"reason": e.Reason,
+	}
+}
+
+// ComputeHash returns the hex encoded SHA-256 hash of the JSON encoding of
+// an entry without its hash and signature
+func (e AuditEntry) ComputeHash() (string, error) {
+	e.Hash = ""
+	e.Signature = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// summarizeAuditArgs returns a redacted summary of the arguments of a command. Top-level
+// arguments are kept in JSON, except that sensitive ones are redacted and long ones are
+// replaced by their hashes.
+func summarizeAuditArgs(args json.RawMessage) map[string]string {
+	if len(args) == 0 || string(args) == "null" {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(args, &fields); err != nil {
+		return map[string]string{"_": summarizeAuditArg(args)}
+	}
+
+	summary := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if auditRedactedArgs[k] {
+			summary[k] = "[redacted]"
+			continue
+		}
+		summary[k] = summarizeAuditArg(v)
+	}
+	return summary
+}
+
+func summarizeAuditArg(v json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		s = string(v)
+	}
+	if len(s) > auditArgMaxLen {
+		hash := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(hash[:])
+	}
+	return s
+}
+
+// audit appends a command handled by Process to the audit log. The result is taken
+// from the first response. Failures are logged without affecting the command.
+func (c *Controller) audit(did string, device uint32, req RequestCommand, responses [][]byte) {
+	entry := AuditEntry{
+		DID:     did,
+		Device:  device,
+		Command: req.Command,
+		Args:    summarizeAuditArgs(req.Args),
+		Result:  auditResultOK,
+		At:      c.now().UTC(),
+		Signer:  c.identity().DID,
+	}
+
+	if len(responses) == 0 {
+		entry.Result = auditResultError
+		entry.Error = "no response"
+	} else {
+		var resp struct {
+			Error *string `json:"error"`
+		}
+		if err := json.Unmarshal(responses[0], &resp); err == nil && resp.Error != nil {
+			entry.Result = auditResultError
+			entry.Error = *resp.Error
+		}
+	}
+
+	if err := c.store.AppendAuditEntry(entry, c.sealAuditEntry); err != nil {
+		log.WithError(err).WithField("did", did).WithField("command", req.Command).Error("fail to append audit entry")
+	}
+}
+
+// sealAuditEntry computes the hash of an entry and signs it by the pod identity
+func (c *Controller) sealAuditEntry(entry *AuditEntry) error {
+	hash, err := entry.ComputeHash()
+	if err != nil {
+		return err
+	}
+
+	signature, err := key.Sign(c.identity().PrivateKey, hash)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	entry.Signature = signature
+	return nil
+}
+
+// auditLogMaxEntries returns the number of entries kept in the audit log
+func auditLogMaxEntries() int {
+	if n := viper.GetInt("audit_log.max_entries"); n > 0 {
+		return n
+	}
+	return defaultAuditLogMaxEntries
+}
+
+// VerifyAuditLog checks that entries start right after the anchor, end at the head and
+// are continuous, chained and signed by one of the signers. A zero anchor means the
+// entries start from the first one, and a zero head means the end is not checked. It
+// returns an AuditVerificationError of the first entry which fails the checks.
+func VerifyAuditLog(anchor AuditAnchor, head AuditHead, entries []AuditEntry, signers ...string) error {
+	trusted := make(map[string]bool, len(signers))
+	for _, s := range signers {
+		trusted[s] = true
+	}
+
+	prevHash := anchor.Hash
+	for i, e := range entries {
+		if seq := anchor.Seq + uint64(i+1); e.Seq != seq {
+			return &AuditVerificationError{seq, "entry missing"}
+		}
+
+		if e.PrevHash != prevHash {
+			return &AuditVerificationError{e.Seq, "previous hash mismatched"}
+		}
+
+		hash, err := e.ComputeHash()
+		if err != nil {
+			return err
+		}
+		if e.Hash != hash {
+			return &AuditVerificationError{e.Seq, "hash mismatched"}
+		}
+
+		if !trusted[e.Signer] {
+			return &AuditVerificationError{e.Seq, "untrusted signer"}
+		}
+		if !key.VerifySignature(e.Signer, e.Hash, e.Signature) {
+			return &AuditVerificationError{e.Seq, "invalid signature"}
+		}
+
+		prevHash = e.Hash
+	}
+
+	if head.Seq == 0 {
+		return nil
+	}
+	if !trusted[head.Signer] || !key.VerifySignature(head.Signer, head.Hash, head.Signature) {
+		return &AuditVerificationError{head.Seq, "invalid head signature"}
+	}
+	last := anchor
+	if len(entries) > 0 {
+		last = AuditAnchor{Seq: entries[len(entries)-1].Seq, Hash: entries[len(entries)-1].Hash}
+	}
+	if last.Seq < head.Seq {
+		return &AuditVerificationError{last.Seq + 1, "entry missing"}
+	}
+	if last.Seq != head.Seq || last.Hash != head.Hash {
+		return &AuditVerificationError{head.Seq, "head mismatched"}
+	}
+	return nil
+}
+
+// getAuditLog returns a page of audit entries which match the filters of the query
+func (c *Controller) getAuditLog(did string, query AuditQuery) (map[string]interface{}, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to read the audit log")
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = defaultAuditLogPageSize
+	}
+	if query.Limit > maxAuditLogPageSize {
+		query.Limit = maxAuditLogPageSize
+	}
+
+	entries := c.store.AuditEntries(query)
+	resp := map[string]interface{}{
+		"entries": entries,
+	}
+	if len(entries) == query.Limit {
+		resp["next_after_seq"] = entries[len(entries)-1].Seq
+	}
+	return resp, nil
+}
+
+// verifyAuditLog verifies the whole audit log and returns its head
+func (c *Controller) verifyAuditLog(did string) (map[string]interface{}, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to verify the audit log")
+	}
+
+	anchor := c.store.AuditLogAnchor()
+	head := c.store.AuditLogHead()
+	entries := c.store.AuditEntries(AuditQuery{})
+	if err := VerifyAuditLog(anchor, head, entries, c.podDIDs()...); err != nil {
+		log.WithError(err).Error("audit log verification failed")
+		return nil, err
+	}
+
+	resp := map[string]interface{}{
+		"entries": len(entries),
+	}
+	if anchor.Seq > 0 {
+		resp["trimmed_seq"] = anchor.Seq
+		resp["trimmed_hash"] = anchor.Hash
+	}
+	if len(entries) > 0 {
+		resp["head_seq"] = entries[len(entries)-1].Seq
+		resp["head_hash"] = entries[len(entries)-1].Hash
+	}
+	return resp, nil
+}
+
+// trimAuditLog removes the oldest entries of the audit log beyond the retention
+func (c *Controller) trimAuditLog() {
+	removed, err := c.store.TrimAuditLog(auditLogMaxEntries())
+	if err != nil {
+		log.WithError(err).Error("fail to trim the audit log")
+		return
+	}
+	if removed > 0 {
+		log.WithField("removed", removed).Info("audit log trimmed")
+	}
+}
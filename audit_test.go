@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSummarizeAuditArgs(t *testing.T) {
+	psbt := strings.Repeat("cHNidP8B", 20)
+	summary := summarizeAuditArgs(json.RawMessage(`{"psbt":"` + psbt + `","signature":"3045","member_did":"did:key:member","access_mode":1,"methods":["getbalances"]}`))
+	assert.Equal(t, map[string]string{
+		"psbt":        "sha256:1a101ece66eee63647458d1625e6f23ca486dbd3e00e453ee811ef0ed92443ac",
+		"signature":   "[redacted]",
+		"member_did":  "did:key:member",
+		"access_mode": "1",
+		"methods":     `["getbalances"]`,
+	}, summary)
+
+	assert.Nil(t, summarizeAuditArgs(nil))
+	assert.Nil(t, summarizeAuditArgs(json.RawMessage(`null`)))
+	assert.Equal(t, map[string]string{"_": "[1,2]"}, summarizeAuditArgs(json.RawMessage(`[1,2]`)))
+}
+
+func newAuditTestController(t *testing.T) *Controller {
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	s := NewBoltStore(filepath.Join(t.TempDir(), "audit.db"), i.PrivateKey)
+	t.Cleanup(func() { s.db.Close() })
+
+	return &Controller{ownerDID: "did:key:owner", Identity: i, store: s}
+}
+
+func TestAuditLog(t *testing.T) {
+	c := newAuditTestController(t)
+	now := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	c.clock = func() time.Time { return now }
+
+	c.audit("did:key:owner", 1, RequestCommand{ID: "1", Command: "set_member", Args: json.RawMessage(`{"member_did":"did:key:member","access_mode":1}`)},
+		CommandResponse("1", map[string]string{"status": "ok"}, nil))
+	now = now.Add(time.Hour)
+	c.audit("did:key:member", 2, RequestCommand{ID: "2", Command: "finish_psbt", Args: json.RawMessage(`{"psbt":"cHNidP8B"}`)},
+		CommandResponse("2", nil, errors.New("spending limit exceeded")))
+	now = now.Add(time.Hour)
+	c.audit("did:key:owner", 1, RequestCommand{ID: "3", Command: "list_members"}, nil)
+
+	entries := c.store.AuditEntries(AuditQuery{})
+	assert.Len(t, entries, 3)
+	assert.Equal(t, uint64(1), entries[0].Seq)
+	assert.Equal(t, "", entries[0].PrevHash)
+	assert.Equal(t, map[string]string{"member_did": "did:key:member", "access_mode": "1"}, entries[0].Args)
+	assert.Equal(t, auditResultOK, entries[0].Result)
+	assert.Equal(t, entries[0].Hash, entries[1].PrevHash)
+	assert.Equal(t, "did:key:member", entries[1].DID)
+	assert.Equal(t, uint32(2), entries[1].Device)
+	assert.Equal(t, auditResultError, entries[1].Result)
+	assert.Equal(t, "spending limit exceeded", entries[1].Error)
+	assert.Equal(t, "no response", entries[2].Error)
+	assert.NoError(t, VerifyAuditLog(AuditAnchor{}, AuditHead{}, entries, c.Identity.DID))
+
+	// entries signed by others are not trusted
+	assert.Equal(t, &AuditVerificationError{1, "untrusted signer"}, VerifyAuditLog(AuditAnchor{}, AuditHead{}, entries, "did:key:other"))
+
+	// paging and filters
+	resp, err := c.getAuditLog("did:key:owner", AuditQuery{Limit: 2})
+	assert.NoError(t, err)
+	assert.Len(t, resp["entries"], 2)
+	assert.Equal(t, uint64(2), resp["next_after_seq"])
+
+	resp, err = c.getAuditLog("did:key:owner", AuditQuery{AfterSeq: 2, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, entries[2:], resp["entries"])
+	assert.NotContains(t, resp, "next_after_seq")
+
+	since := now.Add(-90 * time.Minute)
+	resp, err = c.getAuditLog("did:key:owner", AuditQuery{DID: "did:key:owner", Since: &since})
+	assert.NoError(t, err)
+	assert.Equal(t, entries[2:], resp["entries"])
+
+	resp, err = c.getAuditLog("did:key:owner", AuditQuery{Command: "finish_psbt"})
+	assert.NoError(t, err)
+	assert.Equal(t, entries[1:2], resp["entries"])
+
+	_, err = c.getAuditLog("did:key:member", AuditQuery{})
+	assert.EqualError(t, err, "only the owner is allowed to read the audit log")
+
+	resp, err = c.verifyAuditLog("did:key:owner")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"entries": 3, "head_seq": uint64(3), "head_hash": entries[2].Hash}, resp)
+}
+
+func TestTrimAuditLog(t *testing.T) {
+	viper.Set("audit_log.max_entries", 2)
+	defer viper.Set("audit_log.max_entries", 0)
+
+	c := newAuditTestController(t)
+	for _, command := range []string{"set_member", "finish_psbt", "remove_member", "list_members"} {
+		c.audit("did:key:owner", 1, RequestCommand{ID: "1", Command: command}, CommandResponse("1", nil, nil))
+	}
+	entries := c.store.AuditEntries(AuditQuery{})
+
+	c.trimAuditLog()
+	assert.Equal(t, entries[2:], c.store.AuditEntries(AuditQuery{}))
+
+	resp, err := c.verifyAuditLog("did:key:owner")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"entries":      2,
+		"head_seq":     uint64(4),
+		"head_hash":    entries[3].Hash,
+		"trimmed_seq":  uint64(2),
+		"trimmed_hash": entries[1].Hash,
+	}, resp)
+
+	// remaining entries have to be chained to the anchor
+	anchor := c.store.AuditLogAnchor()
+	assert.Equal(t, &AuditVerificationError{3, "entry missing"}, VerifyAuditLog(anchor, AuditHead{}, entries[3:], c.Identity.DID))
+	assert.Equal(t, &AuditVerificationError{3, "previous hash mismatched"},
+		VerifyAuditLog(AuditAnchor{Seq: 2, Hash: entries[0].Hash}, AuditHead{}, entries[2:], c.Identity.DID))
+}
+
+func TestVerifyTamperedAuditLog(t *testing.T) {
+	c := newAuditTestController(t)
+	for _, command := range []string{"set_member", "finish_psbt", "remove_member"} {
+		c.audit("did:key:owner", 1, RequestCommand{ID: "1", Command: command}, CommandResponse("1", nil, nil))
+	}
+	entries := c.store.AuditEntries(AuditQuery{})
+	s := c.store.(*BoltStore)
+
+	// an entry rewritten by someone who has the store key
+	tampered := append([]AuditEntry{}, entries...)
+	tampered[1].DID = "did:key:someone-else"
+	assert.Equal(t, &AuditVerificationError{2, "hash mismatched"}, VerifyAuditLog(AuditAnchor{}, AuditHead{}, tampered, c.Identity.DID))
+
+	tampered[1] = entries[1]
+	tampered[1].Signature = entries[0].Signature
+	assert.Equal(t, &AuditVerificationError{2, "invalid signature"}, VerifyAuditLog(AuditAnchor{}, AuditHead{}, tampered, c.Identity.DID))
+
+	// an entry removed from the middle
+	assert.Equal(t, &AuditVerificationError{2, "entry missing"}, VerifyAuditLog(AuditAnchor{}, AuditHead{}, []AuditEntry{entries[0], entries[2]}, c.Identity.DID))
+
+	// an entry corrupted in the file is skipped and the log keeps growing from the head
+	assert.NoError(t, s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAuditLog).Put(auditKey(3), []byte("corrupted"))
+	}))
+	c.audit("did:key:owner", 1, RequestCommand{ID: "1", Command: "list_members"}, CommandResponse("1", nil, nil))
+
+	corrupted := entries[2]
+	entries = c.store.AuditEntries(AuditQuery{})
+	assert.Len(t, entries, 3)
+	assert.Equal(t, uint64(4), entries[2].Seq)
+	assert.Equal(t, corrupted.Hash, entries[2].PrevHash)
+
+	_, err := c.verifyAuditLog("did:key:owner")
+	assert.Equal(t, &AuditVerificationError{3, "entry missing"}, err)
+}
+
+func TestVerifyTruncatedAuditLog(t *testing.T) {
+	c := newAuditTestController(t)
+	for _, command := range []string{"set_member", "finish_psbt", "remove_member"} {
+		c.audit("did:key:owner", 1, RequestCommand{ID: "1", Command: command}, CommandResponse("1", nil, nil))
+	}
+	entries := c.store.AuditEntries(AuditQuery{})
+	head := c.store.AuditLogHead()
+	assert.Equal(t, AuditHead{Seq: 3, Hash: entries[2].Hash, Signer: c.Identity.DID, Signature: entries[2].Signature}, head)
+	assert.NoError(t, VerifyAuditLog(AuditAnchor{}, head, entries, c.Identity.DID))
+
+	// entries removed from the tail are detected by the head
+	assert.Equal(t, &AuditVerificationError{3, "entry missing"}, VerifyAuditLog(AuditAnchor{}, head, entries[:2], c.Identity.DID))
+	assert.Equal(t, &AuditVerificationError{1, "entry missing"}, VerifyAuditLog(AuditAnchor{}, head, nil, c.Identity.DID))
+
+	forged := head
+	forged.Seq = 2
+	assert.Equal(t, &AuditVerificationError{2, "head mismatched"}, VerifyAuditLog(AuditAnchor{}, forged, entries[:2], c.Identity.DID))
+	forged = AuditHead{Seq: 2, Hash: entries[1].Hash, Signer: c.Identity.DID, Signature: entries[0].Signature}
+	assert.Equal(t, &AuditVerificationError{2, "invalid head signature"}, VerifyAuditLog(AuditAnchor{}, forged, entries[:2], c.Identity.DID))
+
+	s := c.store.(*BoltStore)
+	assert.NoError(t, s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAuditLog).Delete(auditKey(3))
+	}))
+	_, err := c.verifyAuditLog("did:key:owner")
+	assert.Equal(t, &AuditVerificationError{3, "entry missing"}, err)
+
+	// a new entry does not take the place of the removed one
+	c.audit("did:key:owner", 1, RequestCommand{ID: "1", Command: "list_members"}, CommandResponse("1", nil, nil))
+	entries = c.store.AuditEntries(AuditQuery{})
+	assert.Equal(t, uint64(4), entries[2].Seq)
+	_, err = c.verifyAuditLog("did:key:owner")
+	assert.Equal(t, &AuditVerificationError{3, "entry missing"}, err)
+}
@@ -0,0 +1,714 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/bitcoind"
+	"github.com/bitmark-inc/autonomy-pod-controller/config"
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+	"github.com/bitmark-inc/autonomy-pod-controller/utils"
+)
+
+const (
+	backupFormatVersion = 1
+
+	// backupChunkSize is the max size of the encrypted backup in a chunk
+	backupChunkSize = 32 * 1024
+	maxBackupSize   = 64 * 1024 * 1024
+
+	// backupMaxAuditEntries is the number of the latest audit entries kept in a backup
+	// so that the audit log does not push the backup over maxBackupSize
+	backupMaxAuditEntries = 10000
+
+	// backupImportTTL is how long chunks of an incomplete import are kept
+	backupImportTTL = 10 * time.Minute
+
+	backupFileManifest    = "manifest.json"
+	backupFileSignature   = "manifest.sig"
+	backupFileStore       = "controller.db"
+	backupFileAuthKey     = "auth_key.json"
+	backupFileMasterKey   = "gordian_master_key"
+	backupFileStoreKey    = "db_key"
+	backupFileDescriptors = "descriptors.json"
+
+	// pendingRestoreFile lists staged files of an imported backup which are
+	// moved into place at the next start
+	pendingRestoreFile = "pending_restore.json"
+	stagedRestoreExt   = ".restore"
+
+	// restoredDescriptorsFile keeps wallet descriptors of a restored backup until
+	// they are imported into the wallet
+	restoredDescriptorsFile = "restored_descriptors.json"
+)
+
+// BackupManifest describes the content of a backup archive. The manifest is
+// signed by the exporting pod and it has the SHA-256 hashes of files, so the
+// archive is authenticated after the owner encrypts it again for another pod.
+type BackupManifest struct {
+	Version       int               `json:"version"`
+	PodDID        string            `json:"pod_did"`
+	Owner         string            `json:"owner"`
+	SchemaVersion uint64            `json:"schema_version"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Files         []string          `json:"files"`
+	Hashes        map[string]string `json:"hashes"`
+}
+
+// BackupChunk is a base64 encoded part of an encrypted backup
+type BackupChunk struct {
+	BackupID string `json:"backup_id"`
+	Index    int    `json:"index"`
+	Total    int    `json:"total"`
+	Chunk    string `json:"chunk"`
+}
+
+// ExportedBackupChunk is a chunk of an exported backup. The SHA-256 hash of the
+// whole encrypted backup is signed by the pod identity.
+type ExportedBackupChunk struct {
+	BackupChunk
+	SHA256    string `json:"sha256"`
+	Identity  string `json:"identity"`
+	Signature string `json:"signature"`
+}
+
+// walletDescriptor is an active descriptor of the wallet returned by `listdescriptors`
+type walletDescriptor struct {
+	Desc      string  `json:"desc"`
+	Timestamp int64   `json:"timestamp"`
+	Active    bool    `json:"active"`
+	Internal  *bool   `json:"internal,omitempty"`
+	Range     []int64 `json:"range,omitempty"`
+	Next      *int64  `json:"next,omitempty"`
+}
+
+// backupImport keeps received chunks of a backup until all of them arrive
+type backupImport struct {
+	id        string
+	total     int
+	size      int
+	chunks    map[int][]byte
+	startedAt time.Time
+}
+
+// backupFilePaths returns paths of files bundled in backups by their names in archives
+func backupFilePaths() map[string]string {
+	paths := map[string]string{
+		backupFileStore:     config.AbsoluteApplicationFilePath(viper.GetString("db_name")),
+		backupFileAuthKey:   config.AbsoluteApplicationFilePath(viper.GetString("auth_key_file")),
+		backupFileMasterKey: config.AbsoluteApplicationFilePath(viper.GetString("gordian_master_key_file")),
+	}
+	if keyFile := viper.GetString("db_key_file"); keyFile != "" {
+		paths[backupFileStoreKey] = config.AbsoluteApplicationFilePath(keyFile)
+	}
+	return paths
+}
+
+// restoreFilePaths returns paths which files of a backup are restored to by their
+// names in archives
+func restoreFilePaths() map[string]string {
+	paths := backupFilePaths()
+	paths[backupFileDescriptors] = config.AbsoluteApplicationFilePath(restoredDescriptorsFile)
+	return paths
+}
+
+// exportBackup bundles the state of the pod into an archive encrypted to the owner
+// and splits it into chunks
+func (c *Controller) exportBackup(did string) ([]interface{}, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to export backups")
+	}
+
+	descriptors, err := listWalletDescriptors()
+	if err != nil {
+		return nil, fmt.Errorf("fail to list wallet descriptors: %s", err)
+	}
+
+	archive, err := c.buildBackupArchive(did, descriptors)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := key.EncryptToDID(did, archive)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) > maxBackupSize {
+		return nil, fmt.Errorf("backup exceeds the max size of %d bytes", maxBackupSize)
+	}
+
+	hashString := sha256Hex(encrypted)
+	signature, err := key.Sign(c.identity().PrivateKey, hashString)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := utils.GenerateRandomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	backupID := hex.EncodeToString(b)
+
+	total := (len(encrypted) + backupChunkSize - 1) / backupChunkSize
+	chunks := make([]interface{}, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * backupChunkSize
+		if end > len(encrypted) {
+			end = len(encrypted)
+		}
+		chunks = append(chunks, ExportedBackupChunk{
+			BackupChunk: BackupChunk{
+				BackupID: backupID,
+				Index:    i,
+				Total:    total,
+				Chunk:    base64.StdEncoding.EncodeToString(encrypted[i*backupChunkSize : end]),
+			},
+			SHA256:    hashString,
+			Identity:  c.identity().DID,
+			Signature: signature,
+		})
+	}
+
+	log.WithField("backup_id", backupID).WithField("chunks", total).Info("backup exported")
+	return chunks, nil
+}
+
+// buildBackupArchive writes the store snapshot, key files and wallet descriptors
+// into a gzipped tar archive led by a manifest signed by the pod identity
+func (c *Controller) buildBackupArchive(owner string, descriptors []byte) ([]byte, error) {
+	var snapshot bytes.Buffer
+	if err := c.store.WriteSnapshot(&snapshot, backupMaxAuditEntries); err != nil {
+		return nil, fmt.Errorf("fail to snapshot the store: %s", err)
+	}
+
+	files := map[string][]byte{
+		backupFileStore: snapshot.Bytes(),
+	}
+	if descriptors != nil {
+		files[backupFileDescriptors] = descriptors
+	}
+
+	for name, path := range backupFilePaths() {
+		if name == backupFileStore {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			// the master key is created along with the wallet
+			if name == backupFileMasterKey && os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("fail to read %s: %s", name, err)
+		}
+		files[name] = content
+	}
+
+	manifest := BackupManifest{
+		Version:       backupFormatVersion,
+		PodDID:        c.identity().DID,
+		Owner:         owner,
+		SchemaVersion: latestSchemaVersion(),
+		CreatedAt:     c.now().UTC(),
+		Hashes:        make(map[string]string),
+	}
+	for _, name := range []string{backupFileStore, backupFileAuthKey, backupFileMasterKey, backupFileStoreKey, backupFileDescriptors} {
+		if content, ok := files[name]; ok {
+			manifest.Files = append(manifest.Files, name)
+			manifest.Hashes[name] = sha256Hex(content)
+		}
+	}
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := key.Sign(c.identity().PrivateKey, sha256Hex(m))
+	if err != nil {
+		return nil, err
+	}
+
+	files[backupFileManifest] = m
+	files[backupFileSignature] = []byte(signature)
+	return writeBackupArchive(append([]string{backupFileManifest, backupFileSignature}, manifest.Files...), files, manifest.CreatedAt)
+}
+
+// writeBackupArchive writes files into a gzipped tar archive in the given order
+func writeBackupArchive(names []string, files map[string][]byte, modTime time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		content := files[name]
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(content)),
+			ModTime: modTime,
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sha256Hex returns the SHA-256 hash of data in hex
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// readBackupArchive returns the manifest and files of a backup archive. The manifest
+// has to be signed by the pod it names and files have to match their hashes in it.
+func readBackupArchive(archive []byte) (*BackupManifest, map[string][]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid backup archive: %s", err)
+	}
+
+	// the decompressed content is limited as well
+	files := make(map[string][]byte)
+	tr := tar.NewReader(io.LimitReader(gr, maxBackupSize))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid backup archive: %s", err)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid backup archive: %s", err)
+		}
+		files[h.Name] = content
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(files[backupFileManifest], &manifest); err != nil {
+		return nil, nil, errors.New("invalid backup manifest")
+	}
+	if manifest.Version != backupFormatVersion {
+		return nil, nil, fmt.Errorf("unsupported backup version: %d", manifest.Version)
+	}
+	if !key.VerifySignature(manifest.PodDID, sha256Hex(files[backupFileManifest]), string(files[backupFileSignature])) {
+		return nil, nil, errors.New("the backup manifest is not signed by its pod")
+	}
+	for _, name := range manifest.Files {
+		content, ok := files[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is missing from the backup", name)
+		}
+		if sha256Hex(content) != manifest.Hashes[name] {
+			return nil, nil, fmt.Errorf("%s mismatched its hash in the manifest", name)
+		}
+	}
+	for name := range files {
+		if _, ok := manifest.Hashes[name]; !ok && name != backupFileManifest && name != backupFileSignature {
+			return nil, nil, fmt.Errorf("%s is not listed in the manifest", name)
+		}
+	}
+	for _, name := range []string{backupFileStore, backupFileAuthKey} {
+		if _, ok := files[name]; !ok {
+			return nil, nil, fmt.Errorf("%s is missing from the backup", name)
+		}
+	}
+	delete(files, backupFileManifest)
+	delete(files, backupFileSignature)
+
+	return &manifest, files, nil
+}
+
+// importBackup collects chunks of a backup, which is exported by a pod and encrypted
+// to the identity of this pod by the owner. Once all chunks arrive, it is verified and
+// its files, including the wallet descriptors, are staged to replace the current ones
+// at the next start.
+func (c *Controller) importBackup(did string, chunk BackupChunk) (map[string]interface{}, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to import backups")
+	}
+	if err := c.checkFreshPod(); err != nil {
+		return nil, err
+	}
+
+	encrypted, received, err := c.receiveBackupChunk(chunk)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted == nil {
+		return map[string]interface{}{
+			"backup_id": chunk.BackupID,
+			"received":  received,
+			"total":     chunk.Total,
+		}, nil
+	}
+
+	archive, err := key.Decrypt(c.identity().PrivateKey, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("fail to decrypt the backup: %s", err)
+	}
+
+	manifest, files, err := readBackupArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.verifyBackup(manifest, files); err != nil {
+		return nil, err
+	}
+
+	if err := stageRestore(files); err != nil {
+		return nil, fmt.Errorf("fail to stage the backup: %s", err)
+	}
+	c.restartRequired = true
+
+	log.WithField("pod_did", manifest.PodDID).WithField("created_at", manifest.CreatedAt).Info("backup imported")
+	return map[string]interface{}{
+		"backup_id":        chunk.BackupID,
+		"pod_did":          manifest.PodDID,
+		"created_at":       manifest.CreatedAt,
+		"restart_required": true,
+	}, nil
+}
+
+// checkFreshPod returns an error if the pod has a wallet, members or a pending restore
+func (c *Controller) checkFreshPod() error {
+	for _, path := range []string{
+		config.AbsoluteApplicationFilePath(viper.GetString("gordian_master_key_file")),
+		config.AbsoluteApplicationFilePath(pendingRestoreFile),
+		config.AbsoluteApplicationFilePath(restoredDescriptorsFile),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return errors.New("backups are only able to be imported into a fresh pod")
+		}
+	}
+	if len(c.store.Members()) > 0 {
+		return errors.New("backups are only able to be imported into a fresh pod")
+	}
+	return nil
+}
+
+// verifyBackup checks that a backup belongs to the owner and it is able to be
+// restored with the current config
+func (c *Controller) verifyBackup(manifest *BackupManifest, files map[string][]byte) error {
+	if manifest.Owner != c.owner() {
+		return errors.New("the backup belongs to another owner")
+	}
+	if manifest.SchemaVersion > latestSchemaVersion() {
+		return fmt.Errorf("unsupported schema version: %d", manifest.SchemaVersion)
+	}
+
+	var k KeyFile
+	if err := json.Unmarshal(files[backupFileAuthKey], &k); err != nil {
+		return errors.New("invalid auth key in the backup")
+	}
+	privateKey, err := hex.DecodeString(k.PrivateKey)
+	if err != nil || !validPrivateKey(privateKey) || key.DID(privateKey) != manifest.PodDID {
+		return errors.New("the auth key in the backup mismatched the pod did")
+	}
+
+	_, hasStoreKey := files[backupFileStoreKey]
+	if hasStoreKey != (viper.GetString("db_key_file") != "") {
+		return errors.New("db_key_file has to be set if and only if the backup has a store key file")
+	}
+	return nil
+}
+
+// validPrivateKey returns whether bytes are a secp256k1 private key
+func validPrivateKey(privateKey []byte) bool {
+	d := new(big.Int).SetBytes(privateKey)
+	return len(privateKey) == 32 && d.Sign() > 0 && d.Cmp(btcec.S256().N) < 0
+}
+
+// receiveBackupChunk keeps a chunk of the backup being imported. It returns the whole
+// backup once all chunks are received, or the number of received chunks.
+func (c *Controller) receiveBackupChunk(chunk BackupChunk) ([]byte, int, error) {
+	if chunk.BackupID == "" || chunk.Total <= 0 || chunk.Index < 0 || chunk.Index >= chunk.Total {
+		return nil, 0, errors.New("invalid backup chunk")
+	}
+	data, err := base64.StdEncoding.DecodeString(chunk.Chunk)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid backup chunk: %s", err)
+	}
+
+	c.backupImportLock.Lock()
+	defer c.backupImportLock.Unlock()
+
+	now := c.now()
+	imp := c.backupImport
+	if imp == nil || imp.id != chunk.BackupID || now.Sub(imp.startedAt) > backupImportTTL {
+		imp = &backupImport{
+			id:        chunk.BackupID,
+			total:     chunk.Total,
+			chunks:    make(map[int][]byte),
+			startedAt: now,
+		}
+		c.backupImport = imp
+	}
+	if chunk.Total != imp.total {
+		return nil, 0, errors.New("the number of backup chunks mismatched")
+	}
+
+	if _, ok := imp.chunks[chunk.Index]; !ok {
+		imp.size += len(data)
+		if imp.size > maxBackupSize {
+			c.backupImport = nil
+			return nil, 0, errors.New("backup too large")
+		}
+		imp.chunks[chunk.Index] = data
+	}
+	if len(imp.chunks) < imp.total {
+		return nil, len(imp.chunks), nil
+	}
+
+	backup := make([]byte, 0, imp.size)
+	for i := 0; i < imp.total; i++ {
+		backup = append(backup, imp.chunks[i]...)
+	}
+	c.backupImport = nil
+	return backup, imp.total, nil
+}
+
+// RestartRequired returns whether the pod controller has to be restarted to apply
+// an imported backup
+func (c *Controller) RestartRequired() bool {
+	return c.restartRequired
+}
+
+// stageRestore writes files of a backup next to the files they replace and records
+// them in the pending restore file
+func stageRestore(files map[string][]byte) error {
+	pending := make(map[string]string)
+	for name, target := range restoreFilePaths() {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		staged := target + stagedRestoreExt
+		if err := ioutil.WriteFile(staged, content, 0600); err != nil {
+			return err
+		}
+		pending[staged] = target
+	}
+
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(config.AbsoluteApplicationFilePath(pendingRestoreFile), b, 0600)
+}
+
+// applyPendingRestore moves staged files of an imported backup into place. It has to
+// be called before the identity and the store are loaded. The messaging database of
+// the replaced identity is removed as well.
+func applyPendingRestore() error {
+	path := config.AbsoluteApplicationFilePath(pendingRestoreFile)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var pending map[string]string
+	if err := json.Unmarshal(b, &pending); err != nil {
+		return err
+	}
+	for staged, target := range pending {
+		// a staged file is missing if it is moved before an interruption
+		if err := os.Rename(staged, target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	messagingDB := config.AbsoluteApplicationFilePath(viper.GetString("messaging.db_name"))
+	if err := os.Remove(messagingDB); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	log.WithField("files", len(pending)).Info("backup restored")
+	return os.Remove(path)
+}
+
+// importRestoredDescriptors imports wallet descriptors of a restored backup into
+// the wallet and removes them afterwards. It returns nil if there is nothing to import.
+func importRestoredDescriptors() error {
+	path := config.AbsoluteApplicationFilePath(restoredDescriptorsFile)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := importWalletDescriptors(b); err != nil {
+		return err
+	}
+
+	log.Info("wallet descriptors of the backup imported")
+	return os.Remove(path)
+}
+
+// listWalletDescriptors returns active descriptors of the wallet with private keys.
+// It returns nil if the wallet has not been created.
+func listWalletDescriptors() ([]byte, error) {
+	client, err := bitcoind.NewBtcdRPCClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Shutdown()
+
+	private, _ := json.Marshal(btcjson.Bool(true))
+	resp, err := client.RawRequest("listdescriptors", []json.RawMessage{private})
+	if err != nil {
+		if jerr, ok := err.(*btcjson.RPCError); ok && jerr.Code == btcjson.ErrRPCWalletNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var result struct {
+		Descriptors []walletDescriptor `json:"descriptors"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, err
+	}
+
+	active := make([]walletDescriptor, 0, len(result.Descriptors))
+	for _, d := range result.Descriptors {
+		if d.Active {
+			active = append(active, d)
+		}
+	}
+	return json.Marshal(active)
+}
+
+// importWalletDescriptors imports descriptors of a backup into the wallet.
+// The wallet is created if it does not exist.
+func importWalletDescriptors(b []byte) error {
+	var descriptors []walletDescriptor
+	if err := json.Unmarshal(b, &descriptors); err != nil {
+		return err
+	}
+	if len(descriptors) == 0 {
+		return nil
+	}
+
+	client, err := bitcoind.NewBtcdRPCClient()
+	if err != nil {
+		return err
+	}
+	defer client.Shutdown()
+
+	if _, err := client.GetWalletInfo(); err != nil {
+		jerr, ok := err.(*btcjson.RPCError)
+		if !ok || jerr.Code != btcjson.ErrRPCWalletNotFound {
+			return err
+		}
+		if err := createDescriptorWallet(client); err != nil {
+			return err
+		}
+	}
+
+	requests := make([]map[string]interface{}, 0, len(descriptors))
+	for _, d := range descriptors {
+		r := map[string]interface{}{
+			"desc":      d.Desc,
+			"active":    d.Active,
+			"timestamp": d.Timestamp,
+		}
+		if d.Internal != nil {
+			r["internal"] = *d.Internal
+		}
+		if d.Range != nil {
+			r["range"] = d.Range
+		}
+		if d.Next != nil {
+			r["next_index"] = *d.Next
+		}
+		requests = append(requests, r)
+	}
+
+	params, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+	resp, err := client.RawRequest("importdescriptors", []json.RawMessage{params})
+	if err != nil {
+		return err
+	}
+
+	var results []struct {
+		Success bool `json:"success"`
+		Error   *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(resp, &results); err != nil {
+		return err
+	}
+	for i, r := range results {
+		if !r.Success {
+			message := "unknown error"
+			if r.Error != nil {
+				message = r.Error.Message
+			}
+			return fmt.Errorf("descriptor %d: %s", i, message)
+		}
+	}
+	return nil
+}
+
+// createDescriptorWallet creates the blank descriptor wallet of the pod
+func createDescriptorWallet(client *rpcclient.Client) error {
+	walletName, _ := json.Marshal(btcjson.String("gordian"))
+	passphrase, _ := json.Marshal(btcjson.String(""))
+	t, _ := json.Marshal(btcjson.Bool(true))
+	f, _ := json.Marshal(btcjson.Bool(false))
+	createWalletParams := []json.RawMessage{
+		walletName, // wallet_name
+		f,          // disable_private_keys
+		t,          // blank
+		passphrase, // passphrase
+		t,          // avoid_reuse
+		t,          // descriptors
+		f,          // load_on_startup
+	}
+
+	_, err := client.RawRequest("createwallet", createWalletParams)
+	return err
+}
@@ -0,0 +1,418 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/config"
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+// fakeBitcoind serves wallet RPCs used by backups and records imported descriptors
+type fakeBitcoind struct {
+	walletCreated bool
+	imported      []map[string]interface{}
+}
+
+func (f *fakeBitcoind) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	var result interface{}
+	var rpcErr interface{}
+	switch req.Method {
+	case "listdescriptors":
+		result = map[string]interface{}{
+			"wallet_name": "gordian",
+			"descriptors": []map[string]interface{}{
+				{"desc": "wpkh(tprv/84'/1'/0'/0/*)#external", "timestamp": 1627776000, "active": true, "internal": false, "range": []int{0, 999}, "next": 3},
+				{"desc": "wpkh(tprv/84'/1'/0'/1/*)#internal", "timestamp": 1627776000, "active": true, "internal": true, "range": []int{0, 999}, "next": 1},
+				{"desc": "pkh(tprv/44'/1'/0'/0/*)#inactive", "timestamp": 1627776000, "active": false},
+			},
+		}
+	case "getwalletinfo":
+		if !f.walletCreated {
+			rpcErr = map[string]interface{}{"code": -18, "message": "Requested wallet does not exist or is not loaded"}
+		} else {
+			result = map[string]interface{}{"walletname": "gordian"}
+		}
+	case "createwallet":
+		f.walletCreated = true
+		result = map[string]interface{}{"name": "gordian"}
+	case "importdescriptors":
+		json.Unmarshal(req.Params[0], &f.imported)
+		results := make([]map[string]interface{}, len(f.imported))
+		for i := range results {
+			results[i] = map[string]interface{}{"success": true}
+		}
+		result = results
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": req.ID, "result": result, "error": rpcErr})
+}
+
+// setupBackupTestPod points the data dir to a new directory with the key files of a pod
+func setupBackupTestPod(t *testing.T, i *PodIdentity, masterKey string) {
+	viper.Set("data_dir", t.TempDir())
+	assert.NoError(t, i.SaveKey(config.AbsoluteApplicationFilePath(viper.GetString("auth_key_file"))))
+	if masterKey != "" {
+		assert.NoError(t, ioutil.WriteFile(config.AbsoluteApplicationFilePath(viper.GetString("gordian_master_key_file")), []byte(masterKey), 0600))
+	}
+}
+
+func TestExportAndImportBackup(t *testing.T) {
+	bitcoind := &fakeBitcoind{}
+	server := httptest.NewServer(bitcoind)
+	defer server.Close()
+
+	viper.Set("bitcoind.rpcconnect", server.URL)
+	viper.Set("bitcoind.rpcuser", "user")
+	viper.Set("bitcoind.rpcpassword", "password")
+	viper.Set("db_name", "controller.db")
+	viper.Set("auth_key_file", "auth_key.json")
+	viper.Set("gordian_master_key_file", "gordian_master_key")
+	viper.Set("messaging.db_name", "messaging.db")
+	defer func() {
+		for _, k := range []string{"data_dir", "bitcoind.rpcconnect", "bitcoind.rpcuser", "bitcoind.rpcpassword", "db_name", "auth_key_file", "gordian_master_key_file", "messaging.db_name"} {
+			viper.Set(k, "")
+		}
+	}()
+
+	owner, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	// export a backup from a pod in use
+	source, err := NewPodIdentity()
+	assert.NoError(t, err)
+	setupBackupTestPod(t, source, "tprv-master-key")
+
+	sourceStore := NewBoltStore(config.AbsoluteApplicationFilePath("controller.db"), source.PrivateKey)
+	defer sourceStore.db.Close()
+	assert.NoError(t, sourceStore.SaveMember(Member{DID: "did:key:member", AccessMode: AccessModeLimited}))
+
+	c := &Controller{ownerDID: owner.DID, Identity: source, store: sourceStore}
+	c.clock = func() time.Time { return time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC) }
+
+	_, err = c.exportBackup("did:key:member")
+	assert.EqualError(t, err, "only the owner is allowed to export backups")
+
+	chunks, err := c.exportBackup(owner.DID)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 1)
+
+	chunk := chunks[0].(ExportedBackupChunk)
+	assert.Equal(t, 0, chunk.Index)
+	assert.Equal(t, 1, chunk.Total)
+	assert.Equal(t, source.DID, chunk.Identity)
+	assert.True(t, key.VerifySignature(source.DID, chunk.SHA256, chunk.Signature))
+
+	encrypted, err := base64.StdEncoding.DecodeString(chunk.Chunk)
+	assert.NoError(t, err)
+	archive, err := key.Decrypt(owner.PrivateKey, encrypted)
+	assert.NoError(t, err)
+
+	manifest, files, err := readBackupArchive(archive)
+	assert.NoError(t, err)
+	assert.Equal(t, source.DID, manifest.PodDID)
+	assert.Equal(t, owner.DID, manifest.Owner)
+	assert.Equal(t, latestSchemaVersion(), manifest.SchemaVersion)
+	assert.Equal(t, []string{backupFileStore, backupFileAuthKey, backupFileMasterKey, backupFileDescriptors}, manifest.Files)
+	assert.Equal(t, "tprv-master-key", string(files[backupFileMasterKey]))
+	assert.Equal(t, sha256Hex(files[backupFileMasterKey]), manifest.Hashes[backupFileMasterKey])
+
+	var descriptors []walletDescriptor
+	assert.NoError(t, json.Unmarshal(files[backupFileDescriptors], &descriptors))
+	assert.Len(t, descriptors, 2)
+
+	// the owner re-encrypts the backup to a freshly provisioned pod
+	target, err := NewPodIdentity()
+	assert.NoError(t, err)
+	setupBackupTestPod(t, target, "")
+
+	targetStore := NewBoltStore(config.AbsoluteApplicationFilePath("controller.db"), target.PrivateKey)
+	c = &Controller{ownerDID: owner.DID, Identity: target, store: targetStore}
+
+	reencrypted, err := key.EncryptToDID(target.DID, archive)
+	assert.NoError(t, err)
+
+	_, err = c.importBackup("did:key:member", BackupChunk{})
+	assert.EqualError(t, err, "only the owner is allowed to import backups")
+
+	half := len(reencrypted) / 2
+	parts := [][]byte{reencrypted[:half], reencrypted[half:]}
+	resp, err := c.importBackup(owner.DID, BackupChunk{BackupID: "b1", Index: 1, Total: 2, Chunk: base64.StdEncoding.EncodeToString(parts[1])})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"backup_id": "b1", "received": 1, "total": 2}, resp)
+	assert.False(t, c.RestartRequired())
+
+	resp, err = c.importBackup(owner.DID, BackupChunk{BackupID: "b1", Index: 0, Total: 2, Chunk: base64.StdEncoding.EncodeToString(parts[0])})
+	assert.NoError(t, err)
+	assert.Equal(t, source.DID, resp["pod_did"])
+	assert.True(t, c.RestartRequired())
+
+	// the wallet is untouched until the backup is applied
+	assert.False(t, bitcoind.walletCreated)
+	assert.Empty(t, bitcoind.imported)
+
+	// a staged backup blocks another import
+	_, err = c.importBackup(owner.DID, BackupChunk{BackupID: "b2", Index: 0, Total: 1, Chunk: base64.StdEncoding.EncodeToString(reencrypted)})
+	assert.EqualError(t, err, "backups are only able to be imported into a fresh pod")
+
+	// the backup is applied at the next start
+	targetStore.db.Close()
+	assert.NoError(t, ioutil.WriteFile(config.AbsoluteApplicationFilePath("messaging.db"), []byte("messaging"), 0600))
+	assert.NoError(t, applyPendingRestore())
+
+	_, err = os.Stat(config.AbsoluteApplicationFilePath(pendingRestoreFile))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(config.AbsoluteApplicationFilePath("messaging.db"))
+	assert.True(t, os.IsNotExist(err))
+
+	restored, _, err := CreateOrLoadPodIdentityFromKey(config.AbsoluteApplicationFilePath("auth_key.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, source.DID, restored.DID)
+
+	restoredStore, err := openBoltStore(config.AbsoluteApplicationFilePath("controller.db"), restored.PrivateKey)
+	assert.NoError(t, err)
+	defer restoredStore.db.Close()
+	assert.Equal(t, AccessModeLimited, restoredStore.MemberAccessMode("did:key:member"))
+
+	// descriptors are imported into the wallet after the restart
+	assert.NoError(t, importRestoredDescriptors())
+	assert.True(t, bitcoind.walletCreated)
+	assert.Len(t, bitcoind.imported, 2)
+	assert.Equal(t, "wpkh(tprv/84'/1'/0'/0/*)#external", bitcoind.imported[0]["desc"])
+	assert.Equal(t, float64(3), bitcoind.imported[0]["next_index"])
+	_, err = os.Stat(config.AbsoluteApplicationFilePath(restoredDescriptorsFile))
+	assert.True(t, os.IsNotExist(err))
+
+	// nothing is left to restore
+	assert.NoError(t, applyPendingRestore())
+	assert.NoError(t, importRestoredDescriptors())
+}
+
+func TestReadTamperedBackupArchive(t *testing.T) {
+	viper.Set("db_name", "controller.db")
+	viper.Set("auth_key_file", "auth_key.json")
+	viper.Set("gordian_master_key_file", "gordian_master_key")
+	defer func() {
+		for _, k := range []string{"data_dir", "db_name", "auth_key_file", "gordian_master_key_file"} {
+			viper.Set(k, "")
+		}
+	}()
+
+	owner, err := NewPodIdentity()
+	assert.NoError(t, err)
+	pod, err := NewPodIdentity()
+	assert.NoError(t, err)
+	setupBackupTestPod(t, pod, "tprv-master-key")
+
+	s := NewBoltStore(config.AbsoluteApplicationFilePath("controller.db"), pod.PrivateKey)
+	defer s.db.Close()
+	c := &Controller{ownerDID: owner.DID, Identity: pod, store: s}
+	archive, err := c.buildBackupArchive(owner.DID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, files, err := readBackupArchive(archive)
+	assert.NoError(t, err)
+
+	var names []string
+	entries := make(map[string][]byte)
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	assert.NoError(t, err)
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		content, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		names = append(names, h.Name)
+		entries[h.Name] = content
+	}
+	assert.Equal(t, files[backupFileAuthKey], entries[backupFileAuthKey])
+
+	// rebuild writes the archive again with an entry replaced or added
+	rebuild := func(name string, content []byte) []byte {
+		modified := make(map[string][]byte)
+		for n, c := range entries {
+			modified[n] = c
+		}
+		modifiedNames := names
+		if _, ok := modified[name]; !ok {
+			modifiedNames = append(append([]string{}, names...), name)
+		}
+		modified[name] = content
+
+		b, err := writeBackupArchive(modifiedNames, modified, time.Now())
+		assert.NoError(t, err)
+		return b
+	}
+
+	_, _, err = readBackupArchive(rebuild(backupFileMasterKey, []byte("tprv-another-key")))
+	assert.EqualError(t, err, "gordian_master_key mismatched its hash in the manifest")
+
+	_, _, err = readBackupArchive(rebuild(backupFileDescriptors, []byte("[]")))
+	assert.EqualError(t, err, "descriptors.json is not listed in the manifest")
+
+	another, err := NewPodIdentity()
+	assert.NoError(t, err)
+	forged, err := key.Sign(another.PrivateKey, sha256Hex(entries[backupFileManifest]))
+	assert.NoError(t, err)
+	_, _, err = readBackupArchive(rebuild(backupFileSignature, []byte(forged)))
+	assert.EqualError(t, err, "the backup manifest is not signed by its pod")
+}
+
+func TestImportBackupRejection(t *testing.T) {
+	viper.Set("gordian_master_key_file", "gordian_master_key")
+	viper.Set("data_dir", t.TempDir())
+	defer viper.Set("gordian_master_key_file", "")
+	defer viper.Set("data_dir", "")
+
+	owner, err := NewPodIdentity()
+	assert.NoError(t, err)
+	pod, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	s := NewMemoryStore()
+	c := &Controller{ownerDID: owner.DID, Identity: pod, store: s}
+
+	manifest := &BackupManifest{Version: backupFormatVersion, PodDID: owner.DID, Owner: "did:key:another-owner"}
+	files := map[string][]byte{backupFileAuthKey: []byte(`{"private_key":"00"}`)}
+	assert.EqualError(t, c.verifyBackup(manifest, files), "the backup belongs to another owner")
+
+	manifest.Owner = owner.DID
+	manifest.SchemaVersion = latestSchemaVersion() + 1
+	assert.EqualError(t, c.verifyBackup(manifest, files), fmt.Sprintf("unsupported schema version: %d", latestSchemaVersion()+1))
+
+	manifest.SchemaVersion = latestSchemaVersion()
+	assert.EqualError(t, c.verifyBackup(manifest, files), "the auth key in the backup mismatched the pod did")
+
+	// a backup encrypted to another key
+	encrypted, err := key.EncryptToDID(owner.DID, []byte("archive"))
+	assert.NoError(t, err)
+	_, err = c.importBackup(owner.DID, BackupChunk{BackupID: "b1", Index: 0, Total: 1, Chunk: base64.StdEncoding.EncodeToString(encrypted)})
+	assert.EqualError(t, err, "fail to decrypt the backup: invalid mac hash")
+
+	_, err = c.importBackup(owner.DID, BackupChunk{BackupID: "b1", Index: 2, Total: 2, Chunk: ""})
+	assert.EqualError(t, err, "invalid backup chunk")
+
+	_, err = c.importBackup(owner.DID, BackupChunk{BackupID: "b1", Index: 0, Total: 2, Chunk: "AA=="})
+	assert.NoError(t, err)
+	_, err = c.importBackup(owner.DID, BackupChunk{BackupID: "b1", Index: 1, Total: 3, Chunk: "AA=="})
+	assert.EqualError(t, err, "the number of backup chunks mismatched")
+
+	// a pod with members is not fresh
+	assert.NoError(t, s.SaveMember(Member{DID: "did:key:member", AccessMode: AccessModeLimited}))
+	_, err = c.importBackup(owner.DID, BackupChunk{BackupID: "b1", Index: 0, Total: 1, Chunk: "AA=="})
+	assert.EqualError(t, err, "backups are only able to be imported into a fresh pod")
+}
+
+func TestExportBackupWithLargeAuditLog(t *testing.T) {
+	bitcoind := &fakeBitcoind{}
+	server := httptest.NewServer(bitcoind)
+	defer server.Close()
+
+	viper.Set("bitcoind.rpcconnect", server.URL)
+	viper.Set("bitcoind.rpcuser", "user")
+	viper.Set("bitcoind.rpcpassword", "password")
+	viper.Set("db_name", "controller.db")
+	viper.Set("auth_key_file", "auth_key.json")
+	viper.Set("gordian_master_key_file", "gordian_master_key")
+	defer func() {
+		for _, k := range []string{"data_dir", "bitcoind.rpcconnect", "bitcoind.rpcuser", "bitcoind.rpcpassword", "db_name", "auth_key_file", "gordian_master_key_file"} {
+			viper.Set(k, "")
+		}
+	}()
+
+	owner, err := NewPodIdentity()
+	assert.NoError(t, err)
+	pod, err := NewPodIdentity()
+	assert.NoError(t, err)
+	setupBackupTestPod(t, pod, "tprv-master-key")
+
+	s := NewBoltStore(config.AbsoluteApplicationFilePath("controller.db"), pod.PrivateKey)
+	defer s.db.Close()
+
+	// fill the audit log with entries of long arguments until the store alone
+	// exceeds the max size of a backup
+	args := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		args[fmt.Sprintf("arg-%d", i)] = strings.Repeat("a", auditArgMaxLen)
+	}
+	total := 2 * backupMaxAuditEntries
+	assert.NoError(t, s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketAuditLog)
+		for seq := 1; seq <= total; seq++ {
+			v, err := json.Marshal(AuditEntry{Seq: uint64(seq), DID: owner.DID, Command: "bitcoind", Args: args, Hash: fmt.Sprintf("hash-%d", seq)})
+			if err != nil {
+				return err
+			}
+			if err := b.Put(auditKey(uint64(seq)), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	info, err := os.Stat(config.AbsoluteApplicationFilePath("controller.db"))
+	assert.NoError(t, err)
+	assert.Greater(t, info.Size(), int64(maxBackupSize))
+
+	c := &Controller{ownerDID: owner.DID, Identity: pod, store: s}
+	chunks, err := c.exportBackup(owner.DID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.LessOrEqual(t, len(chunks)*backupChunkSize, maxBackupSize+backupChunkSize)
+
+	encrypted := make([]byte, 0, len(chunks)*backupChunkSize)
+	for _, chunk := range chunks {
+		b, err := base64.StdEncoding.DecodeString(chunk.(ExportedBackupChunk).Chunk)
+		assert.NoError(t, err)
+		encrypted = append(encrypted, b...)
+	}
+	archive, err := key.Decrypt(owner.PrivateKey, encrypted)
+	assert.NoError(t, err)
+	_, files, err := readBackupArchive(archive)
+	assert.NoError(t, err)
+
+	// only the latest entries are kept in the backup
+	path := filepath.Join(t.TempDir(), "restored.db")
+	assert.NoError(t, ioutil.WriteFile(path, files[backupFileStore], 0600))
+	restored, err := openBoltStore(path, pod.PrivateKey)
+	assert.NoError(t, err)
+	defer restored.db.Close()
+	entries := restored.AuditEntries(AuditQuery{})
+	assert.Len(t, entries, backupMaxAuditEntries)
+	assert.Equal(t, uint64(total-backupMaxAuditEntries+1), entries[0].Seq)
+	assert.Equal(t, AuditAnchor{Seq: uint64(total - backupMaxAuditEntries), Hash: fmt.Sprintf("hash-%d", total-backupMaxAuditEntries)}, restored.AuditLogAnchor())
+}
@@ -0,0 +1,355 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/utils"
+)
+
+const (
+	// bindingSessionTTL is how long a client has to respond a `bind` by `bind_ack`
+	bindingSessionTTL = 5 * time.Minute
+	// bindingTimestampWindow is the maximal difference between the timestamp of
+	// a `bind_ack` and the time it is received
+	bindingTimestampWindow = 2 * time.Minute
+	// bindingMaxAttempts is the number of bad `bind_ack` signatures before a lockout
+	bindingMaxAttempts = 5
+	// bindingLockout is how long a device is not allowed to bind after a lockout
+	bindingLockout = 15 * time.Minute
+
+	// legacyBindingDevice is the device which bindings made before the multi-device
+	// support belong to. It is the primary device of the messaging service.
+	legacyBindingDevice uint32 = 1
+
+	// pairingCodeLength is the number of symbols of a pairing code
+	pairingCodeLength = 8
+	// pairingCodeAlphabet excludes symbols which are easily confused like 0, O, 1 and I
+	pairingCodeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+)
+
+var bindingKeySeparator = []byte("#")
+
+// bindingKey is the store key of the binding of a device of a DID
+func bindingKey(did string, device uint32) []byte {
+	return []byte(fmt.Sprintf("%s#%d", did, device))
+}
+
+// bindingKeyPrefix is the common prefix of the store keys of all devices of a DID
+func bindingKeyPrefix(did string) []byte {
+	return append([]byte(did), bindingKeySeparator...)
+}
+
+// BindingSession is the binding state of a device of a DID. A session is created by
+// `bind` and it is completed by a `bind_ack` with a valid signature before it expires.
+type BindingSession struct {
+	Label           string        `json:"label,omitempty"`
+	Nonce           string        `json:"nonce"`
+	PairingCode     string        `json:"pairing_code,omitempty"`
+	CreatedAt       time.Time     `json:"created_at"`
+	TTL             time.Duration `json:"ttl"`
+	TimestampWindow time.Duration `json:"timestamp_window"`
+	Attempts        int           `json:"attempts"`
+	LockedUntil     *time.Time    `json:"locked_until,omitempty"`
+	ClientTimestamp string        `json:"client_timestamp,omitempty"`
+	Bound           bool          `json:"bound"`
+	BoundAt         *time.Time    `json:"bound_at,omitempty"`
+}
+
+// Expired returns whether a session is no longer able to be completed
+func (s BindingSession) Expired(now time.Time) bool {
+	return s.Nonce == "" || now.After(s.CreatedAt.Add(s.TTL))
+}
+
+// Locked returns whether a DID is not allowed to bind at the given time
+func (s BindingSession) Locked(now time.Time) bool {
+	return s.LockedUntil != nil && now.Before(*s.LockedUntil)
+}
+
+// checkTimestamp validates whether a client timestamp in milliseconds is fresh
+func (s BindingSession) checkTimestamp(timestamp string, now time.Time) error {
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid binding ack timestamp")
+	}
+
+	t := time.Unix(0, ms*int64(time.Millisecond))
+	if t.Before(s.CreatedAt.Add(-s.TimestampWindow)) {
+		return fmt.Errorf("binding ack timestamp is before the binding session")
+	}
+	if math.Abs(float64(now.Sub(t))) > float64(s.TimestampWindow) {
+		return fmt.Errorf("binding ack timestamp is out of the window")
+	}
+	return nil
+}
+
+// checkPairingCode validates a normalized pairing code. It always passes if the
+// session does not require a pairing code.
+func (s BindingSession) checkPairingCode(code string) bool {
+	if s.PairingCode == "" {
+		return code == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(s.PairingCode), []byte(code)) == 1
+}
+
+// generatePairingCode returns a random pairing code. Each symbol comes from a random
+// byte, which is not biased because 256 is a multiple of the size of the alphabet.
+func generatePairingCode() (string, error) {
+	b, err := utils.GenerateRandomBytes(pairingCodeLength)
+	if err != nil {
+		return "", err
+	}
+
+	code := make([]byte, pairingCodeLength)
+	for i := range b {
+		code[i] = pairingCodeAlphabet[int(b[i])%len(pairingCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// formatPairingCode splits a pairing code into two halves for people to read
+func formatPairingCode(code string) string {
+	return code[:len(code)/2] + "-" + code[len(code)/2:]
+}
+
+// normalizePairingCode removes separators and spaces of a pairing code typed by
+// people and converts it to upper case
+func normalizePairingCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+var (
+	legacyValueBound = []byte("true")
+)
+
+// encodeBindingSession serializes a binding session
+func encodeBindingSession(s BindingSession) ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// decodeBindingSession deserializes a binding session. Legacy bindings were stored as
+// `true` for bound DIDs and the raw nonce for pending ones. A legacy pending binding
+// is decoded as an expired session.
+func decodeBindingSession(v []byte) (*BindingSession, error) {
+	if bytes.Equal(v, legacyValueBound) {
+		return &BindingSession{Bound: true}, nil
+	}
+	if len(v) == 0 || v[0] != '{' {
+		return &BindingSession{}, nil
+	}
+
+	var s BindingSession
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// DeviceBinding is the binding session of a device of a DID
+type DeviceBinding struct {
+	DID    string
+	Device uint32
+	BindingSession
+}
+
+// decodeDeviceBinding deserializes a binding session along with its store key
+func decodeDeviceBinding(k, v []byte) (*DeviceBinding, error) {
+	i := bytes.LastIndex(k, bindingKeySeparator)
+	if i < 0 {
+		return nil, fmt.Errorf("invalid binding key: %s", k)
+	}
+	device, err := strconv.ParseUint(string(k[i+1:]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid binding key: %s", k)
+	}
+
+	session, err := decodeBindingSession(v)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceBinding{DID: string(k[:i]), Device: uint32(device), BindingSession: *session}, nil
+}
+
+type BindParams struct {
+	Label string `json:"label"`
+
+	// Invitation is required for DIDs which are not members yet
+	Invitation *InvitationToken `json:"invitation,omitempty"`
+}
+
+type RevokeBindingRPCParams struct {
+	DID    string `json:"did"`
+	Device uint32 `json:"device"`
+}
+
+// BindingLockedError is returned if a DID is temporarily not allowed to bind
+// because of repeated bad `bind_ack` signatures
+type BindingLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BindingLockedError) Error() string {
+	return fmt.Sprintf("binding is locked. retry after %d seconds", e.retryAfterSeconds())
+}
+
+func (e *BindingLockedError) Code() string {
+	return "binding_locked"
+}
+
+func (e *BindingLockedError) Details() interface{} {
+	return map[string]interface{}{
+		"retry_after": e.retryAfterSeconds(),
+	}
+}
+
+// retryAfterSeconds rounds the retry-after duration up to seconds
+func (e *BindingLockedError) retryAfterSeconds() int64 {
+	return int64(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// unbind removes the binding of the requesting device. Its member record is kept
+// so that it is able to bind again.
+func (c *Controller) unbind(did string, device uint32) (map[string]string, error) {
+	if err := c.store.RemoveBinding(did, device); err != nil {
+		return nil, err
+	}
+	log.WithField("did", did).WithField("device", device).Info("unbind account")
+
+	return map[string]string{"status": "ok"}, nil
+}
+
+// revokeBinding cuts off a device of a DID, or all of its devices if the target
+// device is 0. The member record and the pending approvals of the DID are removed
+// once it has no device left. Only the owner is allowed to use it. The owner is
+// allowed to revoke its other devices but never all of them.
+func (c *Controller) revokeBinding(did string, device uint32, targetDID string, targetDevice uint32) (map[string]string, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to revoke bindings")
+	}
+	if targetDID == c.owner() && (targetDevice == 0 || targetDevice == device) {
+		return nil, fmt.Errorf("not allowed to revoke the binding of the owner")
+	}
+
+	found := false
+	for _, b := range c.store.DeviceBindings(targetDID) {
+		if targetDevice == 0 || b.Device == targetDevice {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("binding not found")
+	}
+
+	if err := c.store.RevokeBinding(targetDID, targetDevice); err != nil {
+		return nil, err
+	}
+	log.WithField("did", targetDID).WithField("device", targetDevice).Info("binding revoked")
+
+	return map[string]string{"status": "ok"}, nil
+}
+
+// listBindings returns binding states of all devices which have started binding.
+// Only the owner is allowed to use it.
+func (c *Controller) listBindings(did string) (map[string]interface{}, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to list bindings")
+	}
+
+	deviceBindings := c.store.Bindings()
+	sort.Slice(deviceBindings, func(i, j int) bool {
+		if deviceBindings[i].DID != deviceBindings[j].DID {
+			return deviceBindings[i].DID < deviceBindings[j].DID
+		}
+		return deviceBindings[i].Device < deviceBindings[j].Device
+	})
+
+	bindings := make([]map[string]interface{}, 0, len(deviceBindings))
+	for _, b := range deviceBindings {
+		state := bindingStatePending
+		if b.Bound {
+			state = bindingStateBound
+		}
+
+		bindings = append(bindings, map[string]interface{}{
+			"did":          b.DID,
+			"device":       b.Device,
+			"label":        b.Label,
+			"access_mode":  c.accessMode(b.DID),
+			"binding":      state,
+			"bound_at":     b.BoundAt,
+			"locked_until": b.LockedUntil,
+		})
+	}
+
+	return map[string]interface{}{
+		"bindings": bindings,
+	}, nil
+}
+
+// boundDevices returns the devices of a DID which have completed binding
+func (c *Controller) boundDevices(did string) []uint32 {
+	devices := make([]uint32, 0)
+	for _, b := range c.store.DeviceBindings(did) {
+		if b.Bound {
+			devices = append(devices, b.Device)
+		}
+	}
+	return devices
+}
+
+// ResponseDevices returns the devices a response to a request from a device should
+// be sent to. The response is sent to all bound devices of the DID along with the
+// requesting device if `messaging.broadcast_responses` is enabled.
+func (c *Controller) ResponseDevices(did string, device uint32) []uint32 {
+	devices := []uint32{device}
+	if !viper.GetBool("messaging.broadcast_responses") {
+		return devices
+	}
+
+	for _, d := range c.boundDevices(did) {
+		if d != device {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// pairingCodes serves pairing codes of pending binding sessions through the local
+// admin endpoint
+func (c *Controller) pairingCodes(context *gin.Context) {
+	now := c.now()
+
+	codes := make([]map[string]interface{}, 0)
+	for _, b := range c.store.Bindings() {
+		if b.Bound || b.PairingCode == "" || b.Expired(now) {
+			continue
+		}
+
+		codes = append(codes, map[string]interface{}{
+			"did":          b.DID,
+			"device":       b.Device,
+			"label":        b.Label,
+			"pairing_code": formatPairingCode(b.PairingCode),
+			"expires_at":   b.CreatedAt.Add(b.TTL),
+		})
+	}
+
+	context.JSON(200, gin.H{"pairing_codes": codes})
+}
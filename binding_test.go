@@ -0,0 +1,397 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+func TestBindingSessionExpired(t *testing.T) {
+	now := time.Now()
+
+	s := BindingSession{Nonce: "1eba606e", CreatedAt: now, TTL: time.Minute}
+	assert.False(t, s.Expired(now.Add(30*time.Second)))
+	assert.True(t, s.Expired(now.Add(2*time.Minute)))
+
+	s.Nonce = ""
+	assert.True(t, s.Expired(now))
+}
+
+func TestBindingSessionCheckTimestamp(t *testing.T) {
+	now := time.Unix(0, 1618456405107*int64(time.Millisecond))
+	s := BindingSession{Nonce: "1eba606e", CreatedAt: now, TimestampWindow: time.Minute}
+
+	assert.NoError(t, s.checkTimestamp("1618456405107", now))
+	assert.NoError(t, s.checkTimestamp("1618456405107", now.Add(30*time.Second)))
+	assert.EqualError(t, s.checkTimestamp("1618456405107", now.Add(2*time.Minute)), "binding ack timestamp is out of the window")
+	assert.EqualError(t, s.checkTimestamp("1618456285107", now), "binding ack timestamp is before the binding session")
+	assert.EqualError(t, s.checkTimestamp("not-a-number", now), "invalid binding ack timestamp")
+}
+
+func TestDecodeBindingSession(t *testing.T) {
+	s, err := decodeBindingSession([]byte("true"))
+	assert.NoError(t, err)
+	assert.True(t, s.Bound)
+
+	s, err = decodeBindingSession([]byte("1eba606e"))
+	assert.NoError(t, err)
+	assert.False(t, s.Bound)
+	assert.True(t, s.Expired(time.Now()))
+
+	lockedUntil := time.Now().UTC().Truncate(time.Second)
+	v, err := encodeBindingSession(BindingSession{Nonce: "1eba606e", Attempts: 2, LockedUntil: &lockedUntil})
+	assert.NoError(t, err)
+	s, err = decodeBindingSession(v)
+	assert.NoError(t, err)
+	assert.Equal(t, &BindingSession{Nonce: "1eba606e", Attempts: 2, LockedUntil: &lockedUntil}, s)
+}
+
+func TestBindACKExpiredSession(t *testing.T) {
+	did := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	now := time.Unix(0, 1618456405107*int64(time.Millisecond))
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().BindingSession(did, uint32(1)).Return(&BindingSession{
+		Nonce:           "1eba606e",
+		CreatedAt:       now.Add(-10 * time.Minute),
+		TTL:             bindingSessionTTL,
+		TimestampWindow: bindingTimestampWindow,
+	})
+
+	c := Controller{store: mockedStore, clock: func() time.Time { return now }}
+
+	_, err := c.bindACK(did, 1, BindACKParams{
+		Timestamp: "1618456405107",
+		Signature: "3045022100d500b7ebbadeed51aaff844a0e7d741eb5bbf4c14b8d8476d87fae4ae02ab08b0220787dcaeae59327d1ff17db5b25386bf3250425a702a212e4fbd470b890d45ea6",
+	})
+	assert.EqualError(t, err, "binding session expired")
+}
+
+func TestBindACKWithoutSession(t *testing.T) {
+	did := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().BindingSession(did, uint32(1)).Return(nil)
+	mockedStore.EXPECT().BindingSession(did, uint32(1)).Return(&BindingSession{Bound: true})
+
+	c := Controller{store: mockedStore}
+
+	_, err := c.bindACK(did, 1, BindACKParams{})
+	assert.EqualError(t, err, "binding session not found")
+
+	_, err = c.bindACK(did, 1, BindACKParams{})
+	assert.EqualError(t, err, "binding session not found")
+}
+
+func TestBindACKLockout(t *testing.T) {
+	did := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	now := time.Unix(0, 1618456405107*int64(time.Millisecond))
+	session := BindingSession{
+		Nonce:           "1eba606e",
+		CreatedAt:       now,
+		TTL:             bindingSessionTTL,
+		TimestampWindow: bindingTimestampWindow,
+		Attempts:        bindingMaxAttempts - 1,
+	}
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().BindingSession(did, uint32(1)).Return(&session)
+	mockedStore.EXPECT().SaveBindingSession(did, uint32(1), gomock.Any()).DoAndReturn(func(did string, device uint32, s BindingSession) error {
+		session = s
+		return nil
+	})
+
+	c := Controller{store: mockedStore, clock: func() time.Time { return now }}
+
+	_, err := c.bindACK(did, 1, BindACKParams{
+		Timestamp: "1618456405107",
+		Signature: "3045022100d500b7ebbadeed51aaff844a0e7d741eb5bbf4c14b8d8476d87fae4ae02ab08b0220787dcaeae59327d1ff17db5b25386bf3250425a702a212e4fbd470b890d45ea8",
+	})
+	assert.EqualError(t, err, "invalid binding ack signature")
+	assert.Equal(t, 0, session.Attempts)
+	assert.Empty(t, session.Nonce)
+	assert.Equal(t, now.Add(bindingLockout), *session.LockedUntil)
+
+	// the valid signature is rejected during the lockout
+	mockedStore.EXPECT().BindingSession(did, uint32(1)).Return(&session)
+	_, err = c.bindACK(did, 1, BindACKParams{
+		Timestamp: "1618456405107",
+		Signature: "3045022100d500b7ebbadeed51aaff844a0e7d741eb5bbf4c14b8d8476d87fae4ae02ab08b0220787dcaeae59327d1ff17db5b25386bf3250425a702a212e4fbd470b890d45ea6",
+	})
+	assert.Equal(t, &BindingLockedError{RetryAfter: bindingLockout}, err)
+	assert.Equal(t, "binding_locked", err.(*BindingLockedError).Code())
+}
+
+func TestUnbind(t *testing.T) {
+	did := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().RemoveBinding(did, uint32(1)).Return(nil)
+
+	c := Controller{store: mockedStore}
+
+	r, err := c.unbind(did, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"status": "ok"}, r)
+}
+
+func TestRevokeBinding(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	unknownDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().DeviceBindings(unknownDID).Return([]DeviceBinding{})
+	mockedStore.EXPECT().DeviceBindings(memberDID).Times(3).Return([]DeviceBinding{
+		{DID: memberDID, Device: 1, BindingSession: BindingSession{Bound: true}},
+		{DID: memberDID, Device: 2, BindingSession: BindingSession{Bound: true}},
+	})
+	mockedStore.EXPECT().DeviceBindings(ownerDID).Return([]DeviceBinding{
+		{DID: ownerDID, Device: 1, BindingSession: BindingSession{Bound: true}},
+		{DID: ownerDID, Device: 2, BindingSession: BindingSession{Bound: true}},
+	})
+	mockedStore.EXPECT().RevokeBinding(memberDID, uint32(2)).Return(nil)
+	mockedStore.EXPECT().RevokeBinding(memberDID, uint32(0)).Return(nil)
+	mockedStore.EXPECT().RevokeBinding(ownerDID, uint32(2)).Return(nil)
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	_, err := c.revokeBinding(memberDID, 1, memberDID, 1)
+	assert.EqualError(t, err, "only the owner is allowed to revoke bindings")
+
+	_, err = c.revokeBinding(ownerDID, 1, ownerDID, 0)
+	assert.EqualError(t, err, "not allowed to revoke the binding of the owner")
+
+	_, err = c.revokeBinding(ownerDID, 1, ownerDID, 1)
+	assert.EqualError(t, err, "not allowed to revoke the binding of the owner")
+
+	_, err = c.revokeBinding(ownerDID, 1, unknownDID, 0)
+	assert.EqualError(t, err, "binding not found")
+
+	_, err = c.revokeBinding(ownerDID, 1, memberDID, 3)
+	assert.EqualError(t, err, "binding not found")
+
+	// revoke a single device
+	r, err := c.revokeBinding(ownerDID, 1, memberDID, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"status": "ok"}, r)
+
+	// revoke all devices
+	_, err = c.revokeBinding(ownerDID, 1, memberDID, 0)
+	assert.NoError(t, err)
+
+	// the owner revokes its lost tablet
+	_, err = c.revokeBinding(ownerDID, 1, ownerDID, 2)
+	assert.NoError(t, err)
+}
+
+func TestListBindings(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	pendingDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+	boundAt := time.Now()
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Bindings().Return([]DeviceBinding{
+		{DID: ownerDID, Device: 2, BindingSession: BindingSession{Label: "tablet", Bound: true, BoundAt: &boundAt}},
+		{DID: ownerDID, Device: 1, BindingSession: BindingSession{Label: "phone", Bound: true, BoundAt: &boundAt}},
+		{DID: memberDID, Device: 1, BindingSession: BindingSession{Bound: true, BoundAt: &boundAt}},
+		{DID: pendingDID, Device: 1, BindingSession: BindingSession{Nonce: "1eba606e"}},
+	})
+	mockedStore.EXPECT().Member(memberDID).Return(&Member{DID: memberDID, AccessMode: AccessModeLimited})
+	mockedStore.EXPECT().Member(pendingDID).Return(nil)
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	_, err := c.listBindings(memberDID)
+	assert.EqualError(t, err, "only the owner is allowed to list bindings")
+
+	r, err := c.listBindings(ownerDID)
+	assert.NoError(t, err)
+
+	bindings := r["bindings"].([]map[string]interface{})
+	assert.Len(t, bindings, 4)
+	assert.Equal(t, map[string]interface{}{
+		"did":          memberDID,
+		"device":       uint32(1),
+		"label":        "",
+		"access_mode":  AccessModeLimited,
+		"binding":      bindingStateBound,
+		"bound_at":     &boundAt,
+		"locked_until": (*time.Time)(nil),
+	}, bindings[0])
+	assert.Equal(t, ownerDID, bindings[1]["did"])
+	assert.Equal(t, "phone", bindings[1]["label"])
+	assert.Equal(t, AccessModeFull, bindings[1]["access_mode"])
+	assert.Equal(t, "tablet", bindings[2]["label"])
+	assert.Equal(t, pendingDID, bindings[3]["did"])
+	assert.Equal(t, bindingStatePending, bindings[3]["binding"])
+	assert.Equal(t, AccessModeNotApplicant, bindings[3]["access_mode"])
+}
+
+func TestResponseDevices(t *testing.T) {
+	did := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().DeviceBindings(did).Return([]DeviceBinding{
+		{DID: did, Device: 1, BindingSession: BindingSession{Bound: true}},
+		{DID: did, Device: 2, BindingSession: BindingSession{Bound: true}},
+		{DID: did, Device: 3, BindingSession: BindingSession{Nonce: "1eba606e"}},
+	})
+
+	c := Controller{store: mockedStore}
+
+	assert.Equal(t, []uint32{2}, c.ResponseDevices(did, 2))
+
+	viper.Set("messaging.broadcast_responses", true)
+	defer viper.Set("messaging.broadcast_responses", false)
+	assert.Equal(t, []uint32{2, 1}, c.ResponseDevices(did, 2))
+}
+
+func TestPairingCode(t *testing.T) {
+	code, err := generatePairingCode()
+	assert.NoError(t, err)
+	assert.Len(t, code, pairingCodeLength)
+	for _, r := range code {
+		assert.Contains(t, pairingCodeAlphabet, string(r))
+	}
+
+	assert.Equal(t, "ABCD-EFGH", formatPairingCode("ABCDEFGH"))
+	assert.Equal(t, "ABCDEFGH", normalizePairingCode("abcd-efgh"))
+	assert.Equal(t, "ABCDEFGH", normalizePairingCode(" ABCD EFGH "))
+
+	s := BindingSession{PairingCode: "ABCDEFGH"}
+	assert.True(t, s.checkPairingCode("ABCDEFGH"))
+	assert.False(t, s.checkPairingCode("ABCDEFGX"))
+	assert.False(t, s.checkPairingCode(""))
+
+	s = BindingSession{}
+	assert.True(t, s.checkPairingCode(""))
+	assert.False(t, s.checkPairingCode("ABCDEFGH"))
+}
+
+func TestBindWithPairingCode(t *testing.T) {
+	pod, err := NewPodIdentity()
+	assert.NoError(t, err)
+	client, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	viper.Set("pairing.enabled", true)
+	defer viper.Set("pairing.enabled", false)
+
+	now := time.Now()
+	var session BindingSession
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().BindingSession(client.DID, uint32(1)).AnyTimes().DoAndReturn(func(did string, device uint32) *BindingSession {
+		s := session
+		return &s
+	})
+	mockedStore.EXPECT().SaveBindingSession(client.DID, uint32(1), gomock.Any()).AnyTimes().DoAndReturn(func(did string, device uint32, s BindingSession) error {
+		session = s
+		return nil
+	})
+
+	c := Controller{Identity: pod, store: mockedStore, clock: func() time.Time { return now }}
+
+	r, err := c.bind(client.DID, 1, "phone")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", r["pairing_required"])
+	assert.Len(t, session.PairingCode, pairingCodeLength)
+
+	timestamp := fmt.Sprint(now.UnixNano() / int64(time.Millisecond))
+	code := formatPairingCode(session.PairingCode)
+
+	// the signature without the pairing code is rejected
+	signature, err := key.Sign(client.PrivateKey, r["nonce"]+timestamp)
+	assert.NoError(t, err)
+	_, err = c.bindACK(client.DID, 1, BindACKParams{Timestamp: timestamp, Signature: signature, PairingCode: code})
+	assert.EqualError(t, err, "invalid binding ack signature")
+
+	// a wrong pairing code counts as a bad attempt
+	signature, err = key.Sign(client.PrivateKey, r["nonce"]+timestamp+"ABCDEFGH")
+	assert.NoError(t, err)
+	_, err = c.bindACK(client.DID, 1, BindACKParams{Timestamp: timestamp, Signature: signature, PairingCode: "ABCD-EFGH"})
+	assert.EqualError(t, err, "invalid pairing code")
+	assert.Equal(t, 2, session.Attempts)
+
+	signature, err = key.Sign(client.PrivateKey, r["nonce"]+timestamp+session.PairingCode)
+	assert.NoError(t, err)
+	_, err = c.bindACK(client.DID, 1, BindACKParams{Timestamp: timestamp, Signature: signature, PairingCode: code})
+	assert.NoError(t, err)
+	assert.True(t, session.Bound)
+	assert.Empty(t, session.PairingCode)
+	assert.Equal(t, "phone", session.Label)
+}
+
+func TestPairingCodesEndpoint(t *testing.T) {
+	did := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	now := time.Now().UTC().Truncate(time.Second)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Bindings().Return([]DeviceBinding{
+		{DID: did, Device: 1, BindingSession: BindingSession{Bound: true}},
+		{DID: did, Device: 2, BindingSession: BindingSession{Label: "tablet", Nonce: "1eba606e", PairingCode: "ABCDEFGH", CreatedAt: now, TTL: bindingSessionTTL}},
+		{DID: did, Device: 3, BindingSession: BindingSession{Nonce: "1eba606c", PairingCode: "ABCDEFGX", CreatedAt: now.Add(-time.Hour), TTL: bindingSessionTTL}},
+		{DID: did, Device: 4, BindingSession: BindingSession{Nonce: "1eba606a", CreatedAt: now, TTL: bindingSessionTTL}},
+	})
+
+	c := Controller{store: mockedStore, clock: func() time.Time { return now }}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/pairing-codes", c.pairingCodes)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/pairing-codes", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var r struct {
+		PairingCodes []struct {
+			DID         string    `json:"did"`
+			Device      uint32    `json:"device"`
+			Label       string    `json:"label"`
+			PairingCode string    `json:"pairing_code"`
+			ExpiresAt   time.Time `json:"expires_at"`
+		} `json:"pairing_codes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &r))
+	assert.Len(t, r.PairingCodes, 1)
+	assert.Equal(t, uint32(2), r.PairingCodes[0].Device)
+	assert.Equal(t, "tablet", r.PairingCodes[0].Label)
+	assert.Equal(t, "ABCD-EFGH", r.PairingCodes[0].PairingCode)
+	assert.True(t, now.Add(bindingSessionTTL).Equal(r.PairingCodes[0].ExpiresAt))
+}
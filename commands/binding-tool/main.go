@@ -14,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	messaging "github.com/bitmark-inc/autonomy-messaging-go"
@@ -25,10 +26,11 @@ import (
 )
 
 type BindResponse struct {
-	Identity  string `json:"identity"`
-	Nonce     string `json:"nonce"`
-	Timestamp string `json:"timestamp"`
-	Signature string `json:"signature"`
+	Identity        string `json:"identity"`
+	Nonce           string `json:"nonce"`
+	Timestamp       string `json:"timestamp"`
+	Signature       string `json:"signature"`
+	PairingRequired string `json:"pairing_required"`
 }
 
 type CreateWalletResponse struct {
@@ -45,6 +47,25 @@ func Sign(privateKey []byte, message string) (string, error) {
 	return hex.EncodeToString(s), nil
 }
 
+// responseContent returns the content of a response from pod. A response envelope
+// signed by pod is verified and unwrapped. Unsigned responses are refused if
+// `pod.require_signed_response` is set.
+func responseContent(r *messaging.Message, podDID string) ([]byte, error) {
+	var signed key.SignedResponse
+	if err := json.Unmarshal(r.Content, &signed); err != nil {
+		return nil, err
+	}
+
+	if signed.Signature == "" {
+		if viper.GetBool("pod.require_signed_response") {
+			return nil, fmt.Errorf("unsigned response")
+		}
+		return r.Content, nil
+	}
+
+	return key.VerifyResponse(podDID, signed)
+}
+
 // bind invokes a bind request from pod
 func bind(wsClient *messaging.WSMessagingClient, respCh <-chan *messaging.Message, podDID string) (string, error) {
 	wsClient.SendWhisperMessages(podDID, 0, [][]byte{[]byte(`{"id":"1","command":"bind"}`)})
@@ -55,7 +76,11 @@ func bind(wsClient *messaging.WSMessagingClient, respCh <-chan *messaging.Messag
 		Data  BindResponse `json:"data"`
 	}
 
-	if err := json.Unmarshal(r.Content, &resp); err != nil {
+	content, err := responseContent(r, podDID)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(content, &resp); err != nil {
 		return "", err
 	}
 	log.WithField("resp", resp).Info("bind resp")
@@ -66,24 +91,38 @@ func bind(wsClient *messaging.WSMessagingClient, respCh <-chan *messaging.Messag
 	if !key.VerifySignature(podDID, resp.Data.Nonce+resp.Data.Timestamp, resp.Data.Signature) {
 		return "", fmt.Errorf("invalid bind info")
 	}
+	if resp.Data.PairingRequired == "true" {
+		log.Info("pairing required. pass the pairing code of the pod to bind_ack by -pairing-code")
+	}
 	return resp.Data.Nonce, nil
 }
 
-// bindACK responses a bind request to pod
-func bindACK(wsClient *messaging.WSMessagingClient, respCh <-chan *messaging.Message, podDID, nonce string, privateKey []byte) error {
+// normalizePairingCode removes separators and spaces of a pairing code and converts
+// it to upper case as the pod does before verifying the signature
+func normalizePairingCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// bindACK responses a bind request to pod. The pairing code is required if the pod
+// is in the pairing mode.
+func bindACK(wsClient *messaging.WSMessagingClient, respCh <-chan *messaging.Message, podDID, nonce, pairingCode string, privateKey []byte) error {
 	nowString := fmt.Sprint(int64(time.Now().UnixNano()) / int64(time.Millisecond))
-	signature, err := Sign(privateKey, nonce+nowString)
+	signature, err := Sign(privateKey, nonce+nowString+normalizePairingCode(pairingCode))
 	if err != nil {
 		return err
 	}
 
+	args := map[string]string{
+		"timestamp": nowString,
+		"signature": signature,
+	}
+	if pairingCode != "" {
+		args["pairing_code"] = pairingCode
+	}
 	bindAckReq := map[string]interface{}{
 		"id":      "test",
 		"command": "bind_ack",
-		"args": map[string]string{
-			"timestamp": nowString,
-			"signature": signature,
-		},
+		"args":    args,
 	}
 	log.WithField("bindAckReq", bindAckReq).Info("bind ack request")
 
@@ -101,7 +140,11 @@ func bindACK(wsClient *messaging.WSMessagingClient, respCh <-chan *messaging.Mes
 		Data  map[string]interface{} `json:"data"`
 	}
 
-	if err := json.Unmarshal(r.Content, &resp); err != nil {
+	content, err := responseContent(r, podDID)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, &resp); err != nil {
 		return err
 	}
 	log.WithField("resp", resp).Info("bind ack resp")
@@ -129,8 +172,13 @@ func bitcoinCommand(wsClient *messaging.WSMessagingClient, respCh <-chan *messag
 	wsClient.SendWhisperMessages(podDID, 0, [][]byte{b})
 	r := <-respCh
 
+	content, err := responseContent(r, podDID)
+	if err != nil {
+		return nil, err
+	}
+
 	var bitcoindResp json.RawMessage
-	if err := json.Unmarshal(r.Content, &bitcoindResp); err != nil {
+	if err := json.Unmarshal(content, &bitcoindResp); err != nil {
 		return nil, err
 	}
 
@@ -159,7 +207,11 @@ func createWallet(wsClient *messaging.WSMessagingClient, respCh <-chan *messagin
 		Data  CreateWalletResponse `json:"data"`
 	}
 
-	if err := json.Unmarshal(r.Content, &resp); err != nil {
+	content, err := responseContent(r, podDID)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(content, &resp); err != nil {
 		return "", err
 	}
 
@@ -190,7 +242,11 @@ func sendCommand(wsClient *messaging.WSMessagingClient, respCh <-chan *messaging
 		Data  json.RawMessage `json:"data"`
 	}
 
-	if err := json.Unmarshal(r.Content, &resp); err != nil {
+	content, err := responseContent(r, podDID)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &resp); err != nil {
 		return nil, err
 	}
 
@@ -202,9 +258,10 @@ func sendCommand(wsClient *messaging.WSMessagingClient, respCh <-chan *messaging
 }
 
 func main() {
-	var configFile string
+	var configFile, pairingCode string
 	flag.StringVar(&configFile, "c", "./config.yaml", "[optional] path of configuration file")
 	flag.StringVar(&configFile, "config", "./config.yaml", "[optional] path of configuration file")
+	flag.StringVar(&pairingCode, "pairing-code", "", "[optional] pairing code of the binding session for bind_ack, like 7KQX-M2HD")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: binding-tool [options] [command]\n")
 		flag.PrintDefaults()
@@ -221,7 +278,9 @@ func main() {
 		return
 	}
 
-	config.LoadConfig(configFile)
+	if err := config.LoadConfig(configFile); err != nil {
+		log.WithError(err).Fatalf("fail to load config")
+	}
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
@@ -271,7 +330,7 @@ func main() {
 				flag.Usage()
 				break
 			}
-			if err := bindACK(wsClient, msgCh, podDID, commands[1], privateKey); err != nil {
+			if err := bindACK(wsClient, msgCh, podDID, commands[1], pairingCode, privateKey); err != nil {
 				log.WithError(err).Error("bind ack fail")
 				os.Exit(1)
 			}
@@ -7,14 +7,36 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
+	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-func LoadConfig(file string) {
+// FileLoader loads a file whose path is set in the config. The path is empty
+// if it is not set.
+type FileLoader func(file string) error
+
+type registeredFile struct {
+	key  string
+	load FileLoader
+}
+
+var registeredFiles []registeredFile
+
+// RegisterFile registers the loader of a file whose path is set by a config key.
+// LoadConfig loads the file and reloads it whenever the file is changed or the
+// process receives SIGHUP.
+func RegisterFile(key string, load FileLoader) {
+	registeredFiles = append(registeredFiles, registeredFile{key: key, load: load})
+}
+
+func LoadConfig(file string) error {
 	// Config from file
 	viper.SetConfigType("yaml")
 	if file != "" {
@@ -47,6 +69,36 @@ func LoadConfig(file string) {
 	default:
 		log.SetLevel(log.ErrorLevel)
 	}
+
+	return loadRegisteredFiles()
+}
+
+// loadRegisteredFiles loads registered files and watches them. A file failing
+// to be reloaded is ignored and the loaded one is kept.
+func loadRegisteredFiles() error {
+	for _, f := range registeredFiles {
+		path := viper.GetString(f.key)
+		if err := f.load(path); err != nil {
+			return fmt.Errorf("fail to load %s: %s", f.key, err)
+		}
+		if path == "" {
+			continue
+		}
+
+		load := f.load
+		logger := log.WithField("key", f.key).WithField("file", path)
+		err := watchFile(path, func() {
+			if err := load(path); err != nil {
+				logger.WithError(err).Error("fail to reload the file. keep the current one")
+				return
+			}
+			logger.Info("file reloaded")
+		})
+		if err != nil {
+			return fmt.Errorf("fail to watch %s: %s", f.key, err)
+		}
+	}
+	return nil
 }
 
 // AbsoluteApplicationFilePath returns the absolute file path under the specified data directory
@@ -56,3 +108,47 @@ func AbsoluteApplicationFilePath(name string) string {
 	}
 	return filepath.Join(viper.GetString("data_dir"), name)
 }
+
+// watchFile calls reload whenever the file is changed or the process receives SIGHUP.
+// The parent directory is watched so that files replaced by editors or config
+// management tools are still tracked.
+func watchFile(file string, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-hangup:
+				reload()
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == file &&
+					event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					reload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).Error("fail to watch file")
+			}
+		}
+	}()
+
+	return nil
+}
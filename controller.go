@@ -13,6 +13,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
@@ -29,8 +30,12 @@ import (
 
 // BindACKParams is the parameters for command `bind_ack`
 type BindACKParams struct {
-	Timestamp string `json:"timestamp"`
-	Signature string `json:"signature"`
+	Timestamp   string `json:"timestamp"`
+	Signature   string `json:"signature"`
+	PairingCode string `json:"pairing_code"`
+
+	// Invitation is redeemed once the binding completes
+	Invitation *InvitationToken `json:"invitation,omitempty"`
 }
 
 // BindACKParams is the parameters for command `bind_ack`
@@ -46,14 +51,39 @@ type CreateWalletRPCParams struct {
 type UpdateMemberAccessModeRPCParams struct {
 	MemberDID  string     `json:"member_did"`
 	AccessMode AccessMode `json:"access_mode"`
+	ExpiresAt  *time.Time `json:"expires_at"`
 }
 
 type RemoveMemberAccessModeRPCParams struct {
 	MemberDID string `json:"member_did"`
 }
 
+type MemberRPCPolicyRPCParams struct {
+	MemberDID string   `json:"member_did"`
+	Methods   []string `json:"methods"`
+}
+
 type FinishPSBTRPCParams struct {
-	PSBT string `json:"psbt"`
+	PSBT                    string `json:"psbt"`
+	AllowUntrustedAddresses bool   `json:"allow_untrusted_addresses"`
+}
+
+type PendingPSBTRPCParams struct {
+	TxID string `json:"txid"`
+}
+
+type DelayedTxRPCParams struct {
+	TxID string `json:"txid"`
+}
+
+type TrustedAddressRPCParams struct {
+	Address string `json:"address"`
+	Label   string `json:"label"`
+}
+
+type SpendingLimitRPCParams struct {
+	DID string `json:"did"`
+	SpendingLimit
 }
 
 type BitcoindCtlResponse struct {
@@ -63,28 +93,75 @@ type BitcoindCtlResponse struct {
 
 type Controller struct {
 	ownerDID       string
+	ownerLock      sync.RWMutex
 	httpClient     *http.Client
 	Identity       *PodIdentity
+	identityLock   sync.RWMutex
 	store          Store
+	rateLimiter    *RateLimiter
 	LastActiveTime time.Time
+
+	// clock returns the current time. It is time.Now if it is not set.
+	clock func() time.Time
+
+	// vaultLock serializes broadcasting and cancelling transactions in the vault
+	vaultLock sync.Mutex
+
+	// approvalLock serializes votes and expiry of PSBTs waiting for approvals so that
+	// a PSBT is never released, rejected or expired twice
+	approvalLock sync.Mutex
+
+	// backupImport keeps chunks of the backup being imported
+	backupImport     *backupImport
+	backupImportLock sync.Mutex
+	restartRequired  bool
+
+	// retiredIdentity is the identity retired by a rotation until the messaging loop takes it
+	retiredIdentity *RetiredIdentity
 }
 
 func NewController(ownerDID string, i *PodIdentity) *Controller {
+	keyMaterial, err := storeKeyMaterial(i)
+	if err != nil {
+		log.WithError(err).Panic("fail to load the store key")
+	}
+	store := NewBoltStore(config.AbsoluteApplicationFilePath(viper.GetString("db_name")), keyMaterial)
+
+	// the owner from an ownership transfer overrides the one in the config
+	owner, err := store.Owner()
+	if err != nil {
+		log.WithError(err).Panic("fail to read the owner")
+	}
+	if owner != "" {
+		ownerDID = owner
+	}
+
 	return &Controller{
 		ownerDID: ownerDID,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 		Identity:       i,
-		store:          NewBoltStore(config.AbsoluteApplicationFilePath(viper.GetString("db_name"))),
+		store:          store,
+		rateLimiter:    NewRateLimiter(),
 		LastActiveTime: time.Now(),
 	}
 }
 
-// Process handles messages from clients and returns a response message
+// Process handles messages sent to the current identity of the pod and returns a response message
 func (c *Controller) Process(m *messaging.Message) [][]byte {
+	return c.ProcessAs(c.identity(), m)
+}
+
+// ProcessAs handles messages sent to the given identity of the pod, which is the current
+// one or one retired by a rotation, and returns a response message signed by it
+func (c *Controller) ProcessAs(recipient *PodIdentity, m *messaging.Message) (responses [][]byte) {
+	// only authorized requests keep the pod active
+	throttled, authorized := false, false
 	defer func() {
-		c.LastActiveTime = time.Now()
+		if authorized {
+			c.LastActiveTime = c.now()
+		}
 		if r := recover(); r != nil {
 			log.WithField("recover", r).Error("panic caught")
 		}
@@ -94,21 +171,93 @@ func (c *Controller) Process(m *messaging.Message) [][]byte {
 	if err := json.Unmarshal(m.Content, &req); err != nil {
 		log.WithError(err).Error("fail to decode content")
 	}
+	defer func() {
+		responses = c.signResponses(recipient, req.ID, responses)
+	}()
+	// requests are audited along with their results, including ones which are rejected.
+	// Throttled requests are only logged, so the audit log grows no faster than the
+	// rate limits allow.
+	defer func() {
+		if throttled {
+			return
+		}
+		if !authorized {
+			log.WithField("did", m.Source).WithField("device", m.SourceDevice).
+				WithField("command", req.Command).Warn("request rejected")
+		}
+		c.audit(m.Source, m.SourceDevice, req, responses)
+	}()
 
 	accessMode := c.accessMode(m.Source)
 
+	// requests are throttled before they are authorized so that DIDs which are not
+	// members are not able to try signatures, invitations or ownership transfers endlessly
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.Allow(m.Source, m.SourceDevice, accessMode, req.Command, c.now()); err != nil {
+			throttled = true
+			log.WithError(err).WithField("did", m.Source).Warn("request throttled")
+			return CommandResponse(req.ID, nil, err)
+		}
+	}
+
+	if err := c.verifyCommandSignature(m.Source, m.SourceDevice, req); err != nil {
+		log.WithError(err).WithField("did", m.Source).Warn("command signature rejected")
+		return CommandResponse(req.ID, nil, err)
+	}
+
+	// accept_ownership is allowed for the new owner of a pending ownership transfer
+	if req.Command == "accept_ownership" && c.isPendingOwner(m.Source) {
+		authorized = true
+		var params AcceptOwnershipRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for accept_ownership: %s", err.Error()))
+		}
+
+		resp, err := c.acceptOwnership(m.Source, params)
+		return CommandResponse(req.ID, resp, err)
+	}
+
+	// redeem_invite is allowed for new DIDs which are not members yet
+	if req.Command == "redeem_invite" && accessMode == AccessModeNotApplicant {
+		var params InvitationToken
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for redeem_invite: %s", err.Error()))
+		}
+
+		resp, err := c.redeemInvite(m.Source, params)
+		authorized = err == nil
+		return CommandResponse(req.ID, resp, err)
+	}
+
+	// new DIDs bind with an invitation, which is redeemed during or right after the binding
+	if (req.Command == "bind" || req.Command == "bind_ack") && accessMode == AccessModeNotApplicant {
+		resp, err := c.bindByInvitation(m.Source, m.SourceDevice, req)
+		authorized = err == nil
+		return CommandResponse(req.ID, resp, err)
+	}
+
 	if !HasCommandAccess(req.Command, accessMode) {
 		return CommandResponse(req.ID, nil, errors.New("not allowed to use this command"))
 	}
 
-	if !c.hasCorrectBindingState(m.Source, req.Command) {
+	if !c.hasCorrectBindingState(m.Source, m.SourceDevice, req.Command) {
 		return CommandResponse(req.ID, nil, errors.New("incorrect binding state"))
 	}
+	authorized = true
+
+	c.touchMember(m.Source, c.now())
 
 	log.WithField("command request", req).Debug("parse command")
 	switch req.Command {
 	case "bind":
-		resp, err := c.bind(m.Source)
+		var params BindParams
+		if len(req.Args) > 0 {
+			if err := json.Unmarshal(req.Args, &params); err != nil {
+				return CommandResponse(req.ID, nil, fmt.Errorf("bad request for bind: %s", err.Error()))
+			}
+		}
+
+		resp, err := c.bind(m.Source, m.SourceDevice, params.Label)
 		return CommandResponse(req.ID, resp, err)
 	case "bind_ack":
 		var params BindACKParams
@@ -116,7 +265,21 @@ func (c *Controller) Process(m *messaging.Message) [][]byte {
 			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for bind_ack: %s", err.Error()))
 		}
 
-		resp, err := c.bindACK(m.Source, params)
+		resp, err := c.bindACK(m.Source, m.SourceDevice, params)
+		return CommandResponse(req.ID, resp, err)
+	case "unbind":
+		resp, err := c.unbind(m.Source, m.SourceDevice)
+		return CommandResponse(req.ID, resp, err)
+	case "revoke_binding":
+		var params RevokeBindingRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for revoke_binding: %s", err.Error()))
+		}
+
+		resp, err := c.revokeBinding(m.Source, m.SourceDevice, params.DID, params.Device)
+		return CommandResponse(req.ID, resp, err)
+	case "list_bindings":
+		resp, err := c.listBindings(m.Source)
 		return CommandResponse(req.ID, resp, err)
 	case "create_wallet":
 		var params CreateWalletRPCParams
@@ -132,7 +295,91 @@ func (c *Controller) Process(m *messaging.Message) [][]byte {
 			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for finish_psbt: %s", err.Error()))
 		}
 
-		resp, err := c.finishPSBT(params.PSBT)
+		resp, err := c.finishPSBT(m.Source, params)
+		return CommandResponse(req.ID, resp, err)
+	case "approve_psbt":
+		var params PendingPSBTRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for approve_psbt: %s", err.Error()))
+		}
+
+		resp, err := c.approvePSBT(m.Source, params.TxID)
+		return CommandResponse(req.ID, resp, err)
+	case "reject_psbt":
+		var params PendingPSBTRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for reject_psbt: %s", err.Error()))
+		}
+
+		resp, err := c.rejectPSBT(m.Source, params.TxID)
+		return CommandResponse(req.ID, resp, err)
+	case "list_pending_psbts":
+		resp, err := c.listPendingPSBTs()
+		return CommandResponse(req.ID, resp, err)
+	case "cancel_pending_tx":
+		var params DelayedTxRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for cancel_pending_tx: %s", err.Error()))
+		}
+
+		resp, err := c.cancelPendingTx(m.Source, params.TxID)
+		return CommandResponse(req.ID, resp, err)
+	case "list_pending_txs":
+		resp, err := c.listPendingTxs()
+		return CommandResponse(req.ID, resp, err)
+	case "add_trusted_address":
+		var params TrustedAddressRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for add_trusted_address: %s", err.Error()))
+		}
+
+		resp, err := c.addTrustedAddress(m.Source, params.Address, params.Label)
+		return CommandResponse(req.ID, resp, err)
+	case "remove_trusted_address":
+		var params TrustedAddressRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for remove_trusted_address: %s", err.Error()))
+		}
+
+		resp, err := c.removeTrustedAddress(params.Address)
+		return CommandResponse(req.ID, resp, err)
+	case "list_trusted_addresses":
+		resp, err := c.listTrustedAddresses()
+		return CommandResponse(req.ID, resp, err)
+	case "set_spending_limit":
+		var params SpendingLimitRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for set_spending_limit: %s", err.Error()))
+		}
+
+		resp, err := c.setSpendingLimit(params.DID, params.SpendingLimit)
+		return CommandResponse(req.ID, resp, err)
+	case "get_spending_limit":
+		var params SpendingLimitRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for get_spending_limit: %s", err.Error()))
+		}
+
+		resp, err := c.getSpendingLimit(params.DID)
+		return CommandResponse(req.ID, resp, err)
+	case "create_invite":
+		var params CreateInviteRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for create_invite: %s", err.Error()))
+		}
+
+		resp, err := c.createInvite(m.Source, params)
+		return CommandResponse(req.ID, resp, err)
+	case "revoke_invite":
+		var params InviteRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for revoke_invite: %s", err.Error()))
+		}
+
+		resp, err := c.revokeInvite(params.Nonce)
+		return CommandResponse(req.ID, resp, err)
+	case "list_invites":
+		resp, err := c.listInvites()
 		return CommandResponse(req.ID, resp, err)
 	case "set_member":
 		var params UpdateMemberAccessModeRPCParams
@@ -140,14 +387,86 @@ func (c *Controller) Process(m *messaging.Message) [][]byte {
 			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for set_member: %s", err.Error()))
 		}
 
-		resp, err := c.setMember(params.MemberDID, params.AccessMode)
+		resp, err := c.setMember(m.Source, params.MemberDID, params.AccessMode, params.ExpiresAt)
 		return CommandResponse(req.ID, resp, err)
 	case "remove_member":
 		var params RemoveMemberAccessModeRPCParams
 		if err := json.Unmarshal(req.Args, &params); err != nil {
 			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for remove_member: %s", err.Error()))
 		}
-		resp, err := c.removeMember(params.MemberDID)
+		resp, err := c.removeMember(m.Source, params.MemberDID)
+		return CommandResponse(req.ID, resp, err)
+	case "list_members":
+		resp, err := c.listMembers(m.Source)
+		return CommandResponse(req.ID, resp, err)
+	case "set_member_profile":
+		var params MemberProfileRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for set_member_profile: %s", err.Error()))
+		}
+		resp, err := c.setMemberProfile(params.MemberDID, params.Label)
+		return CommandResponse(req.ID, resp, err)
+	case "set_member_rpc_policy":
+		var params MemberRPCPolicyRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for set_member_rpc_policy: %s", err.Error()))
+		}
+		resp, err := c.setMemberRPCPolicy(params.MemberDID, params.Methods)
+		return CommandResponse(req.ID, resp, err)
+	case "get_member_rpc_policy":
+		var params MemberRPCPolicyRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for get_member_rpc_policy: %s", err.Error()))
+		}
+		resp, err := c.getMemberRPCPolicy(params.MemberDID)
+		return CommandResponse(req.ID, resp, err)
+	case "transfer_ownership":
+		var params TransferOwnershipRPCParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for transfer_ownership: %s", err.Error()))
+		}
+
+		resp, err := c.transferOwnership(m.Source, params.NewOwnerDID)
+		return CommandResponse(req.ID, resp, err)
+	case "get_ownership_history":
+		resp, err := c.getOwnershipHistory()
+		return CommandResponse(req.ID, resp, err)
+	case "get_audit_log":
+		var params AuditQuery
+		if len(req.Args) > 0 {
+			if err := json.Unmarshal(req.Args, &params); err != nil {
+				return CommandResponse(req.ID, nil, fmt.Errorf("bad request for get_audit_log: %s", err.Error()))
+			}
+		}
+
+		resp, err := c.getAuditLog(m.Source, params)
+		return CommandResponse(req.ID, resp, err)
+	case "verify_audit_log":
+		resp, err := c.verifyAuditLog(m.Source)
+		return CommandResponse(req.ID, resp, err)
+	case "rotate_identity":
+		var params RotateIdentityRPCParams
+		if len(req.Args) > 0 {
+			if err := json.Unmarshal(req.Args, &params); err != nil {
+				return CommandResponse(req.ID, nil, fmt.Errorf("bad request for rotate_identity: %s", err.Error()))
+			}
+		}
+
+		resp, err := c.rotateIdentity(m.Source, params.Force)
+		return CommandResponse(req.ID, resp, err)
+	case "get_identity_rotations":
+		resp, err := c.getIdentityRotations()
+		return CommandResponse(req.ID, resp, err)
+	case "export_backup":
+		chunks, err := c.exportBackup(m.Source)
+		return ChunkedCommandResponse(req.ID, chunks, err)
+	case "import_backup":
+		var params BackupChunk
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for import_backup: %s", err.Error()))
+		}
+
+		resp, err := c.importBackup(m.Source, params)
 		return CommandResponse(req.ID, resp, err)
 	case "start_bitcoind":
 		resp, err := c.startBitcoind()
@@ -164,7 +483,11 @@ func (c *Controller) Process(m *messaging.Message) [][]byte {
 			return CommandResponse(req.ID, nil, fmt.Errorf("bad request for bitcoind: %s", err.Error()))
 		}
 
-		if !HasBitcoinRPCAccess(params.Method, accessMode) {
+		memberAllowList, err := c.memberRPCPolicy(m.Source)
+		if err != nil {
+			return CommandResponse(req.ID, nil, err)
+		}
+		if !HasBitcoinRPCAccess(params.Method, accessMode, memberAllowList) {
 			return CommandResponse(req.ID, nil, errors.New("not allowed to use this RPC"))
 		}
 
@@ -176,68 +499,169 @@ func (c *Controller) Process(m *messaging.Message) [][]byte {
 }
 
 func (c *Controller) accessMode(did string) AccessMode {
-	if did == c.ownerDID {
+	if did == c.owner() {
 		return AccessModeFull
 	}
 
-	mode := c.store.MemberAccessMode(did)
-	if mode > AccessModeMinimal {
+	m := c.store.Member(did)
+	if m == nil || !m.AccessMode.IsMemberAccessMode() || m.Expired(c.now()) {
 		return AccessModeNotApplicant
 	}
-	return mode
+	return m.AccessMode
+}
+
+// memberRPCPolicy returns the custom bitcoind RPC allow list of a member.
+// The owner never has a custom allow list.
+func (c *Controller) memberRPCPolicy(did string) ([]string, error) {
+	if did == c.owner() {
+		return nil, nil
+	}
+	return c.store.MemberRPCPolicy(did)
 }
 
-func (c *Controller) hasCorrectBindingState(did, command string) bool {
+// now returns the current time of the controller clock
+func (c *Controller) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+// hasCorrectBindingState checks the binding state of the requesting device
+func (c *Controller) hasCorrectBindingState(did string, device uint32, command string) bool {
 	switch command {
 	case "bind", "bind_ack":
-		return !c.store.HasBinding(did)
+		return !c.store.HasBinding(did, device)
 	default:
-		return c.store.HasBinding(did)
+		return c.store.HasBinding(did, device)
 	}
 }
 
-// bind triggers the bind process which is triggerred by a client.
-func (c *Controller) bind(did string) (map[string]string, error) {
+// bind triggers the bind process which is triggerred by a device of a client. It starts
+// a new binding session which expires after bindingSessionTTL.
+func (c *Controller) bind(did string, device uint32, label string) (map[string]string, error) {
+	now := c.now()
+
+	session := c.store.BindingSession(did, device)
+	if session == nil {
+		session = &BindingSession{}
+	}
+	if session.Locked(now) {
+		return nil, &BindingLockedError{RetryAfter: session.LockedUntil.Sub(now)}
+	}
+
 	b, err := utils.GenerateRandomBytes(4)
 	if err != nil {
 		return nil, err
 	}
 
 	nonce := hex.EncodeToString(b)
-	nowString := fmt.Sprint(int64(time.Now().UnixNano()) / int64(time.Millisecond))
-	signature, err := key.Sign(c.Identity.PrivateKey, nonce+nowString)
+	nowString := fmt.Sprint(now.UnixNano() / int64(time.Millisecond))
+	signature, err := key.Sign(c.identity().PrivateKey, nonce+nowString)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := c.store.SetBinding(did, nonce); err != nil {
+	var pairingCode string
+	if viper.GetBool("pairing.enabled") {
+		pairingCode, err = generatePairingCode()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// attempts are kept across sessions so that a new session does not reset the lockout
+	if err := c.store.SaveBindingSession(did, device, BindingSession{
+		Label:           label,
+		Nonce:           nonce,
+		PairingCode:     pairingCode,
+		CreatedAt:       now,
+		TTL:             bindingSessionTTL,
+		TimestampWindow: bindingTimestampWindow,
+		Attempts:        session.Attempts,
+	}); err != nil {
 		return nil, err
 	}
 
-	return map[string]string{
-		"identity":  c.Identity.DID,
+	resp := map[string]string{
+		"identity":  c.identity().DID,
 		"nonce":     nonce,
 		"timestamp": nowString,
 		"signature": signature,
-	}, nil
+	}
+
+	if pairingCode != "" {
+		resp["pairing_required"] = "true"
+		// pairing codes are only shown by the admin endpoint if it is enabled
+		if viper.GetString("pairing.admin_address") == "" {
+			log.WithField("did", did).WithField("device", device).WithField("pairing_code", formatPairingCode(pairingCode)).Info("pairing code generated")
+		}
+	}
+
+	return resp, nil
 }
 
-// bindACK process the client response of a binding process. It checks the nonce
-// and the signature using owner DID.
-func (c *Controller) bindACK(did string, ackParams BindACKParams) (map[string]string, error) {
-	nonce := c.store.BindingNonce(did)
+// bindACK process the client response of a binding process. It checks the nonce,
+// the pairing code if it is required, and the signature using owner DID. The device
+// is locked out for a while after bindingMaxAttempts bad attempts.
+func (c *Controller) bindACK(did string, device uint32, ackParams BindACKParams) (map[string]string, error) {
+	now := c.now()
+
+	session := c.store.BindingSession(did, device)
+	if session == nil || session.Bound {
+		return nil, fmt.Errorf("binding session not found")
+	}
+	if session.Locked(now) {
+		return nil, &BindingLockedError{RetryAfter: session.LockedUntil.Sub(now)}
+	}
+	if session.Expired(now) {
+		return nil, fmt.Errorf("binding session expired")
+	}
 
-	if !key.VerifySignature(did, nonce+ackParams.Timestamp, ackParams.Signature) {
-		err := fmt.Errorf("invalid binding ack signature")
+	if err := session.checkTimestamp(ackParams.Timestamp, now); err != nil {
 		log.WithError(err).Error("fail to bind account")
 		return nil, err
 	}
 
-	if err := c.store.CompleteBinding(did); err != nil {
+	var ackErr error
+	pairingCode := normalizePairingCode(ackParams.PairingCode)
+	if !session.checkPairingCode(pairingCode) {
+		ackErr = fmt.Errorf("invalid pairing code")
+	} else if !key.VerifySignature(did, session.Nonce+ackParams.Timestamp+pairingCode, ackParams.Signature) {
+		ackErr = fmt.Errorf("invalid binding ack signature")
+	}
+
+	if ackErr != nil {
+		session.Attempts++
+		if session.Attempts >= bindingMaxAttempts {
+			lockedUntil := now.Add(bindingLockout)
+			session.LockedUntil = &lockedUntil
+			session.Attempts = 0
+			session.Nonce = ""
+			session.PairingCode = ""
+			log.WithField("did", did).WithField("locked_until", lockedUntil).Warn("binding locked")
+		}
+		if err := c.store.SaveBindingSession(did, device, *session); err != nil {
+			log.WithError(err).Error("fail to save binding session")
+		}
+
+		log.WithError(ackErr).Error("fail to bind account")
+		return nil, ackErr
+	}
+
+	if err := c.store.SaveBindingSession(did, device, BindingSession{
+		Label:           session.Label,
+		CreatedAt:       session.CreatedAt,
+		TTL:             session.TTL,
+		TimestampWindow: session.TimestampWindow,
+		ClientTimestamp: ackParams.Timestamp,
+		Bound:           true,
+		BoundAt:         &now,
+	}); err != nil {
 		log.WithError(err).Error("fail to bind account")
 		return nil, err
 	}
-	log.WithField("did", did).Println("bind account successfully")
+	log.WithField("did", did).WithField("device", device).Println("bind account successfully")
 
 	return map[string]string{"status": "ok"}, nil
 }
@@ -250,6 +674,11 @@ func (c *Controller) bitcoinRPC(did string, bitcoindParams BitcoindRPCParams) (m
 		return nil, err
 	}
 
+	params, err = ApplyBitcoinRPCConstraints(bitcoindParams.Method, params)
+	if err != nil {
+		return nil, err
+	}
+
 	client, err := bitcoind.NewHttpRPCClient(c.httpClient)
 	statusCode, responseBody, err := client.Call(bitcoindParams.Method, params)
 	if err != nil {
@@ -331,21 +760,7 @@ func (c *Controller) createWallet(incompleteDescriptor string) (map[string]strin
 	}
 
 	if shouldCreateWallet {
-		walletName, _ := json.Marshal(btcjson.String("gordian"))
-		passphrase, _ := json.Marshal(btcjson.String(""))
-		t, _ := json.Marshal(btcjson.Bool(true))
-		f, _ := json.Marshal(btcjson.Bool(false))
-		createWalletParams := []json.RawMessage{
-			walletName, // wallet_name
-			f,          // disable_private_keys
-			t,          // blank
-			passphrase, // passphrase
-			t,          // avoid_reuse
-			t,          // descriptors
-			f,          // load_on_startup
-		}
-
-		if _, err := client.RawRequest("createwallet", createWalletParams); err != nil {
+		if err := createDescriptorWallet(client); err != nil {
 			return nil, err
 		}
 	}
@@ -399,26 +814,75 @@ func (c *Controller) createWallet(incompleteDescriptor string) (map[string]strin
 	return map[string]string{"descriptor": gordianWalletDescriptor}, nil
 }
 
-// finishPSBT finalizes the PSBT and broadcasts the transaction
-func (c *Controller) finishPSBT(psbt string) (map[string]string, error) {
+// finishPSBT finalizes the PSBT and broadcasts the transaction. Before signing, the
+// payments must go to trusted addresses and the amount leaving the wallet is checked
+// against the spending limit of the DID. Only the owner is able to override the
+// trusted address check. Large transactions are kept in the vault for a while
+// before they are broadcast.
+func (c *Controller) finishPSBT(did string, params FinishPSBTRPCParams) (map[string]string, error) {
+	if params.AllowUntrustedAddresses && did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to pay to untrusted addresses")
+	}
+
+	unsignedTx, err := utils.DecodePSBTUnsignedTx(params.PSBT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid psbt: %s", err)
+	}
+
 	client, err := bitcoind.NewBtcdRPCClient()
 	if err != nil {
 		return nil, err
 	}
 	defer client.Shutdown()
 
-	processedPSBT, err := client.WalletProcessPsbt(psbt, btcjson.Bool(true), rpcclient.SigHashAll, btcjson.Bool(true))
+	chain, err := walletChainParams(client)
+	if err != nil {
+		return nil, err
+	}
+	isChange := walletChangeChecker(client, chain)
+	payments, err := outgoingPayments(unsignedTx, chain, isChange)
+	if err != nil {
+		return nil, err
+	}
+	if !params.AllowUntrustedAddresses {
+		if err := c.checkTrustedAddresses(payments); err != nil {
+			return nil, err
+		}
+	}
+	amount, err := outgoingAmount(unsignedTx, isChange)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkSpendingLimit(did, amount, c.now()); err != nil {
+		return nil, err
+	}
+
+	if quorum := viper.GetInt("psbt_approval.quorum"); quorum > 1 {
+		return c.submitPSBTForApproval(did, params.PSBT, unsignedTx.TxHash().String(), payments, params.AllowUntrustedAddresses)
+	}
+
+	txHex, err := c.signPSBT(client, params.PSBT)
 	if err != nil {
 		return nil, err
 	}
+
+	return c.releaseTransaction(client, did, txHex, amount)
+}
+
+// signPSBT signs the PSBT with the wallet and returns the finalized transaction in hex
+func (c *Controller) signPSBT(client *rpcclient.Client, psbt string) (string, error) {
+	processedPSBT, err := client.WalletProcessPsbt(psbt, btcjson.Bool(true), rpcclient.SigHashAll, btcjson.Bool(true))
+	if err != nil {
+		return "", err
+	}
 	if !processedPSBT.Complete {
-		return nil, fmt.Errorf("psbt not completed: %s", err)
+		return "", fmt.Errorf("psbt not completed: %s", err)
 	}
 
 	psbtBytes, _ := json.Marshal(btcjson.String(processedPSBT.Psbt))
 	r, err := client.RawRequest("finalizepsbt", []json.RawMessage{psbtBytes})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	var finalizePSBTResult struct {
 		PSBT     string `json:"psbt"`
@@ -426,39 +890,172 @@ func (c *Controller) finishPSBT(psbt string) (map[string]string, error) {
 		Complete bool   `json:"complete"`
 	}
 	if err := json.Unmarshal(r, &finalizePSBTResult); err != nil {
-		return nil, fmt.Errorf("unexpected response from finalizepsbt: %s", err)
+		return "", fmt.Errorf("unexpected response from finalizepsbt: %s", err)
 	}
 	if !finalizePSBTResult.Complete {
-		return nil, fmt.Errorf("psbt not finalized: %s", err)
+		return "", fmt.Errorf("psbt not finalized: %s", err)
 	}
 
-	txBytes, _ := json.Marshal(btcjson.String(finalizePSBTResult.Hex))
-	r, err = client.RawRequest("sendrawtransaction", []json.RawMessage{txBytes})
+	return finalizePSBTResult.Hex, nil
+}
+
+// broadcastTransaction sends a raw transaction to the network and returns its txid
+func (c *Controller) broadcastTransaction(client *rpcclient.Client, txHex string) (string, error) {
+	txBytes, _ := json.Marshal(btcjson.String(txHex))
+	r, err := client.RawRequest("sendrawtransaction", []json.RawMessage{txBytes})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	var txID string
 	if err := json.Unmarshal(r, &txID); err != nil {
-		return nil, fmt.Errorf("unexpected response from sendrawtransaction: %s", err)
+		return "", fmt.Errorf("unexpected response from sendrawtransaction: %s", err)
 	}
 
-	return map[string]string{"txid": txID}, nil
+	return txID, nil
 }
 
-func (c *Controller) setMember(memberDID string, accessMode AccessMode) (map[string]string, error) {
-	if err := c.store.UpdateMemberAccessMode(memberDID, accessMode); err != nil {
+// setSpendingLimit sets the spending limit of a DID in satoshis
+func (c *Controller) setSpendingLimit(did string, limit SpendingLimit) (map[string]string, error) {
+	if did == "" {
+		return nil, fmt.Errorf("did is required")
+	}
+	if limit.Daily < 0 || limit.Weekly < 0 || limit.PerTransaction < 0 {
+		return nil, fmt.Errorf("spending limit must not be negative")
+	}
+
+	if err := c.store.SetSpendingLimit(did, limit); err != nil {
 		return nil, err
 	}
 	return map[string]string{"status": "ok"}, nil
 }
 
-func (c *Controller) removeMember(memberDID string) (map[string]string, error) {
+// getSpendingLimit returns the spending limit of a DID and the amount it has spent
+func (c *Controller) getSpendingLimit(did string) (map[string]interface{}, error) {
+	if did == "" {
+		return nil, fmt.Errorf("did is required")
+	}
+
+	now := c.now()
+	limit, err := c.store.SpendingLimit(did)
+	if err != nil {
+		return nil, err
+	}
+	spentDaily, err := c.store.SpentSince(did, now.Add(-spendingDailyPeriod))
+	if err != nil {
+		return nil, err
+	}
+	spentWeekly, err := c.store.SpentSince(did, now.Add(-spendingWeeklyPeriod))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"did":             did,
+		"daily":           limit.Daily,
+		"weekly":          limit.Weekly,
+		"per_transaction": limit.PerTransaction,
+		"spent_daily":     spentDaily,
+		"spent_weekly":    spentWeekly,
+	}, nil
+}
+
+// setMember adds a member or updates the access mode of a member. A DID is not allowed to
+// grant an access mode, or to update a member of an access mode, which is out of its privilege.
+// A member with a nil expiresAt never expires.
+func (c *Controller) setMember(did, memberDID string, accessMode AccessMode, expiresAt *time.Time) (map[string]string, error) {
+	if !accessMode.IsMemberAccessMode() {
+		return nil, fmt.Errorf("invalid access mode")
+	}
+
+	now := c.now()
+	if expiresAt != nil && !expiresAt.After(now) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+
+	if memberDID == c.owner() {
+		return nil, fmt.Errorf("not allowed to change the access mode of the owner")
+	}
+
+	granterMode := c.accessMode(did)
+	if !CanGrantAccessMode(granterMode, accessMode) {
+		return nil, fmt.Errorf("not allowed to grant the access mode")
+	}
+
+	m := c.store.Member(memberDID)
+	if m != nil && !CanGrantAccessMode(granterMode, m.AccessMode) {
+		return nil, fmt.Errorf("not allowed to update the member")
+	}
+
+	if m == nil {
+		m = &Member{
+			DID:     memberDID,
+			AddedBy: did,
+			AddedAt: now,
+		}
+	}
+	m.AccessMode = accessMode
+	m.ExpiresAt = expiresAt
+
+	if err := c.store.SaveMember(*m); err != nil {
+		return nil, err
+	}
+	return map[string]string{"status": "ok"}, nil
+}
+
+// removeMember removes a member which is within the privilege of the DID
+func (c *Controller) removeMember(did, memberDID string) (map[string]string, error) {
+	if !CanGrantAccessMode(c.accessMode(did), c.store.MemberAccessMode(memberDID)) {
+		return nil, fmt.Errorf("not allowed to remove the member")
+	}
+
 	if err := c.store.RemoveMember(memberDID); err != nil {
 		return nil, err
 	}
 	return map[string]string{"status": "ok"}, nil
 }
 
+// setMemberRPCPolicy sets a custom bitcoind RPC allow list for a member.
+// An empty list resets the member back to the allow list of its access mode.
+func (c *Controller) setMemberRPCPolicy(memberDID string, methods []string) (map[string]string, error) {
+	if c.store.MemberAccessMode(memberDID) == AccessModeNotApplicant {
+		return nil, fmt.Errorf("member not found")
+	}
+
+	for _, m := range methods {
+		if !IsBitcoinRPCAllowListed(m) {
+			return nil, fmt.Errorf("unsupported rpc method: %s", m)
+		}
+	}
+
+	if err := c.store.SetMemberRPCPolicy(memberDID, methods); err != nil {
+		return nil, err
+	}
+	return map[string]string{"status": "ok"}, nil
+}
+
+// getMemberRPCPolicy returns the bitcoind RPC methods a member is allowed to call
+func (c *Controller) getMemberRPCPolicy(memberDID string) (map[string]interface{}, error) {
+	mode := c.store.MemberAccessMode(memberDID)
+	if mode == AccessModeNotApplicant {
+		return nil, fmt.Errorf("member not found")
+	}
+
+	custom := true
+	methods, err := c.store.MemberRPCPolicy(memberDID)
+	if err != nil {
+		return nil, err
+	}
+	if methods == nil {
+		custom = false
+		methods = BitcoinRPCAllowList(mode)
+	}
+
+	return map[string]interface{}{
+		"member_did": memberDID,
+		"custom":     custom,
+		"methods":    methods,
+	}, nil
+}
+
 func (c *Controller) startBitcoind() (*BitcoindCtlResponse, error) {
 	req, err := http.NewRequest("POST", viper.GetString("bitcoind_ctl.endpoint")+"/start", nil)
 	if err != nil {
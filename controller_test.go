@@ -8,6 +8,7 @@ package main
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/suite"
@@ -28,35 +29,88 @@ func (suite *ControllerTestSuite) TestBind() {
 	mockCtl := gomock.NewController(suite.T())
 	defer mockCtl.Finish()
 	mockedStore := NewMockStore(mockCtl)
-	mockedStore.EXPECT().SetBinding(did, gomock.Any()).Times(1).Return(nil)
+	mockedStore.EXPECT().BindingSession(did, uint32(1)).Times(1).Return(&BindingSession{Attempts: 2})
+	mockedStore.EXPECT().SaveBindingSession(did, uint32(1), gomock.Any()).Times(1).DoAndReturn(func(did string, device uint32, s BindingSession) error {
+		suite.NotEmpty(s.Nonce)
+		suite.Equal(bindingSessionTTL, s.TTL)
+		suite.Equal(bindingTimestampWindow, s.TimestampWindow)
+		suite.Equal(2, s.Attempts)
+		suite.False(s.Bound)
+		return nil
+	})
 
 	c := Controller{
 		Identity: suite.Identity,
 		store:    mockedStore,
 	}
 
-	r, err := c.bind(did)
+	r, err := c.bind(did, 1, "")
 	suite.NoError(err)
 	suite.Equal(r["identity"], suite.Identity.DID)
 	suite.True(key.VerifySignature(r["identity"], r["nonce"]+r["timestamp"], r["signature"]))
 }
 
+func (suite *ControllerTestSuite) TestBindWhenLocked() {
+	did := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	now := time.Now()
+	lockedUntil := now.Add(time.Minute)
+
+	mockCtl := gomock.NewController(suite.T())
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().BindingSession(did, uint32(1)).Times(1).Return(&BindingSession{LockedUntil: &lockedUntil})
+
+	c := Controller{
+		Identity: suite.Identity,
+		store:    mockedStore,
+		clock:    func() time.Time { return now },
+	}
+
+	_, err := c.bind(did, 1, "")
+	suite.Equal(&BindingLockedError{RetryAfter: time.Minute}, err)
+	suite.EqualError(err, "binding is locked. retry after 60 seconds")
+}
+
 func (suite *ControllerTestSuite) TestBindAckWithValidNonceAndSignature() {
 	didWithValidNonceAndSignature := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
 	didWithWrongNonce := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
 	didWithInvalidSignature := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
 
+	// the timestamp of the test signatures
+	now := time.Unix(0, 1618456405107*int64(time.Millisecond))
+	session := func(nonce string) *BindingSession {
+		return &BindingSession{
+			Nonce:           nonce,
+			CreatedAt:       now.Add(-time.Minute),
+			TTL:             bindingSessionTTL,
+			TimestampWindow: bindingTimestampWindow,
+		}
+	}
+
 	mockCtl := gomock.NewController(suite.T())
 	defer mockCtl.Finish()
 	mockedStore := NewMockStore(mockCtl)
-	mockedStore.EXPECT().BindingNonce(didWithValidNonceAndSignature).AnyTimes().Return("1eba606e")
-	mockedStore.EXPECT().BindingNonce(didWithWrongNonce).AnyTimes().Return("1eba606a")
-	mockedStore.EXPECT().BindingNonce(didWithInvalidSignature).AnyTimes().Return("1eba606c")
-	mockedStore.EXPECT().CompleteBinding(didWithValidNonceAndSignature).Times(1).Return(nil)
+	mockedStore.EXPECT().BindingSession(didWithValidNonceAndSignature, uint32(1)).AnyTimes().Return(session("1eba606e"))
+	mockedStore.EXPECT().BindingSession(didWithWrongNonce, uint32(1)).AnyTimes().Return(session("1eba606a"))
+	mockedStore.EXPECT().BindingSession(didWithInvalidSignature, uint32(1)).AnyTimes().Return(session("1eba606c"))
+	mockedStore.EXPECT().SaveBindingSession(didWithValidNonceAndSignature, uint32(1), gomock.Any()).Times(1).DoAndReturn(func(did string, device uint32, s BindingSession) error {
+		suite.True(s.Bound)
+		suite.Equal(&now, s.BoundAt)
+		suite.Equal("1618456405107", s.ClientTimestamp)
+		suite.Empty(s.Nonce)
+		return nil
+	})
+	mockedStore.EXPECT().SaveBindingSession(didWithWrongNonce, uint32(1), gomock.Any()).Times(1).DoAndReturn(func(did string, device uint32, s BindingSession) error {
+		suite.False(s.Bound)
+		suite.Equal(1, s.Attempts)
+		return nil
+	})
+	mockedStore.EXPECT().SaveBindingSession(didWithInvalidSignature, uint32(1), gomock.Any()).Times(1).Return(nil)
 
 	c := Controller{
 		Identity: suite.Identity,
 		store:    mockedStore,
+		clock:    func() time.Time { return now },
 	}
 
 	testCases := []struct {
@@ -86,7 +140,7 @@ func (suite *ControllerTestSuite) TestBindAckWithValidNonceAndSignature() {
 	}
 
 	for _, t := range testCases {
-		resp, err := c.bindACK(t.did, BindACKParams{
+		resp, err := c.bindACK(t.did, 1, BindACKParams{
 			Timestamp: "1618456405107",
 			Signature: "3045022100d500b7ebbadeed51aaff844a0e7d741eb5bbf4c14b8d8476d87fae4ae02ab08b0220787dcaeae59327d1ff17db5b25386bf3250425a702a212e4fbd470b890d45ea6",
 		})
@@ -104,18 +158,27 @@ func (suite *ControllerTestSuite) TestAccessMode() {
 	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
 	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
 	memberWithInvalidAccessModeDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+	expiredMemberDID := "did:key:zQ3shk5bp53SwcW4685TwY1BuieKLTLEPLSJRG8Qknu9oddRj"
+	nonMemberDID := "did:key:zQ3shaZgv7c7EetwDBsnXxFQ9B9WcH8Kfr7bTLDYaj3cDE8Ec"
+
+	expiredAt := time.Now().Add(-time.Minute)
+	expiresAt := time.Now().Add(time.Hour)
 
 	mockCtl := gomock.NewController(suite.T())
 	defer mockCtl.Finish()
 	mockedStore := NewMockStore(mockCtl)
-	mockedStore.EXPECT().MemberAccessMode(memberDID).AnyTimes().Return(AccessModeLimited)
-	mockedStore.EXPECT().MemberAccessMode(memberWithInvalidAccessModeDID).AnyTimes().Return(AccessMode(10))
+	mockedStore.EXPECT().Member(memberDID).AnyTimes().Return(&Member{DID: memberDID, AccessMode: AccessModeLimited, ExpiresAt: &expiresAt})
+	mockedStore.EXPECT().Member(memberWithInvalidAccessModeDID).AnyTimes().Return(&Member{DID: memberWithInvalidAccessModeDID, AccessMode: AccessMode(10)})
+	mockedStore.EXPECT().Member(expiredMemberDID).AnyTimes().Return(&Member{DID: expiredMemberDID, AccessMode: AccessModeLimited, ExpiresAt: &expiredAt})
+	mockedStore.EXPECT().Member(nonMemberDID).AnyTimes().Return(nil)
 
 	c := Controller{ownerDID: ownerDID, store: mockedStore}
 
 	suite.Equal(AccessModeFull, c.accessMode(ownerDID))
 	suite.Equal(AccessModeLimited, c.accessMode(memberDID))
 	suite.Equal(AccessModeNotApplicant, c.accessMode(memberWithInvalidAccessModeDID))
+	suite.Equal(AccessModeNotApplicant, c.accessMode(expiredMemberDID))
+	suite.Equal(AccessModeNotApplicant, c.accessMode(nonMemberDID))
 }
 
 func (suite *ControllerTestSuite) TestHasCorrectBindingState() {
@@ -125,18 +188,66 @@ func (suite *ControllerTestSuite) TestHasCorrectBindingState() {
 	mockCtl := gomock.NewController(suite.T())
 	defer mockCtl.Finish()
 	mockedStore := NewMockStore(mockCtl)
-	mockedStore.EXPECT().HasBinding(didWithBinding).AnyTimes().Return(true)
-	mockedStore.EXPECT().HasBinding(didWithoutBinding).AnyTimes().Return(false)
+	mockedStore.EXPECT().HasBinding(didWithBinding, uint32(1)).AnyTimes().Return(true)
+	mockedStore.EXPECT().HasBinding(didWithoutBinding, uint32(1)).AnyTimes().Return(false)
 
 	c := Controller{store: mockedStore}
 
-	suite.False(c.hasCorrectBindingState(didWithBinding, "bind"))
-	suite.False(c.hasCorrectBindingState(didWithBinding, "bind_ack"))
-	suite.True(c.hasCorrectBindingState(didWithoutBinding, "bind"))
-	suite.True(c.hasCorrectBindingState(didWithoutBinding, "bind_ack"))
+	suite.False(c.hasCorrectBindingState(didWithBinding, 1, "bind"))
+	suite.False(c.hasCorrectBindingState(didWithBinding, 1, "bind_ack"))
+	suite.True(c.hasCorrectBindingState(didWithoutBinding, 1, "bind"))
+	suite.True(c.hasCorrectBindingState(didWithoutBinding, 1, "bind_ack"))
+
+	suite.True(c.hasCorrectBindingState(didWithBinding, 1, "create_wallet"))
+	suite.False(c.hasCorrectBindingState(didWithoutBinding, 1, "create_wallet"))
+}
+
+func (suite *ControllerTestSuite) TestSetMemberRPCPolicy() {
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	nonMemberDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
 
-	suite.True(c.hasCorrectBindingState(didWithBinding, "create_wallet"))
-	suite.False(c.hasCorrectBindingState(didWithoutBinding, "create_wallet"))
+	mockCtl := gomock.NewController(suite.T())
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().MemberAccessMode(memberDID).AnyTimes().Return(AccessModeLimited)
+	mockedStore.EXPECT().MemberAccessMode(nonMemberDID).AnyTimes().Return(AccessModeNotApplicant)
+	mockedStore.EXPECT().SetMemberRPCPolicy(memberDID, []string{"getbalances"}).Times(1).Return(nil)
+
+	c := Controller{store: mockedStore}
+
+	_, err := c.setMemberRPCPolicy(memberDID, []string{"getbalances"})
+	suite.NoError(err)
+
+	_, err = c.setMemberRPCPolicy(memberDID, []string{"dumpprivkey"})
+	suite.EqualError(err, "unsupported rpc method: dumpprivkey")
+
+	_, err = c.setMemberRPCPolicy(nonMemberDID, []string{"getbalances"})
+	suite.EqualError(err, "member not found")
+}
+
+func (suite *ControllerTestSuite) TestGetMemberRPCPolicy() {
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	memberWithPolicyDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+
+	mockCtl := gomock.NewController(suite.T())
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().MemberAccessMode(memberDID).AnyTimes().Return(AccessModeLimited)
+	mockedStore.EXPECT().MemberAccessMode(memberWithPolicyDID).AnyTimes().Return(AccessModeLimited)
+	mockedStore.EXPECT().MemberRPCPolicy(memberDID).AnyTimes().Return(nil, nil)
+	mockedStore.EXPECT().MemberRPCPolicy(memberWithPolicyDID).AnyTimes().Return([]string{"getbalances"}, nil)
+
+	c := Controller{store: mockedStore}
+
+	r, err := c.getMemberRPCPolicy(memberDID)
+	suite.NoError(err)
+	suite.Equal(false, r["custom"])
+	suite.Equal([]string{}, r["methods"])
+
+	r, err = c.getMemberRPCPolicy(memberWithPolicyDID)
+	suite.NoError(err)
+	suite.Equal(true, r["custom"])
+	suite.Equal([]string{"getbalances"}, r["methods"])
 }
 
 func TestControllerTestSuite(t *testing.T) {
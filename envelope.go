@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+const (
+	commandSignatureMissing  = "missing"
+	commandSignatureInvalid  = "invalid"
+	commandSignatureReplayed = "replayed"
+)
+
+// CommandSignatureError is returned if a command is not properly signed by the DID key of the client
+type CommandSignatureError struct {
+	Reason      string
+	LastCounter uint64
+}
+
+func (e *CommandSignatureError) Error() string {
+	switch e.Reason {
+	case commandSignatureMissing:
+		return "command signature is required"
+	case commandSignatureReplayed:
+		return "command counter is not greater than the last one"
+	default:
+		return "invalid command signature"
+	}
+}
+
+func (e *CommandSignatureError) Code() string {
+	return "command_signature_rejected"
+}
+
+func (e *CommandSignatureError) Details() interface{} {
+	details := map[string]interface{}{
+		"reason": e.Reason,
+	}
+	if e.Reason == commandSignatureReplayed {
+		details["last_counter"] = e.LastCounter
+	}
+	return details
+}
+
+// commandSignatureMessage is the message signed by a client for a command sent to a
+// pod from a device. Args are signed as the raw JSON sent by the client. The pod DID
+// and the device are signed so that a command is not able to be replayed to another
+// pod or from another device, which has its own counter.
+func commandSignatureMessage(req RequestCommand, podDID string, device uint32) string {
+	return strings.Join([]string{req.ID, req.Command, string(req.Args), fmt.Sprint(req.Counter), podDID, fmt.Sprint(device)}, "\n")
+}
+
+// verifyCommandSignature checks the signature of a command and its counter, which
+// must be greater than the last one of the device. Commands signed for former DIDs
+// of the pod are accepted. Unsigned commands are accepted unless
+// `command_signature.required` is enabled.
+func (c *Controller) verifyCommandSignature(did string, device uint32, req RequestCommand) error {
+	if req.Signature == "" {
+		if viper.GetBool("command_signature.required") {
+			return &CommandSignatureError{Reason: commandSignatureMissing}
+		}
+		return nil
+	}
+
+	verified := false
+	for _, podDID := range c.podDIDs() {
+		if key.VerifySignature(did, commandSignatureMessage(req, podDID, device), req.Signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return &CommandSignatureError{Reason: commandSignatureInvalid}
+	}
+
+	if err := c.store.AdvanceCommandCounter(did, device, req.Counter); err != nil {
+		if err == ErrStaleCommandCounter {
+			return &CommandSignatureError{Reason: commandSignatureReplayed, LastCounter: c.store.CommandCounter(did, device)}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	messaging "github.com/bitmark-inc/autonomy-messaging-go"
+	"github.com/golang/mock/gomock"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+func signedCommand(t *testing.T, i *PodIdentity, req RequestCommand, podDID string, device uint32) RequestCommand {
+	signature, err := key.Sign(i.PrivateKey, commandSignatureMessage(req, podDID, device))
+	assert.NoError(t, err)
+	req.Signature = signature
+	return req
+}
+
+func TestCommandSignatureMessage(t *testing.T) {
+	req := RequestCommand{ID: "1", Command: "set_member", Args: json.RawMessage(`{"member_did":"did:key:a","access_mode":1}`), Counter: 7}
+	assert.Equal(t, "1\nset_member\n{\"member_did\":\"did:key:a\",\"access_mode\":1}\n7\ndid:key:pod\n2", commandSignatureMessage(req, "did:key:pod", 2))
+}
+
+func TestVerifyCommandSignature(t *testing.T) {
+	client, err := NewPodIdentity()
+	assert.NoError(t, err)
+	another, err := NewPodIdentity()
+	assert.NoError(t, err)
+	pod, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().IdentityRotations().AnyTimes().Return(nil)
+	mockedStore.EXPECT().AdvanceCommandCounter(client.DID, uint32(1), uint64(2)).Return(nil)
+	mockedStore.EXPECT().AdvanceCommandCounter(client.DID, uint32(1), uint64(1)).Return(ErrStaleCommandCounter)
+	mockedStore.EXPECT().CommandCounter(client.DID, uint32(1)).Return(uint64(2))
+
+	c := Controller{Identity: pod, store: mockedStore}
+
+	req := RequestCommand{ID: "1", Command: "list_members", Args: json.RawMessage(`{}`), Counter: 2}
+	assert.NoError(t, c.verifyCommandSignature(client.DID, 1, signedCommand(t, client, req, pod.DID, 1)))
+
+	// a replayed counter
+	req.Counter = 1
+	err = c.verifyCommandSignature(client.DID, 1, signedCommand(t, client, req, pod.DID, 1))
+	assert.Equal(t, &CommandSignatureError{Reason: commandSignatureReplayed, LastCounter: 2}, err)
+	assert.Equal(t, map[string]interface{}{"reason": "replayed", "last_counter": uint64(2)}, err.(*CommandSignatureError).Details())
+
+	// signed by another key
+	req.Counter = 3
+	err = c.verifyCommandSignature(client.DID, 1, signedCommand(t, another, req, pod.DID, 1))
+	assert.Equal(t, &CommandSignatureError{Reason: commandSignatureInvalid}, err)
+
+	// tampered args
+	signed := signedCommand(t, client, req, pod.DID, 1)
+	signed.Args = json.RawMessage(`{"member_did":"did:key:b"}`)
+	err = c.verifyCommandSignature(client.DID, 1, signed)
+	assert.EqualError(t, err, "invalid command signature")
+
+	// a command captured from a device is not accepted from another device of the DID
+	err = c.verifyCommandSignature(client.DID, 2, signedCommand(t, client, req, pod.DID, 1))
+	assert.EqualError(t, err, "invalid command signature")
+
+	// a command sent to another pod of the same owner is not accepted
+	err = c.verifyCommandSignature(client.DID, 1, signedCommand(t, client, req, another.DID, 1))
+	assert.EqualError(t, err, "invalid command signature")
+
+	// unsigned commands are only accepted if signatures are not required
+	req.Signature = ""
+	assert.NoError(t, c.verifyCommandSignature(client.DID, 1, req))
+
+	viper.Set("command_signature.required", true)
+	defer viper.Set("command_signature.required", false)
+	err = c.verifyCommandSignature(client.DID, 1, req)
+	assert.EqualError(t, err, "command signature is required")
+}
+
+func TestVerifyCommandSignatureOfFormerPodDID(t *testing.T) {
+	client, err := NewPodIdentity()
+	assert.NoError(t, err)
+	pod, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	s := NewMemoryStore()
+	assert.NoError(t, s.RotateIdentity(IdentityRotation{OldDID: "did:key:former-pod", NewDID: pod.DID}, nil))
+	c := Controller{Identity: pod, store: s}
+
+	// commands sent to the former DID during the grace period are accepted
+	req := RequestCommand{ID: "1", Command: "list_members", Args: json.RawMessage(`{}`), Counter: 1}
+	assert.NoError(t, c.verifyCommandSignature(client.DID, 1, signedCommand(t, client, req, "did:key:former-pod", 1)))
+}
+
+func TestProcessSignedCommand(t *testing.T) {
+	owner, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().IdentityRotations().AnyTimes().Return(nil)
+	mockedStore.EXPECT().AdvanceCommandCounter(owner.DID, uint32(1), uint64(1)).Return(nil)
+	mockedStore.EXPECT().AdvanceCommandCounter(owner.DID, uint32(1), uint64(1)).Return(ErrStaleCommandCounter)
+	mockedStore.EXPECT().CommandCounter(owner.DID, uint32(1)).Return(uint64(1))
+	mockedStore.EXPECT().HasBinding(owner.DID, uint32(1)).Return(true)
+	mockedStore.EXPECT().DelayedTransactions().Return([]DelayedTransaction{})
+	mockedStore.EXPECT().AppendAuditEntry(gomock.Any(), gomock.Any()).Times(1).Return(nil)
+	// the replay is rejected and audited with its error
+	mockedStore.EXPECT().AppendAuditEntry(gomock.Any(), gomock.Any()).Times(1).DoAndReturn(func(e AuditEntry, _ func(*AuditEntry) error) error {
+		assert.Equal(t, auditResultError, e.Result)
+		assert.Equal(t, "command counter is not greater than the last one", e.Error)
+		return nil
+	})
+
+	c := Controller{ownerDID: owner.DID, Identity: owner, store: mockedStore}
+
+	req := signedCommand(t, owner, RequestCommand{ID: "1", Command: "list_pending_txs", Args: json.RawMessage(`{}`), Counter: 1}, owner.DID, 1)
+	content, err := json.Marshal(req)
+	assert.NoError(t, err)
+
+	m := &messaging.Message{Source: owner.DID, SourceDevice: 1, Content: content}
+	resp := c.Process(m)
+	assert.NotContains(t, string(resp[0]), "error")
+
+	// the same message is rejected as a replay
+	resp = c.Process(m)
+	var r map[string]interface{}
+	assert.NoError(t, json.Unmarshal(resp[0], &r))
+	assert.Equal(t, "command_signature_rejected", r["code"])
+}
@@ -8,8 +8,9 @@ require (
 	github.com/bitmark-inc/secp256k1-go v0.0.0-20210301070431-3d05e3361433
 	github.com/btcsuite/btcd v0.21.0-beta.0.20210413192109-2d7825cf709f
 	github.com/btcsuite/btcutil v1.0.3-0.20201208143702-a53e38424cce
-	github.com/btcsuite/btcutil/psbt v1.0.2
+	github.com/btcsuite/btcutil/psbt v1.0.3-0.20201208143702-a53e38424cce
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gin-gonic/gin v1.7.2
 	github.com/golang/mock v1.5.0
 	github.com/multiformats/go-multicodec v0.2.0
@@ -17,5 +18,6 @@ require (
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.7.0
 	go.etcd.io/bbolt v1.3.5
-	golang.org/x/crypto v0.0.0-20210415154028-4f45737414dc // indirect
+	golang.org/x/crypto v0.0.0-20210415154028-4f45737414dc
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,461 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	messaging "github.com/bitmark-inc/autonomy-messaging-go"
+	"github.com/bitmark-inc/autonomy-pod-controller/config"
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+const (
+	identityRotationDefaultGracePeriod = 72 * time.Hour
+
+	// the key file and the messaging database of the retired identity are kept
+	// with this suffix until the grace period ends
+	retiredIdentityFileExt = ".previous"
+)
+
+// IdentityRotation is the statement of the pod moving from the old DID to the new DID.
+// It is signed by both keys so that clients are able to follow the pod to the new DID.
+type IdentityRotation struct {
+	OldDID       string    `json:"old_did"`
+	NewDID       string    `json:"new_did"`
+	RotatedAt    time.Time `json:"rotated_at"`
+	GraceUntil   time.Time `json:"grace_until"`
+	OldSignature string    `json:"old_signature"`
+	NewSignature string    `json:"new_signature"`
+}
+
+// message returns the message signed by both keys of a rotation
+func (r IdentityRotation) message() string {
+	return fmt.Sprintf("rotate_identity%s%s%d%d", r.OldDID, r.NewDID,
+		r.RotatedAt.UnixNano()/int64(time.Millisecond), r.GraceUntil.UnixNano()/int64(time.Millisecond))
+}
+
+// Verify checks that the rotation is signed by both the old and the new DID
+func (r IdentityRotation) Verify() error {
+	if !key.VerifySignature(r.OldDID, r.message(), r.OldSignature) {
+		return errors.New("invalid signature of the old identity")
+	}
+	if !key.VerifySignature(r.NewDID, r.message(), r.NewSignature) {
+		return errors.New("invalid signature of the new identity")
+	}
+	return nil
+}
+
+// RotateIdentityRPCParams are the arguments of rotate_identity. Force rotates the
+// identity again before the grace period of the last rotation ends.
+type RotateIdentityRPCParams struct {
+	Force bool `json:"force"`
+}
+
+// RetiredIdentity is a former identity of the pod which keeps receiving messages
+// until the grace period of its rotation ends
+type RetiredIdentity struct {
+	Identity *PodIdentity
+	Rotation IdentityRotation
+}
+
+// retiredMessage is a message received by a retired identity. Responses are signed by
+// the retired identity and sent back through its websocket connection.
+type retiredMessage struct {
+	identity *PodIdentity
+	message  *messaging.Message
+	ws       *messaging.WSMessagingClient
+}
+
+// identityRotationGracePeriod returns how long the old DID keeps being served after a rotation
+func identityRotationGracePeriod() time.Duration {
+	if d := viper.GetDuration("identity_rotation.grace_period"); d > 0 {
+		return d
+	}
+	return identityRotationDefaultGracePeriod
+}
+
+// retiredKeyFile returns the path of the key file of the retired identity
+func retiredKeyFile() string {
+	return config.AbsoluteApplicationFilePath(viper.GetString("auth_key_file")) + retiredIdentityFileExt
+}
+
+// retiredMessagingDB returns the path of the messaging database of the retired identity
+func retiredMessagingDB() string {
+	return config.AbsoluteApplicationFilePath(viper.GetString("messaging.db_name")) + retiredIdentityFileExt
+}
+
+// removeRetiredIdentityFiles removes the key file and the messaging database of the
+// retired identity once its grace period ends
+func removeRetiredIdentityFiles() {
+	for _, path := range []string{retiredKeyFile(), retiredMessagingDB()} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", path).Error("fail to remove a file of the retired identity")
+		}
+	}
+}
+
+// serveRetiredIdentity keeps a retired identity connected to the messaging server and
+// forwards its messages until the grace period of its rotation ends. Files of the
+// retired identity are removed afterwards. It returns without removing the files once
+// stop is closed, which happens when another rotation retires the current identity.
+func serveRetiredIdentity(r *RetiredIdentity, messages chan<- retiredMessage, stop <-chan struct{}, retryInterval time.Duration, retryCounts int) {
+	logger := log.WithField("did", r.Identity.DID)
+
+	graceEnd := time.NewTimer(time.Until(r.Rotation.GraceUntil))
+	defer graceEnd.Stop()
+
+	stopRenewal := make(chan struct{})
+	defer close(stopRenewal)
+	go renewAuthToken(r.Identity, time.Minute, stopRenewal)
+
+	for {
+		select {
+		case <-stop:
+			logger.Info("the retired identity is replaced by another rotation")
+			return
+		default:
+		}
+
+		if r.Identity.AuthToken() == "" {
+			if err := r.Identity.Auth(); err != nil {
+				logger.WithError(err).Error("retired identity authentication fail")
+			}
+		}
+
+		var ws *messaging.WSMessagingClient
+		var messagingClient *messaging.Client
+		if r.Identity.AuthToken() != "" {
+			messagingClient, ws = connectMessaging(r.Identity, retiredMessagingDB(), retryInterval, retryCounts)
+			if ws == nil {
+				logger.Error("fail to connect the retired identity to the messaging server")
+				messagingClient.Close()
+			}
+		}
+
+		if ws == nil {
+			select {
+			case <-stop:
+				logger.Info("the retired identity is replaced by another rotation")
+				return
+			case <-graceEnd.C:
+				removeRetiredIdentityFiles()
+				logger.Info("grace period of the retired identity ended")
+				return
+			case <-time.After(retryInterval):
+				continue
+			}
+		}
+
+	MESSAGE_LOOP:
+		for {
+			select {
+			case <-stop:
+				ws.Close()
+				messagingClient.Close()
+				logger.Info("the retired identity is replaced by another rotation")
+				return
+			case <-graceEnd.C:
+				ws.Close()
+				messagingClient.Close()
+				removeRetiredIdentityFiles()
+				logger.Info("grace period of the retired identity ended")
+				return
+			case m := <-ws.WhisperMessages():
+				// there will be a very last nil message if a connection is closed from the server
+				if m == nil {
+					logger.Info("connection of the retired identity closed by server")
+					ws.Close()
+					messagingClient.Close()
+					break MESSAGE_LOOP
+				}
+
+				select {
+				case messages <- retiredMessage{identity: r.Identity, message: m, ws: ws}:
+				case <-stop:
+					ws.Close()
+					messagingClient.Close()
+					logger.Info("the retired identity is replaced by another rotation")
+					return
+				}
+
+				messagingClient.RefreshToken(r.Identity.AuthToken())
+				if err := messagingClient.RegisterKeys(); err != nil {
+					logger.WithError(err).Error("failed to refill pre-keys of the retired identity")
+				}
+			}
+		}
+	}
+}
+
+// identity returns the current identity of the pod
+func (c *Controller) identity() *PodIdentity {
+	c.identityLock.RLock()
+	defer c.identityLock.RUnlock()
+	return c.Identity
+}
+
+// podDIDs returns the current DID of the pod followed by its former DIDs
+func (c *Controller) podDIDs() []string {
+	dids := []string{c.identity().DID}
+	rotations := c.store.IdentityRotations()
+	for i := len(rotations) - 1; i >= 0; i-- {
+		dids = append(dids, rotations[i].OldDID)
+	}
+	return dids
+}
+
+// isPodDID returns whether a DID is the current or a former DID of the pod
+func (c *Controller) isPodDID(did string) bool {
+	if did == c.identity().DID {
+		return true
+	}
+	for _, r := range c.store.IdentityRotations() {
+		if r.OldDID == did {
+			return true
+		}
+	}
+	return false
+}
+
+// rotateIdentity replaces the identity of the pod with a new key. The new identity is
+// authenticated before anything is changed. The old identity is kept to receive
+// messages until the grace period ends. Another rotation is refused during the grace
+// period unless it is forced for an emergency, which stops serving the identity
+// retired by the last rotation at once.
+func (c *Controller) rotateIdentity(did string, force bool) (*IdentityRotation, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to rotate the identity")
+	}
+
+	now := c.now()
+	rotations := c.store.IdentityRotations()
+	if len(rotations) > 0 && now.Before(rotations[len(rotations)-1].GraceUntil) && !force {
+		return nil, fmt.Errorf("the grace period of the last rotation has not ended")
+	}
+
+	oldIdentity := c.identity()
+	newIdentity, err := NewPodIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := newIdentity.Auth(); err != nil {
+		return nil, fmt.Errorf("fail to authenticate the new identity: %s", err)
+	}
+
+	rotation := IdentityRotation{
+		OldDID:     oldIdentity.DID,
+		NewDID:     newIdentity.DID,
+		RotatedAt:  now.UTC().Truncate(time.Millisecond),
+		GraceUntil: now.Add(identityRotationGracePeriod()).UTC().Truncate(time.Millisecond),
+	}
+	if rotation.OldSignature, err = key.Sign(oldIdentity.PrivateKey, rotation.message()); err != nil {
+		return nil, err
+	}
+	if rotation.NewSignature, err = key.Sign(newIdentity.PrivateKey, rotation.message()); err != nil {
+		return nil, err
+	}
+
+	if err := c.replaceIdentityKey(oldIdentity, newIdentity, rotation); err != nil {
+		return nil, err
+	}
+
+	c.identityLock.Lock()
+	c.Identity = newIdentity
+	c.retiredIdentity = &RetiredIdentity{Identity: oldIdentity, Rotation: rotation}
+	c.identityLock.Unlock()
+
+	log.WithField("old_did", rotation.OldDID).
+		WithField("new_did", rotation.NewDID).
+		WithField("grace_until", rotation.GraceUntil).
+		Info("identity rotated")
+	c.notifyIdentityRotated(rotation)
+	return &rotation, nil
+}
+
+// replaceIdentityKey writes the key of the new identity into the auth key file and
+// records the rotation. The store key is re-wrapped along with the rotation if it is
+// derived from the identity key. The old key is kept in the retired key file.
+func (c *Controller) replaceIdentityKey(oldIdentity, newIdentity *PodIdentity, rotation IdentityRotation) error {
+	keyFile := config.AbsoluteApplicationFilePath(viper.GetString("auth_key_file"))
+	stagedKeyFile := keyFile + ".new"
+	if err := newIdentity.SaveKey(stagedKeyFile); err != nil {
+		return fmt.Errorf("fail to save the new identity key: %s", err)
+	}
+	if err := oldIdentity.SaveKey(retiredKeyFile()); err != nil {
+		os.Remove(stagedKeyFile)
+		return fmt.Errorf("fail to keep the old identity key: %s", err)
+	}
+
+	var keyMaterial []byte
+	if viper.GetString("db_key_file") == "" {
+		keyMaterial = newIdentity.PrivateKey
+	}
+	if err := c.store.RotateIdentity(rotation, keyMaterial); err != nil {
+		os.Remove(stagedKeyFile)
+		os.Remove(retiredKeyFile())
+		return fmt.Errorf("fail to record the identity rotation: %s", err)
+	}
+
+	if err := os.Rename(stagedKeyFile, keyFile); err != nil {
+		// the store is only able to be opened by the new key from now on. The staged
+		// key is moved into place by recoverIdentityRotation when the controller restarts.
+		log.WithError(err).WithField("key_file", stagedKeyFile).Error("fail to replace the identity key")
+		return err
+	}
+	return nil
+}
+
+// recoverIdentityRotation finishes or rolls back a rotation which is interrupted before
+// the new key replaces the auth key file. The new key is staged next to the auth key
+// file before the rotation is recorded in the store, and the store key is re-wrapped
+// in the same transaction. The rotation is finished if the store has recorded it, or
+// the staged key is dropped otherwise.
+func recoverIdentityRotation() error {
+	keyFile := config.AbsoluteApplicationFilePath(viper.GetString("auth_key_file"))
+	stagedKeyFile := keyFile + ".new"
+	if _, err := os.Stat(stagedKeyFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	logger := log.WithField("key_file", stagedKeyFile)
+	staged, err := new(PodIdentity).LoadKey(stagedKeyFile)
+	if err != nil {
+		// the key is staged before the store is changed, so an unreadable one is never recorded
+		logger.WithError(err).Warn("drop the unreadable staged identity key")
+		return rollbackIdentityRotation(keyFile, stagedKeyFile)
+	}
+
+	recorded, err := identityRotationRecorded(keyFile, staged)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		logger.WithField("did", staged.DID).Warn("roll back the interrupted identity rotation")
+		return rollbackIdentityRotation(keyFile, stagedKeyFile)
+	}
+
+	logger.WithField("did", staged.DID).Warn("finish the interrupted identity rotation")
+	return os.Rename(stagedKeyFile, keyFile)
+}
+
+// identityRotationRecorded returns whether the last rotation recorded in the store
+// moves the pod to the staged identity
+func identityRotationRecorded(keyFile string, staged *PodIdentity) (bool, error) {
+	dbPath := config.AbsoluteApplicationFilePath(viper.GetString("db_name"))
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	keyMaterial, err := storeKeyMaterial(staged)
+	if err != nil {
+		return false, err
+	}
+	s, err := openBoltStore(dbPath, keyMaterial)
+	if err != nil {
+		if viper.GetString("db_key_file") != "" {
+			return false, err
+		}
+
+		// the store key has not been re-wrapped if the store is still opened by the current key
+		current, loadErr := new(PodIdentity).LoadKey(keyFile)
+		if loadErr != nil {
+			return false, err
+		}
+		if s, err = openBoltStore(dbPath, current.PrivateKey); err != nil {
+			return false, err
+		}
+		defer s.db.Close()
+		return false, nil
+	}
+	defer s.db.Close()
+
+	rotations := s.IdentityRotations()
+	return len(rotations) > 0 && rotations[len(rotations)-1].NewDID == staged.DID, nil
+}
+
+// rollbackIdentityRotation removes the staged key of an unrecorded rotation along
+// with the copy of the current key if it has been kept as the retired one
+func rollbackIdentityRotation(keyFile, stagedKeyFile string) error {
+	current, err := new(PodIdentity).LoadKey(keyFile)
+	if err != nil {
+		return err
+	}
+	if retired, err := new(PodIdentity).LoadKey(retiredKeyFile()); err == nil && retired.DID == current.DID {
+		if err := os.Remove(retiredKeyFile()); err != nil {
+			return err
+		}
+	}
+	return os.Remove(stagedKeyFile)
+}
+
+// notifyIdentityRotated sends the rotation statement to the owner and members
+func (c *Controller) notifyIdentityRotated(rotation IdentityRotation) {
+	data := map[string]interface{}{
+		"event":    "identity_rotated",
+		"rotation": rotation,
+	}
+	contents := map[string]string{
+		"en": "Your pod has moved to a new identity",
+	}
+
+	dids := []string{c.owner()}
+	for _, m := range c.store.Members() {
+		dids = append(dids, m.DID)
+	}
+	for _, did := range dids {
+		if err := c.sendNotification(did, contents, data); err != nil {
+			log.WithError(err).WithField("did", did).Error("fail to notify the identity rotation")
+		}
+	}
+}
+
+// TakeIdentityRotation returns the identity retired by a rotation which has not been
+// handled by the messaging loop, and it clears the rotation
+func (c *Controller) TakeIdentityRotation() *RetiredIdentity {
+	c.identityLock.Lock()
+	defer c.identityLock.Unlock()
+
+	r := c.retiredIdentity
+	c.retiredIdentity = nil
+	return r
+}
+
+// LoadRetiredIdentity loads the identity retired by the last rotation if its grace
+// period has not ended. Files of a retired identity are removed after its grace period.
+func (c *Controller) LoadRetiredIdentity() *RetiredIdentity {
+	rotations := c.store.IdentityRotations()
+	if len(rotations) == 0 {
+		return nil
+	}
+
+	last := rotations[len(rotations)-1]
+	if last.NewDID != c.identity().DID || !c.now().Before(last.GraceUntil) {
+		removeRetiredIdentityFiles()
+		return nil
+	}
+
+	i, err := new(PodIdentity).LoadKey(retiredKeyFile())
+	if err != nil || i.DID != last.OldDID {
+		log.WithError(err).Error("fail to load the retired identity")
+		return nil
+	}
+	return &RetiredIdentity{Identity: i, Rotation: last}
+}
+
+// getIdentityRotations returns all rotations of the pod identity
+func (c *Controller) getIdentityRotations() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"identity":  c.identity().DID,
+		"rotations": c.store.IdentityRotations(),
+	}, nil
+}
@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/config"
+)
+
+// fakeAutonomyAPI authenticates pods and records notifications
+type fakeAutonomyAPI struct {
+	sync.Mutex
+	notified []string
+}
+
+func (f *fakeAutonomyAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/auth":
+		json.NewEncoder(w).Encode(map[string]string{"jwt_token": "token"})
+	case "/notifications":
+		var body struct {
+			AccountID string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.Lock()
+		f.notified = append(f.notified, body.AccountID)
+		f.Unlock()
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRotateIdentity(t *testing.T) {
+	api := &fakeAutonomyAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	viper.Set("data_dir", t.TempDir())
+	viper.Set("auth_key_file", "auth_key.json")
+	viper.Set("db_name", "controller.db")
+	viper.Set("messaging.db_name", "messaging.db")
+	viper.Set("messaging.endpoint", server.URL)
+	viper.Set("notification_url", server.URL+"/notifications")
+	defer func() {
+		for _, k := range []string{"data_dir", "auth_key_file", "db_name", "messaging.db_name", "messaging.endpoint", "notification_url"} {
+			viper.Set(k, "")
+		}
+	}()
+
+	ownerDID := "did:key:owner"
+	memberDID := "did:key:member"
+	keyFile := config.AbsoluteApplicationFilePath("auth_key.json")
+
+	old, err := NewPodIdentity()
+	assert.NoError(t, err)
+	assert.NoError(t, old.SaveKey(keyFile))
+
+	s := NewBoltStore(config.AbsoluteApplicationFilePath("controller.db"), old.PrivateKey)
+	assert.NoError(t, s.SaveMember(Member{DID: memberDID, AccessMode: AccessModeLimited}))
+
+	now := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	c := &Controller{ownerDID: ownerDID, Identity: old, store: s, httpClient: http.DefaultClient}
+	c.clock = func() time.Time { return now }
+
+	c.audit(ownerDID, 1, RequestCommand{ID: "1", Command: "list_members"}, CommandResponse("1", nil, nil))
+	token, err := c.createInvite(ownerDID, CreateInviteRPCParams{AccessMode: AccessModeMinimal})
+	assert.NoError(t, err)
+
+	_, err = c.rotateIdentity(memberDID, false)
+	assert.EqualError(t, err, "only the owner is allowed to rotate the identity")
+
+	rotation, err := c.rotateIdentity(ownerDID, false)
+	assert.NoError(t, err)
+	assert.NoError(t, rotation.Verify())
+	assert.Equal(t, old.DID, rotation.OldDID)
+	assert.Equal(t, c.identity().DID, rotation.NewDID)
+	assert.NotEqual(t, old.DID, rotation.NewDID)
+	assert.True(t, now.Add(identityRotationDefaultGracePeriod).Equal(rotation.GraceUntil))
+	assert.Equal(t, []string{ownerDID, memberDID}, api.notified)
+
+	// a forged statement is rejected
+	forged := *rotation
+	forged.NewDID = old.DID
+	assert.Error(t, forged.Verify())
+
+	// the key file holds the new identity and the old one is kept until the grace period ends
+	current, err := new(PodIdentity).LoadKey(keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, rotation.NewDID, current.DID)
+	_, err = os.Stat(keyFile + ".new")
+	assert.True(t, os.IsNotExist(err))
+
+	retired := c.TakeIdentityRotation()
+	assert.Equal(t, old.DID, retired.Identity.DID)
+	assert.Nil(t, c.TakeIdentityRotation())
+
+	loaded := c.LoadRetiredIdentity()
+	assert.Equal(t, old.DID, loaded.Identity.DID)
+	assert.Equal(t, rotation.NewDID, loaded.Rotation.NewDID)
+
+	_, err = c.rotateIdentity(ownerDID, false)
+	assert.EqualError(t, err, "the grace period of the last rotation has not ended")
+
+	// invitations and the audit log signed by the old identity are still valid
+	c.audit(ownerDID, 1, RequestCommand{ID: "2", Command: "list_members"}, CommandResponse("2", nil, nil))
+	assert.NoError(t, VerifyAuditLog(AuditAnchor{}, AuditHead{}, s.AuditEntries(AuditQuery{}), c.podDIDs()...))
+	_, err = c.redeemInvite("did:key:new-member", *token)
+	assert.NoError(t, err)
+
+	r, err := c.getIdentityRotations()
+	assert.NoError(t, err)
+	assert.Equal(t, rotation.NewDID, r["identity"])
+	assert.Len(t, r["rotations"], 1)
+
+	// the store is only able to be opened by the new key
+	assert.NoError(t, s.db.Close())
+	_, err = openBoltStore(config.AbsoluteApplicationFilePath("controller.db"), old.PrivateKey)
+	assert.Error(t, err)
+	s, err = openBoltStore(config.AbsoluteApplicationFilePath("controller.db"), current.PrivateKey)
+	assert.NoError(t, err)
+	defer s.db.Close()
+	c.store = s
+	assert.Equal(t, AccessModeLimited, s.MemberAccessMode(memberDID))
+
+	// files of the retired identity are removed after the grace period
+	now = rotation.GraceUntil
+	assert.Nil(t, c.LoadRetiredIdentity())
+	_, err = os.Stat(retiredKeyFile())
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = c.rotateIdentity(ownerDID, false)
+	assert.NoError(t, err)
+	assert.Len(t, s.IdentityRotations(), 2)
+
+	// the owner is able to rotate again during the grace period for an emergency
+	_, err = c.rotateIdentity(ownerDID, false)
+	assert.Error(t, err)
+	forcedRotation, err := c.rotateIdentity(ownerDID, true)
+	assert.NoError(t, err)
+	assert.Len(t, s.IdentityRotations(), 3)
+	assert.Equal(t, forcedRotation.NewDID, c.identity().DID)
+	assert.Equal(t, forcedRotation.OldDID, c.LoadRetiredIdentity().Identity.DID)
+}
+
+func TestRecoverIdentityRotation(t *testing.T) {
+	viper.Set("data_dir", t.TempDir())
+	viper.Set("auth_key_file", "auth_key.json")
+	viper.Set("db_name", "controller.db")
+	defer func() {
+		for _, k := range []string{"data_dir", "auth_key_file", "db_name"} {
+			viper.Set(k, "")
+		}
+	}()
+
+	keyFile := config.AbsoluteApplicationFilePath("auth_key.json")
+	dbPath := config.AbsoluteApplicationFilePath("controller.db")
+	old, err := NewPodIdentity()
+	assert.NoError(t, err)
+	assert.NoError(t, old.SaveKey(keyFile))
+	s := NewBoltStore(dbPath, old.PrivateKey)
+
+	// nothing to recover
+	assert.NoError(t, recoverIdentityRotation())
+
+	// a crash before the rotation is recorded rolls it back
+	staged, err := NewPodIdentity()
+	assert.NoError(t, err)
+	assert.NoError(t, staged.SaveKey(keyFile+".new"))
+	assert.NoError(t, old.SaveKey(retiredKeyFile()))
+	assert.NoError(t, s.db.Close())
+
+	assert.NoError(t, recoverIdentityRotation())
+	current, err := new(PodIdentity).LoadKey(keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, old.DID, current.DID)
+	for _, path := range []string{keyFile + ".new", retiredKeyFile()} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	s, err = openBoltStore(dbPath, old.PrivateKey)
+	assert.NoError(t, err)
+
+	// a crash after the rotation is recorded finishes it
+	assert.NoError(t, staged.SaveKey(keyFile+".new"))
+	assert.NoError(t, old.SaveKey(retiredKeyFile()))
+	assert.NoError(t, s.RotateIdentity(IdentityRotation{OldDID: old.DID, NewDID: staged.DID}, staged.PrivateKey))
+	assert.NoError(t, s.db.Close())
+
+	assert.NoError(t, recoverIdentityRotation())
+	current, err = new(PodIdentity).LoadKey(keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, staged.DID, current.DID)
+	_, err = os.Stat(keyFile + ".new")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(retiredKeyFile())
+	assert.NoError(t, err)
+	s, err = openBoltStore(dbPath, current.PrivateKey)
+	assert.NoError(t, err)
+	assert.NoError(t, s.db.Close())
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -93,6 +94,6 @@ func (suite *PodIdentityTestSuite) TestCreateOrLoadPodIdentityWithoutExistingKey
 
 func TestPodIdentityTestSuite(t *testing.T) {
 	suite.Run(t, &PodIdentityTestSuite{
-		KeyFile: "keyfile_test.json",
+		KeyFile: filepath.Join(t.TempDir(), "keyfile_test.json"),
 	})
 }
@@ -0,0 +1,286 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+	"github.com/bitmark-inc/autonomy-pod-controller/utils"
+)
+
+const (
+	invitationDefaultTTL = 24 * time.Hour
+	invitationMaxTTL     = 30 * 24 * time.Hour
+)
+
+const (
+	invitationStatusPending  = "pending"
+	invitationStatusRedeemed = "redeemed"
+	invitationStatusRevoked  = "revoked"
+	invitationStatusExpired  = "expired"
+)
+
+// Invitation is a single-use grant of an access mode for a new member
+type Invitation struct {
+	Nonce      string     `json:"nonce"`
+	AccessMode AccessMode `json:"access_mode"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RedeemedBy string     `json:"redeemed_by,omitempty"`
+	RedeemedAt *time.Time `json:"redeemed_at,omitempty"`
+	Revoked    bool       `json:"revoked"`
+}
+
+// Status returns the status of an invitation at the given time
+func (i Invitation) Status(now time.Time) string {
+	switch {
+	case i.RedeemedBy != "":
+		return invitationStatusRedeemed
+	case i.Revoked:
+		return invitationStatusRevoked
+	case now.After(i.ExpiresAt):
+		return invitationStatusExpired
+	default:
+		return invitationStatusPending
+	}
+}
+
+// InvitationToken is the invitation handed to a new member. It is signed by the pod identity.
+type InvitationToken struct {
+	Identity   string     `json:"identity"`
+	Nonce      string     `json:"nonce"`
+	AccessMode AccessMode `json:"access_mode"`
+	ExpiresAt  string     `json:"expires_at"`
+	Signature  string     `json:"signature"`
+}
+
+// message returns the signed message of an invitation token
+func (t InvitationToken) message() string {
+	return fmt.Sprintf("%s%s%d%s", t.Identity, t.Nonce, t.AccessMode, t.ExpiresAt)
+}
+
+type CreateInviteRPCParams struct {
+	AccessMode AccessMode `json:"access_mode"`
+	TTL        int64      `json:"ttl"`
+}
+
+type InviteRPCParams struct {
+	Nonce string `json:"nonce"`
+}
+
+// invitationToken builds the unsigned token of an invitation
+func (c *Controller) invitationToken(i Invitation) InvitationToken {
+	return InvitationToken{
+		Identity:   c.identity().DID,
+		Nonce:      i.Nonce,
+		AccessMode: i.AccessMode,
+		ExpiresAt:  fmt.Sprint(i.ExpiresAt.UnixNano() / int64(time.Millisecond)),
+	}
+}
+
+// createInvite creates an invitation of an access mode which expires after ttl seconds
+func (c *Controller) createInvite(did string, params CreateInviteRPCParams) (*InvitationToken, error) {
+	if !params.AccessMode.IsMemberAccessMode() {
+		return nil, fmt.Errorf("invalid access mode")
+	}
+	if !CanGrantAccessMode(c.accessMode(did), params.AccessMode) {
+		return nil, fmt.Errorf("not allowed to grant the access mode")
+	}
+
+	ttl := invitationDefaultTTL
+	if params.TTL < 0 {
+		return nil, fmt.Errorf("invalid ttl")
+	} else if params.TTL > 0 {
+		ttl = time.Duration(params.TTL) * time.Second
+	}
+	if ttl > invitationMaxTTL {
+		return nil, fmt.Errorf("ttl exceeds the maximum %s", invitationMaxTTL)
+	}
+
+	b, err := utils.GenerateRandomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := c.now()
+	invitation := Invitation{
+		Nonce:      hex.EncodeToString(b),
+		AccessMode: params.AccessMode,
+		CreatedBy:  did,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl).Truncate(time.Millisecond),
+	}
+
+	token := c.invitationToken(invitation)
+	if token.Signature, err = key.Sign(c.identity().PrivateKey, token.message()); err != nil {
+		return nil, err
+	}
+
+	if err := c.store.SaveInvitation(invitation); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// redeemInvite makes a new DID a member by an invitation.
+// An invitation could only be redeemed once before it expires.
+func (c *Controller) redeemInvite(did string, token InvitationToken) (map[string]interface{}, error) {
+	if c.accessMode(did) != AccessModeNotApplicant {
+		return nil, fmt.Errorf("already a member")
+	}
+
+	now := c.now()
+	invitation, err := c.pendingInvitation(token, now)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation.RedeemedBy = did
+	invitation.RedeemedAt = &now
+	if err := c.store.SaveInvitation(*invitation); err != nil {
+		return nil, err
+	}
+
+	if err := c.store.SaveMember(Member{
+		DID:        did,
+		AccessMode: invitation.AccessMode,
+		AddedBy:    invitation.CreatedBy,
+		AddedAt:    now,
+	}); err != nil {
+		return nil, err
+	}
+	log.WithField("did", did).WithField("access_mode", invitation.AccessMode).Info("invitation redeemed")
+
+	return map[string]interface{}{
+		"status":      "ok",
+		"access_mode": invitation.AccessMode,
+	}, nil
+}
+
+// pendingInvitation returns the invitation of a token if the token is signed by
+// the pod and the invitation is neither redeemed, revoked nor expired
+func (c *Controller) pendingInvitation(token InvitationToken, now time.Time) (*Invitation, error) {
+	if !c.isPodDID(token.Identity) || token.Signature == "" ||
+		!key.VerifySignature(token.Identity, token.message(), token.Signature) {
+		return nil, fmt.Errorf("invalid invitation signature")
+	}
+
+	invitation := c.store.Invitation(token.Nonce)
+	if invitation == nil {
+		return nil, fmt.Errorf("invitation not found")
+	}
+
+	// invitations signed by a former identity are still valid
+	expected := c.invitationToken(*invitation)
+	expected.Identity = token.Identity
+	if expected.message() != token.message() {
+		return nil, fmt.Errorf("invitation not found")
+	}
+
+	if status := invitation.Status(now); status != invitationStatusPending {
+		return nil, fmt.Errorf("invitation is %s", status)
+	}
+
+	return invitation, nil
+}
+
+// bindByInvitation lets a new DID which is not a member yet bind with an invitation.
+// `bind` requires a pending invitation and `bind_ack` redeems the invitation once the
+// binding completes if it is given. Otherwise, the invitation is redeemed by
+// `redeem_invite` while the binding session is in progress or after it is bound.
+func (c *Controller) bindByInvitation(did string, device uint32, req RequestCommand) (interface{}, error) {
+	if c.store.HasBinding(did, device) {
+		return nil, fmt.Errorf("incorrect binding state")
+	}
+
+	switch req.Command {
+	case "bind":
+		var params BindParams
+		if len(req.Args) > 0 {
+			if err := json.Unmarshal(req.Args, &params); err != nil {
+				return nil, fmt.Errorf("bad request for bind: %s", err.Error())
+			}
+		}
+		if params.Invitation == nil {
+			return nil, fmt.Errorf("not allowed to use this command")
+		}
+		if _, err := c.pendingInvitation(*params.Invitation, c.now()); err != nil {
+			return nil, err
+		}
+
+		return c.bind(did, device, params.Label)
+	case "bind_ack":
+		var params BindACKParams
+		if err := json.Unmarshal(req.Args, &params); err != nil {
+			return nil, fmt.Errorf("bad request for bind_ack: %s", err.Error())
+		}
+		if params.Invitation != nil {
+			if _, err := c.pendingInvitation(*params.Invitation, c.now()); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := c.bindACK(did, device, params)
+		if err != nil || params.Invitation == nil {
+			return resp, err
+		}
+		if _, err := c.redeemInvite(did, *params.Invitation); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("not allowed to use this command")
+}
+
+// revokeInvite revokes an invitation which is not redeemed yet
+func (c *Controller) revokeInvite(nonce string) (map[string]string, error) {
+	invitation := c.store.Invitation(nonce)
+	if invitation == nil {
+		return nil, fmt.Errorf("invitation not found")
+	}
+
+	if invitation.RedeemedBy != "" {
+		return nil, fmt.Errorf("invitation is %s", invitationStatusRedeemed)
+	}
+
+	invitation.Revoked = true
+	if err := c.store.SaveInvitation(*invitation); err != nil {
+		return nil, err
+	}
+	return map[string]string{"status": "ok"}, nil
+}
+
+// listInvites returns all invitations along with their status
+func (c *Controller) listInvites() (map[string]interface{}, error) {
+	now := c.now()
+	invitations := make([]map[string]interface{}, 0)
+	for _, i := range c.store.Invitations() {
+		invitation := map[string]interface{}{
+			"nonce":       i.Nonce,
+			"access_mode": i.AccessMode,
+			"created_by":  i.CreatedBy,
+			"created_at":  i.CreatedAt,
+			"expires_at":  i.ExpiresAt,
+			"status":      i.Status(now),
+		}
+		if i.RedeemedBy != "" {
+			invitation["redeemed_by"] = i.RedeemedBy
+			invitation["redeemed_at"] = i.RedeemedAt
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	return map[string]interface{}{"invitations": invitations}, nil
+}
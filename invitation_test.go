@@ -0,0 +1,259 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	messaging "github.com/bitmark-inc/autonomy-messaging-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+func TestInvitationStatus(t *testing.T) {
+	now := time.Now()
+	i := Invitation{ExpiresAt: now.Add(time.Hour)}
+	assert.Equal(t, invitationStatusPending, i.Status(now))
+	assert.Equal(t, invitationStatusExpired, i.Status(now.Add(2*time.Hour)))
+
+	i.Revoked = true
+	assert.Equal(t, invitationStatusRevoked, i.Status(now))
+
+	i.RedeemedBy = "did:key:member"
+	assert.Equal(t, invitationStatusRedeemed, i.Status(now))
+}
+
+func TestCreateAndRedeemInvite(t *testing.T) {
+	ownerDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+	newMemberDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+
+	var invitation *Invitation
+	mockedStore.EXPECT().SaveInvitation(gomock.Any()).AnyTimes().DoAndReturn(func(i Invitation) error {
+		invitation = &i
+		return nil
+	})
+	mockedStore.EXPECT().Invitation(gomock.Any()).AnyTimes().DoAndReturn(func(nonce string) *Invitation {
+		if invitation == nil || invitation.Nonce != nonce {
+			return nil
+		}
+		i := *invitation
+		return &i
+	})
+	mockedStore.EXPECT().Member(newMemberDID).Return(nil).Times(2)
+	mockedStore.EXPECT().Member(memberDID).Return(&Member{DID: memberDID, AccessMode: AccessModeMinimal})
+	mockedStore.EXPECT().SaveMember(gomock.Any()).DoAndReturn(func(m Member) error {
+		assert.Equal(t, newMemberDID, m.DID)
+		assert.Equal(t, AccessModeLimited, m.AccessMode)
+		assert.Equal(t, ownerDID, m.AddedBy)
+		return nil
+	})
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore, Identity: i}
+
+	_, err = c.createInvite(ownerDID, CreateInviteRPCParams{AccessMode: AccessModeNotApplicant})
+	assert.EqualError(t, err, "invalid access mode")
+
+	_, err = c.createInvite(ownerDID, CreateInviteRPCParams{AccessMode: AccessModeLimited, TTL: 365 * 24 * 3600})
+	assert.Error(t, err)
+
+	token, err := c.createInvite(ownerDID, CreateInviteRPCParams{AccessMode: AccessModeLimited})
+	assert.NoError(t, err)
+	assert.Equal(t, i.DID, token.Identity)
+	assert.Equal(t, AccessModeLimited, token.AccessMode)
+	assert.True(t, key.VerifySignature(i.DID, token.message(), token.Signature))
+	assert.Equal(t, ownerDID, invitation.CreatedBy)
+	assert.Equal(t, invitationStatusPending, invitation.Status(time.Now()))
+
+	_, err = c.redeemInvite(memberDID, *token)
+	assert.EqualError(t, err, "already a member")
+
+	// the access mode is covered by the signature
+	forged := *token
+	forged.AccessMode = AccessModeFull
+	_, err = c.redeemInvite(newMemberDID, forged)
+	assert.EqualError(t, err, "invalid invitation signature")
+
+	r, err := c.redeemInvite(newMemberDID, *token)
+	assert.NoError(t, err)
+	assert.Equal(t, AccessModeLimited, r["access_mode"])
+	assert.Equal(t, newMemberDID, invitation.RedeemedBy)
+
+	_, err = c.revokeInvite(token.Nonce)
+	assert.EqualError(t, err, "invitation is redeemed")
+}
+
+func TestRedeemRevokedInvite(t *testing.T) {
+	ownerDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+	newMemberDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+
+	var invitation *Invitation
+	mockedStore.EXPECT().SaveInvitation(gomock.Any()).AnyTimes().DoAndReturn(func(i Invitation) error {
+		invitation = &i
+		return nil
+	})
+	mockedStore.EXPECT().Invitation(gomock.Any()).AnyTimes().DoAndReturn(func(nonce string) *Invitation {
+		if invitation == nil || invitation.Nonce != nonce {
+			return nil
+		}
+		i := *invitation
+		return &i
+	})
+	mockedStore.EXPECT().Member(newMemberDID).AnyTimes().Return(nil)
+	mockedStore.EXPECT().Invitations().DoAndReturn(func() []Invitation {
+		return []Invitation{*invitation}
+	})
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore, Identity: i}
+
+	token, err := c.createInvite(ownerDID, CreateInviteRPCParams{AccessMode: AccessModeMinimal, TTL: 60})
+	assert.NoError(t, err)
+
+	_, err = c.revokeInvite("unknown")
+	assert.EqualError(t, err, "invitation not found")
+
+	_, err = c.revokeInvite(token.Nonce)
+	assert.NoError(t, err)
+	assert.True(t, invitation.Revoked)
+
+	_, err = c.redeemInvite(newMemberDID, *token)
+	assert.EqualError(t, err, "invitation is revoked")
+
+	r, err := c.listInvites()
+	assert.NoError(t, err)
+	invitations := r["invitations"].([]map[string]interface{})
+	assert.Len(t, invitations, 1)
+	assert.Equal(t, invitationStatusRevoked, invitations[0]["status"])
+}
+
+func TestProcessRedeemInviteThrottled(t *testing.T) {
+	ownerDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+	strangerDID := "did:key:stranger"
+
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	c := Controller{ownerDID: ownerDID, store: NewMemoryStore(), Identity: i, rateLimiter: NewRateLimiter()}
+	token, err := c.createInvite(ownerDID, CreateInviteRPCParams{AccessMode: AccessModeMinimal})
+	assert.NoError(t, err)
+
+	// guessing nonces is limited by the guest rate limit
+	redeem := func(nonce string) map[string]interface{} {
+		guess := *token
+		guess.Nonce = nonce
+		args, err := json.Marshal(guess)
+		assert.NoError(t, err)
+
+		resp := c.Process(&messaging.Message{Source: strangerDID, SourceDevice: 1,
+			Content: []byte(fmt.Sprintf(`{"id":"1","command":"redeem_invite","args":%s}`, args))})
+		var r map[string]interface{}
+		assert.NoError(t, json.Unmarshal(resp[0], &r))
+		return r
+	}
+	for n := 0; n < int(defaultGuestRateLimit.Burst); n++ {
+		assert.Equal(t, "invalid invitation signature", redeem(fmt.Sprintf("guess-%d", n))["error"])
+	}
+	assert.Equal(t, "rate_limited", redeem(token.Nonce)["code"])
+	assert.Equal(t, AccessModeNotApplicant, c.accessMode(strangerDID))
+}
+
+func TestProcessBindByInvitation(t *testing.T) {
+	ownerDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+
+	pod, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	c := Controller{ownerDID: ownerDID, store: NewMemoryStore(), Identity: pod}
+
+	process := func(client *PodIdentity, command string, args interface{}) map[string]interface{} {
+		b, err := json.Marshal(args)
+		assert.NoError(t, err)
+
+		resp := c.Process(&messaging.Message{Source: client.DID, SourceDevice: 1,
+			Content: []byte(fmt.Sprintf(`{"id":"1","command":"%s","args":%s}`, command, b))})
+		var r map[string]interface{}
+		assert.NoError(t, json.Unmarshal(resp[0], &r))
+		return r
+	}
+	bind := func(client *PodIdentity, token *InvitationToken) map[string]interface{} {
+		return process(client, "bind", BindParams{Label: "phone", Invitation: token})
+	}
+	bindACK := func(client *PodIdentity, bindResp map[string]interface{}, token *InvitationToken) map[string]interface{} {
+		data := bindResp["data"].(map[string]interface{})
+		timestamp := fmt.Sprint(time.Now().UnixNano() / int64(time.Millisecond))
+		signature, err := key.Sign(client.PrivateKey, data["nonce"].(string)+timestamp)
+		assert.NoError(t, err)
+		return process(client, "bind_ack", BindACKParams{Timestamp: timestamp, Signature: signature, Invitation: token})
+	}
+	invite := func() *InvitationToken {
+		token, err := c.createInvite(ownerDID, CreateInviteRPCParams{AccessMode: AccessModeMinimal})
+		assert.NoError(t, err)
+		return token
+	}
+
+	// new DIDs could not bind without an invitation
+	stranger, err := NewPodIdentity()
+	assert.NoError(t, err)
+	assert.Equal(t, "not allowed to use this command", bind(stranger, nil)["error"])
+	assert.Equal(t, "binding session not found", bindACK(stranger, map[string]interface{}{"data": map[string]interface{}{"nonce": ""}}, nil)["error"])
+
+	// redeem the invitation while the binding session is in progress
+	client, err := NewPodIdentity()
+	assert.NoError(t, err)
+	token := invite()
+	r := bind(client, token)
+	assert.Nil(t, r["error"])
+	assert.Equal(t, "ok", process(client, "redeem_invite", token)["data"].(map[string]interface{})["status"])
+	assert.Equal(t, AccessModeMinimal, c.accessMode(client.DID))
+	assert.Nil(t, bindACK(client, r, nil)["error"])
+	assert.True(t, c.store.HasBinding(client.DID, 1))
+
+	// redeem the invitation by bind_ack
+	client, err = NewPodIdentity()
+	assert.NoError(t, err)
+	token = invite()
+	r = bind(client, token)
+	assert.Nil(t, r["error"])
+	assert.Nil(t, bindACK(client, r, token)["error"])
+	assert.True(t, c.store.HasBinding(client.DID, 1))
+	assert.Equal(t, AccessModeMinimal, c.accessMode(client.DID))
+
+	// redeem the invitation right after bind_ack
+	client, err = NewPodIdentity()
+	assert.NoError(t, err)
+	token = invite()
+	r = bind(client, token)
+	assert.Nil(t, r["error"])
+	assert.Nil(t, bindACK(client, r, nil)["error"])
+	assert.True(t, c.store.HasBinding(client.DID, 1))
+	assert.Equal(t, AccessModeNotApplicant, c.accessMode(client.DID))
+	assert.Equal(t, "ok", process(client, "redeem_invite", token)["data"].(map[string]interface{})["status"])
+	assert.Equal(t, AccessModeMinimal, c.accessMode(client.DID))
+
+	// a redeemed invitation could not be used to bind again
+	stranger, err = NewPodIdentity()
+	assert.NoError(t, err)
+	assert.Equal(t, "invitation is redeemed", bind(stranger, token)["error"])
+}
@@ -0,0 +1,31 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package key
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// EncryptToDID encrypts data to the secp256k1 public key of a DID by ECIES with
+// AES-256-CBC and HMAC-SHA256 in the format of btcec
+func EncryptToDID(did string, data []byte) ([]byte, error) {
+	pub, err := PublicKeyFromDID(did)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := btcec.ParsePubKey(pub, btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	return btcec.Encrypt(pubKey, data)
+}
+
+// Decrypt decrypts data which is encrypted to the public key of a private key by EncryptToDID
+func Decrypt(privateKey []byte, data []byte) ([]byte, error) {
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), privateKey)
+	return btcec.Decrypt(priv, data)
+}
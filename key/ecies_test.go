@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package key
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptToDID(t *testing.T) {
+	privateKey, _ := hex.DecodeString("5fe2b0b0a4b4e6b59b8b5e3d21a4ff5b7e7c0d6bba0c0f0e8b0f4b6e7d2c1a09")
+	data := []byte("the state of a pod")
+
+	encrypted, err := EncryptToDID(DID(privateKey), data)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), string(data))
+
+	decrypted, err := Decrypt(privateKey, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	anotherKey, _ := hex.DecodeString("6fe2b0b0a4b4e6b59b8b5e3d21a4ff5b7e7c0d6bba0c0f0e8b0f4b6e7d2c1a09")
+	_, err = Decrypt(anotherKey, encrypted)
+	assert.Equal(t, btcec.ErrInvalidMAC, err)
+
+	_, err = EncryptToDID("did:key:invalid", data)
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package key
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// SignedResponse is a response envelope signed by the pod identity. The payload is
+// kept as a string so that clients are able to hash the exact bytes. The signer is
+// the DID of the pod which the request was sent to.
+type SignedResponse struct {
+	ID          string `json:"id"`
+	Signer      string `json:"signer"`
+	Payload     string `json:"payload"`
+	PayloadHash string `json:"payload_hash"`
+	Timestamp   string `json:"timestamp"`
+	Signature   string `json:"signature"`
+}
+
+// PayloadHash returns the hex encoded SHA-256 hash of a response payload
+func PayloadHash(payload []byte) string {
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// ResponseMessage returns the message signed for a response
+func ResponseMessage(id, signer, payloadHash, timestamp string) string {
+	return strings.Join([]string{id, signer, payloadHash, timestamp}, "\n")
+}
+
+// SignResponse wraps a response payload into an envelope signed by the given private key
+func SignResponse(privateKey []byte, id string, payload []byte, timestamp string) (*SignedResponse, error) {
+	signer := DID(privateKey)
+	payloadHash := PayloadHash(payload)
+	signature, err := Sign(privateKey, ResponseMessage(id, signer, payloadHash, timestamp))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignedResponse{
+		ID:          id,
+		Signer:      signer,
+		Payload:     string(payload),
+		PayloadHash: payloadHash,
+		Timestamp:   timestamp,
+		Signature:   signature,
+	}, nil
+}
+
+// VerifyResponse validates a response envelope signed by the given DID and returns its payload
+func VerifyResponse(did string, r SignedResponse) ([]byte, error) {
+	if r.Signer != did {
+		return nil, errors.New("response signed by another DID")
+	}
+
+	payload := []byte(r.Payload)
+	if PayloadHash(payload) != r.PayloadHash {
+		return nil, errors.New("payload hash mismatched")
+	}
+
+	if !VerifySignature(did, ResponseMessage(r.ID, r.Signer, r.PayloadHash, r.Timestamp), r.Signature) {
+		return nil, errors.New("invalid response signature")
+	}
+
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+	if p.ID != r.ID {
+		return nil, errors.New("response id mismatched")
+	}
+
+	return payload, nil
+}
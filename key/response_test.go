@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package key
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignResponse(t *testing.T) {
+	privateKey, _ := hex.DecodeString("5fe2b0b0a4b4e6b59b8b5e3d21a4ff5b7e7c0d6bba0c0f0e8b0f4b6e7d2c1a09")
+	did := DID(privateKey)
+	payload := []byte(`{"id":"1","data":{"txid":"1d7c02a6e5bd32e3c77f47a6a2fd8c2dde4b55e0b4b4b4a6f2a5b3c4d5e6f708"}}`)
+
+	r, err := SignResponse(privateKey, "1", payload, "1618456405107")
+	assert.NoError(t, err)
+	assert.Equal(t, PayloadHash(payload), r.PayloadHash)
+	assert.Equal(t, did, r.Signer)
+
+	p, err := VerifyResponse(did, *r)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, p)
+
+	tampered := *r
+	tampered.Payload = `{"id":"1","data":{"txid":"0000"}}`
+	_, err = VerifyResponse(did, tampered)
+	assert.EqualError(t, err, "payload hash mismatched")
+
+	tampered = *r
+	tampered.Timestamp = "1618456405108"
+	_, err = VerifyResponse(did, tampered)
+	assert.EqualError(t, err, "invalid response signature")
+
+	anotherKey, _ := hex.DecodeString("6fe2b0b0a4b4e6b59b8b5e3d21a4ff5b7e7c0d6bba0c0f0e8b0f4b6e7d2c1a09")
+	_, err = VerifyResponse(DID(anotherKey), *r)
+	assert.EqualError(t, err, "response signed by another DID")
+
+	// the signer is signed along with the response
+	tampered = *r
+	tampered.Signer = DID(anotherKey)
+	_, err = VerifyResponse(DID(anotherKey), tampered)
+	assert.EqualError(t, err, "invalid response signature")
+
+	// the envelope id must be the id of the payload
+	r, err = SignResponse(privateKey, "2", payload, "1618456405107")
+	assert.NoError(t, err)
+	_, err = VerifyResponse(did, *r)
+	assert.EqualError(t, err, "response id mismatched")
+}
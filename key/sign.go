@@ -41,7 +41,7 @@ func VerifySignature(did, message, signature string) bool {
 	}
 
 	sig, err := hex.DecodeString(signature)
-	if err != nil {
+	if err != nil || len(sig) == 0 {
 		return false
 	}
 
@@ -28,6 +28,10 @@ type RequestCommand struct {
 	ID      string          `json:"id"`
 	Command string          `json:"command"`
 	Args    json.RawMessage `json:"args"`
+
+	// Counter and Signature sign the command by the DID key of the client
+	Counter   uint64 `json:"counter,omitempty"`
+	Signature string `json:"signature,omitempty"`
 }
 
 // renewBefore: 10 minutes in seconds
@@ -43,7 +47,19 @@ func main() {
 	flag.IntVar(&retryCounts, "count", 12, "[optional] retry counts for messaging API")
 	flag.Parse()
 
-	config.LoadConfig(configFile)
+	if err := config.LoadConfig(configFile); err != nil {
+		log.WithError(err).Panic("fail to load config")
+	}
+
+	// an imported backup replaces the identity and the store, so it is applied before they are loaded
+	if err := applyPendingRestore(); err != nil {
+		log.WithError(err).Panic("fail to apply the pending restore")
+	}
+
+	// a rotation interrupted by a crash is finished or rolled back before the identity is loaded
+	if err := recoverIdentityRotation(); err != nil {
+		log.WithError(err).Panic("fail to recover the interrupted identity rotation")
+	}
 
 	i, created, err := CreateOrLoadPodIdentityFromKey(config.AbsoluteApplicationFilePath(viper.GetString("auth_key_file")))
 	if err != nil {
@@ -52,7 +68,7 @@ func main() {
 
 	ownerDID := viper.GetString("owner_did")
 	controller := NewController(ownerDID, i)
-	log.WithField("owner_did", ownerDID).
+	log.WithField("owner_did", controller.owner()).
 		WithField("identity", i.DID).
 		WithField("created", created).
 		Info("controller initialized")
@@ -102,85 +118,85 @@ func main() {
 		}(time.Minute)
 	}
 
-	// The goroutine will continuously check auth_token and re-request a new one if
-	// a token is going to be expired.
+	// The goroutine will continuously broadcast transactions in the vault once their delays have passed.
 	go func(checkInterval time.Duration) {
 		for {
-			token := i.AuthToken()
-			if token == "" {
-				// wait for the first token to be acquired from the first authentication
-				time.Sleep(time.Second)
-				continue
-			}
+			controller.broadcastDueTransactions(controller.now())
+			time.Sleep(checkInterval)
+		}
+	}(time.Minute)
 
-			// parse the jwt claim without verified the token signature
-			t, _, err := new(jwt.Parser).ParseUnverified(token, &jwt.StandardClaims{})
-			if err != nil {
-				log.WithError(err).Panic("fail to parse token")
+	// The goroutine will import wallet descriptors of a restored backup once bitcoind is available.
+	go func(retryInterval time.Duration) {
+		for {
+			err := importRestoredDescriptors()
+			if err == nil {
+				return
 			}
+			log.WithError(err).Error("fail to import wallet descriptors of the backup. retry later")
+			time.Sleep(retryInterval)
+		}
+	}(time.Minute)
 
-			if claims, ok := t.Claims.(*jwt.StandardClaims); ok {
-				if time.Now().Unix() > (claims.ExpiresAt - int64(renewBefore)) {
-					if err := i.Auth(); err != nil {
-						log.WithError(err).Error("fail to refresh token")
-					}
-					log.Info("successfully refresh a new token")
-				} else {
-					log.WithField("expires_at", claims.ExpiresAt).Debug("token not expired")
-				}
-				time.Sleep(checkInterval)
-				continue
-			} else {
-				log.WithError(errors.New("error casting token claims")).Panic("fail to refresh token")
-			}
+	// The goroutine will continuously remove PSBTs which have waited for approvals too long.
+	go func(checkInterval time.Duration) {
+		for {
+			controller.sweepExpiredPSBTs(controller.now())
+			time.Sleep(checkInterval)
+		}
+	}(time.Minute)
+
+	// The goroutine will continuously remove members whose grants are expired.
+	go func(checkInterval time.Duration) {
+		for {
+			controller.sweepExpiredMembers(controller.now())
+			time.Sleep(checkInterval)
+		}
+	}(time.Minute)
+
+	// The goroutine will continuously remove the oldest audit entries beyond the retention.
+	go func(checkInterval time.Duration) {
+		for {
+			controller.trimAuditLog()
+			time.Sleep(checkInterval)
 		}
 	}(time.Minute)
 
+	// The goroutine will continuously check auth_token and re-request a new one if
+	// a token is going to be expired.
+	stopRenewal := make(chan struct{})
+	go renewAuthToken(i, time.Minute, stopRenewal)
+
 	go func() {
 		router := gin.New()
 		router.GET("/tx-notification/:txid", controller.transactionNotify)
 		router.Run(viper.GetString("server_port"))
 	}()
 
+	if address := viper.GetString("pairing.admin_address"); viper.GetBool("pairing.enabled") && address != "" {
+		go func() {
+			router := gin.New()
+			router.GET("/pairing-codes", controller.pairingCodes)
+			router.Run(address)
+		}()
+	}
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
+	// messages to a retired identity are served until the grace period of its rotation ends
+	retiredMessages := make(chan retiredMessage)
+	stopRetired := make(chan struct{})
+	if r := controller.LoadRetiredIdentity(); r != nil {
+		log.WithField("did", r.Identity.DID).WithField("grace_until", r.Rotation.GraceUntil).Info("serve the retired identity")
+		go serveRetiredIdentity(r, retiredMessages, stopRetired, time.Duration(retryInterval)*time.Second, retryCounts)
+	}
+
 CONNECTION_LOOP:
 	// This is the main loop for maintaining a persistant websocket connection to API server
 	for {
-		authToken := i.AuthToken()
-
-		messagingClient := messaging.New(
-			&http.Client{Timeout: 10 * time.Second},
-			viper.GetString("messaging.endpoint"),
-			authToken,
-			config.AbsoluteApplicationFilePath(viper.GetString("messaging.db_name")))
-
-		var ws *messaging.WSMessagingClient
-		for i := 0; i < retryCounts; i++ {
-			if i != 0 {
-				time.Sleep(time.Duration(retryInterval) * time.Second)
-			}
-			if err := messagingClient.RegisterAccount(); err != nil {
-				log.WithError(err).Error("registering account")
-				continue
-			}
-
-			if err := messagingClient.RegisterKeys(); err != nil {
-				log.WithError(err).Error("failed to register pre-keys on startup")
-				continue
-			}
-
-			c, err := messagingClient.NewWSClient()
-			if err != nil {
-				log.WithError(err).Error("fail to establish websocket connection")
-				continue
-			}
-
-			ws = c
-			break
-		}
-
+		messagingClient, ws := connectMessaging(i, config.AbsoluteApplicationFilePath(viper.GetString("messaging.db_name")),
+			time.Duration(retryInterval)*time.Second, retryCounts)
 		if ws == nil {
 			log.WithField("retry", retryCounts).Fatalf("maximum retries exceeded for establishing the websocket connection")
 		}
@@ -223,14 +239,136 @@ CONNECTION_LOOP:
 				log.WithField("message", m).Debug("receive message")
 				responseMessage := controller.Process(m)
 				if responseMessage != nil {
-					ws.SendWhisperMessages(m.Source, m.SourceDevice, responseMessage)
+					for _, device := range controller.ResponseDevices(m.Source, m.SourceDevice) {
+						ws.SendWhisperMessages(m.Source, device, responseMessage)
+					}
+				}
+
+				// reconnect by the new identity and serve the old one until its grace period ends
+				if r := controller.TakeIdentityRotation(); r != nil {
+					close(addKey)
+					ws.Close()
+					messagingClient.Close()
+
+					// a forced rotation replaces the identity retired by the last one
+					close(stopRetired)
+					stopRetired = make(chan struct{})
+
+					messagingDB := config.AbsoluteApplicationFilePath(viper.GetString("messaging.db_name"))
+					if err := os.RemoveAll(retiredMessagingDB()); err != nil {
+						log.WithError(err).Error("fail to remove the messaging database of the former retired identity")
+					}
+					if err := os.Rename(messagingDB, retiredMessagingDB()); err != nil {
+						log.WithError(err).Error("fail to keep the messaging database of the retired identity")
+					}
+
+					close(stopRenewal)
+					i = controller.identity()
+					stopRenewal = make(chan struct{})
+					go renewAuthToken(i, time.Minute, stopRenewal)
+					go serveRetiredIdentity(r, retiredMessages, stopRetired, time.Duration(retryInterval)*time.Second, retryCounts)
+					continue CONNECTION_LOOP
+				}
+
+				// exit so that the imported backup is applied when the service is restarted
+				if controller.RestartRequired() {
+					log.Info("restart required to apply the imported backup")
+					close(addKey)
+					ws.Close()
+					messagingClient.Close()
+					break CONNECTION_LOOP
 				}
 
 				select {
 				case addKey <- struct{}{}:
 				default:
 				}
+			case rm := <-retiredMessages:
+				log.WithField("message", rm.message).Debug("receive message to the retired identity")
+				responseMessage := controller.ProcessAs(rm.identity, rm.message)
+				if responseMessage != nil {
+					for _, device := range controller.ResponseDevices(rm.message.Source, rm.message.SourceDevice) {
+						rm.ws.SendWhisperMessages(rm.message.Source, device, responseMessage)
+					}
+				}
+			}
+		}
+	}
+}
+
+// renewAuthToken continuously checks the auth token of an identity and re-requests
+// a new one if the token is going to be expired. It returns once stop is closed.
+func renewAuthToken(i *PodIdentity, checkInterval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		token := i.AuthToken()
+		if token == "" {
+			// wait for the first token to be acquired from the first authentication
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// parse the jwt claim without verified the token signature
+		t, _, err := new(jwt.Parser).ParseUnverified(token, &jwt.StandardClaims{})
+		if err != nil {
+			log.WithError(err).Panic("fail to parse token")
+		}
+
+		if claims, ok := t.Claims.(*jwt.StandardClaims); ok {
+			if time.Now().Unix() > (claims.ExpiresAt - int64(renewBefore)) {
+				if err := i.Auth(); err != nil {
+					log.WithError(err).Error("fail to refresh token")
+				}
+				log.Info("successfully refresh a new token")
+			} else {
+				log.WithField("expires_at", claims.ExpiresAt).Debug("token not expired")
 			}
+		} else {
+			log.WithError(errors.New("error casting token claims")).Panic("fail to refresh token")
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(checkInterval):
+		}
+	}
+}
+
+// connectMessaging registers an identity to the messaging server and establishes
+// the websocket connection. The websocket client is nil if all retries fail.
+func connectMessaging(i *PodIdentity, dbPath string, retryInterval time.Duration, retryCounts int) (*messaging.Client, *messaging.WSMessagingClient) {
+	messagingClient := messaging.New(
+		&http.Client{Timeout: 10 * time.Second},
+		viper.GetString("messaging.endpoint"),
+		i.AuthToken(),
+		dbPath)
+
+	for c := 0; c < retryCounts; c++ {
+		if c != 0 {
+			time.Sleep(retryInterval)
+		}
+		if err := messagingClient.RegisterAccount(); err != nil {
+			log.WithError(err).Error("registering account")
+			continue
+		}
+
+		if err := messagingClient.RegisterKeys(); err != nil {
+			log.WithError(err).Error("failed to register pre-keys on startup")
+			continue
+		}
+
+		ws, err := messagingClient.NewWSClient()
+		if err != nil {
+			log.WithError(err).Error("fail to establish websocket connection")
+			continue
 		}
+		return messagingClient, ws
 	}
+	return messagingClient, nil
 }
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// memberRecordVersion is the version of member records in the store.
+// Records without a version are the legacy 8-byte access modes.
+const memberRecordVersion = 1
+
+// memberActivityResolution is the minimal interval between updates of the last active time
+const memberActivityResolution = time.Minute
+
+const (
+	bindingStateNone    = "none"
+	bindingStatePending = "pending"
+	bindingStateBound   = "bound"
+)
+
+// Member is a DID granted with an access mode by the owner
+type Member struct {
+	DID          string     `json:"did"`
+	AccessMode   AccessMode `json:"access_mode"`
+	Label        string     `json:"label"`
+	AddedBy      string     `json:"added_by"`
+	AddedAt      time.Time  `json:"added_at"`
+	LastActiveAt *time.Time `json:"last_active_at"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+}
+
+// Expired returns whether the grant of a member is expired at the given time
+func (m Member) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// memberRecord is the versioned value of a member in the store
+type memberRecord struct {
+	Version int `json:"version"`
+	Member
+}
+
+// encodeMember serializes a member into a versioned record
+func encodeMember(m Member) ([]byte, error) {
+	return json.Marshal(memberRecord{Version: memberRecordVersion, Member: m})
+}
+
+// isLegacyMember returns whether a member record is a legacy 8-byte access mode
+func isLegacyMember(v []byte) bool {
+	return len(v) == 8 && v[0] != '{'
+}
+
+// legacyAccessMode returns the access mode of a legacy member record. Legacy records
+// only granted Full, Limited and Minimal. Other values used to grant no access, so
+// they are not read as the Admin access mode added later.
+func legacyAccessMode(v []byte) (AccessMode, error) {
+	mode := binary.BigEndian.Uint64(v)
+	switch AccessMode(mode) {
+	case AccessModeFull, AccessModeLimited, AccessModeMinimal:
+		return AccessMode(mode), nil
+	}
+	return AccessModeNotApplicant, fmt.Errorf("invalid legacy access mode: %d", mode)
+}
+
+// decodeMember deserializes a member record. The legacy record which
+// is an 8-byte access mode is decoded without metadata.
+func decodeMember(did string, v []byte) (*Member, error) {
+	if isLegacyMember(v) {
+		mode, err := legacyAccessMode(v)
+		if err != nil {
+			return nil, err
+		}
+		return &Member{
+			DID:        did,
+			AccessMode: mode,
+		}, nil
+	}
+
+	var r memberRecord
+	if err := json.Unmarshal(v, &r); err != nil {
+		return nil, err
+	}
+	if r.Version != memberRecordVersion {
+		return nil, fmt.Errorf("unsupported member record version: %d", r.Version)
+	}
+
+	r.Member.DID = did
+	return &r.Member, nil
+}
+
+type MemberProfileRPCParams struct {
+	MemberDID string `json:"member_did"`
+	Label     string `json:"label"`
+}
+
+// bindingState returns the binding state of a DID. A DID is bound if any of its
+// devices is bound.
+func (c *Controller) bindingState(did string) string {
+	state := bindingStateNone
+	for _, b := range c.store.DeviceBindings(did) {
+		if b.Bound {
+			return bindingStateBound
+		}
+		state = bindingStatePending
+	}
+	return state
+}
+
+// touchMember updates the last active time of a member
+func (c *Controller) touchMember(did string, now time.Time) {
+	if did == c.owner() {
+		return
+	}
+
+	m := c.store.Member(did)
+	if m == nil || (m.LastActiveAt != nil && now.Sub(*m.LastActiveAt) < memberActivityResolution) {
+		return
+	}
+
+	if err := c.store.TouchMember(did, now); err != nil {
+		log.WithError(err).WithField("did", did).Error("fail to update last active time")
+	}
+}
+
+// listMembers returns all members along with their metadata. Only the owner is allowed to use it.
+func (c *Controller) listMembers(did string) (map[string]interface{}, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to list members")
+	}
+
+	members := make([]map[string]interface{}, 0)
+	for _, m := range c.store.Members() {
+		members = append(members, map[string]interface{}{
+			"did":            m.DID,
+			"access_mode":    m.AccessMode,
+			"label":          m.Label,
+			"binding":        c.bindingState(m.DID),
+			"added_by":       m.AddedBy,
+			"added_at":       m.AddedAt,
+			"last_active_at": m.LastActiveAt,
+			"expires_at":     m.ExpiresAt,
+		})
+	}
+
+	return map[string]interface{}{
+		"owner":   c.owner(),
+		"members": members,
+	}, nil
+}
+
+// setMemberProfile attaches a display label to a member
+func (c *Controller) setMemberProfile(memberDID, label string) (map[string]string, error) {
+	m := c.store.Member(memberDID)
+	if m == nil {
+		return nil, fmt.Errorf("member not found")
+	}
+
+	m.Label = label
+	if err := c.store.SaveMember(*m); err != nil {
+		return nil, err
+	}
+	return map[string]string{"status": "ok"}, nil
+}
+
+// sweepExpiredMembers removes expired members and notifies the owner about them
+func (c *Controller) sweepExpiredMembers(now time.Time) {
+	members, err := c.store.RemoveExpiredMembers(now)
+	if err != nil {
+		log.WithError(err).Error("fail to remove expired members")
+		return
+	}
+
+	for _, m := range members {
+		log.WithField("did", m.DID).WithField("expires_at", m.ExpiresAt).Info("expired member removed")
+		c.notifyMemberExpired(m)
+	}
+}
+
+// notifyMemberExpired notifies the owner that the grant of a member is expired
+func (c *Controller) notifyMemberExpired(m Member) {
+	data := map[string]interface{}{
+		"event":       "member_expired",
+		"did":         m.DID,
+		"label":       m.Label,
+		"access_mode": m.AccessMode,
+		"expires_at":  m.ExpiresAt,
+	}
+
+	name := m.Label
+	if name == "" {
+		name = m.DID
+	}
+	contents := map[string]string{
+		"en": fmt.Sprintf("The access of %s expired", name),
+	}
+
+	if err := c.sendNotification(c.owner(), contents, data); err != nil {
+		log.WithError(err).WithField("did", m.DID).Error("fail to notify the expired member")
+	}
+}
@@ -0,0 +1,277 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMember(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	newMemberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	memberDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+
+	addedAt := time.Now().Add(-time.Hour)
+	member := Member{DID: memberDID, AccessMode: AccessModeMinimal, Label: "Bob", AddedBy: ownerDID, AddedAt: addedAt}
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Member(newMemberDID).Return(nil)
+	mockedStore.EXPECT().Member(memberDID).Return(&member)
+	mockedStore.EXPECT().SaveMember(gomock.Any()).DoAndReturn(func(m Member) error {
+		assert.Equal(t, newMemberDID, m.DID)
+		assert.Equal(t, AccessModeLimited, m.AccessMode)
+		assert.Equal(t, ownerDID, m.AddedBy)
+		assert.False(t, m.AddedAt.IsZero())
+		return nil
+	})
+	mockedStore.EXPECT().SaveMember(Member{
+		DID: memberDID, AccessMode: AccessModeLimited, Label: "Bob", AddedBy: ownerDID, AddedAt: addedAt,
+	}).Return(nil)
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	_, err := c.setMember(ownerDID, newMemberDID, AccessModeLimited, nil)
+	assert.NoError(t, err)
+
+	// metadata is kept when the access mode is updated
+	_, err = c.setMember(ownerDID, memberDID, AccessModeLimited, nil)
+	assert.NoError(t, err)
+}
+
+func TestSetMemberWithExpiry(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	expiresAt := time.Now().Add(24 * time.Hour)
+	expiredAt := time.Now().Add(-time.Minute)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Member(memberDID).Return(nil)
+	mockedStore.EXPECT().SaveMember(gomock.Any()).DoAndReturn(func(m Member) error {
+		assert.Equal(t, &expiresAt, m.ExpiresAt)
+		return nil
+	})
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	_, err := c.setMember(ownerDID, memberDID, AccessModeLimited, &expiredAt)
+	assert.EqualError(t, err, "expires_at must be in the future")
+
+	_, err = c.setMember(ownerDID, memberDID, AccessModeLimited, &expiresAt)
+	assert.NoError(t, err)
+}
+
+func TestSweepExpiredMembers(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	notifications := make([]map[string]interface{}, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&n)
+		notifications = append(notifications, n)
+	}))
+	defer server.Close()
+	viper.Set("notification_url", server.URL)
+	defer viper.Set("notification_url", "")
+
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	now := time.Now()
+	expiredAt := now.Add(-time.Minute)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().RemoveExpiredMembers(now).Return([]Member{
+		{DID: memberDID, AccessMode: AccessModeLimited, Label: "Accountant", ExpiresAt: &expiredAt},
+	}, nil)
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore, Identity: i, httpClient: http.DefaultClient}
+	c.sweepExpiredMembers(now)
+
+	assert.Len(t, notifications, 1)
+	assert.Equal(t, ownerDID, notifications[0]["AccountID"])
+	data := notifications[0]["Data"].(map[string]interface{})
+	assert.Equal(t, "member_expired", data["event"])
+	assert.Equal(t, memberDID, data["did"])
+}
+
+func TestSetMemberByAdmin(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	adminDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	limitedDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+	fullDID := "did:key:zQ3shk5bp53SwcW4685TwY1BuieKLTLEPLSJRG8Qknu9oddRj"
+	newMemberDID := "did:key:zQ3shaZgv7c7EetwDBsnXxFQ9B9WcH8Kfr7bTLDYaj3cDE8Ec"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Member(adminDID).AnyTimes().Return(&Member{DID: adminDID, AccessMode: AccessModeAdmin})
+	mockedStore.EXPECT().MemberAccessMode(adminDID).AnyTimes().Return(AccessModeAdmin)
+	mockedStore.EXPECT().MemberAccessMode(limitedDID).AnyTimes().Return(AccessModeLimited)
+	mockedStore.EXPECT().MemberAccessMode(fullDID).AnyTimes().Return(AccessModeFull)
+	mockedStore.EXPECT().Member(limitedDID).AnyTimes().Return(&Member{DID: limitedDID, AccessMode: AccessModeLimited})
+	mockedStore.EXPECT().Member(fullDID).AnyTimes().Return(&Member{DID: fullDID, AccessMode: AccessModeFull})
+	mockedStore.EXPECT().Member(newMemberDID).AnyTimes().Return(nil)
+	mockedStore.EXPECT().SaveMember(gomock.Any()).Times(2).Return(nil)
+	mockedStore.EXPECT().RemoveMember(limitedDID).Return(nil)
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	_, err := c.setMember(adminDID, newMemberDID, AccessModeMinimal, nil)
+	assert.NoError(t, err)
+	_, err = c.setMember(adminDID, limitedDID, AccessModeMinimal, nil)
+	assert.NoError(t, err)
+
+	// admins are not allowed to promote anyone to admin or full
+	_, err = c.setMember(adminDID, newMemberDID, AccessModeAdmin, nil)
+	assert.EqualError(t, err, "not allowed to grant the access mode")
+	_, err = c.setMember(adminDID, limitedDID, AccessModeFull, nil)
+	assert.EqualError(t, err, "not allowed to grant the access mode")
+	_, err = c.setMember(adminDID, adminDID, AccessModeFull, nil)
+	assert.EqualError(t, err, "not allowed to grant the access mode")
+
+	// admins are not allowed to touch members of higher access modes
+	_, err = c.setMember(adminDID, fullDID, AccessModeMinimal, nil)
+	assert.EqualError(t, err, "not allowed to update the member")
+	_, err = c.removeMember(adminDID, fullDID)
+	assert.EqualError(t, err, "not allowed to remove the member")
+	_, err = c.removeMember(adminDID, adminDID)
+	assert.EqualError(t, err, "not allowed to remove the member")
+
+	_, err = c.removeMember(adminDID, limitedDID)
+	assert.NoError(t, err)
+
+	_, err = c.setMember(limitedDID, newMemberDID, AccessModeMinimal, nil)
+	assert.EqualError(t, err, "not allowed to grant the access mode")
+
+	_, err = c.setMember(adminDID, ownerDID, AccessModeMinimal, nil)
+	assert.EqualError(t, err, "not allowed to change the access mode of the owner")
+
+	_, err = c.setMember(ownerDID, newMemberDID, AccessMode(10), nil)
+	assert.EqualError(t, err, "invalid access mode")
+}
+
+func TestListMembers(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	pendingMemberDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+
+	now := time.Now()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Members().Return([]Member{
+		{DID: memberDID, AccessMode: AccessModeLimited, Label: "Alice", AddedBy: ownerDID, AddedAt: now, LastActiveAt: &now},
+		{DID: pendingMemberDID, AccessMode: AccessModeMinimal},
+	})
+	mockedStore.EXPECT().DeviceBindings(memberDID).Return([]DeviceBinding{
+		{DID: memberDID, Device: 1, BindingSession: BindingSession{Nonce: "1eba606e"}},
+		{DID: memberDID, Device: 2, BindingSession: BindingSession{Bound: true}},
+	})
+	mockedStore.EXPECT().DeviceBindings(pendingMemberDID).Return([]DeviceBinding{
+		{DID: pendingMemberDID, Device: 1, BindingSession: BindingSession{Nonce: "1eba606e"}},
+	})
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	_, err := c.listMembers(memberDID)
+	assert.EqualError(t, err, "only the owner is allowed to list members")
+
+	r, err := c.listMembers(ownerDID)
+	assert.NoError(t, err)
+	assert.Equal(t, ownerDID, r["owner"])
+
+	members := r["members"].([]map[string]interface{})
+	assert.Len(t, members, 2)
+	assert.Equal(t, map[string]interface{}{
+		"did":            memberDID,
+		"access_mode":    AccessModeLimited,
+		"label":          "Alice",
+		"binding":        bindingStateBound,
+		"added_by":       ownerDID,
+		"added_at":       now,
+		"last_active_at": &now,
+		"expires_at":     (*time.Time)(nil),
+	}, members[0])
+	assert.Equal(t, bindingStatePending, members[1]["binding"])
+}
+
+func TestSetMemberProfile(t *testing.T) {
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Member("did:key:unknown").Return(nil)
+	mockedStore.EXPECT().Member(memberDID).Return(&Member{DID: memberDID, AccessMode: AccessModeLimited})
+	mockedStore.EXPECT().SaveMember(Member{DID: memberDID, AccessMode: AccessModeLimited, Label: "Alice"}).Return(nil)
+
+	c := Controller{store: mockedStore}
+
+	_, err := c.setMemberProfile("did:key:unknown", "Alice")
+	assert.EqualError(t, err, "member not found")
+
+	_, err = c.setMemberProfile(memberDID, "Alice")
+	assert.NoError(t, err)
+}
+
+func TestTouchMember(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	now := time.Now()
+	recently := now.Add(-10 * time.Second)
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	gomock.InOrder(
+		mockedStore.EXPECT().Member(memberDID).Return(&Member{DID: memberDID}),
+		mockedStore.EXPECT().TouchMember(memberDID, now).Return(nil),
+		mockedStore.EXPECT().Member(memberDID).Return(&Member{DID: memberDID, LastActiveAt: &recently}),
+	)
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	c.touchMember(ownerDID, now)
+	c.touchMember(memberDID, now)
+
+	// the last active time is not updated too often
+	c.touchMember(memberDID, now)
+}
+
+func TestDecodeLegacyMember(t *testing.T) {
+	legacy := func(mode uint64) []byte {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, mode)
+		return v
+	}
+
+	m, err := decodeMember("did:key:member", legacy(uint64(AccessModeLimited)))
+	assert.NoError(t, err)
+	assert.Equal(t, &Member{DID: "did:key:member", AccessMode: AccessModeLimited}, m)
+
+	// values out of Full, Limited and Minimal are never read as Admin
+	_, err = decodeMember("did:key:member", legacy(uint64(AccessModeAdmin)))
+	assert.EqualError(t, err, "invalid legacy access mode: 3")
+	_, err = decodeMember("did:key:member", legacy(7))
+	assert.EqualError(t, err, "invalid legacy access mode: 7")
+}
@@ -0,0 +1,337 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/utils"
+)
+
+var (
+	bucketMetadata = []byte("metadata")
+
+	keySchemaVersion = []byte("schema_version")
+)
+
+// migration upgrades the store from the previous schema version to its version
+type migration struct {
+	version     uint64
+	description string
+	migrate     func(tx *bolt.Tx, kek []byte) error
+}
+
+// migrations are ordered by versions. A store without a schema version is of
+// version 0, which keeps `true` or nonces in bindings and 8-byte access modes in
+// members. New migrations must be appended with the next version. Values are
+// sealed since encryptedSchemaVersion, so later migrations have to unwrap the
+// store key by the key encryption key to read them.
+var migrations = []migration{
+	{1, "create buckets", createBuckets},
+	{2, "key bindings by devices", migrateLegacyBindings},
+	{3, "convert bindings into binding sessions", migrateBindingSessions},
+	{4, "convert members into versioned records", migrateMemberRecords},
+	{5, "encrypt values", encryptValues},
+	{6, "create the audit log", createAuditLog},
+	{7, "create the identity rotations", createIdentityRotations},
+}
+
+// encryptedSchemaVersion is the first schema version with sealed values
+const encryptedSchemaVersion = 5
+
+// latestSchemaVersion is the schema version of a store with all migrations applied
+func latestSchemaVersion() uint64 {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaVersion returns the schema version of a store
+func schemaVersion(tx *bolt.Tx) uint64 {
+	b := tx.Bucket(bucketMetadata)
+	if b == nil {
+		return 0
+	}
+	v := b.Get(keySchemaVersion)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// setSchemaVersion updates the schema version of a store
+func setSchemaVersion(tx *bolt.Tx, version uint64) error {
+	b, err := tx.CreateBucketIfNotExists(bucketMetadata)
+	if err != nil {
+		return err
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, version)
+	return b.Put(keySchemaVersion, v)
+}
+
+// isEmpty returns whether a store has no bucket at all
+func isEmpty(tx *bolt.Tx) bool {
+	empty := true
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		empty = false
+		return nil
+	})
+	return empty
+}
+
+// backupPath returns the path of the backup of a store before migrating from a version
+func backupPath(path string, version uint64) string {
+	return fmt.Sprintf("%s.v%d.bak", path, version)
+}
+
+// removePlaintextBackups removes backups of a store which are written before its
+// values are encrypted
+func removePlaintextBackups(path string) {
+	for version := uint64(0); version < encryptedSchemaVersion; version++ {
+		backup := backupPath(path, version)
+		if err := os.Remove(backup); err != nil {
+			if !os.IsNotExist(err) {
+				log.WithError(err).WithField("backup", backup).Error("fail to remove the plaintext backup")
+			}
+			continue
+		}
+		log.WithField("backup", backup).Warn("plaintext backup removed")
+	}
+}
+
+// migrate applies pending migrations in order. Each migration runs inside its own
+// transaction along with the update of the schema version. A backup of a store
+// with data is written before any migration is applied.
+func migrate(db *bolt.DB, kek []byte) error {
+	var version uint64
+	var empty bool
+	db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		empty = isEmpty(tx)
+		return nil
+	})
+
+	latest := latestSchemaVersion()
+	if version > latest {
+		return fmt.Errorf("unsupported schema version: %d", version)
+	}
+	if version == latest {
+		return nil
+	}
+
+	if !empty {
+		backup := backupPath(db.Path(), version)
+		if err := db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backup, 0600)
+		}); err != nil {
+			return fmt.Errorf("fail to back up the store: %w", err)
+		}
+		log.WithField("backup", backup).Info("store backed up before migrations")
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := m.migrate(tx, kek); err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, m.version)
+		}); err != nil {
+			return fmt.Errorf("fail to migrate the store to version %d (%s): %w", m.version, m.description, err)
+		}
+		log.WithField("version", m.version).WithField("description", m.description).Info("store migrated")
+	}
+	return nil
+}
+
+// createBuckets creates all buckets of the store
+func createBuckets(tx *bolt.Tx, _ []byte) error {
+	for _, name := range [][]byte{
+		bucketBinding,
+		bucketMember,
+		bucketMemberRPCPolicy,
+		bucketSpendingLimit,
+		bucketSpending,
+		bucketTrustedAddress,
+		bucketPendingApproval,
+		bucketDelayedTx,
+		bucketOwnership,
+		bucketOwnershipEvent,
+		bucketInvitation,
+		bucketCommandCounter,
+	} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLegacyBindings moves bindings keyed by DIDs only to the primary
+// device of the DIDs
+func migrateLegacyBindings(tx *bolt.Tx, _ []byte) error {
+	b := tx.Bucket(bucketBinding)
+	legacy := make(map[string][]byte)
+	if err := b.ForEach(func(k, v []byte) error {
+		if !bytes.Contains(k, bindingKeySeparator) {
+			legacy[string(k)] = append([]byte{}, v...)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for did, v := range legacy {
+		if err := b.Put(bindingKey(did, legacyBindingDevice), v); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(did)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateBindingSessions rewrites legacy binding values, which are `true` for
+// bound DIDs and nonces for pending ones, into binding sessions
+func migrateBindingSessions(tx *bolt.Tx, _ []byte) error {
+	b := tx.Bucket(bucketBinding)
+	sessions := make(map[string][]byte)
+	if err := b.ForEach(func(k, v []byte) error {
+		if len(v) > 0 && v[0] == '{' {
+			return nil
+		}
+
+		session, err := decodeBindingSession(v)
+		if err != nil {
+			return err
+		}
+		if sessions[string(k)], err = encodeBindingSession(*session); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for k, v := range sessions {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateMemberRecords rewrites legacy 8-byte access modes of members into versioned records
+func migrateMemberRecords(tx *bolt.Tx, _ []byte) error {
+	b := tx.Bucket(bucketMember)
+	records := make(map[string][]byte)
+	invalid := make([]string, 0)
+	if err := b.ForEach(func(k, v []byte) error {
+		if len(v) > 0 && v[0] == '{' {
+			return nil
+		}
+
+		// a legacy value out of Full, Limited and Minimal granted no access
+		if isLegacyMember(v) {
+			if _, err := legacyAccessMode(v); err != nil {
+				log.WithError(err).WithField("did", string(k)).Warn("drop an invalid legacy member")
+				invalid = append(invalid, string(k))
+				return nil
+			}
+		}
+
+		m, err := decodeMember(string(k), v)
+		if err != nil {
+			return err
+		}
+		if records[string(k)], err = encodeMember(*m); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for k, v := range records {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	for _, k := range invalid {
+		if err := b.Delete([]byte(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptValues generates the data encryption key of the store, saves it wrapped by
+// the key encryption key and seals all values. Keys are left in plaintext.
+func encryptValues(tx *bolt.Tx, kek []byte) error {
+	dek, err := utils.GenerateRandomBytes(storeKeyLen)
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrapStoreKey(kek, dek)
+	if err != nil {
+		return err
+	}
+	metadata, err := tx.CreateBucketIfNotExists(bucketMetadata)
+	if err != nil {
+		return err
+	}
+	if err := metadata.Put(keyEncryptionKey, wrapped); err != nil {
+		return err
+	}
+
+	c, err := newStoreCipher(dek)
+	if err != nil {
+		return err
+	}
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if bytes.Equal(name, bucketMetadata) {
+			return nil
+		}
+
+		sealed := make(map[string][]byte)
+		if err := b.ForEach(func(k, v []byte) error {
+			var err error
+			sealed[string(k)], err = c.seal(name, k, v)
+			return err
+		}); err != nil {
+			return err
+		}
+
+		for k, v := range sealed {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// createAuditLog creates the bucket of the audit log
+func createAuditLog(tx *bolt.Tx, _ []byte) error {
+	_, err := tx.CreateBucketIfNotExists(bucketAuditLog)
+	return err
+}
+
+// createIdentityRotations creates the bucket of identity rotations
+func createIdentityRotations(tx *bolt.Tx, _ []byte) error {
+	_, err := tx.CreateBucketIfNotExists(bucketIdentityRotation)
+	return err
+}
@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+// createLegacyStore creates a store of schema version 0, which keeps `true` or
+// nonces in bindings and 8-byte access modes in members
+func createLegacyStore(t *testing.T, path string, bindings map[string]string, members map[string]AccessMode) {
+	db, err := bolt.Open(path, 0600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(bucketBinding)
+		if err != nil {
+			return err
+		}
+		for did, v := range bindings {
+			if err := b.Put([]byte(did), []byte(v)); err != nil {
+				return err
+			}
+		}
+
+		b, err = tx.CreateBucket(bucketMember)
+		if err != nil {
+			return err
+		}
+		for did, mode := range members {
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, uint64(mode))
+			if err := b.Put([]byte(did), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func TestMigrateLegacyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	ownerDID := "did:key:owner"
+	pendingDID := "did:key:pending-member"
+	memberDID := "did:key:member"
+	staleDID := "did:key:stale-member"
+
+	// a legacy value of 3 granted no access before the Admin access mode was added
+	createLegacyStore(t, path,
+		map[string]string{ownerDID: "true", pendingDID: "1eba606e"},
+		map[string]AccessMode{memberDID: AccessModeLimited, pendingDID: AccessModeMinimal, staleDID: AccessMode(3)})
+
+	s := NewBoltStore(path, []byte("store key material"))
+	defer s.db.Close()
+
+	s.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, latestSchemaVersion(), schemaVersion(tx))
+
+		// values are rewritten into the current formats and sealed
+		for k, v := range map[string][]byte{
+			ownerDID + "#1":   tx.Bucket(bucketBinding).Get([]byte(ownerDID + "#1")),
+			pendingDID + "#1": tx.Bucket(bucketBinding).Get([]byte(pendingDID + "#1")),
+			memberDID:         tx.Bucket(bucketMember).Get([]byte(memberDID)),
+		} {
+			assert.Equal(t, sealedValueVersion, v[0], k)
+		}
+		for k, bucket := range map[string][]byte{
+			ownerDID + "#1":   bucketBinding,
+			pendingDID + "#1": bucketBinding,
+			memberDID:         bucketMember,
+		} {
+			v, err := s.bucket(tx, bucket).Get([]byte(k))
+			assert.NoError(t, err)
+			assert.Equal(t, byte('{'), v[0], k)
+		}
+		assert.Nil(t, tx.Bucket(bucketBinding).Get([]byte(ownerDID)))
+		assert.Nil(t, tx.Bucket(bucketMember).Get([]byte(staleDID)))
+		return nil
+	})
+
+	assert.True(t, s.HasBinding(ownerDID, legacyBindingDevice))
+	assert.False(t, s.HasBinding(pendingDID, legacyBindingDevice))
+	assert.NotNil(t, s.BindingSession(pendingDID, legacyBindingDevice))
+	assert.Equal(t, &Member{DID: memberDID, AccessMode: AccessModeLimited}, s.Member(memberDID))
+	assert.Equal(t, AccessModeMinimal, s.MemberAccessMode(pendingDID))
+	assert.Nil(t, s.Member(staleDID))
+	assert.Equal(t, AccessModeNotApplicant, s.MemberAccessMode(staleDID))
+	assert.Len(t, s.Members(), 2)
+	assert.NotNil(t, s.Invitations())
+
+	// the plaintext backup is removed once values are encrypted
+	_, err := os.Stat(path + ".v0.bak")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMigrateNewStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "new.db")
+
+	s := NewBoltStore(path, []byte("store key material"))
+	s.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, latestSchemaVersion(), schemaVersion(tx))
+		return nil
+	})
+	assert.NoError(t, s.db.Close())
+
+	// an empty store is not backed up
+	_, err := os.Stat(path + ".v0.bak")
+	assert.True(t, os.IsNotExist(err))
+
+	// migrations are not applied twice
+	s = NewBoltStore(path, []byte("store key material"))
+	defer s.db.Close()
+	_, err = os.Stat(fmt.Sprintf("%s.v%d.bak", path, latestSchemaVersion()))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMigrateUnsupportedVersion(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "future.db"), 0600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return setSchemaVersion(tx, latestSchemaVersion()+1)
+	}))
+	assert.EqualError(t, migrate(db, []byte("key encryption key")), fmt.Sprintf("unsupported schema version: %d", latestSchemaVersion()+1))
+}
+
+func TestMigrateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failure.db")
+	createLegacyStore(t, path, map[string]string{"did:key:owner": "true"}, nil)
+
+	original := migrations
+	defer func() { migrations = original }()
+	migrations = []migration{
+		original[0],
+		{2, "fail", func(tx *bolt.Tx, _ []byte) error {
+			if _, err := tx.CreateBucket([]byte("partial")); err != nil {
+				return err
+			}
+			return errors.New("broken migration")
+		}},
+	}
+
+	db, err := bolt.Open(path, 0600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.EqualError(t, migrate(db, []byte("key encryption key")), "fail to migrate the store to version 2 (fail): broken migration")
+
+	// the failed migration is rolled back while the previous one is kept
+	db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, uint64(1), schemaVersion(tx))
+		assert.Nil(t, tx.Bucket([]byte("partial")))
+		assert.NotNil(t, tx.Bucket(bucketInvitation))
+		return nil
+	})
+
+	// the store is backed up as it is before migrations
+	backup, err := bolt.Open(path+".v0.bak", 0600, &bolt.Options{ReadOnly: true})
+	assert.NoError(t, err)
+	defer backup.Close()
+	backup.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, uint64(0), schemaVersion(tx))
+		assert.Equal(t, []byte("true"), tx.Bucket(bucketBinding).Get([]byte("did:key:owner")))
+		return nil
+	})
+}
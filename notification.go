@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 
@@ -54,12 +55,6 @@ func (c *Controller) transactionNotify(context *gin.Context) {
 		})
 	}
 
-	// prepare the notify params
-	type notifyFormat struct {
-		AccountID string
-		Contents  map[string]string
-		Data      map[string]interface{}
-	}
 	notifyContent := map[string]string{
 		"en": "Transaction Notification",
 	}
@@ -72,42 +67,48 @@ func (c *Controller) transactionNotify(context *gin.Context) {
 		"vouts":         vouts,
 	}
 
-	body := new(bytes.Buffer)
-	if err := json.NewEncoder(body).Encode(notifyFormat{AccountID: c.ownerDID, Contents: notifyContent, Data: notifyData}); err != nil {
+	if err := c.sendNotification(c.owner(), notifyContent, notifyData); err != nil {
 		logFields := map[string]interface{}{
 			"notifyData": notifyData,
 		}
-		replyWithError(context, err, "failed to encode tx", logFields)
+		replyWithError(context, err, "failed to notify", logFields)
 		return
 	}
+	context.JSON(200, gin.H{"ok": 1})
+}
+
+// sendNotification sends a notification to an account through the notification API
+func (c *Controller) sendNotification(accountID string, contents map[string]string, data map[string]interface{}) error {
+	// prepare the notify params
+	type notifyFormat struct {
+		AccountID string
+		Contents  map[string]string
+		Data      map[string]interface{}
+	}
+
+	body := new(bytes.Buffer)
+	if err := json.NewEncoder(body).Encode(notifyFormat{AccountID: accountID, Contents: contents, Data: data}); err != nil {
+		return err
+	}
 
 	// start to call notification api
 	notifyURL := viper.GetString("notification_url")
 
 	notifyReq, _ := http.NewRequest("POST", notifyURL, body)
 	notifyReq.Header.Add("Content-Type", "application/json")
-	notifyReq.Header.Add("Authorization", "Bearer "+c.Identity.authToken)
+	notifyReq.Header.Add("Authorization", "Bearer "+c.identity().authToken)
 
 	resp, err := c.httpClient.Do(notifyReq)
 	if err != nil {
-		logFields := map[string]interface{}{
-			"notifyData": notifyData,
-		}
-		replyWithError(context, err, "failed to notify", logFields)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		r, _ := ioutil.ReadAll(resp.Body)
-		logFields := map[string]interface{}{
-			"status": resp.StatusCode,
-			"body":   string(r),
-		}
-		replyWithError(context, err, "failed to notify", logFields)
-		return
+		return fmt.Errorf("notification api request fail. status: %d, body: %s", resp.StatusCode, string(r))
 	}
-	context.JSON(200, gin.H{"ok": 1})
+	return nil
 }
 
 func getVinAddresses(client *bitcoind.HttpBitcoind, txId string, vout int) ([]string, error) {
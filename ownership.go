@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+	"github.com/bitmark-inc/autonomy-pod-controller/utils"
+)
+
+// ownershipTransferTTL is how long the new owner has to accept a transfer
+const ownershipTransferTTL = 24 * time.Hour
+
+const (
+	ownershipEventInitiated = "transfer_initiated"
+	ownershipEventAccepted  = "transfer_accepted"
+)
+
+// OwnershipTransfer is an ownership transfer waiting for the acceptance of the new owner
+type OwnershipTransfer struct {
+	NewOwner    string    `json:"new_owner"`
+	Nonce       string    `json:"nonce"`
+	InitiatedBy string    `json:"initiated_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// OwnershipEvent is a record of the ownership audit trail
+type OwnershipEvent struct {
+	Event         string    `json:"event"`
+	PreviousOwner string    `json:"previous_owner"`
+	NewOwner      string    `json:"new_owner"`
+	At            time.Time `json:"at"`
+}
+
+type TransferOwnershipRPCParams struct {
+	NewOwnerDID string `json:"new_owner_did"`
+}
+
+type AcceptOwnershipRPCParams struct {
+	Timestamp string `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// owner returns the DID of the pod owner
+func (c *Controller) owner() string {
+	c.ownerLock.RLock()
+	defer c.ownerLock.RUnlock()
+	return c.ownerDID
+}
+
+// isPendingOwner returns whether a DID is the new owner of a pending ownership transfer
+func (c *Controller) isPendingOwner(did string) bool {
+	transfer := c.store.PendingOwnershipTransfer()
+	return transfer != nil && transfer.NewOwner == did
+}
+
+// transferOwnership starts transferring the ownership to a new DID. It returns a challenge
+// signed by the pod which the new owner has to sign and send back by `accept_ownership`.
+func (c *Controller) transferOwnership(did, newOwnerDID string) (map[string]interface{}, error) {
+	owner := c.owner()
+	if did != owner {
+		return nil, fmt.Errorf("only the owner is allowed to transfer the ownership")
+	}
+
+	if newOwnerDID == owner {
+		return nil, fmt.Errorf("the new owner is already the owner")
+	}
+	if _, err := key.PublicKeyFromDID(newOwnerDID); err != nil {
+		return nil, fmt.Errorf("invalid new owner did: %s", err)
+	}
+
+	b, err := utils.GenerateRandomBytes(4)
+	if err != nil {
+		return nil, err
+	}
+
+	now := c.now()
+	nonce := hex.EncodeToString(b)
+	nowString := fmt.Sprint(now.UnixNano() / int64(time.Millisecond))
+	signature, err := key.Sign(c.identity().PrivateKey, nonce+nowString)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := OwnershipTransfer{
+		NewOwner:    newOwnerDID,
+		Nonce:       nonce,
+		InitiatedBy: did,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ownershipTransferTTL),
+	}
+	if err := c.store.SetPendingOwnershipTransfer(transfer); err != nil {
+		return nil, err
+	}
+
+	if err := c.store.AddOwnershipEvent(OwnershipEvent{
+		Event:         ownershipEventInitiated,
+		PreviousOwner: owner,
+		NewOwner:      newOwnerDID,
+		At:            now,
+	}); err != nil {
+		return nil, err
+	}
+	log.WithField("new_owner", newOwnerDID).Info("ownership transfer initiated")
+
+	return map[string]interface{}{
+		"new_owner_did": newOwnerDID,
+		"identity":      c.identity().DID,
+		"nonce":         nonce,
+		"timestamp":     nowString,
+		"signature":     signature,
+		"expires_at":    transfer.ExpiresAt,
+	}, nil
+}
+
+// acceptOwnership completes an ownership transfer. The new owner proves the control
+// of its DID by signing the nonce of the transfer like `bind_ack`.
+func (c *Controller) acceptOwnership(did string, params AcceptOwnershipRPCParams) (map[string]string, error) {
+	transfer := c.store.PendingOwnershipTransfer()
+	if transfer == nil || transfer.NewOwner != did {
+		return nil, fmt.Errorf("no pending ownership transfer")
+	}
+
+	now := c.now()
+	if now.After(transfer.ExpiresAt) {
+		return nil, fmt.Errorf("ownership transfer expired")
+	}
+
+	if !key.VerifySignature(did, transfer.Nonce+params.Timestamp, params.Signature) {
+		err := fmt.Errorf("invalid ownership ack signature")
+		log.WithError(err).Error("fail to accept ownership")
+		return nil, err
+	}
+
+	c.ownerLock.Lock()
+	defer c.ownerLock.Unlock()
+
+	previousOwner := c.ownerDID
+	if err := c.store.TransferOwnership(OwnershipEvent{
+		Event:         ownershipEventAccepted,
+		PreviousOwner: previousOwner,
+		NewOwner:      did,
+		At:            now,
+	}); err != nil {
+		log.WithError(err).Error("fail to accept ownership")
+		return nil, err
+	}
+	c.ownerDID = did
+
+	log.WithField("previous_owner", previousOwner).WithField("new_owner", did).Info("ownership transferred")
+
+	return map[string]string{"status": "ok"}, nil
+}
+
+// getOwnershipHistory returns the ownership audit trail
+func (c *Controller) getOwnershipHistory() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"owner":  c.owner(),
+		"events": c.store.OwnershipEvents(),
+	}, nil
+}
@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	messaging "github.com/bitmark-inc/autonomy-messaging-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+func TestTransferOwnership(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	newOwnerDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+
+	var transfer OwnershipTransfer
+	mockedStore.EXPECT().SetPendingOwnershipTransfer(gomock.Any()).DoAndReturn(func(t OwnershipTransfer) error {
+		transfer = t
+		return nil
+	})
+	mockedStore.EXPECT().AddOwnershipEvent(gomock.Any()).DoAndReturn(func(e OwnershipEvent) error {
+		assert.Equal(t, ownershipEventInitiated, e.Event)
+		assert.Equal(t, ownerDID, e.PreviousOwner)
+		assert.Equal(t, newOwnerDID, e.NewOwner)
+		return nil
+	})
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore, Identity: i}
+
+	_, err = c.transferOwnership(newOwnerDID, newOwnerDID)
+	assert.EqualError(t, err, "only the owner is allowed to transfer the ownership")
+
+	_, err = c.transferOwnership(ownerDID, ownerDID)
+	assert.EqualError(t, err, "the new owner is already the owner")
+
+	_, err = c.transferOwnership(ownerDID, "did:key:invalid")
+	assert.Error(t, err)
+
+	r, err := c.transferOwnership(ownerDID, newOwnerDID)
+	assert.NoError(t, err)
+	assert.Equal(t, newOwnerDID, r["new_owner_did"])
+	assert.Equal(t, i.DID, r["identity"])
+	assert.Equal(t, transfer.Nonce, r["nonce"])
+	assert.Equal(t, ownerDID, transfer.InitiatedBy)
+	assert.True(t, key.VerifySignature(i.DID, r["nonce"].(string)+r["timestamp"].(string), r["signature"].(string)))
+}
+
+func TestAcceptOwnership(t *testing.T) {
+	ownerDID := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+	newOwnerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	otherDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	// the signature of the nonce 1eba606e with the timestamp 1618456405107 signed by the new owner
+	params := AcceptOwnershipRPCParams{
+		Timestamp: "1618456405107",
+		Signature: "3045022100d500b7ebbadeed51aaff844a0e7d741eb5bbf4c14b8d8476d87fae4ae02ab08b0220787dcaeae59327d1ff17db5b25386bf3250425a702a212e4fbd470b890d45ea6",
+	}
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+
+	transfer := &OwnershipTransfer{
+		NewOwner:  newOwnerDID,
+		Nonce:     "1eba606e",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	mockedStore.EXPECT().PendingOwnershipTransfer().AnyTimes().DoAndReturn(func() *OwnershipTransfer {
+		return transfer
+	})
+	mockedStore.EXPECT().TransferOwnership(gomock.Any()).DoAndReturn(func(e OwnershipEvent) error {
+		assert.Equal(t, ownershipEventAccepted, e.Event)
+		assert.Equal(t, ownerDID, e.PreviousOwner)
+		assert.Equal(t, newOwnerDID, e.NewOwner)
+		return nil
+	})
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	assert.True(t, c.isPendingOwner(newOwnerDID))
+	assert.False(t, c.isPendingOwner(otherDID))
+
+	_, err := c.acceptOwnership(otherDID, params)
+	assert.EqualError(t, err, "no pending ownership transfer")
+
+	_, err = c.acceptOwnership(newOwnerDID, AcceptOwnershipRPCParams{
+		Timestamp: "1618456405108",
+		Signature: params.Signature,
+	})
+	assert.EqualError(t, err, "invalid ownership ack signature")
+	assert.Equal(t, ownerDID, c.owner())
+
+	transfer.ExpiresAt = time.Now().Add(-time.Second)
+	_, err = c.acceptOwnership(newOwnerDID, params)
+	assert.EqualError(t, err, "ownership transfer expired")
+
+	transfer.ExpiresAt = time.Now().Add(time.Hour)
+	r, err := c.acceptOwnership(newOwnerDID, params)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", r["status"])
+	assert.Equal(t, newOwnerDID, c.owner())
+	assert.Equal(t, AccessModeFull, c.accessMode(newOwnerDID))
+}
+
+func TestProcessAcceptOwnershipThrottled(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+	newOwner, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	c := Controller{ownerDID: ownerDID, store: NewMemoryStore(), Identity: i, rateLimiter: NewRateLimiter()}
+	r, err := c.transferOwnership(ownerDID, newOwner.DID)
+	assert.NoError(t, err)
+
+	// the pending owner is not bound, but its attempts are limited by the guest rate limit
+	accept := func(signature string) map[string]interface{} {
+		resp := c.Process(&messaging.Message{Source: newOwner.DID, SourceDevice: 1,
+			Content: []byte(fmt.Sprintf(`{"id":"1","command":"accept_ownership","args":{"timestamp":"1","signature":"%s"}}`, signature))})
+		var r map[string]interface{}
+		assert.NoError(t, json.Unmarshal(resp[0], &r))
+		return r
+	}
+	for n := 0; n < int(defaultGuestRateLimit.Burst); n++ {
+		assert.Equal(t, "invalid ownership ack signature", accept("00")["error"])
+	}
+
+	signature, err := key.Sign(newOwner.PrivateKey, r["nonce"].(string)+"1")
+	assert.NoError(t, err)
+	assert.Equal(t, "rate_limited", accept(signature)["code"])
+	assert.Equal(t, ownerDID, c.owner())
+}
@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// statuses of transactions reported to clients
+const (
+	txStatusPending   = "pending"
+	txStatusDelayed   = "delayed"
+	txStatusBroadcast = "broadcast"
+	txStatusRejected  = "rejected"
+	txStatusCancelled = "cancelled"
+	txStatusFailed    = "failed"
+	txStatusExpired   = "expired"
+)
+
+// Payment is a transaction output which pays to outside of the wallet.
+// Address is empty if the output script is non-standard.
+type Payment struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+// outgoingPayments returns outputs of a transaction which are counted by
+// outgoingAmount along with their addresses
+func outgoingPayments(tx *wire.MsgTx, params *chaincfg.Params, isChange func(pkScript []byte) (bool, error)) ([]Payment, error) {
+	payments := make([]Payment, 0)
+	for _, out := range tx.TxOut {
+		change, err := isChange(out.PkScript)
+		if err != nil {
+			return nil, err
+		}
+		if change {
+			continue
+		}
+
+		payment := Payment{Amount: out.Value}
+		if _, addrs, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, params); err == nil && len(addrs) == 1 {
+			payment.Address = addrs[0].EncodeAddress()
+		}
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// totalAmount returns the sum of amounts of payments
+func totalAmount(payments []Payment) int64 {
+	var amount int64
+	for _, p := range payments {
+		amount += p.Amount
+	}
+	return amount
+}
+
+// normalizeAddress validates a bitcoin address of any supported network and
+// returns its canonical encoding
+func normalizeAddress(address string) (string, error) {
+	for _, params := range []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params, &chaincfg.RegressionNetParams} {
+		addr, err := btcutil.DecodeAddress(address, params)
+		if err == nil && addr.IsForNet(params) {
+			return addr.EncodeAddress(), nil
+		}
+	}
+	return "", fmt.Errorf("invalid address: %s", address)
+}
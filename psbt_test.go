@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func testnetP2WPKHOutput(t *testing.T, value int64, seed byte) (*wire.TxOut, string) {
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{seed}, 20), &chaincfg.TestNet3Params)
+	assert.NoError(t, err)
+	script, err := txscript.PayToAddrScript(addr)
+	assert.NoError(t, err)
+	return wire.NewTxOut(value, script), addr.EncodeAddress()
+}
+
+func TestOutgoingPayments(t *testing.T) {
+	paymentOutput, paymentAddress := testnetP2WPKHOutput(t, 10000, 0x01)
+	anotherPaymentOutput, anotherPaymentAddress := testnetP2WPKHOutput(t, 2500, 0x02)
+	changeOutput, _ := testnetP2WPKHOutput(t, 50000, 0x03)
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxOut(paymentOutput)
+	tx.AddTxOut(anotherPaymentOutput)
+	tx.AddTxOut(changeOutput)
+	tx.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN, 0x01, 0xff}))
+
+	payments, err := outgoingPayments(tx, &chaincfg.TestNet3Params, func(pkScript []byte) (bool, error) {
+		return bytes.Equal(pkScript, changeOutput.PkScript), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Payment{
+		{Address: paymentAddress, Amount: 10000},
+		{Address: anotherPaymentAddress, Amount: 2500},
+		{Address: "", Amount: 0},
+	}, payments)
+	assert.Equal(t, int64(12500), totalAmount(payments))
+
+	_, err = outgoingPayments(tx, &chaincfg.TestNet3Params, func(pkScript []byte) (bool, error) {
+		return false, errors.New("rpc error")
+	})
+	assert.EqualError(t, err, "rpc error")
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	address, err := normalizeAddress("TB1Q5G27R0RQS3DA3EKHHEP08YLXG7V6GCDS3PGTRH")
+	assert.NoError(t, err)
+	assert.Equal(t, "tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh", address)
+
+	address, err = normalizeAddress("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2")
+	assert.NoError(t, err)
+	assert.Equal(t, "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", address)
+
+	_, err = normalizeAddress("not-an-address")
+	assert.EqualError(t, err, "invalid address: not-an-address")
+}
@@ -0,0 +1,246 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	commandClassNode    = "node"
+	commandClassDefault = "default"
+
+	// guestRateLimitRole is the role in `rate_limit` for DIDs which are not members
+	guestRateLimitRole = "guest"
+
+	// rateLimiterEvictInterval is how often idle buckets and past quotas are evicted
+	rateLimiterEvictInterval = 10 * time.Minute
+
+	// rateLimiterMaxEntries caps the number of quotas the limiter keeps. Once it is
+	// reached, new DIDs which are not members share a single quota.
+	rateLimiterMaxEntries = 10000
+)
+
+// defaultGuestRateLimit throttles requests of DIDs which are not members if
+// `rate_limit.guest` is not configured
+var defaultGuestRateLimit = RateLimit{Rate: 6, Burst: 6, Daily: 100}
+
+// defaultMemberRateLimit throttles requests of members for all command classes if
+// the role of the member is not configured in `rate_limit`
+var defaultMemberRateLimit = RateLimit{Rate: 60, Burst: 60, Daily: 10000}
+
+// commandClasses groups commands which share a rate limit. Commands
+// not in the list belong to the default class.
+var commandClasses = map[string]string{
+	"bitcoind":            commandClassNode,
+	"get_bitcoind_status": commandClassNode,
+	"start_bitcoind":      commandClassNode,
+	"stop_bitcoind":       commandClassNode,
+}
+
+// commandClass returns the rate limit class of a command
+func commandClass(command string) string {
+	if class, ok := commandClasses[command]; ok {
+		return class
+	}
+	return commandClassDefault
+}
+
+// RateLimit is the rate limit of a command class for an access mode.
+// A zero value of a field means there is no such limit.
+type RateLimit struct {
+	// Rate is the number of requests allowed per minute
+	Rate float64
+	// Burst is the number of requests allowed at once. It is the rate by default.
+	Burst float64
+	// Daily is the number of requests allowed per UTC day
+	Daily int64
+}
+
+// rateLimitConfig reads the rate limit of a command class for an access mode from
+// `rate_limit.<role>.<class>` in the config. DIDs which are not members use the
+// role `guest`, which falls back to defaultGuestRateLimit. Roles of members fall
+// back to defaultMemberRateLimit.
+func rateLimitConfig(mode AccessMode, class string) RateLimit {
+	role, ok := accessModeRoles[mode]
+	if !ok {
+		role = guestRateLimitRole
+		if !viper.IsSet("rate_limit." + role) {
+			return defaultGuestRateLimit
+		}
+	} else if !viper.IsSet("rate_limit." + role) {
+		return defaultMemberRateLimit
+	}
+
+	prefix := fmt.Sprintf("rate_limit.%s.%s.", role, class)
+	limit := RateLimit{
+		Rate:  viper.GetFloat64(prefix + "rate"),
+		Burst: viper.GetFloat64(prefix + "burst"),
+		Daily: viper.GetInt64(prefix + "daily"),
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Rate
+	}
+	return limit
+}
+
+// RateLimitError is returned if a request is throttled
+type RateLimitError struct {
+	Class      string
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded. retry after %d seconds", e.Limit, e.retryAfterSeconds())
+}
+
+func (e *RateLimitError) Code() string {
+	return "rate_limited"
+}
+
+func (e *RateLimitError) Details() interface{} {
+	return map[string]interface{}{
+		"class":       e.Class,
+		"limit":       e.Limit,
+		"retry_after": e.retryAfterSeconds(),
+	}
+}
+
+// retryAfterSeconds rounds the retry-after duration up to seconds
+func (e *RateLimitError) retryAfterSeconds() int64 {
+	return int64(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// tokenBucket refills tokens continuously at the rate up to the burst
+type tokenBucket struct {
+	limit     RateLimit
+	tokens    float64
+	updatedAt time.Time
+}
+
+// take takes a token from the bucket. It returns how long to wait for
+// the next token if the bucket is empty.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	if elapsed := now.Sub(b.updatedAt); elapsed > 0 {
+		b.tokens = math.Min(b.limit.Burst, b.tokens+elapsed.Minutes()*b.limit.Rate)
+	}
+	b.updatedAt = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Minute))
+	return false, wait
+}
+
+// idle returns whether the bucket is refilled to the burst at the given time, so that
+// it is not different from a new one
+func (b *tokenBucket) idle(now time.Time) bool {
+	return b.tokens+now.Sub(b.updatedAt).Minutes()*b.limit.Rate >= b.limit.Burst
+}
+
+// dailyQuota counts requests of a UTC day
+type dailyQuota struct {
+	day   time.Time
+	count int64
+}
+
+// RateLimiter throttles requests of each device of a DID and command class by token buckets
+// and daily quotas
+type RateLimiter struct {
+	sync.Mutex
+	buckets    map[string]*tokenBucket
+	quotas     map[string]*dailyQuota
+	limit      func(mode AccessMode, class string) RateLimit
+	maxEntries int
+	evictedAt  time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets:    make(map[string]*tokenBucket),
+		quotas:     make(map[string]*dailyQuota),
+		limit:      rateLimitConfig,
+		maxEntries: rateLimiterMaxEntries,
+	}
+}
+
+// Allow checks whether a request of a command from a device of a DID is allowed at the
+// given time. Each device has its own limits. It returns a RateLimitError with the
+// retry-after duration if the request is throttled. A throttled request does not
+// consume the quota.
+func (l *RateLimiter) Allow(did string, device uint32, mode AccessMode, command string, now time.Time) error {
+	class := commandClass(command)
+	_, isMember := accessModeRoles[mode]
+	if !isMember {
+		// DIDs which are not members are not allowed to use any class, so all their
+		// requests share the default class
+		class = commandClassDefault
+	}
+	limit := l.limit(mode, class)
+	key := string(bindingKey(did, device)) + "/" + class
+
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.evictedAt) >= rateLimiterEvictInterval {
+		l.evict(now)
+	}
+
+	// members are bounded by the store, but anyone could send requests as a new DID
+	if _, ok := l.quotas[key]; !ok && !isMember && len(l.quotas) >= l.maxEntries {
+		key = guestRateLimitRole + "/" + class
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	quota := l.quotas[key]
+	if quota == nil || !quota.day.Equal(today) {
+		quota = &dailyQuota{day: today}
+		l.quotas[key] = quota
+	}
+	if limit.Daily > 0 && quota.count >= limit.Daily {
+		return &RateLimitError{Class: class, Limit: "daily", RetryAfter: today.Add(24 * time.Hour).Sub(now)}
+	}
+
+	if limit.Rate > 0 {
+		bucket := l.buckets[key]
+		if bucket == nil || bucket.limit != limit {
+			bucket = &tokenBucket{limit: limit, tokens: limit.Burst, updatedAt: now}
+			l.buckets[key] = bucket
+		}
+		if ok, wait := bucket.take(now); !ok {
+			return &RateLimitError{Class: class, Limit: "rate", RetryAfter: wait}
+		}
+	}
+
+	quota.count++
+	return nil
+}
+
+// evict removes buckets which are refilled and quotas of past days so that the
+// limiter does not grow with every DID it has seen
+func (l *RateLimiter) evict(now time.Time) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	for key, quota := range l.quotas {
+		if !quota.day.Equal(today) {
+			delete(l.quotas, key)
+		}
+	}
+	for key, bucket := range l.buckets {
+		if bucket.idle(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.evictedAt = now
+}
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	messaging "github.com/bitmark-inc/autonomy-messaging-go"
+	"github.com/golang/mock/gomock"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandClass(t *testing.T) {
+	assert.Equal(t, commandClassNode, commandClass("bitcoind"))
+	assert.Equal(t, commandClassNode, commandClass("get_bitcoind_status"))
+	assert.Equal(t, commandClassDefault, commandClass("finish_psbt"))
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	viper.Set("rate_limit.minimal.node.rate", 10)
+	viper.Set("rate_limit.minimal.node.daily", 1000)
+	defer viper.Set("rate_limit", nil)
+
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 10, Daily: 1000}, rateLimitConfig(AccessModeMinimal, commandClassNode))
+	assert.Equal(t, RateLimit{}, rateLimitConfig(AccessModeMinimal, commandClassDefault))
+
+	// members are throttled by default if their roles are not configured
+	assert.Equal(t, defaultMemberRateLimit, rateLimitConfig(AccessModeFull, commandClassNode))
+	assert.Equal(t, defaultMemberRateLimit, rateLimitConfig(AccessModeAdmin, commandClassDefault))
+
+	// DIDs which are not members are throttled by default
+	assert.Equal(t, defaultGuestRateLimit, rateLimitConfig(AccessModeNotApplicant, commandClassDefault))
+	viper.Set("rate_limit.guest.default.rate", 2)
+	assert.Equal(t, RateLimit{Rate: 2, Burst: 2}, rateLimitConfig(AccessModeNotApplicant, commandClassDefault))
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	l := NewRateLimiter()
+	l.limit = func(mode AccessMode, class string) RateLimit {
+		if class == commandClassNode {
+			return RateLimit{Rate: 6, Burst: 2}
+		}
+		return RateLimit{}
+	}
+
+	did := "did:key:member"
+	anotherDID := "did:key:another-member"
+	now := time.Now()
+
+	assert.NoError(t, l.Allow(did, 1, AccessModeMinimal, "bitcoind", now))
+	assert.NoError(t, l.Allow(did, 1, AccessModeMinimal, "get_bitcoind_status", now))
+
+	err := l.Allow(did, 1, AccessModeMinimal, "bitcoind", now)
+	assert.Equal(t, &RateLimitError{Class: commandClassNode, Limit: "rate", RetryAfter: 10 * time.Second}, err)
+	assert.EqualError(t, err, "rate limit exceeded. retry after 10 seconds")
+
+	// other devices, DIDs and command classes have their own limits
+	assert.NoError(t, l.Allow(did, 2, AccessModeMinimal, "bitcoind", now))
+	assert.NoError(t, l.Allow(anotherDID, 1, AccessModeMinimal, "bitcoind", now))
+	assert.NoError(t, l.Allow(did, 1, AccessModeMinimal, "list_pending_psbts", now))
+
+	// a token is refilled every 10 seconds
+	err = l.Allow(did, 1, AccessModeMinimal, "bitcoind", now.Add(5*time.Second))
+	assert.Equal(t, 5*time.Second, err.(*RateLimitError).RetryAfter)
+	assert.NoError(t, l.Allow(did, 1, AccessModeMinimal, "bitcoind", now.Add(10*time.Second)))
+}
+
+func TestRateLimiterDailyQuota(t *testing.T) {
+	l := NewRateLimiter()
+	l.limit = func(mode AccessMode, class string) RateLimit {
+		return RateLimit{Daily: 2}
+	}
+
+	did := "did:key:member"
+	now := time.Date(2021, 7, 26, 23, 0, 0, 0, time.UTC)
+
+	assert.NoError(t, l.Allow(did, 1, AccessModeLimited, "bitcoind", now))
+	assert.NoError(t, l.Allow(did, 1, AccessModeLimited, "bitcoind", now))
+
+	err := l.Allow(did, 1, AccessModeLimited, "bitcoind", now)
+	assert.Equal(t, &RateLimitError{Class: commandClassNode, Limit: "daily", RetryAfter: time.Hour}, err)
+	assert.Equal(t, map[string]interface{}{
+		"class":       commandClassNode,
+		"limit":       "daily",
+		"retry_after": int64(3600),
+	}, err.(*RateLimitError).Details())
+
+	// a device does not use up the quota of another device
+	assert.NoError(t, l.Allow(did, 2, AccessModeLimited, "bitcoind", now))
+
+	// the quota is reset on the next UTC day
+	assert.NoError(t, l.Allow(did, 1, AccessModeLimited, "bitcoind", now.Add(time.Hour)))
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l := NewRateLimiter()
+	l.limit = func(mode AccessMode, class string) RateLimit {
+		return RateLimit{Rate: 1, Burst: 1, Daily: 10}
+	}
+
+	now := time.Date(2021, 7, 26, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, l.Allow("did:key:idle", 1, AccessModeMinimal, "bitcoind", now))
+	assert.NoError(t, l.Allow("did:key:busy", 1, AccessModeMinimal, "bitcoind", now.Add(rateLimiterEvictInterval)))
+	assert.Len(t, l.buckets, 1)
+	assert.Len(t, l.quotas, 2)
+
+	// quotas of past days are evicted along with refilled buckets
+	assert.NoError(t, l.Allow("did:key:busy", 1, AccessModeMinimal, "bitcoind", now.Add(24*time.Hour)))
+	assert.Len(t, l.buckets, 1)
+	assert.Len(t, l.quotas, 1)
+	assert.Equal(t, int64(1), l.quotas["did:key:busy#1/"+commandClassNode].count)
+}
+
+func TestRateLimiterMaxEntries(t *testing.T) {
+	l := NewRateLimiter()
+	l.maxEntries = 2
+	l.limit = func(mode AccessMode, class string) RateLimit {
+		return RateLimit{Daily: 2}
+	}
+
+	now := time.Date(2021, 7, 26, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, l.Allow("did:key:guest-1", 1, AccessModeNotApplicant, "bind", now))
+	assert.NoError(t, l.Allow("did:key:guest-2", 1, AccessModeNotApplicant, "bind", now))
+
+	// new DIDs which are not members share a quota once the limiter is full
+	assert.NoError(t, l.Allow("did:key:guest-3", 1, AccessModeNotApplicant, "bind", now))
+	assert.NoError(t, l.Allow("did:key:guest-4", 1, AccessModeNotApplicant, "bind", now))
+	assert.Error(t, l.Allow("did:key:guest-5", 1, AccessModeNotApplicant, "bind", now))
+	assert.Len(t, l.quotas, 3)
+
+	// DIDs seen before keep their own quotas and members are never shared
+	assert.NoError(t, l.Allow("did:key:guest-1", 1, AccessModeNotApplicant, "bind", now))
+	assert.NoError(t, l.Allow("did:key:member", 1, AccessModeMinimal, "bind", now))
+	assert.Len(t, l.quotas, 4)
+}
+
+func TestProcessThrottledRequest(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().HasBinding(ownerDID, gomock.Any()).AnyTimes().Return(true)
+	mockedStore.EXPECT().DelayedTransactions().Times(2).Return([]DelayedTransaction{})
+	// throttled requests are not audited
+	mockedStore.EXPECT().AppendAuditEntry(gomock.Any(), gomock.Any()).Times(2).Return(nil)
+
+	l := NewRateLimiter()
+	l.limit = func(mode AccessMode, class string) RateLimit {
+		return RateLimit{Rate: 1, Burst: 1}
+	}
+
+	c := Controller{ownerDID: ownerDID, Identity: i, store: mockedStore, rateLimiter: l}
+
+	m := &messaging.Message{Source: ownerDID, SourceDevice: 1, Content: []byte(`{"id":"1","command":"list_pending_txs","args":{}}`)}
+	resp := c.Process(m)
+	assert.NotContains(t, string(resp[0]), "error")
+
+	lastActiveTime := c.LastActiveTime
+	resp = c.Process(m)
+
+	var r map[string]interface{}
+	assert.NoError(t, json.Unmarshal(resp[0], &r))
+	assert.Equal(t, "rate_limited", r["code"])
+	assert.Equal(t, float64(60), r["details"].(map[string]interface{})["retry_after"])
+	assert.Equal(t, lastActiveTime, c.LastActiveTime)
+
+	// other devices of the DID have their own limits
+	resp = c.Process(&messaging.Message{Source: ownerDID, SourceDevice: 2, Content: m.Content})
+	assert.NotContains(t, string(resp[0]), "error")
+}
+
+func TestProcessThrottlesNonMembers(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	strangerDID := "did:key:stranger"
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Member(strangerDID).AnyTimes().Return(nil)
+	mockedStore.EXPECT().Invitation(gomock.Any()).AnyTimes().Return(nil)
+	mockedStore.EXPECT().IdentityRotations().AnyTimes().Return(nil)
+	mockedStore.EXPECT().PendingOwnershipTransfer().AnyTimes().Return(nil)
+	// rejected requests are audited with their errors, but throttled ones are not
+	audited := make([]AuditEntry, 0)
+	mockedStore.EXPECT().AppendAuditEntry(gomock.Any(), gomock.Any()).Times(2).DoAndReturn(func(e AuditEntry, _ func(*AuditEntry) error) error {
+		audited = append(audited, e)
+		return nil
+	})
+
+	l := NewRateLimiter()
+	l.limit = func(mode AccessMode, class string) RateLimit {
+		if mode == AccessModeNotApplicant {
+			return RateLimit{Rate: 1, Burst: 2}
+		}
+		return RateLimit{}
+	}
+
+	c := Controller{ownerDID: ownerDID, Identity: i, store: mockedStore, rateLimiter: l}
+
+	for _, command := range []string{
+		`{"id":"1","command":"redeem_invite","args":{"identity":"did:key:pod","nonce":"n1","signature":"00"}}`,
+		`{"id":"2","command":"accept_ownership","args":{}}`,
+		`{"id":"3","command":"list_members","args":{}}`,
+	} {
+		resp := c.Process(&messaging.Message{Source: strangerDID, SourceDevice: 1, Content: []byte(command)})
+		var r map[string]interface{}
+		assert.NoError(t, json.Unmarshal(resp[0], &r))
+		if r["id"] == "3" {
+			assert.Equal(t, "rate_limited", r["code"])
+		} else {
+			assert.NotEqual(t, "rate_limited", r["code"])
+		}
+	}
+
+	// rejected requests do not keep the pod active
+	assert.True(t, c.LastActiveTime.IsZero())
+	assert.Len(t, audited, 2)
+	for i, command := range []string{"redeem_invite", "accept_ownership"} {
+		assert.Equal(t, command, audited[i].Command)
+		assert.Equal(t, auditResultError, audited[i].Result)
+	}
+}
@@ -7,9 +7,24 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
 )
 
+// DetailedError is an error which carries a machine-readable code and details
+// so that clients are able to react to it programmatically
+type DetailedError interface {
+	error
+	Code() string
+	Details() interface{}
+}
+
 func CommandResponse(id string, data interface{}, err error) [][]byte {
 	if err != nil {
 		return [][]byte{ErrorResponse(id, err)}
@@ -17,12 +32,34 @@ func CommandResponse(id string, data interface{}, err error) [][]byte {
 	return [][]byte{ObjectResponse(id, data)}
 }
 
+// ChunkedCommandResponse returns a response for each part of data which is too
+// large to be sent in a message
+func ChunkedCommandResponse(id string, chunks []interface{}, err error) [][]byte {
+	if err != nil {
+		return [][]byte{ErrorResponse(id, err)}
+	}
+
+	responses := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		responses = append(responses, ObjectResponse(id, chunk))
+	}
+	return responses
+}
+
 // ErrorResponse serializes an error into response bytes
 func ErrorResponse(id string, err error) []byte {
-	b, err := json.Marshal(map[string]string{
+	resp := map[string]interface{}{
 		"id":    id,
 		"error": err.Error(),
-	})
+	}
+
+	var detailedErr DetailedError
+	if errors.As(err, &detailedErr) {
+		resp["code"] = detailedErr.Code()
+		resp["details"] = detailedErr.Details()
+	}
+
+	b, err := json.Marshal(resp)
 	if err != nil {
 		panic(fmt.Errorf("error response with error: %s", err.Error()))
 	}
@@ -40,3 +77,33 @@ func ObjectResponse(id string, object interface{}) []byte {
 	}
 	return b
 }
+
+// signResponses wraps responses into envelopes signed by the given pod identity if
+// `response_signature.enabled` is set. An unsigned response is returned if it
+// fails to be signed.
+func (c *Controller) signResponses(signer *PodIdentity, id string, responses [][]byte) [][]byte {
+	if !viper.GetBool("response_signature.enabled") {
+		return responses
+	}
+
+	timestamp := fmt.Sprint(c.now().UnixNano() / int64(time.Millisecond))
+	signed := make([][]byte, 0, len(responses))
+	for _, payload := range responses {
+		b, err := signResponse(signer, id, payload, timestamp)
+		if err != nil {
+			log.WithError(err).WithField("id", id).Error("fail to sign response")
+			b = payload
+		}
+		signed = append(signed, b)
+	}
+	return signed
+}
+
+// signResponse serializes a response envelope signed by a pod identity
+func signResponse(signer *PodIdentity, id string, payload []byte, timestamp string) ([]byte, error) {
+	r, err := key.SignResponse(signer.PrivateKey, id, payload, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(r)
+}
@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	messaging "github.com/bitmark-inc/autonomy-messaging-go"
+	"github.com/golang/mock/gomock"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/key"
+)
+
+func TestSignResponses(t *testing.T) {
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	now := time.Unix(0, 1618456405107*int64(time.Millisecond))
+	c := Controller{Identity: i, clock: func() time.Time { return now }}
+
+	responses := CommandResponse("1", map[string]string{"txid": "1d7c02a6"}, nil)
+
+	// responses are not signed by default
+	assert.Equal(t, responses, c.signResponses(i, "1", responses))
+
+	viper.Set("response_signature.enabled", true)
+	defer viper.Set("response_signature.enabled", false)
+
+	signed := c.signResponses(i, "1", responses)
+	assert.Len(t, signed, 1)
+
+	var r key.SignedResponse
+	assert.NoError(t, json.Unmarshal(signed[0], &r))
+	assert.Equal(t, "1", r.ID)
+	assert.Equal(t, "1618456405107", r.Timestamp)
+	assert.Equal(t, i.DID, r.Signer)
+
+	payload, err := key.VerifyResponse(i.DID, r)
+	assert.NoError(t, err)
+	assert.Equal(t, responses[0], payload)
+
+	// errors are signed as well
+	signed = c.signResponses(i, "2", CommandResponse("2", nil, errors.New("not allowed to use this command")))
+	assert.NoError(t, json.Unmarshal(signed[0], &r))
+	payload, err = key.VerifyResponse(i.DID, r)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"2","error":"not allowed to use this command"}`, string(payload))
+}
+
+func TestProcessSignedResponse(t *testing.T) {
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+	did := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().Member(did).Times(2).Return(nil)
+	mockedStore.EXPECT().AppendAuditEntry(gomock.Any(), gomock.Any()).Times(2).Return(nil)
+
+	viper.Set("response_signature.enabled", true)
+	defer viper.Set("response_signature.enabled", false)
+
+	c := Controller{Identity: i, store: mockedStore}
+
+	resp := c.Process(&messaging.Message{Source: did, SourceDevice: 1, Content: []byte(`{"id":"test","command":"list_members","args":{}}`)})
+
+	var r key.SignedResponse
+	assert.NoError(t, json.Unmarshal(resp[0], &r))
+	payload, err := key.VerifyResponse(i.DID, r)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"test","error":"not allowed to use this command"}`, string(payload))
+
+	// a message sent to a retired identity is answered by the retired identity
+	retired, err := NewPodIdentity()
+	assert.NoError(t, err)
+	resp = c.ProcessAs(retired, &messaging.Message{Source: did, SourceDevice: 1, Content: []byte(`{"id":"test","command":"list_members","args":{}}`)})
+	assert.NoError(t, json.Unmarshal(resp[0], &r))
+	assert.Equal(t, retired.DID, r.Signer)
+	_, err = key.VerifyResponse(retired.DID, r)
+	assert.NoError(t, err)
+	_, err = key.VerifyResponse(i.DID, r)
+	assert.Error(t, err)
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bitcoinRPCParams are the positional parameter names of bitcoind RPCs
+// which are able to be constrained by the ACL policy
+var bitcoinRPCParams = map[string][]string{
+	"getbalances":            {},
+	"getblockchaininfo":      {},
+	"getmininginfo":          {},
+	"getnettotals":           {},
+	"getnetworkinfo":         {},
+	"getnewaddress":          {"label", "address_type"},
+	"getreceivedbyaddress":   {"address", "minconf", "include_immature_coinbase"},
+	"gettransaction":         {"txid", "include_watchonly", "verbose"},
+	"getwalletinfo":          {},
+	"listtransactions":       {"label", "count", "skip", "include_watchonly"},
+	"walletcreatefundedpsbt": {"inputs", "outputs", "locktime", "options", "bip32derivs"},
+}
+
+// ArgumentConstraintError is returned if a parameter of a bitcoind RPC breaks a constraint
+type ArgumentConstraintError struct {
+	Method string
+	Param  string
+	Rule   string
+}
+
+func (e *ArgumentConstraintError) Error() string {
+	return fmt.Sprintf("parameter %s of %s breaks the %s constraint", e.Param, e.Method, e.Rule)
+}
+
+func (e *ArgumentConstraintError) Code() string {
+	return "argument_constraint_violated"
+}
+
+func (e *ArgumentConstraintError) Details() interface{} {
+	return map[string]interface{}{
+		"method": e.Method,
+		"param":  e.Param,
+		"rule":   e.Rule,
+	}
+}
+
+// paramIndex returns the position of a named parameter of a bitcoind RPC.
+// A nested parameter is addressed by a dotted path like `options.replaceable`
+// and its position is the one of the top level parameter.
+func paramIndex(method, param string) int {
+	name := strings.SplitN(param, ".", 2)[0]
+	for i, p := range bitcoinRPCParams[method] {
+		if p == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// validate checks whether a constraint is well-formed for a bitcoind RPC
+func (c ArgumentConstraint) validate(method string) error {
+	if _, ok := bitcoinRPCParams[method]; !ok {
+		return fmt.Errorf("unsupported method")
+	}
+	if paramIndex(method, c.Param) < 0 {
+		return fmt.Errorf("unknown parameter: %s", c.Param)
+	}
+	for _, key := range strings.Split(c.Param, ".") {
+		if key == "" {
+			return fmt.Errorf("invalid parameter path: %s", c.Param)
+		}
+	}
+
+	rules := 0
+	if c.Max != nil {
+		rules++
+	}
+	for _, v := range []interface{}{c.Equals, c.Force} {
+		if v == nil {
+			continue
+		}
+		rules++
+		switch v.(type) {
+		case string, bool, int, float64:
+		default:
+			return fmt.Errorf("parameter %s must equal to a scalar value", c.Param)
+		}
+	}
+	if c.Forbidden {
+		rules++
+	}
+	if rules != 1 {
+		return fmt.Errorf("parameter %s must have exactly one rule", c.Param)
+	}
+	return nil
+}
+
+// apply validates the positional parameters of a bitcoind RPC against the constraint.
+// A parameter of the `force` rule is filled in if it is not given.
+func (c ArgumentConstraint) apply(method string, params []interface{}) ([]interface{}, error) {
+	i := paramIndex(method, c.Param)
+	if i < 0 {
+		return params, nil
+	}
+	path := strings.Split(c.Param, ".")[1:]
+
+	var value interface{}
+	if i < len(params) {
+		value = lookupParam(params[i], path)
+	}
+
+	if value == nil {
+		if c.Force == nil {
+			return params, nil
+		}
+
+		for len(params) <= i {
+			params = append(params, nil)
+		}
+		params[i] = setParam(params[i], path, c.Force)
+		return params, nil
+	}
+
+	switch {
+	case c.Forbidden:
+		return nil, &ArgumentConstraintError{Method: method, Param: c.Param, Rule: "forbidden"}
+	case c.Max != nil:
+		n, ok := toFloat(value)
+		if !ok || n > *c.Max {
+			return nil, &ArgumentConstraintError{Method: method, Param: c.Param, Rule: "max"}
+		}
+	case c.Equals != nil:
+		if !scalarEqual(c.Equals, value) {
+			return nil, &ArgumentConstraintError{Method: method, Param: c.Param, Rule: "equals"}
+		}
+	case c.Force != nil:
+		if !scalarEqual(c.Force, value) {
+			return nil, &ArgumentConstraintError{Method: method, Param: c.Param, Rule: "force"}
+		}
+	}
+	return params, nil
+}
+
+// lookupParam returns the value of a nested parameter. It returns nil if the value is not given.
+func lookupParam(value interface{}, path []string) interface{} {
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// setParam sets the value of a nested parameter and returns the updated parameter
+func setParam(param interface{}, path []string, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	object, ok := param.(map[string]interface{})
+	if !ok {
+		object = make(map[string]interface{})
+	}
+	object[path[0]] = setParam(object[path[0]], path[1:], value)
+	return object
+}
+
+// ApplyBitcoinRPCConstraints validates parameters of a bitcoind RPC against
+// the argument constraints of the ACL policy. It returns the parameters with
+// forced values filled in.
+func ApplyBitcoinRPCConstraints(method string, params []interface{}) ([]interface{}, error) {
+	var err error
+	for _, c := range currentACLPolicy().RPCConstraints[method] {
+		if params, err = c.apply(method, params); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// toFloat converts a number decoded from YAML or JSON to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// scalarEqual compares scalar values regardless of the numeric types
+func scalarEqual(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return a == b
+}
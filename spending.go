@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	spendingDailyPeriod  = 24 * time.Hour
+	spendingWeeklyPeriod = 7 * 24 * time.Hour
+
+	// spendingRecordRetention is how long a spending record is kept. It must
+	// cover the longest spending period.
+	spendingRecordRetention = spendingWeeklyPeriod
+)
+
+// SpendingLimit is the amount of satoshis a DID is allowed to spend.
+// A zero value of a field means there is no such limit.
+type SpendingLimit struct {
+	Daily          int64 `json:"daily"`
+	Weekly         int64 `json:"weekly"`
+	PerTransaction int64 `json:"per_transaction"`
+}
+
+// SpendingLimitError is returned if a transaction breaches a spending limit
+type SpendingLimitError struct {
+	Limit  string
+	Max    int64
+	Spent  int64
+	Amount int64
+}
+
+func (e *SpendingLimitError) Error() string {
+	return fmt.Sprintf("%s spending limit exceeded", e.Limit)
+}
+
+func (e *SpendingLimitError) Code() string {
+	return "spending_limit_exceeded"
+}
+
+func (e *SpendingLimitError) Details() interface{} {
+	remaining := e.Max - e.Spent
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return map[string]interface{}{
+		"limit":     e.Limit,
+		"max":       e.Max,
+		"spent":     e.Spent,
+		"amount":    e.Amount,
+		"remaining": remaining,
+	}
+}
+
+// checkSpendingLimit validates whether a DID is allowed to spend the amount
+func (c *Controller) checkSpendingLimit(did string, amount int64, now time.Time) error {
+	limit, err := c.store.SpendingLimit(did)
+	if err != nil {
+		return err
+	}
+
+	if limit.PerTransaction > 0 && amount > limit.PerTransaction {
+		return &SpendingLimitError{Limit: "per_transaction", Max: limit.PerTransaction, Amount: amount}
+	}
+
+	if limit.Daily > 0 {
+		spent, err := c.store.SpentSince(did, now.Add(-spendingDailyPeriod))
+		if err != nil {
+			return err
+		}
+		if spent+amount > limit.Daily {
+			return &SpendingLimitError{Limit: "daily", Max: limit.Daily, Spent: spent, Amount: amount}
+		}
+	}
+
+	if limit.Weekly > 0 {
+		spent, err := c.store.SpentSince(did, now.Add(-spendingWeeklyPeriod))
+		if err != nil {
+			return err
+		}
+		if spent+amount > limit.Weekly {
+			return &SpendingLimitError{Limit: "weekly", Max: limit.Weekly, Spent: spent, Amount: amount}
+		}
+	}
+
+	return nil
+}
+
+// outgoingAmount returns the amount of satoshis that leaves the wallet which
+// is the total value of outputs minus the change outputs
+func outgoingAmount(tx *wire.MsgTx, isChange func(pkScript []byte) (bool, error)) (int64, error) {
+	var amount int64
+	for _, out := range tx.TxOut {
+		change, err := isChange(out.PkScript)
+		if err != nil {
+			return 0, err
+		}
+		if !change {
+			amount += out.Value
+		}
+	}
+	return amount, nil
+}
+
+// walletChangeChecker returns a function which tells whether an output script
+// is owned by the wallet of the bitcoind. Answers are cached so that a transaction
+// is able to be checked more than once by a single checker.
+func walletChangeChecker(client *rpcclient.Client, params *chaincfg.Params) func(pkScript []byte) (bool, error) {
+	cache := make(map[string]bool)
+	return func(pkScript []byte) (bool, error) {
+		if mine, ok := cache[string(pkScript)]; ok {
+			return mine, nil
+		}
+
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, params)
+		if err != nil || len(addrs) != 1 {
+			// non-standard outputs are never treated as change
+			return false, nil
+		}
+
+		address, _ := json.Marshal(addrs[0].EncodeAddress())
+		r, err := client.RawRequest("getaddressinfo", []json.RawMessage{address})
+		if err != nil {
+			return false, err
+		}
+
+		var addressInfo struct {
+			IsMine bool `json:"ismine"`
+		}
+		if err := json.Unmarshal(r, &addressInfo); err != nil {
+			return false, fmt.Errorf("unexpected response from getaddressinfo: %s", err)
+		}
+		cache[string(pkScript)] = addressInfo.IsMine
+		return addressInfo.IsMine, nil
+	}
+}
+
+// walletChainParams returns the network parameters of the chain of the bitcoind
+func walletChainParams(client *rpcclient.Client) (*chaincfg.Params, error) {
+	blockchainInfo, err := client.GetBlockChainInfo()
+	if err != nil {
+		return nil, err
+	}
+	return chainParams(blockchainInfo.Chain)
+}
+
+// chainParams returns the network parameters of a chain name reported by bitcoind.
+// An unknown chain is refused so that addresses are never decoded for a wrong network.
+func chainParams(chain string) (*chaincfg.Params, error) {
+	switch chain {
+	case "main":
+		return &chaincfg.MainNetParams, nil
+	case "test":
+		return &chaincfg.TestNet3Params, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	default:
+		return nil, fmt.Errorf("unsupported bitcoin network: %s", chain)
+	}
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutgoingAmount(t *testing.T) {
+	changeScript := []byte{0x00, 0x14, 0x01}
+	tx := wire.NewMsgTx(2)
+	tx.AddTxOut(wire.NewTxOut(10000, []byte{0x00, 0x14, 0x02}))
+	tx.AddTxOut(wire.NewTxOut(2500, []byte{0x00, 0x14, 0x03}))
+	tx.AddTxOut(wire.NewTxOut(50000, changeScript))
+
+	amount, err := outgoingAmount(tx, func(pkScript []byte) (bool, error) {
+		return bytes.Equal(pkScript, changeScript), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12500), amount)
+
+	_, err = outgoingAmount(tx, func(pkScript []byte) (bool, error) {
+		return false, errors.New("rpc error")
+	})
+	assert.EqualError(t, err, "rpc error")
+}
+
+func TestChainParams(t *testing.T) {
+	params, err := chainParams("main")
+	assert.NoError(t, err)
+	assert.Equal(t, &chaincfg.MainNetParams, params)
+
+	params, err = chainParams("regtest")
+	assert.NoError(t, err)
+	assert.Equal(t, &chaincfg.RegressionNetParams, params)
+
+	// an unknown network is never treated as mainnet
+	_, err = chainParams("signet")
+	assert.EqualError(t, err, "unsupported bitcoin network: signet")
+}
+
+func TestCheckSpendingLimit(t *testing.T) {
+	did := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	didWithWeeklyLimit := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	didWithoutLimit := "did:key:zQ3shvtd8SgRF7UBHzJsnH1Qu2MKgEMBRujEfr4wp5a171Vv4"
+	now := time.Now()
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().SpendingLimit(did).AnyTimes().Return(SpendingLimit{Daily: 100000, Weekly: 300000, PerTransaction: 50000}, nil)
+	mockedStore.EXPECT().SpendingLimit(didWithWeeklyLimit).AnyTimes().Return(SpendingLimit{Weekly: 300000}, nil)
+	mockedStore.EXPECT().SpendingLimit(didWithoutLimit).AnyTimes().Return(SpendingLimit{}, nil)
+	mockedStore.EXPECT().SpentSince(did, now.Add(-spendingDailyPeriod)).AnyTimes().Return(int64(80000), nil)
+	mockedStore.EXPECT().SpentSince(did, now.Add(-spendingWeeklyPeriod)).AnyTimes().Return(int64(280000), nil)
+	mockedStore.EXPECT().SpentSince(didWithWeeklyLimit, now.Add(-spendingWeeklyPeriod)).AnyTimes().Return(int64(280000), nil)
+
+	c := Controller{store: mockedStore}
+
+	assert.NoError(t, c.checkSpendingLimit(did, 10000, now))
+	assert.NoError(t, c.checkSpendingLimit(didWithoutLimit, 100000000, now))
+
+	err := c.checkSpendingLimit(did, 60000, now)
+	assert.EqualError(t, err, "per_transaction spending limit exceeded")
+
+	err = c.checkSpendingLimit(did, 30000, now)
+	assert.EqualError(t, err, "daily spending limit exceeded")
+	var limitErr *SpendingLimitError
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, map[string]interface{}{
+		"limit":     "daily",
+		"max":       int64(100000),
+		"spent":     int64(80000),
+		"amount":    int64(30000),
+		"remaining": int64(20000),
+	}, limitErr.Details())
+
+	// spending exactly the remaining amount is allowed
+	assert.NoError(t, c.checkSpendingLimit(did, 20000, now))
+
+	err = c.checkSpendingLimit(didWithWeeklyLimit, 30000, now)
+	assert.EqualError(t, err, "weekly spending limit exceeded")
+}
+
+func TestGetSpendingLimitByControllerClock(t *testing.T) {
+	did := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	store := NewMemoryStore()
+	assert.NoError(t, store.SetSpendingLimit(did, SpendingLimit{Daily: 10000}))
+	assert.NoError(t, store.AddSpending(did, 1000, now.Add(-2*time.Hour), "txid-1"))
+	assert.NoError(t, store.AddSpending(did, 2000, now.Add(-2*24*time.Hour), "txid-2"))
+
+	c := Controller{store: store, clock: func() time.Time { return now }}
+
+	r, err := c.getSpendingLimit(did)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), r["spent_daily"])
+	assert.Equal(t, int64(3000), r["spent_weekly"])
+}
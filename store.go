@@ -8,6 +8,14 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -16,108 +24,1300 @@ var (
 	bucketBinding = []byte("bindings")
 	bucketMember  = []byte("members")
 
-	valueTrue  = []byte("true")
-	valueFalse = []byte("false")
+	bucketMemberRPCPolicy  = []byte("member_rpc_policies")
+	bucketSpendingLimit    = []byte("spending_limits")
+	bucketSpending         = []byte("spendings")
+	bucketTrustedAddress   = []byte("trusted_addresses")
+	bucketPendingApproval  = []byte("pending_approvals")
+	bucketDelayedTx        = []byte("delayed_transactions")
+	bucketOwnership        = []byte("ownership")
+	bucketOwnershipEvent   = []byte("ownership_events")
+	bucketInvitation       = []byte("invitations")
+	bucketCommandCounter   = []byte("command_counters")
+	bucketAuditLog         = []byte("audit_log")
+	bucketIdentityRotation = []byte("identity_rotations")
+
+	keyOwner                    = []byte("owner")
+	keyPendingOwnershipTransfer = []byte("pending_transfer")
+	keyAuditLogAnchor           = []byte("audit_log_anchor")
+	keyAuditLogHead             = []byte("audit_log_head")
 )
 
+// ErrStaleCommandCounter is returned if a command counter is not greater than the last one
+var ErrStaleCommandCounter = errors.New("stale command counter")
+
 type Store interface {
-	SetBinding(did, nonce string) error
-	BindingNonce(did string) string
-	CompleteBinding(did string) error
-	HasBinding(did string) bool
-	UpdateMemberAccessMode(memberDID string, accessMode AccessMode) error
+	SaveBindingSession(did string, device uint32, session BindingSession) error
+	BindingSession(did string, device uint32) *BindingSession
+	HasBinding(did string, device uint32) bool
+	Bindings() []DeviceBinding
+	DeviceBindings(did string) []DeviceBinding
+	RemoveBinding(did string, device uint32) error
+	RevokeBinding(did string, device uint32) error
+	SaveMember(member Member) error
+	Member(memberDID string) *Member
+	Members() []Member
+	TouchMember(memberDID string, activeAt time.Time) error
+	RemoveExpiredMembers(now time.Time) ([]Member, error)
 	RemoveMember(memberDID string) error
 	MemberAccessMode(memberDID string) AccessMode
+	SetMemberRPCPolicy(memberDID string, methods []string) error
+	MemberRPCPolicy(memberDID string) ([]string, error)
+	SetSpendingLimit(did string, limit SpendingLimit) error
+	SpendingLimit(did string) (SpendingLimit, error)
+	AddSpending(did string, amount int64, spentAt time.Time, txID string) error
+	RemoveSpending(did string, spentAt time.Time, txID string) error
+	SpentSince(did string, since time.Time) (int64, error)
+	AddTrustedAddress(address TrustedAddress) error
+	RemoveTrustedAddress(address string) error
+	IsTrustedAddress(address string) bool
+	TrustedAddresses() []TrustedAddress
+	SavePendingApproval(approval PendingApproval) error
+	PendingApproval(txID string) *PendingApproval
+	PendingApprovals() []PendingApproval
+	RemovePendingApproval(txID string) error
+	SaveDelayedTransaction(tx DelayedTransaction) error
+	DelayedTransaction(txID string) *DelayedTransaction
+	DelayedTransactions() []DelayedTransaction
+	RemoveDelayedTransaction(txID string) error
+	Owner() (string, error)
+	SetPendingOwnershipTransfer(transfer OwnershipTransfer) error
+	PendingOwnershipTransfer() *OwnershipTransfer
+	RemovePendingOwnershipTransfer() error
+	TransferOwnership(event OwnershipEvent) error
+	AddOwnershipEvent(event OwnershipEvent) error
+	OwnershipEvents() []OwnershipEvent
+	SaveInvitation(invitation Invitation) error
+	Invitation(nonce string) *Invitation
+	Invitations() []Invitation
+	CommandCounter(did string, device uint32) uint64
+	AdvanceCommandCounter(did string, device uint32, counter uint64) error
+	AppendAuditEntry(entry AuditEntry, seal func(*AuditEntry) error) error
+	AuditEntries(query AuditQuery) []AuditEntry
+	TrimAuditLog(maxEntries int) (int, error)
+	AuditLogAnchor() AuditAnchor
+	AuditLogHead() AuditHead
+	WriteSnapshot(w io.Writer, maxAuditEntries int) error
+	RotateIdentity(rotation IdentityRotation, keyMaterial []byte) error
+	IdentityRotations() []IdentityRotation
 }
 
 type BoltStore struct {
-	db *bolt.DB
+	db     *bolt.DB
+	cipher *storeCipher
+	kek    []byte
 }
 
-func NewBoltStore(path string) *BoltStore {
-	db, err := bolt.Open(path, 0666, nil)
+// NewBoltStore opens the store at the path and migrates it to the latest schema.
+// Values are sealed by a data encryption key, which is kept wrapped by a key
+// encryption key derived from the key material.
+func NewBoltStore(path string, keyMaterial []byte) *BoltStore {
+	s, err := openBoltStore(path, keyMaterial)
 	if err != nil {
 		panic(err)
 	}
+	return s
+}
+
+func openBoltStore(path string, keyMaterial []byte) (*BoltStore, error) {
+	kek, err := deriveStoreKEK(keyMaterial)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var version uint64
+	db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	if err := migrate(db, kek); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// plaintext values are left in free pages and backups of a store migrated
+	// from a version without encryption
+	if version < encryptedSchemaVersion {
+		if db, err = compactStore(db); err != nil {
+			return nil, err
+		}
+		removePlaintextBackups(path)
+	}
+
+	var c *storeCipher
+	if err := db.View(func(tx *bolt.Tx) error {
+		c, err = loadStoreCipher(tx, kek)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db, c, kek}, nil
+}
+
+// bucket returns a bucket which seals and opens its values by the store cipher
+func (s *BoltStore) bucket(tx *bolt.Tx, name []byte) *sealedBucket {
+	return &sealedBucket{tx.Bucket(name), name, s.cipher}
+}
+
+// SaveBindingSession creates or updates the binding session of a device of a DID
+func (s *BoltStore) SaveBindingSession(did string, device uint32, session BindingSession) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketBinding)
+		v, err := encodeBindingSession(session)
+		if err != nil {
+			return err
+		}
+		return b.Put(bindingKey(did, device), v)
+	})
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(bucketBinding); err != nil {
+// BindingSession returns the binding session of a device of a DID.
+// It returns nil if the device has never started binding.
+func (s *BoltStore) BindingSession(did string, device uint32) *BindingSession {
+	var session *BindingSession
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketBinding)
+		v, err := b.Get(bindingKey(did, device))
+		if err != nil {
 			return err
 		}
-		if _, err := tx.CreateBucketIfNotExists(bucketMember); err != nil {
+		if v == nil {
+			return nil
+		}
+
+		bs, err := decodeBindingSession(v)
+		if err != nil {
 			return err
 		}
+		session = bs
 		return nil
 	})
-	if err != nil {
-		panic(err)
-	}
+	return session
+}
 
-	return &BoltStore{db}
+func (s *BoltStore) HasBinding(did string, device uint32) bool {
+	session := s.BindingSession(did, device)
+	return session != nil && session.Bound
 }
 
-func (s *BoltStore) SetBinding(did, nonce string) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketBinding)
-		return b.Put([]byte(did), []byte(nonce))
+// Bindings returns binding sessions of all devices which have started binding
+func (s *BoltStore) Bindings() []DeviceBinding {
+	bindings := make([]DeviceBinding, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketBinding)
+		return b.ForEach(func(k, v []byte) error {
+			binding, err := decodeDeviceBinding(k, v)
+			if err != nil {
+				return err
+			}
+			bindings = append(bindings, *binding)
+			return nil
+		})
 	})
+	return bindings
 }
 
-func (s *BoltStore) BindingNonce(did string) string {
-	var nonce string
+// DeviceBindings returns binding sessions of all devices of a DID
+func (s *BoltStore) DeviceBindings(did string) []DeviceBinding {
+	bindings := make([]DeviceBinding, 0)
 	s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketBinding)
-		nonce = string(b.Get([]byte(did)))
-		return nil
+		var err error
+		bindings, err = s.deviceBindings(tx, did)
+		return err
+	})
+	return bindings
+}
+
+// RemoveBinding deletes the binding session of a device of a DID along with
+// its command counter
+func (s *BoltStore) RemoveBinding(did string, device uint32) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.bucket(tx, bucketCommandCounter).Delete(bindingKey(did, device)); err != nil {
+			return err
+		}
+		b := s.bucket(tx, bucketBinding)
+		return b.Delete(bindingKey(did, device))
+	})
+}
+
+// RevokeBinding deletes the binding session and the command counter of a device of
+// a DID. All devices of the DID are revoked if the device is 0. Once the DID has no
+// device left, its member record, its custom bitcoind RPC allow list and its pending
+// approvals are removed as well, and its votes on PSBTs submitted by others are
+// withdrawn.
+func (s *BoltStore) RevokeBinding(did string, device uint32) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bindings, err := s.deviceBindings(tx, did)
+		if err != nil {
+			return err
+		}
+
+		remaining := 0
+		for _, binding := range bindings {
+			if device != 0 && binding.Device != device {
+				remaining++
+				continue
+			}
+			if err := s.bucket(tx, bucketBinding).Delete(bindingKey(did, binding.Device)); err != nil {
+				return err
+			}
+		}
+		if err := s.removeCommandCounters(tx, did, device); err != nil {
+			return err
+		}
+		if remaining > 0 {
+			return nil
+		}
+
+		if err := s.bucket(tx, bucketMember).Delete([]byte(did)); err != nil {
+			return err
+		}
+		if err := s.bucket(tx, bucketMemberRPCPolicy).Delete([]byte(did)); err != nil {
+			return err
+		}
+		return s.removePendingApprovalsOf(tx, did)
 	})
-	return nonce
 }
 
-func (s *BoltStore) CompleteBinding(did string) error {
+// deviceBindings returns binding sessions of all devices of a DID within a transaction
+func (s *BoltStore) deviceBindings(tx *bolt.Tx, did string) ([]DeviceBinding, error) {
+	bindings := make([]DeviceBinding, 0)
+	prefix := bindingKeyPrefix(did)
+
+	c := s.bucket(tx, bucketBinding).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		binding, err := decodeDeviceBinding(k, v)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, *binding)
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// removeCommandCounters removes the command counter of a device of a DID, or
+// counters of all its devices if the device is 0
+func (s *BoltStore) removeCommandCounters(tx *bolt.Tx, did string, device uint32) error {
+	b := s.bucket(tx, bucketCommandCounter)
+	if device != 0 {
+		return b.Delete(bindingKey(did, device))
+	}
+
+	prefix := bindingKeyPrefix(did)
+	keys := make([][]byte, 0)
+	c := b.Bucket.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePendingApprovalsOf removes pending PSBTs submitted by a DID and withdraws
+// its votes on PSBTs submitted by others
+func (s *BoltStore) removePendingApprovalsOf(tx *bolt.Tx, did string) error {
+	b := s.bucket(tx, bucketPendingApproval)
+	removed := make([][]byte, 0)
+	updated := make(map[string][]byte)
+	if err := b.ForEach(func(k, v []byte) error {
+		var approval PendingApproval
+		if err := json.Unmarshal(v, &approval); err != nil {
+			return err
+		}
+
+		if approval.Submitter == did {
+			removed = append(removed, append([]byte{}, k...))
+			return nil
+		}
+
+		if approval.withdrawVotes(did) {
+			v, err := json.Marshal(approval)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = v
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// a bucket must not be modified while iterating it
+	for _, k := range removed {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	for k, v := range updated {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveMember creates or updates a member
+func (s *BoltStore) SaveMember(member Member) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketBinding)
-		return b.Put([]byte(did), valueTrue)
+		b := s.bucket(tx, bucketMember)
+		v, err := encodeMember(member)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(member.DID), v)
 	})
 }
 
-func (s *BoltStore) HasBinding(did string) bool {
-	var bound bool
+// Member returns a member by its DID. It returns nil if the member is not found.
+func (s *BoltStore) Member(memberDID string) *Member {
+	var member *Member
 	s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketBinding)
-		v := b.Get([]byte(did))
-		bound = bytes.Equal(v, valueTrue)
+		b := s.bucket(tx, bucketMember)
+		v, err := b.Get([]byte(memberDID))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return nil
+		}
+
+		m, err := decodeMember(memberDID, v)
+		if err != nil {
+			return err
+		}
+		member = m
 		return nil
 	})
-	return bound
+	return member
+}
+
+// Members returns all members
+func (s *BoltStore) Members() []Member {
+	members := make([]Member, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketMember)
+		return b.ForEach(func(k, v []byte) error {
+			m, err := decodeMember(string(k), v)
+			if err != nil {
+				return err
+			}
+			members = append(members, *m)
+			return nil
+		})
+	})
+	return members
 }
 
-func (s *BoltStore) UpdateMemberAccessMode(memberDID string, accessMode AccessMode) error {
+// TouchMember updates the last active time of a member
+func (s *BoltStore) TouchMember(memberDID string, activeAt time.Time) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketMember)
-		v := make([]byte, 8)
-		binary.BigEndian.PutUint64(v, uint64(accessMode))
+		b := s.bucket(tx, bucketMember)
+		v, err := b.Get([]byte(memberDID))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return nil
+		}
+
+		m, err := decodeMember(memberDID, v)
+		if err != nil {
+			return err
+		}
+		m.LastActiveAt = &activeAt
+
+		if v, err = encodeMember(*m); err != nil {
+			return err
+		}
 		return b.Put([]byte(memberDID), v)
 	})
 }
 
 func (s *BoltStore) RemoveMember(memberDID string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketMember)
+		if err := s.bucket(tx, bucketMemberRPCPolicy).Delete([]byte(memberDID)); err != nil {
+			return err
+		}
+		b := s.bucket(tx, bucketMember)
 		return b.Delete([]byte(memberDID))
 	})
 }
 
+// RemoveExpiredMembers removes members which are expired at the given time
+// along with their custom bitcoind RPC allow lists. It returns the removed members.
+func (s *BoltStore) RemoveExpiredMembers(now time.Time) ([]Member, error) {
+	expired := make([]Member, 0)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketMember)
+		if err := b.ForEach(func(k, v []byte) error {
+			m, err := decodeMember(string(k), v)
+			if err != nil {
+				return err
+			}
+			if m.Expired(now) {
+				expired = append(expired, *m)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, m := range expired {
+			if err := s.bucket(tx, bucketMemberRPCPolicy).Delete([]byte(m.DID)); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte(m.DID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
 func (s *BoltStore) MemberAccessMode(memberDID string) AccessMode {
-	var mode AccessMode
+	if m := s.Member(memberDID); m != nil {
+		return m.AccessMode
+	}
+	return AccessModeNotApplicant
+}
+
+// SetMemberRPCPolicy saves the custom bitcoind RPC allow list of a member.
+// An empty list removes the custom allow list.
+func (s *BoltStore) SetMemberRPCPolicy(memberDID string, methods []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketMemberRPCPolicy)
+		if len(methods) == 0 {
+			return b.Delete([]byte(memberDID))
+		}
+
+		v, err := json.Marshal(methods)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(memberDID), v)
+	})
+}
+
+// MemberRPCPolicy returns the custom bitcoind RPC allow list of a member.
+// It returns nil if the member does not have one.
+func (s *BoltStore) MemberRPCPolicy(memberDID string) ([]string, error) {
+	var methods []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketMemberRPCPolicy)
+		v, err := b.Get([]byte(memberDID))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &methods)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// SetSpendingLimit saves the spending limit of a DID
+func (s *BoltStore) SetSpendingLimit(did string, limit SpendingLimit) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketSpendingLimit)
+		v, err := json.Marshal(limit)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(did), v)
+	})
+}
+
+// SpendingLimit returns the spending limit of a DID. A DID without
+// a spending limit gets a zero value which means no limit.
+func (s *BoltStore) SpendingLimit(did string) (SpendingLimit, error) {
+	var limit SpendingLimit
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketSpendingLimit)
+		v, err := b.Get([]byte(did))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &limit)
+	})
+	if err != nil {
+		return SpendingLimit{}, err
+	}
+	return limit, nil
+}
+
+// spendingKeyPrefix returns the key prefix of spending records of a DID
+func spendingKeyPrefix(did string) []byte {
+	return append([]byte(did), 0)
+}
+
+// spendingKey returns the key of a spending record which is the DID followed
+// by the spending time so that records of a DID are sorted by time. The txid
+// keeps records of transactions spent at the same time apart.
+func spendingKey(did string, t time.Time, txID string) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return append(append(spendingKeyPrefix(did), k...), txID...)
+}
+
+// AddSpending records an amount spent by a DID. Records older than
+// the longest spending period are pruned at the same time.
+func (s *BoltStore) AddSpending(did string, amount int64, spentAt time.Time, txID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketSpending)
+
+		prefix := spendingKeyPrefix(did)
+		expiredKey := spendingKey(did, spentAt.Add(-spendingRecordRetention), "")
+		expiredKeys := make([][]byte, 0)
+		c := b.Bucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, expiredKey) < 0; k, _ = c.Next() {
+			expiredKeys = append(expiredKeys, k)
+		}
+		for _, k := range expiredKeys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(amount))
+		return b.Put(spendingKey(did, spentAt, txID), v)
+	})
+}
+
+// RemoveSpending removes the spending record of a transaction spent by a DID at the
+// given time so that the amount is no longer counted against the spending limit
+func (s *BoltStore) RemoveSpending(did string, spentAt time.Time, txID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketSpending)
+		k := spendingKey(did, spentAt, txID)
+		if b.Bucket.Get(k) == nil {
+			// records added before they are keyed by txid
+			k = spendingKey(did, spentAt, "")
+		}
+		return b.Delete(k)
+	})
+}
+
+// SpentSince returns the total amount spent by a DID since the given time
+func (s *BoltStore) SpentSince(did string, since time.Time) (int64, error) {
+	var total int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := spendingKeyPrefix(did)
+		c := s.bucket(tx, bucketSpending).Cursor()
+		for k, v := c.Seek(spendingKey(did, since, "")); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			total += int64(binary.BigEndian.Uint64(v))
+		}
+		return c.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// AddTrustedAddress saves an address into the address book
+func (s *BoltStore) AddTrustedAddress(address TrustedAddress) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketTrustedAddress)
+		v, err := json.Marshal(address)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(address.Address), v)
+	})
+}
+
+// RemoveTrustedAddress deletes an address from the address book
+func (s *BoltStore) RemoveTrustedAddress(address string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketTrustedAddress)
+		return b.Delete([]byte(address))
+	})
+}
+
+// IsTrustedAddress returns whether an address is in the address book
+func (s *BoltStore) IsTrustedAddress(address string) bool {
+	var trusted bool
+	s.db.View(func(tx *bolt.Tx) error {
+		v, err := s.bucket(tx, bucketTrustedAddress).Get([]byte(address))
+		trusted = err == nil && v != nil
+		return err
+	})
+	return trusted
+}
+
+// TrustedAddresses returns all addresses in the address book
+func (s *BoltStore) TrustedAddresses() []TrustedAddress {
+	addresses := make([]TrustedAddress, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketTrustedAddress)
+		return b.ForEach(func(k, v []byte) error {
+			var address TrustedAddress
+			if err := json.Unmarshal(v, &address); err != nil {
+				return err
+			}
+			addresses = append(addresses, address)
+			return nil
+		})
+	})
+	return addresses
+}
+
+// SavePendingApproval saves a PSBT which is waiting for approvals
+func (s *BoltStore) SavePendingApproval(approval PendingApproval) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketPendingApproval)
+		v, err := json.Marshal(approval)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(approval.TxID), v)
+	})
+}
+
+// PendingApproval returns a pending PSBT by its unsigned txid.
+// It returns nil if the PSBT is not found.
+func (s *BoltStore) PendingApproval(txID string) *PendingApproval {
+	var approval *PendingApproval
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketPendingApproval)
+		v, err := b.Get([]byte(txID))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return nil
+		}
+
+		var a PendingApproval
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		approval = &a
+		return nil
+	})
+	return approval
+}
+
+// PendingApprovals returns all PSBTs which are waiting for approvals
+func (s *BoltStore) PendingApprovals() []PendingApproval {
+	approvals := make([]PendingApproval, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketPendingApproval)
+		return b.ForEach(func(k, v []byte) error {
+			var approval PendingApproval
+			if err := json.Unmarshal(v, &approval); err != nil {
+				return err
+			}
+			approvals = append(approvals, approval)
+			return nil
+		})
+	})
+	return approvals
+}
+
+// RemovePendingApproval deletes a pending PSBT
+func (s *BoltStore) RemovePendingApproval(txID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketPendingApproval)
+		return b.Delete([]byte(txID))
+	})
+}
+
+// SaveDelayedTransaction saves a signed transaction into the vault
+func (s *BoltStore) SaveDelayedTransaction(delayedTx DelayedTransaction) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketDelayedTx)
+		v, err := json.Marshal(delayedTx)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(delayedTx.TxID), v)
+	})
+}
+
+// DelayedTransaction returns a transaction in the vault by its txid.
+// It returns nil if the transaction is not found.
+func (s *BoltStore) DelayedTransaction(txID string) *DelayedTransaction {
+	var delayedTx *DelayedTransaction
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketDelayedTx)
+		v, err := b.Get([]byte(txID))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return nil
+		}
+
+		var t DelayedTransaction
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		delayedTx = &t
+		return nil
+	})
+	return delayedTx
+}
+
+// DelayedTransactions returns all transactions in the vault
+func (s *BoltStore) DelayedTransactions() []DelayedTransaction {
+	delayedTxs := make([]DelayedTransaction, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketDelayedTx)
+		return b.ForEach(func(k, v []byte) error {
+			var t DelayedTransaction
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			delayedTxs = append(delayedTxs, t)
+			return nil
+		})
+	})
+	return delayedTxs
+}
+
+// RemoveDelayedTransaction deletes a transaction from the vault
+func (s *BoltStore) RemoveDelayedTransaction(txID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketDelayedTx)
+		return b.Delete([]byte(txID))
+	})
+}
+
+// Owner returns the owner DID set by an ownership transfer.
+// It returns an empty string if the ownership has never been transferred.
+func (s *BoltStore) Owner() (string, error) {
+	var owner string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v, err := s.bucket(tx, bucketOwnership).Get(keyOwner)
+		if err != nil {
+			return err
+		}
+		owner = string(v)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return owner, nil
+}
+
+// SetPendingOwnershipTransfer saves an ownership transfer waiting for the acceptance
+// of the new owner. It replaces the previous pending transfer.
+func (s *BoltStore) SetPendingOwnershipTransfer(transfer OwnershipTransfer) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketOwnership)
+		v, err := json.Marshal(transfer)
+		if err != nil {
+			return err
+		}
+		return b.Put(keyPendingOwnershipTransfer, v)
+	})
+}
+
+// PendingOwnershipTransfer returns the ownership transfer waiting for acceptance.
+// It returns nil if there is no pending transfer.
+func (s *BoltStore) PendingOwnershipTransfer() *OwnershipTransfer {
+	var transfer *OwnershipTransfer
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketOwnership)
+		v, err := b.Get(keyPendingOwnershipTransfer)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return nil
+		}
+
+		var t OwnershipTransfer
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		transfer = &t
+		return nil
+	})
+	return transfer
+}
+
+// RemovePendingOwnershipTransfer deletes the ownership transfer waiting for acceptance
+func (s *BoltStore) RemovePendingOwnershipTransfer() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketOwnership)
+		return b.Delete(keyPendingOwnershipTransfer)
+	})
+}
+
+// TransferOwnership sets the new owner of the event, drops the pending transfer
+// and appends the event to the ownership audit trail in a single transaction
+func (s *BoltStore) TransferOwnership(event OwnershipEvent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketOwnership)
+		if err := b.Put(keyOwner, []byte(event.NewOwner)); err != nil {
+			return err
+		}
+		if err := b.Delete(keyPendingOwnershipTransfer); err != nil {
+			return err
+		}
+		return s.putOwnershipEvent(tx, event)
+	})
+}
+
+// AddOwnershipEvent appends an event to the ownership audit trail
+func (s *BoltStore) AddOwnershipEvent(event OwnershipEvent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.putOwnershipEvent(tx, event)
+	})
+}
+
+// OwnershipEvents returns the ownership audit trail in chronological order
+func (s *BoltStore) OwnershipEvents() []OwnershipEvent {
+	events := make([]OwnershipEvent, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketOwnershipEvent)
+		return b.ForEach(func(k, v []byte) error {
+			var e OwnershipEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			events = append(events, e)
+			return nil
+		})
+	})
+	return events
+}
+
+// SaveInvitation creates or updates an invitation
+func (s *BoltStore) SaveInvitation(invitation Invitation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketInvitation)
+		v, err := json.Marshal(invitation)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(invitation.Nonce), v)
+	})
+}
+
+// Invitation returns an invitation by its nonce.
+// It returns nil if the invitation is not found.
+func (s *BoltStore) Invitation(nonce string) *Invitation {
+	var invitation *Invitation
 	s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketMember)
-		v := b.Get([]byte(memberDID))
+		b := s.bucket(tx, bucketInvitation)
+		v, err := b.Get([]byte(nonce))
+		if err != nil {
+			return err
+		}
 		if v == nil {
-			mode = AccessModeNotApplicant
-		} else {
-			mode = AccessMode(binary.BigEndian.Uint64(v))
+			return nil
+		}
+
+		var i Invitation
+		if err := json.Unmarshal(v, &i); err != nil {
+			return err
 		}
+		invitation = &i
 		return nil
 	})
-	return mode
+	return invitation
+}
+
+// Invitations returns all invitations
+func (s *BoltStore) Invitations() []Invitation {
+	invitations := make([]Invitation, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketInvitation)
+		return b.ForEach(func(k, v []byte) error {
+			var i Invitation
+			if err := json.Unmarshal(v, &i); err != nil {
+				return err
+			}
+			invitations = append(invitations, i)
+			return nil
+		})
+	})
+	return invitations
+}
+
+// putOwnershipEvent appends an ownership event keyed by the bucket sequence
+func (s *BoltStore) putOwnershipEvent(tx *bolt.Tx, event OwnershipEvent) error {
+	b := s.bucket(tx, bucketOwnershipEvent)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	v, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return b.Put(k, v)
+}
+
+// CommandCounter returns the last command counter of a device of a DID.
+// It returns 0 if the device has never sent a signed command.
+func (s *BoltStore) CommandCounter(did string, device uint32) uint64 {
+	var counter uint64
+	s.db.View(func(tx *bolt.Tx) error {
+		v, err := s.bucket(tx, bucketCommandCounter).Get(bindingKey(did, device))
+		if len(v) == 8 {
+			counter = binary.BigEndian.Uint64(v)
+		}
+		return err
+	})
+	return counter
+}
+
+// AdvanceCommandCounter updates the command counter of a device of a DID. It returns
+// ErrStaleCommandCounter if the counter is not greater than the last one.
+func (s *BoltStore) AdvanceCommandCounter(did string, device uint32, counter uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketCommandCounter)
+		k := bindingKey(did, device)
+		if v, err := b.Get(k); err != nil {
+			return err
+		} else if len(v) == 8 && counter <= binary.BigEndian.Uint64(v) {
+			return ErrStaleCommandCounter
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, counter)
+		return b.Put(k, v)
+	})
+}
+
+// auditKey returns the key of an audit entry which is its big-endian sequence number
+func auditKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// AppendAuditEntry appends an entry to the audit log. The sequence number and the
+// previous hash of the entry are set from the head of the log, and then the entry is
+// sealed by the given function before it is saved along with the new head. A log
+// without a head continues from the last entry, and the previous hash is left empty
+// if the last entry is not readable.
+func (s *BoltStore) AppendAuditEntry(entry AuditEntry, seal func(*AuditEntry) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketAuditLog)
+
+		anchor := s.auditLogAnchor(tx)
+		entry.Seq = anchor.Seq + 1
+		entry.PrevHash = anchor.Hash
+		if head := s.auditLogHead(tx); head.Seq > 0 {
+			entry.Seq = head.Seq + 1
+			entry.PrevHash = head.Hash
+		} else if k, v := b.Bucket.Cursor().Last(); k != nil {
+			entry.Seq = binary.BigEndian.Uint64(k) + 1
+
+			var last AuditEntry
+			if v, err := b.open(k, v); err == nil && json.Unmarshal(v, &last) == nil {
+				entry.PrevHash = last.Hash
+			}
+		}
+
+		if err := seal(&entry); err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(auditKey(entry.Seq), v); err != nil {
+			return err
+		}
+
+		head, err := json.Marshal(auditHeadOf(entry))
+		if err != nil {
+			return err
+		}
+		return s.bucket(tx, bucketMetadata).Put(keyAuditLogHead, head)
+	})
+}
+
+// auditHeadOf returns the head of the audit log whose last entry is the given one
+func auditHeadOf(e AuditEntry) AuditHead {
+	return AuditHead{Seq: e.Seq, Hash: e.Hash, Signer: e.Signer, Signature: e.Signature}
+}
+
+// AuditEntries returns entries of the audit log which match the query. Entries which
+// fail to open are skipped so that the verification of the log reports them.
+func (s *BoltStore) AuditEntries(query AuditQuery) []AuditEntry {
+	entries := make([]AuditEntry, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketAuditLog)
+		c := b.Bucket.Cursor()
+		for k, v := c.Seek(auditKey(query.AfterSeq + 1)); k != nil; k, v = c.Next() {
+			v, err := b.open(k, v)
+			if err != nil {
+				continue
+			}
+
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !query.Match(e) {
+				continue
+			}
+
+			entries = append(entries, e)
+			if query.Limit > 0 && len(entries) >= query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return entries
+}
+
+// TrimAuditLog removes the oldest entries of the audit log so that at most maxEntries
+// entries are kept. The last removed entry is kept as the anchor of the remaining
+// entries. It returns the number of removed entries.
+func (s *BoltStore) TrimAuditLog(maxEntries int) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketAuditLog)
+		c := b.Bucket.Cursor()
+		first, _ := c.First()
+		last, _ := c.Last()
+		if first == nil {
+			return nil
+		}
+
+		n := binary.BigEndian.Uint64(last) - binary.BigEndian.Uint64(first) + 1
+		if n <= uint64(maxEntries) {
+			return nil
+		}
+
+		var anchor AuditAnchor
+		for k, v := c.First(); k != nil && n > uint64(maxEntries); k, v = c.First() {
+			var e AuditEntry
+			if v, err := b.open(k, v); err != nil || json.Unmarshal(v, &e) != nil {
+				return fmt.Errorf("fail to read audit entry %d", binary.BigEndian.Uint64(k))
+			}
+			anchor = AuditAnchor{Seq: e.Seq, Hash: e.Hash}
+
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n--
+			removed++
+		}
+
+		v, err := json.Marshal(anchor)
+		if err != nil {
+			return err
+		}
+		return s.bucket(tx, bucketMetadata).Put(keyAuditLogAnchor, v)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// AuditLogAnchor returns the last entry removed from the audit log. It is zero if
+// no entry has been removed.
+func (s *BoltStore) AuditLogAnchor() AuditAnchor {
+	var anchor AuditAnchor
+	s.db.View(func(tx *bolt.Tx) error {
+		anchor = s.auditLogAnchor(tx)
+		return nil
+	})
+	return anchor
+}
+
+// AuditLogHead returns the last entry appended to the audit log. It is zero if no
+// entry has been appended since the head is kept.
+func (s *BoltStore) AuditLogHead() AuditHead {
+	var head AuditHead
+	s.db.View(func(tx *bolt.Tx) error {
+		head = s.auditLogHead(tx)
+		return nil
+	})
+	return head
+}
+
+func (s *BoltStore) auditLogHead(tx *bolt.Tx) AuditHead {
+	var head AuditHead
+	if v, err := s.bucket(tx, bucketMetadata).Get(keyAuditLogHead); err == nil && v != nil {
+		json.Unmarshal(v, &head)
+	}
+	return head
+}
+
+func (s *BoltStore) auditLogAnchor(tx *bolt.Tx) AuditAnchor {
+	var anchor AuditAnchor
+	if v, err := s.bucket(tx, bucketMetadata).Get(keyAuditLogAnchor); err == nil && v != nil {
+		json.Unmarshal(v, &anchor)
+	}
+	return anchor
+}
+
+// WriteSnapshot writes a consistent copy of the whole database. Values in the copy
+// are still sealed by the store. If maxAuditEntries is positive, at most the latest
+// maxAuditEntries entries of the audit log are kept in the copy and the last dropped
+// entry becomes the anchor of the copy, so that its log is still verifiable.
+func (s *BoltStore) WriteSnapshot(w io.Writer, maxAuditEntries int) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketAuditLog).Cursor()
+		first, _ := c.First()
+		last, _ := c.Last()
+		if maxAuditEntries <= 0 || first == nil ||
+			binary.BigEndian.Uint64(last)-binary.BigEndian.Uint64(first) < uint64(maxAuditEntries) {
+			_, err := tx.WriteTo(w)
+			return err
+		}
+		return s.writeTrimmedSnapshot(tx, w, binary.BigEndian.Uint64(last)-uint64(maxAuditEntries))
+	})
+}
+
+// writeTrimmedSnapshot writes a copy of the database without the audit entries up to
+// lastDropped. The copy is made in a temporary file next to the store.
+func (s *BoltStore) writeTrimmedSnapshot(tx *bolt.Tx, w io.Writer, lastDropped uint64) error {
+	f, err := ioutil.TempFile(filepath.Dir(s.db.Path()), "snapshot-*.db")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	dst, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = dst.Update(func(dstTx *bolt.Tx) error {
+		if err := copyBuckets(tx, dstTx, func(bucket, key []byte) bool {
+			return bytes.Equal(bucket, bucketAuditLog) && binary.BigEndian.Uint64(key) <= lastDropped
+		}); err != nil {
+			return err
+		}
+
+		var e AuditEntry
+		if v, err := s.bucket(tx, bucketAuditLog).Get(auditKey(lastDropped)); err != nil || v == nil || json.Unmarshal(v, &e) != nil {
+			return fmt.Errorf("fail to read audit entry %d", lastDropped)
+		}
+		anchor, err := json.Marshal(AuditAnchor{Seq: e.Seq, Hash: e.Hash})
+		if err != nil {
+			return err
+		}
+		b := &sealedBucket{dstTx.Bucket(bucketMetadata), bucketMetadata, s.cipher}
+		return b.Put(keyAuditLogAnchor, anchor)
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// RotateIdentity records a rotation of the pod identity. The data encryption key is
+// re-wrapped by a key encryption key derived from the key material at the same time
+// unless the key material is nil.
+func (s *BoltStore) RotateIdentity(rotation IdentityRotation, keyMaterial []byte) error {
+	var kek []byte
+	if keyMaterial != nil {
+		var err error
+		if kek, err = deriveStoreKEK(keyMaterial); err != nil {
+			return err
+		}
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if kek != nil {
+			b := tx.Bucket(bucketMetadata)
+			dek, err := unwrapStoreKey(s.kek, b.Get(keyEncryptionKey))
+			if err != nil {
+				return err
+			}
+			wrapped, err := wrapStoreKey(kek, dek)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(keyEncryptionKey, wrapped); err != nil {
+				return err
+			}
+		}
+
+		b := s.bucket(tx, bucketIdentityRotation)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(rotation)
+		if err != nil {
+			return err
+		}
+
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, seq)
+		return b.Put(k, v)
+	}); err != nil {
+		return err
+	}
+
+	if kek != nil {
+		s.kek = kek
+	}
+	return nil
+}
+
+// IdentityRotations returns all rotations of the pod identity in chronological order
+func (s *BoltStore) IdentityRotations() []IdentityRotation {
+	rotations := make([]IdentityRotation, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucketIdentityRotation)
+		return b.ForEach(func(k, v []byte) error {
+			var r IdentityRotation
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			rotations = append(rotations, r)
+			return nil
+		})
+	})
+	return rotations
 }
@@ -0,0 +1,349 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/config"
+	"github.com/bitmark-inc/autonomy-pod-controller/utils"
+)
+
+const (
+	storeKeyLen = chacha20poly1305.KeySize
+
+	// sealedValueVersion prefixes sealed values so that the format could be changed later
+	sealedValueVersion byte = 1
+)
+
+var (
+	keyEncryptionKey = []byte("encryption_key")
+
+	storeKEKInfo = []byte("autonomy-pod-controller/store-kek")
+)
+
+var errUnsealValue = errors.New("fail to unseal the value")
+
+// deriveStoreKEK derives the key encryption key of the store from key material, which
+// is either the private key of the pod identity or the content of the store key file
+func deriveStoreKEK(keyMaterial []byte) ([]byte, error) {
+	if len(keyMaterial) == 0 {
+		return nil, errors.New("empty store key material")
+	}
+
+	kek := make([]byte, storeKeyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, keyMaterial, nil, storeKEKInfo), kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// storeKeyMaterial returns the key material of the store. It is the content of the
+// store key file if `db_key_file` is set, or the private key of the pod identity.
+// The identity key is kept on the same storage as the store, so only a key file on
+// another medium protects the store against the theft of the storage.
+func storeKeyMaterial(i *PodIdentity) ([]byte, error) {
+	keyFile := viper.GetString("db_key_file")
+	if keyFile == "" {
+		return i.PrivateKey, nil
+	}
+	return createOrLoadStoreKeyFile(config.AbsoluteApplicationFilePath(keyFile))
+}
+
+// createOrLoadStoreKeyFile reads the hex encoded key from the store key file.
+// A random key is written into the file if it does not exist.
+func createOrLoadStoreKeyFile(path string) ([]byte, error) {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the store key file: %s", err)
+		}
+		k, err := hex.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(k) != storeKeyLen {
+			return nil, errors.New("invalid store key file")
+		}
+		return k, nil
+	}
+
+	k, err := utils.GenerateRandomBytes(storeKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't create the store key file: %s", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(hex.EncodeToString(k)); err != nil {
+		return nil, fmt.Errorf("can't write the store key file: %s", err)
+	}
+	return k, nil
+}
+
+// storeCipher seals values of the store by XChaCha20-Poly1305. The bucket and the key
+// of a value are authenticated along with it so that a sealed value is not able to be
+// moved to another place.
+type storeCipher struct {
+	aead cipher.AEAD
+}
+
+func newStoreCipher(key []byte) (*storeCipher, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &storeCipher{aead}, nil
+}
+
+// sealedValueAD returns the additional data of a value, which is the bucket name
+// and the key separated by a zero byte
+func sealedValueAD(bucket, key []byte) []byte {
+	ad := make([]byte, 0, len(bucket)+1+len(key))
+	ad = append(ad, bucket...)
+	ad = append(ad, 0)
+	return append(ad, key...)
+}
+
+// seal encrypts a value into the version, a random nonce and the ciphertext
+func (c *storeCipher) seal(bucket, key, value []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, 1+len(nonce)+len(value)+c.aead.Overhead())
+	sealed = append(sealed, sealedValueVersion)
+	sealed = append(sealed, nonce...)
+	return c.aead.Seal(sealed, nonce, value, sealedValueAD(bucket, key)), nil
+}
+
+// open decrypts a sealed value. It returns errUnsealValue if the value is not
+// sealed by the same key for the same bucket and key.
+func (c *storeCipher) open(bucket, key, sealed []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(sealed) < 1+n+c.aead.Overhead() || sealed[0] != sealedValueVersion {
+		return nil, errUnsealValue
+	}
+
+	value, err := c.aead.Open(make([]byte, 0, len(sealed)), sealed[1:1+n], sealed[1+n:], sealedValueAD(bucket, key))
+	if err != nil {
+		return nil, errUnsealValue
+	}
+	return value, nil
+}
+
+// wrapStoreKey seals the data encryption key of the store by the key encryption key
+func wrapStoreKey(kek, dek []byte) ([]byte, error) {
+	c, err := newStoreCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return c.seal(bucketMetadata, keyEncryptionKey, dek)
+}
+
+// unwrapStoreKey opens the data encryption key of the store by the key encryption key
+func unwrapStoreKey(kek, wrapped []byte) ([]byte, error) {
+	c, err := newStoreCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(bucketMetadata, keyEncryptionKey, wrapped)
+}
+
+// loadStoreCipher unwraps the data encryption key of a store and returns its cipher
+func loadStoreCipher(tx *bolt.Tx, kek []byte) (*storeCipher, error) {
+	b := tx.Bucket(bucketMetadata)
+	if b == nil || b.Get(keyEncryptionKey) == nil {
+		return nil, errors.New("the store has no encryption key")
+	}
+
+	dek, err := unwrapStoreKey(kek, b.Get(keyEncryptionKey))
+	if err != nil {
+		return nil, errors.New("fail to unwrap the store encryption key. the key material does not match")
+	}
+	return newStoreCipher(dek)
+}
+
+// sealedBucket seals values put into a bucket and opens values read from it.
+// Values which fail to be authenticated are returned as errors so that a tampered
+// or corrupted value is never read as missing.
+type sealedBucket struct {
+	*bolt.Bucket
+	name   []byte
+	cipher *storeCipher
+}
+
+// UnsealError is returned if a value in the store fails to be authenticated
+type UnsealError struct {
+	Bucket string
+	Key    []byte
+}
+
+func (e *UnsealError) Error() string {
+	return fmt.Sprintf("the value of %q in the bucket %s is tampered or corrupted", e.Key, e.Bucket)
+}
+
+func (b *sealedBucket) open(k, v []byte) ([]byte, error) {
+	value, err := b.cipher.open(b.name, k, v)
+	if err != nil {
+		err := &UnsealError{Bucket: string(b.name), Key: append([]byte{}, k...)}
+		log.WithError(err).Error("fail to open a value of the store")
+		return nil, err
+	}
+	return value, nil
+}
+
+// Get returns the opened value of a key. It returns nil without an error if the
+// key does not exist.
+func (b *sealedBucket) Get(k []byte) ([]byte, error) {
+	v := b.Bucket.Get(k)
+	if v == nil {
+		return nil, nil
+	}
+	return b.open(k, v)
+}
+
+func (b *sealedBucket) Put(k, v []byte) error {
+	sealed, err := b.cipher.seal(b.name, k, v)
+	if err != nil {
+		return err
+	}
+	return b.Bucket.Put(k, sealed)
+}
+
+// ForEach calls the function with opened values. It stops at the first value which
+// fails to open.
+func (b *sealedBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.Bucket.ForEach(func(k, v []byte) error {
+		value, err := b.open(k, v)
+		if err != nil {
+			return err
+		}
+		return fn(k, value)
+	})
+}
+
+func (b *sealedBucket) Cursor() *sealedCursor {
+	return &sealedCursor{Cursor: b.Bucket.Cursor(), bucket: b}
+}
+
+// sealedCursor iterates over opened values of a sealed bucket. The iteration ends at
+// the first value which fails to open and the error is kept in Err.
+type sealedCursor struct {
+	*bolt.Cursor
+	bucket *sealedBucket
+	err    error
+}
+
+func (c *sealedCursor) First() ([]byte, []byte) {
+	return c.open(c.Cursor.First())
+}
+
+func (c *sealedCursor) Last() ([]byte, []byte) {
+	return c.open(c.Cursor.Last())
+}
+
+func (c *sealedCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.open(c.Cursor.Seek(seek))
+}
+
+func (c *sealedCursor) Next() ([]byte, []byte) {
+	return c.open(c.Cursor.Next())
+}
+
+func (c *sealedCursor) Prev() ([]byte, []byte) {
+	return c.open(c.Cursor.Prev())
+}
+
+// Err returns the error of a value which fails to open during the iteration
+func (c *sealedCursor) Err() error {
+	return c.err
+}
+
+func (c *sealedCursor) open(k, v []byte) ([]byte, []byte) {
+	if k == nil || c.err != nil {
+		return nil, nil
+	}
+	value, err := c.bucket.open(k, v)
+	if err != nil {
+		c.err = err
+		return nil, nil
+	}
+	return k, value
+}
+
+// copyBuckets copies all buckets of a transaction into another one as they are, so
+// values stay sealed. Keys for which skip returns true are left out.
+func copyBuckets(tx, dstTx *bolt.Tx, skip func(bucket, key []byte) bool) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		dstBucket, err := dstTx.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		if err := dstBucket.SetSequence(b.Sequence()); err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if skip != nil && skip(name, k) {
+				return nil
+			}
+			return dstBucket.Put(k, v)
+		})
+	})
+}
+
+// compactStore copies the data of a store into a new file and replaces the store
+// with it, so that stale values left in free pages are dropped. It returns the
+// reopened store.
+func compactStore(db *bolt.DB) (*bolt.DB, error) {
+	path := db.Path()
+	compacted := path + ".compact"
+	if err := os.Remove(compacted); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	dst, err := bolt.Open(compacted, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return copyBuckets(tx, dstTx, nil)
+		})
+	}); err != nil {
+		dst.Close()
+		os.Remove(compacted)
+		return nil, err
+	}
+
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(compacted, path); err != nil {
+		return nil, err
+	}
+	return bolt.Open(path, 0600, nil)
+}
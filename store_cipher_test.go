@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStoreCipher(t *testing.T) {
+	c, err := newStoreCipher(bytes.Repeat([]byte{1}, storeKeyLen))
+	assert.NoError(t, err)
+
+	sealed, err := c.seal(bucketMember, []byte("did:key:member"), []byte("access mode"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), "access mode")
+
+	value, err := c.open(bucketMember, []byte("did:key:member"), sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("access mode"), value)
+
+	// a sealed value is bound to its bucket and key
+	_, err = c.open(bucketMember, []byte("did:key:other"), sealed)
+	assert.Equal(t, errUnsealValue, err)
+	_, err = c.open(bucketBinding, []byte("did:key:member"), sealed)
+	assert.Equal(t, errUnsealValue, err)
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = c.open(bucketMember, []byte("did:key:member"), tampered)
+	assert.Equal(t, errUnsealValue, err)
+
+	other, err := newStoreCipher(bytes.Repeat([]byte{2}, storeKeyLen))
+	assert.NoError(t, err)
+	_, err = other.open(bucketMember, []byte("did:key:member"), sealed)
+	assert.Equal(t, errUnsealValue, err)
+
+	// empty values are sealed as well
+	sealed, err = c.seal(bucketOwnership, keyOwner, []byte{})
+	assert.NoError(t, err)
+	value, err = c.open(bucketOwnership, keyOwner, sealed)
+	assert.NoError(t, err)
+	assert.NotNil(t, value)
+	assert.Empty(t, value)
+}
+
+func TestCreateOrLoadStoreKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db_key")
+
+	k, err := createOrLoadStoreKeyFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, k, storeKeyLen)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := createOrLoadStoreKeyFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, k, loaded)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("not a key"), 0600))
+	_, err = createOrLoadStoreKeyFile(path)
+	assert.EqualError(t, err, "invalid store key file")
+}
+
+func TestBoltStoreSealedValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sealed.db")
+	memberDID := "did:key:member"
+	otherDID := "did:key:other"
+
+	s := NewBoltStore(path, []byte("store key material"))
+	assert.NoError(t, s.SaveMember(Member{DID: memberDID, AccessMode: AccessModeFull}))
+	assert.NoError(t, s.SaveMember(Member{DID: otherDID, AccessMode: AccessModeMinimal}))
+
+	// values are not readable from the file
+	assert.NoError(t, s.db.Sync())
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "access_mode")
+
+	// a value moved to another key fails to open and grants nothing
+	assert.NoError(t, s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMember)
+		return b.Put([]byte(otherDID), append([]byte{}, b.Get([]byte(memberDID))...))
+	}))
+	assert.Nil(t, s.Member(otherDID))
+	assert.Equal(t, AccessModeNotApplicant, s.MemberAccessMode(otherDID))
+	assert.NoError(t, s.db.Close())
+
+	// the store is not able to be opened by other key material
+	_, err = openBoltStore(path, []byte("other key material"))
+	assert.EqualError(t, err, "fail to unwrap the store encryption key. the key material does not match")
+
+	s = NewBoltStore(path, []byte("store key material"))
+	defer s.db.Close()
+	assert.Equal(t, AccessModeFull, s.MemberAccessMode(memberDID))
+}
+
+func TestBoltStoreTamperedValuesFailClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tampered.db")
+	did := "did:key:member"
+
+	s := NewBoltStore(path, []byte("store key material"))
+	defer s.db.Close()
+	assert.NoError(t, s.SetSpendingLimit(did, SpendingLimit{Daily: 1000}))
+	assert.NoError(t, s.SetMemberRPCPolicy(did, []string{"getbalances"}))
+	assert.NoError(t, s.AddSpending(did, 500, time.Now(), "txid"))
+	assert.NoError(t, s.TransferOwnership(OwnershipEvent{NewOwner: "did:key:owner"}))
+
+	assert.NoError(t, s.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketSpendingLimit, bucketMemberRPCPolicy, bucketSpending, bucketOwnership} {
+			b := tx.Bucket(bucket)
+			k, v := b.Cursor().First()
+			tampered := append([]byte{}, v...)
+			tampered[len(tampered)-1] ^= 1
+			if err := b.Put(append([]byte{}, k...), tampered); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// a tampered value is never read as a missing one which would grant more
+	_, err := s.SpendingLimit(did)
+	assert.IsType(t, &UnsealError{}, err)
+	_, err = s.MemberRPCPolicy(did)
+	assert.IsType(t, &UnsealError{}, err)
+	_, err = s.SpentSince(did, time.Now().Add(-time.Hour))
+	assert.IsType(t, &UnsealError{}, err)
+	_, err = s.Owner()
+	assert.IsType(t, &UnsealError{}, err)
+
+	c := &Controller{store: s}
+	assert.IsType(t, &UnsealError{}, c.checkSpendingLimit(did, 1, time.Now()))
+	_, err = c.memberRPCPolicy(did)
+	assert.IsType(t, &UnsealError{}, err)
+}
+
+func TestBoltStoreRotateIdentityRewrapsKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rotated.db")
+
+	s := NewBoltStore(path, []byte("store key material"))
+	assert.NoError(t, s.SaveMember(Member{DID: "did:key:member", AccessMode: AccessModeFull}))
+	assert.NoError(t, s.RotateIdentity(IdentityRotation{OldDID: "did:key:old", NewDID: "did:key:new"}, []byte("new key material")))
+
+	// values are still readable after the key is re-wrapped
+	assert.Equal(t, AccessModeFull, s.MemberAccessMode("did:key:member"))
+	assert.NoError(t, s.db.Close())
+
+	_, err := openBoltStore(path, []byte("store key material"))
+	assert.EqualError(t, err, "fail to unwrap the store encryption key. the key material does not match")
+
+	s = NewBoltStore(path, []byte("new key material"))
+	defer s.db.Close()
+	assert.Equal(t, AccessModeFull, s.MemberAccessMode("did:key:member"))
+	assert.Len(t, s.IdentityRotations(), 1)
+}
+
+func TestMigrateLegacyStoreDropsPlaintext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	createLegacyStore(t, path, map[string]string{"did:key:owner": "1eba606e"}, nil)
+
+	s := NewBoltStore(path, []byte("store key material"))
+	defer s.db.Close()
+	assert.NotNil(t, s.BindingSession("did:key:owner", legacyBindingDevice))
+
+	// plaintext values are not left in free pages
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "1eba606e")
+
+	_, err = os.Stat(path + ".compact")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,1036 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryBucket keeps values by keys in the same order as a bolt bucket.
+// Values are copied in and out so that callers never share them with the store.
+type memoryBucket struct {
+	values   map[string][]byte
+	sequence uint64
+}
+
+func (b *memoryBucket) get(k []byte) []byte {
+	v, ok := b.values[string(k)]
+	if !ok {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+func (b *memoryBucket) put(k, v []byte) {
+	b.values[string(k)] = append([]byte{}, v...)
+}
+
+func (b *memoryBucket) delete(k []byte) {
+	delete(b.values, string(k))
+}
+
+// ascend calls the function for values from the key onwards in the key order
+// until the function returns false
+func (b *memoryBucket) ascend(from []byte, fn func(k, v []byte) bool) {
+	keys := make([]string, 0, len(b.values))
+	for k := range b.values {
+		if k >= string(from) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !fn([]byte(k), append([]byte{}, b.values[k]...)) {
+			return
+		}
+	}
+}
+
+// forEach calls the function for all values in the key order. It stops at the first error.
+func (b *memoryBucket) forEach(fn func(k, v []byte) error) error {
+	var err error
+	b.ascend(nil, func(k, v []byte) bool {
+		err = fn(k, v)
+		return err == nil
+	})
+	return err
+}
+
+// MemoryStore is a thread-safe Store which keeps everything in memory. Values are
+// encoded as they are in the BoltStore so that both stores behave the same. It is
+// meant for tests and development.
+type MemoryStore struct {
+	lock    sync.RWMutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{buckets: make(map[string]*memoryBucket)}
+	for _, name := range [][]byte{
+		bucketBinding, bucketMember, bucketMemberRPCPolicy, bucketSpendingLimit,
+		bucketSpending, bucketTrustedAddress, bucketPendingApproval, bucketDelayedTx,
+		bucketOwnership, bucketOwnershipEvent, bucketInvitation, bucketCommandCounter,
+		bucketAuditLog, bucketIdentityRotation, bucketMetadata,
+	} {
+		s.buckets[string(name)] = &memoryBucket{values: make(map[string][]byte)}
+	}
+	return s
+}
+
+// bucket returns a bucket by its name. All buckets are created along with the store
+// so that readers never modify the map of buckets.
+func (s *MemoryStore) bucket(name []byte) *memoryBucket {
+	return s.buckets[string(name)]
+}
+
+// SaveBindingSession creates or updates the binding session of a device of a DID
+func (s *MemoryStore) SaveBindingSession(did string, device uint32, session BindingSession) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := encodeBindingSession(session)
+	if err != nil {
+		return err
+	}
+	s.bucket(bucketBinding).put(bindingKey(did, device), v)
+	return nil
+}
+
+// BindingSession returns the binding session of a device of a DID.
+// It returns nil if the device has never started binding.
+func (s *MemoryStore) BindingSession(did string, device uint32) *BindingSession {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v := s.bucket(bucketBinding).get(bindingKey(did, device))
+	if v == nil {
+		return nil
+	}
+	session, err := decodeBindingSession(v)
+	if err != nil {
+		return nil
+	}
+	return session
+}
+
+func (s *MemoryStore) HasBinding(did string, device uint32) bool {
+	session := s.BindingSession(did, device)
+	return session != nil && session.Bound
+}
+
+// Bindings returns binding sessions of all devices which have started binding
+func (s *MemoryStore) Bindings() []DeviceBinding {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	bindings := make([]DeviceBinding, 0)
+	s.bucket(bucketBinding).forEach(func(k, v []byte) error {
+		binding, err := decodeDeviceBinding(k, v)
+		if err != nil {
+			return err
+		}
+		bindings = append(bindings, *binding)
+		return nil
+	})
+	return bindings
+}
+
+// DeviceBindings returns binding sessions of all devices of a DID
+func (s *MemoryStore) DeviceBindings(did string) []DeviceBinding {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	bindings, err := s.deviceBindings(did)
+	if err != nil {
+		return make([]DeviceBinding, 0)
+	}
+	return bindings
+}
+
+// RemoveBinding deletes the binding session of a device of a DID along with
+// its command counter
+func (s *MemoryStore) RemoveBinding(did string, device uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bucket(bucketCommandCounter).delete(bindingKey(did, device))
+	s.bucket(bucketBinding).delete(bindingKey(did, device))
+	return nil
+}
+
+// RevokeBinding deletes the binding session and the command counter of a device of
+// a DID. All devices of the DID are revoked if the device is 0. Once the DID has no
+// device left, its member record, its custom bitcoind RPC allow list and its pending
+// approvals are removed as well, and its votes on PSBTs submitted by others are
+// withdrawn.
+func (s *MemoryStore) RevokeBinding(did string, device uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	bindings, err := s.deviceBindings(did)
+	if err != nil {
+		return err
+	}
+
+	remaining := 0
+	for _, binding := range bindings {
+		if device != 0 && binding.Device != device {
+			remaining++
+			continue
+		}
+		s.bucket(bucketBinding).delete(bindingKey(did, binding.Device))
+	}
+	s.removeCommandCounters(did, device)
+	if remaining > 0 {
+		return nil
+	}
+
+	s.bucket(bucketMember).delete([]byte(did))
+	s.bucket(bucketMemberRPCPolicy).delete([]byte(did))
+	return s.removePendingApprovalsOf(did)
+}
+
+// deviceBindings returns binding sessions of all devices of a DID. The lock has to be held.
+func (s *MemoryStore) deviceBindings(did string) ([]DeviceBinding, error) {
+	bindings := make([]DeviceBinding, 0)
+	prefix := bindingKeyPrefix(did)
+
+	var err error
+	s.bucket(bucketBinding).ascend(prefix, func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, prefix) {
+			return false
+		}
+
+		var binding *DeviceBinding
+		if binding, err = decodeDeviceBinding(k, v); err != nil {
+			return false
+		}
+		bindings = append(bindings, *binding)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// removeCommandCounters removes the command counter of a device of a DID, or
+// counters of all its devices if the device is 0. The lock has to be held.
+func (s *MemoryStore) removeCommandCounters(did string, device uint32) {
+	b := s.bucket(bucketCommandCounter)
+	if device != 0 {
+		b.delete(bindingKey(did, device))
+		return
+	}
+
+	prefix := bindingKeyPrefix(did)
+	b.ascend(prefix, func(k, _ []byte) bool {
+		if !bytes.HasPrefix(k, prefix) {
+			return false
+		}
+		b.delete(k)
+		return true
+	})
+}
+
+// removePendingApprovalsOf removes pending PSBTs submitted by a DID and withdraws
+// its votes on PSBTs submitted by others. The lock has to be held.
+func (s *MemoryStore) removePendingApprovalsOf(did string) error {
+	b := s.bucket(bucketPendingApproval)
+	return b.forEach(func(k, v []byte) error {
+		var approval PendingApproval
+		if err := json.Unmarshal(v, &approval); err != nil {
+			return err
+		}
+
+		if approval.Submitter == did {
+			b.delete(k)
+			return nil
+		}
+
+		if approval.withdrawVotes(did) {
+			v, err := json.Marshal(approval)
+			if err != nil {
+				return err
+			}
+			b.put(k, v)
+		}
+		return nil
+	})
+}
+
+// SaveMember creates or updates a member
+func (s *MemoryStore) SaveMember(member Member) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := encodeMember(member)
+	if err != nil {
+		return err
+	}
+	s.bucket(bucketMember).put([]byte(member.DID), v)
+	return nil
+}
+
+// Member returns a member by its DID. It returns nil if the member is not found.
+func (s *MemoryStore) Member(memberDID string) *Member {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v := s.bucket(bucketMember).get([]byte(memberDID))
+	if v == nil {
+		return nil
+	}
+	m, err := decodeMember(memberDID, v)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// Members returns all members
+func (s *MemoryStore) Members() []Member {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	members := make([]Member, 0)
+	s.bucket(bucketMember).forEach(func(k, v []byte) error {
+		m, err := decodeMember(string(k), v)
+		if err != nil {
+			return err
+		}
+		members = append(members, *m)
+		return nil
+	})
+	return members
+}
+
+// TouchMember updates the last active time of a member
+func (s *MemoryStore) TouchMember(memberDID string, activeAt time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.bucket(bucketMember)
+	v := b.get([]byte(memberDID))
+	if v == nil {
+		return nil
+	}
+
+	m, err := decodeMember(memberDID, v)
+	if err != nil {
+		return err
+	}
+	m.LastActiveAt = &activeAt
+
+	if v, err = encodeMember(*m); err != nil {
+		return err
+	}
+	b.put([]byte(memberDID), v)
+	return nil
+}
+
+func (s *MemoryStore) RemoveMember(memberDID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bucket(bucketMemberRPCPolicy).delete([]byte(memberDID))
+	s.bucket(bucketMember).delete([]byte(memberDID))
+	return nil
+}
+
+// RemoveExpiredMembers removes members which are expired at the given time
+// along with their custom bitcoind RPC allow lists. It returns the removed members.
+func (s *MemoryStore) RemoveExpiredMembers(now time.Time) ([]Member, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	expired := make([]Member, 0)
+	b := s.bucket(bucketMember)
+	if err := b.forEach(func(k, v []byte) error {
+		m, err := decodeMember(string(k), v)
+		if err != nil {
+			return err
+		}
+		if m.Expired(now) {
+			expired = append(expired, *m)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, m := range expired {
+		s.bucket(bucketMemberRPCPolicy).delete([]byte(m.DID))
+		b.delete([]byte(m.DID))
+	}
+	return expired, nil
+}
+
+func (s *MemoryStore) MemberAccessMode(memberDID string) AccessMode {
+	if m := s.Member(memberDID); m != nil {
+		return m.AccessMode
+	}
+	return AccessModeNotApplicant
+}
+
+// SetMemberRPCPolicy saves the custom bitcoind RPC allow list of a member.
+// An empty list removes the custom allow list.
+func (s *MemoryStore) SetMemberRPCPolicy(memberDID string, methods []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.bucket(bucketMemberRPCPolicy)
+	if len(methods) == 0 {
+		b.delete([]byte(memberDID))
+		return nil
+	}
+
+	v, err := json.Marshal(methods)
+	if err != nil {
+		return err
+	}
+	b.put([]byte(memberDID), v)
+	return nil
+}
+
+// MemberRPCPolicy returns the custom bitcoind RPC allow list of a member.
+// It returns nil if the member does not have one.
+func (s *MemoryStore) MemberRPCPolicy(memberDID string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var methods []string
+	if v := s.bucket(bucketMemberRPCPolicy).get([]byte(memberDID)); v != nil {
+		if err := json.Unmarshal(v, &methods); err != nil {
+			return nil, err
+		}
+	}
+	return methods, nil
+}
+
+// SetSpendingLimit saves the spending limit of a DID
+func (s *MemoryStore) SetSpendingLimit(did string, limit SpendingLimit) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(limit)
+	if err != nil {
+		return err
+	}
+	s.bucket(bucketSpendingLimit).put([]byte(did), v)
+	return nil
+}
+
+// SpendingLimit returns the spending limit of a DID. A DID without
+// a spending limit gets a zero value which means no limit.
+func (s *MemoryStore) SpendingLimit(did string) (SpendingLimit, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var limit SpendingLimit
+	if v := s.bucket(bucketSpendingLimit).get([]byte(did)); v != nil {
+		if err := json.Unmarshal(v, &limit); err != nil {
+			return SpendingLimit{}, err
+		}
+	}
+	return limit, nil
+}
+
+// AddSpending records an amount spent by a DID. Records older than
+// the longest spending period are pruned at the same time.
+func (s *MemoryStore) AddSpending(did string, amount int64, spentAt time.Time, txID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.bucket(bucketSpending)
+	expiredKey := spendingKey(did, spentAt.Add(-spendingRecordRetention), "")
+	b.ascend(spendingKeyPrefix(did), func(k, _ []byte) bool {
+		if bytes.Compare(k, expiredKey) >= 0 {
+			return false
+		}
+		b.delete(k)
+		return true
+	})
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(amount))
+	b.put(spendingKey(did, spentAt, txID), v)
+	return nil
+}
+
+// RemoveSpending removes the spending record of a transaction spent by a DID at the
+// given time so that the amount is no longer counted against the spending limit
+func (s *MemoryStore) RemoveSpending(did string, spentAt time.Time, txID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.bucket(bucketSpending)
+	k := spendingKey(did, spentAt, txID)
+	if b.get(k) == nil {
+		// records added before they are keyed by txid
+		k = spendingKey(did, spentAt, "")
+	}
+	b.delete(k)
+	return nil
+}
+
+// SpentSince returns the total amount spent by a DID since the given time
+func (s *MemoryStore) SpentSince(did string, since time.Time) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var total int64
+	prefix := spendingKeyPrefix(did)
+	s.bucket(bucketSpending).ascend(spendingKey(did, since, ""), func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, prefix) {
+			return false
+		}
+		total += int64(binary.BigEndian.Uint64(v))
+		return true
+	})
+	return total, nil
+}
+
+// AddTrustedAddress saves an address into the address book
+func (s *MemoryStore) AddTrustedAddress(address TrustedAddress) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(address)
+	if err != nil {
+		return err
+	}
+	s.bucket(bucketTrustedAddress).put([]byte(address.Address), v)
+	return nil
+}
+
+// RemoveTrustedAddress deletes an address from the address book
+func (s *MemoryStore) RemoveTrustedAddress(address string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bucket(bucketTrustedAddress).delete([]byte(address))
+	return nil
+}
+
+// IsTrustedAddress returns whether an address is in the address book
+func (s *MemoryStore) IsTrustedAddress(address string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.bucket(bucketTrustedAddress).get([]byte(address)) != nil
+}
+
+// TrustedAddresses returns all addresses in the address book
+func (s *MemoryStore) TrustedAddresses() []TrustedAddress {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	addresses := make([]TrustedAddress, 0)
+	s.bucket(bucketTrustedAddress).forEach(func(k, v []byte) error {
+		var address TrustedAddress
+		if err := json.Unmarshal(v, &address); err != nil {
+			return err
+		}
+		addresses = append(addresses, address)
+		return nil
+	})
+	return addresses
+}
+
+// SavePendingApproval saves a PSBT which is waiting for approvals
+func (s *MemoryStore) SavePendingApproval(approval PendingApproval) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(approval)
+	if err != nil {
+		return err
+	}
+	s.bucket(bucketPendingApproval).put([]byte(approval.TxID), v)
+	return nil
+}
+
+// PendingApproval returns a pending PSBT by its unsigned txid.
+// It returns nil if the PSBT is not found.
+func (s *MemoryStore) PendingApproval(txID string) *PendingApproval {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v := s.bucket(bucketPendingApproval).get([]byte(txID))
+	if v == nil {
+		return nil
+	}
+
+	var a PendingApproval
+	if err := json.Unmarshal(v, &a); err != nil {
+		return nil
+	}
+	return &a
+}
+
+// PendingApprovals returns all PSBTs which are waiting for approvals
+func (s *MemoryStore) PendingApprovals() []PendingApproval {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	approvals := make([]PendingApproval, 0)
+	s.bucket(bucketPendingApproval).forEach(func(k, v []byte) error {
+		var approval PendingApproval
+		if err := json.Unmarshal(v, &approval); err != nil {
+			return err
+		}
+		approvals = append(approvals, approval)
+		return nil
+	})
+	return approvals
+}
+
+// RemovePendingApproval deletes a pending PSBT
+func (s *MemoryStore) RemovePendingApproval(txID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bucket(bucketPendingApproval).delete([]byte(txID))
+	return nil
+}
+
+// SaveDelayedTransaction saves a signed transaction into the vault
+func (s *MemoryStore) SaveDelayedTransaction(delayedTx DelayedTransaction) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(delayedTx)
+	if err != nil {
+		return err
+	}
+	s.bucket(bucketDelayedTx).put([]byte(delayedTx.TxID), v)
+	return nil
+}
+
+// DelayedTransaction returns a transaction in the vault by its txid.
+// It returns nil if the transaction is not found.
+func (s *MemoryStore) DelayedTransaction(txID string) *DelayedTransaction {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v := s.bucket(bucketDelayedTx).get([]byte(txID))
+	if v == nil {
+		return nil
+	}
+
+	var t DelayedTransaction
+	if err := json.Unmarshal(v, &t); err != nil {
+		return nil
+	}
+	return &t
+}
+
+// DelayedTransactions returns all transactions in the vault
+func (s *MemoryStore) DelayedTransactions() []DelayedTransaction {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	delayedTxs := make([]DelayedTransaction, 0)
+	s.bucket(bucketDelayedTx).forEach(func(k, v []byte) error {
+		var t DelayedTransaction
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		delayedTxs = append(delayedTxs, t)
+		return nil
+	})
+	return delayedTxs
+}
+
+// RemoveDelayedTransaction deletes a transaction from the vault
+func (s *MemoryStore) RemoveDelayedTransaction(txID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bucket(bucketDelayedTx).delete([]byte(txID))
+	return nil
+}
+
+// Owner returns the owner DID set by an ownership transfer.
+// It returns an empty string if the ownership has never been transferred.
+func (s *MemoryStore) Owner() (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return string(s.bucket(bucketOwnership).get(keyOwner)), nil
+}
+
+// SetPendingOwnershipTransfer saves an ownership transfer waiting for the acceptance
+// of the new owner. It replaces the previous pending transfer.
+func (s *MemoryStore) SetPendingOwnershipTransfer(transfer OwnershipTransfer) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+	s.bucket(bucketOwnership).put(keyPendingOwnershipTransfer, v)
+	return nil
+}
+
+// PendingOwnershipTransfer returns the ownership transfer waiting for acceptance.
+// It returns nil if there is no pending transfer.
+func (s *MemoryStore) PendingOwnershipTransfer() *OwnershipTransfer {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v := s.bucket(bucketOwnership).get(keyPendingOwnershipTransfer)
+	if v == nil {
+		return nil
+	}
+
+	var t OwnershipTransfer
+	if err := json.Unmarshal(v, &t); err != nil {
+		return nil
+	}
+	return &t
+}
+
+// RemovePendingOwnershipTransfer deletes the ownership transfer waiting for acceptance
+func (s *MemoryStore) RemovePendingOwnershipTransfer() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bucket(bucketOwnership).delete(keyPendingOwnershipTransfer)
+	return nil
+}
+
+// TransferOwnership sets the new owner of the event, drops the pending transfer
+// and appends the event to the ownership audit trail at once
+func (s *MemoryStore) TransferOwnership(event OwnershipEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	b := s.bucket(bucketOwnership)
+	b.put(keyOwner, []byte(event.NewOwner))
+	b.delete(keyPendingOwnershipTransfer)
+	s.putOwnershipEvent(v)
+	return nil
+}
+
+// AddOwnershipEvent appends an event to the ownership audit trail
+func (s *MemoryStore) AddOwnershipEvent(event OwnershipEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.putOwnershipEvent(v)
+	return nil
+}
+
+// OwnershipEvents returns the ownership audit trail in chronological order
+func (s *MemoryStore) OwnershipEvents() []OwnershipEvent {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	events := make([]OwnershipEvent, 0)
+	s.bucket(bucketOwnershipEvent).forEach(func(k, v []byte) error {
+		var e OwnershipEvent
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		events = append(events, e)
+		return nil
+	})
+	return events
+}
+
+// putOwnershipEvent appends an encoded ownership event keyed by the bucket sequence.
+// The lock has to be held.
+func (s *MemoryStore) putOwnershipEvent(v []byte) {
+	b := s.bucket(bucketOwnershipEvent)
+	b.sequence++
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, b.sequence)
+	b.put(k, v)
+}
+
+// SaveInvitation creates or updates an invitation
+func (s *MemoryStore) SaveInvitation(invitation Invitation) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(invitation)
+	if err != nil {
+		return err
+	}
+	s.bucket(bucketInvitation).put([]byte(invitation.Nonce), v)
+	return nil
+}
+
+// Invitation returns an invitation by its nonce.
+// It returns nil if the invitation is not found.
+func (s *MemoryStore) Invitation(nonce string) *Invitation {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v := s.bucket(bucketInvitation).get([]byte(nonce))
+	if v == nil {
+		return nil
+	}
+
+	var i Invitation
+	if err := json.Unmarshal(v, &i); err != nil {
+		return nil
+	}
+	return &i
+}
+
+// Invitations returns all invitations
+func (s *MemoryStore) Invitations() []Invitation {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	invitations := make([]Invitation, 0)
+	s.bucket(bucketInvitation).forEach(func(k, v []byte) error {
+		var i Invitation
+		if err := json.Unmarshal(v, &i); err != nil {
+			return err
+		}
+		invitations = append(invitations, i)
+		return nil
+	})
+	return invitations
+}
+
+// CommandCounter returns the last command counter of a device of a DID.
+// It returns 0 if the device has never sent a signed command.
+func (s *MemoryStore) CommandCounter(did string, device uint32) uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if v := s.bucket(bucketCommandCounter).get(bindingKey(did, device)); len(v) == 8 {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+// AdvanceCommandCounter updates the command counter of a device of a DID. It returns
+// ErrStaleCommandCounter if the counter is not greater than the last one.
+func (s *MemoryStore) AdvanceCommandCounter(did string, device uint32, counter uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.bucket(bucketCommandCounter)
+	k := bindingKey(did, device)
+	if v := b.get(k); len(v) == 8 && counter <= binary.BigEndian.Uint64(v) {
+		return ErrStaleCommandCounter
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, counter)
+	b.put(k, v)
+	return nil
+}
+
+// AppendAuditEntry appends an entry to the audit log. The sequence number and the
+// previous hash of the entry are set from the head of the log, and then the entry is
+// sealed by the given function before it is saved along with the new head.
+func (s *MemoryStore) AppendAuditEntry(entry AuditEntry, seal func(*AuditEntry) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.bucket(bucketAuditLog)
+	anchor := s.auditLogAnchor()
+	entry.Seq = anchor.Seq + 1
+	entry.PrevHash = anchor.Hash
+	if head := s.auditLogHead(); head.Seq > 0 {
+		entry.Seq = head.Seq + 1
+		entry.PrevHash = head.Hash
+	} else {
+		s.lastAuditEntry(&entry)
+	}
+
+	if err := seal(&entry); err != nil {
+		return err
+	}
+
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	head, err := json.Marshal(auditHeadOf(entry))
+	if err != nil {
+		return err
+	}
+	b.put(auditKey(entry.Seq), v)
+	s.bucket(bucketMetadata).put(keyAuditLogHead, head)
+	return nil
+}
+
+// lastAuditEntry sets the sequence number and the previous hash of an entry from
+// the last entry of a log without a head
+func (s *MemoryStore) lastAuditEntry(entry *AuditEntry) {
+	s.bucket(bucketAuditLog).ascend(nil, func(k, v []byte) bool {
+		entry.Seq = binary.BigEndian.Uint64(k) + 1
+
+		var last AuditEntry
+		entry.PrevHash = ""
+		if json.Unmarshal(v, &last) == nil {
+			entry.PrevHash = last.Hash
+		}
+		return true
+	})
+}
+
+// AuditEntries returns entries of the audit log which match the query
+func (s *MemoryStore) AuditEntries(query AuditQuery) []AuditEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	entries := make([]AuditEntry, 0)
+	s.bucket(bucketAuditLog).ascend(auditKey(query.AfterSeq+1), func(k, v []byte) bool {
+		var e AuditEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return false
+		}
+		if !query.Match(e) {
+			return true
+		}
+
+		entries = append(entries, e)
+		return query.Limit <= 0 || len(entries) < query.Limit
+	})
+	return entries
+}
+
+// TrimAuditLog removes the oldest entries of the audit log so that at most maxEntries
+// entries are kept. The last removed entry is kept as the anchor of the remaining
+// entries. It returns the number of removed entries.
+func (s *MemoryStore) TrimAuditLog(maxEntries int) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.bucket(bucketAuditLog)
+	var keys [][]byte
+	var anchor AuditAnchor
+	var err error
+	excess := len(b.values) - maxEntries
+	b.ascend(nil, func(k, v []byte) bool {
+		if len(keys) >= excess {
+			return false
+		}
+
+		var e AuditEntry
+		if err = json.Unmarshal(v, &e); err != nil {
+			return false
+		}
+		anchor = AuditAnchor{Seq: e.Seq, Hash: e.Hash}
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	v, err := json.Marshal(anchor)
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		b.delete(k)
+	}
+	s.bucket(bucketMetadata).put(keyAuditLogAnchor, v)
+	return len(keys), nil
+}
+
+// AuditLogAnchor returns the last entry removed from the audit log. It is zero if
+// no entry has been removed.
+func (s *MemoryStore) AuditLogAnchor() AuditAnchor {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.auditLogAnchor()
+}
+
+// AuditLogHead returns the last entry appended to the audit log. It is zero if no
+// entry has been appended.
+func (s *MemoryStore) AuditLogHead() AuditHead {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.auditLogHead()
+}
+
+func (s *MemoryStore) auditLogHead() AuditHead {
+	var head AuditHead
+	if v := s.bucket(bucketMetadata).get(keyAuditLogHead); v != nil {
+		json.Unmarshal(v, &head)
+	}
+	return head
+}
+
+func (s *MemoryStore) auditLogAnchor() AuditAnchor {
+	var anchor AuditAnchor
+	if v := s.bucket(bucketMetadata).get(keyAuditLogAnchor); v != nil {
+		json.Unmarshal(v, &anchor)
+	}
+	return anchor
+}
+
+// RotateIdentity records a rotation of the pod identity. Values are not encrypted
+// in memory, so the key material is ignored.
+func (s *MemoryStore) RotateIdentity(rotation IdentityRotation, _ []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, err := json.Marshal(rotation)
+	if err != nil {
+		return err
+	}
+
+	b := s.bucket(bucketIdentityRotation)
+	b.sequence++
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, b.sequence)
+	b.put(k, v)
+	return nil
+}
+
+// IdentityRotations returns all rotations of the pod identity in chronological order
+func (s *MemoryStore) IdentityRotations() []IdentityRotation {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rotations := make([]IdentityRotation, 0)
+	s.bucket(bucketIdentityRotation).forEach(func(k, v []byte) error {
+		var r IdentityRotation
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		rotations = append(rotations, r)
+		return nil
+	})
+	return rotations
+}
+
+// WriteSnapshot is not supported since a backup has to be a bolt database
+func (s *MemoryStore) WriteSnapshot(w io.Writer, maxAuditEntries int) error {
+	return errors.New("the memory store does not support snapshots")
+}
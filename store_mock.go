@@ -10,7 +10,9 @@
 package main
 
 import (
+	io "io"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -38,46 +40,284 @@ func (m *MockStore) EXPECT() *MockStoreMockRecorder {
 	return m.recorder
 }
 
-// BindingNonce mocks base method.
-func (m *MockStore) BindingNonce(did string) string {
+// AddOwnershipEvent mocks base method.
+func (m *MockStore) AddOwnershipEvent(event OwnershipEvent) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "BindingNonce", did)
-	ret0, _ := ret[0].(string)
+	ret := m.ctrl.Call(m, "AddOwnershipEvent", event)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddOwnershipEvent indicates an expected call of AddOwnershipEvent.
+func (mr *MockStoreMockRecorder) AddOwnershipEvent(event interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOwnershipEvent", reflect.TypeOf((*MockStore)(nil).AddOwnershipEvent), event)
+}
+
+// AddSpending mocks base method.
+func (m *MockStore) AddSpending(did string, amount int64, spentAt time.Time, txID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddSpending", did, amount, spentAt, txID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddSpending indicates an expected call of AddSpending.
+func (mr *MockStoreMockRecorder) AddSpending(did, amount, spentAt, txID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddSpending", reflect.TypeOf((*MockStore)(nil).AddSpending), did, amount, spentAt, txID)
+}
+
+// AddTrustedAddress mocks base method.
+func (m *MockStore) AddTrustedAddress(address TrustedAddress) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddTrustedAddress", address)
+	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// BindingNonce indicates an expected call of BindingNonce.
-func (mr *MockStoreMockRecorder) BindingNonce(did interface{}) *gomock.Call {
+// AddTrustedAddress indicates an expected call of AddTrustedAddress.
+func (mr *MockStoreMockRecorder) AddTrustedAddress(address interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BindingNonce", reflect.TypeOf((*MockStore)(nil).BindingNonce), did)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddTrustedAddress", reflect.TypeOf((*MockStore)(nil).AddTrustedAddress), address)
 }
 
-// CompleteBinding mocks base method.
-func (m *MockStore) CompleteBinding(did string) error {
+// AdvanceCommandCounter mocks base method.
+func (m *MockStore) AdvanceCommandCounter(did string, device uint32, counter uint64) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CompleteBinding", did)
+	ret := m.ctrl.Call(m, "AdvanceCommandCounter", did, device, counter)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// CompleteBinding indicates an expected call of CompleteBinding.
-func (mr *MockStoreMockRecorder) CompleteBinding(did interface{}) *gomock.Call {
+// AdvanceCommandCounter indicates an expected call of AdvanceCommandCounter.
+func (mr *MockStoreMockRecorder) AdvanceCommandCounter(did, device, counter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AdvanceCommandCounter", reflect.TypeOf((*MockStore)(nil).AdvanceCommandCounter), did, device, counter)
+}
+
+// AppendAuditEntry mocks base method.
+func (m *MockStore) AppendAuditEntry(entry AuditEntry, seal func(*AuditEntry) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AppendAuditEntry", entry, seal)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AppendAuditEntry indicates an expected call of AppendAuditEntry.
+func (mr *MockStoreMockRecorder) AppendAuditEntry(entry, seal interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendAuditEntry", reflect.TypeOf((*MockStore)(nil).AppendAuditEntry), entry, seal)
+}
+
+// AuditEntries mocks base method.
+func (m *MockStore) AuditEntries(query AuditQuery) []AuditEntry {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AuditEntries", query)
+	ret0, _ := ret[0].([]AuditEntry)
+	return ret0
+}
+
+// AuditEntries indicates an expected call of AuditEntries.
+func (mr *MockStoreMockRecorder) AuditEntries(query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AuditEntries", reflect.TypeOf((*MockStore)(nil).AuditEntries), query)
+}
+
+// AuditLogAnchor mocks base method.
+func (m *MockStore) AuditLogAnchor() AuditAnchor {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AuditLogAnchor")
+	ret0, _ := ret[0].(AuditAnchor)
+	return ret0
+}
+
+// AuditLogAnchor indicates an expected call of AuditLogAnchor.
+func (mr *MockStoreMockRecorder) AuditLogAnchor() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AuditLogAnchor", reflect.TypeOf((*MockStore)(nil).AuditLogAnchor))
+}
+
+// AuditLogHead mocks base method.
+func (m *MockStore) AuditLogHead() AuditHead {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AuditLogHead")
+	ret0, _ := ret[0].(AuditHead)
+	return ret0
+}
+
+// AuditLogHead indicates an expected call of AuditLogHead.
+func (mr *MockStoreMockRecorder) AuditLogHead() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AuditLogHead", reflect.TypeOf((*MockStore)(nil).AuditLogHead))
+}
+
+// BindingSession mocks base method.
+func (m *MockStore) BindingSession(did string, device uint32) *BindingSession {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BindingSession", did, device)
+	ret0, _ := ret[0].(*BindingSession)
+	return ret0
+}
+
+// BindingSession indicates an expected call of BindingSession.
+func (mr *MockStoreMockRecorder) BindingSession(did, device interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BindingSession", reflect.TypeOf((*MockStore)(nil).BindingSession), did, device)
+}
+
+// Bindings mocks base method.
+func (m *MockStore) Bindings() []DeviceBinding {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Bindings")
+	ret0, _ := ret[0].([]DeviceBinding)
+	return ret0
+}
+
+// Bindings indicates an expected call of Bindings.
+func (mr *MockStoreMockRecorder) Bindings() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Bindings", reflect.TypeOf((*MockStore)(nil).Bindings))
+}
+
+// CommandCounter mocks base method.
+func (m *MockStore) CommandCounter(did string, device uint32) uint64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CommandCounter", did, device)
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// CommandCounter indicates an expected call of CommandCounter.
+func (mr *MockStoreMockRecorder) CommandCounter(did, device interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CommandCounter", reflect.TypeOf((*MockStore)(nil).CommandCounter), did, device)
+}
+
+// DelayedTransaction mocks base method.
+func (m *MockStore) DelayedTransaction(txID string) *DelayedTransaction {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DelayedTransaction", txID)
+	ret0, _ := ret[0].(*DelayedTransaction)
+	return ret0
+}
+
+// DelayedTransaction indicates an expected call of DelayedTransaction.
+func (mr *MockStoreMockRecorder) DelayedTransaction(txID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DelayedTransaction", reflect.TypeOf((*MockStore)(nil).DelayedTransaction), txID)
+}
+
+// DelayedTransactions mocks base method.
+func (m *MockStore) DelayedTransactions() []DelayedTransaction {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DelayedTransactions")
+	ret0, _ := ret[0].([]DelayedTransaction)
+	return ret0
+}
+
+// DelayedTransactions indicates an expected call of DelayedTransactions.
+func (mr *MockStoreMockRecorder) DelayedTransactions() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DelayedTransactions", reflect.TypeOf((*MockStore)(nil).DelayedTransactions))
+}
+
+// DeviceBindings mocks base method.
+func (m *MockStore) DeviceBindings(did string) []DeviceBinding {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeviceBindings", did)
+	ret0, _ := ret[0].([]DeviceBinding)
+	return ret0
+}
+
+// DeviceBindings indicates an expected call of DeviceBindings.
+func (mr *MockStoreMockRecorder) DeviceBindings(did interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteBinding", reflect.TypeOf((*MockStore)(nil).CompleteBinding), did)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeviceBindings", reflect.TypeOf((*MockStore)(nil).DeviceBindings), did)
 }
 
 // HasBinding mocks base method.
-func (m *MockStore) HasBinding(did string) bool {
+func (m *MockStore) HasBinding(did string, device uint32) bool {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "HasBinding", did)
+	ret := m.ctrl.Call(m, "HasBinding", did, device)
 	ret0, _ := ret[0].(bool)
 	return ret0
 }
 
 // HasBinding indicates an expected call of HasBinding.
-func (mr *MockStoreMockRecorder) HasBinding(did interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) HasBinding(did, device interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HasBinding", reflect.TypeOf((*MockStore)(nil).HasBinding), did, device)
+}
+
+// IdentityRotations mocks base method.
+func (m *MockStore) IdentityRotations() []IdentityRotation {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IdentityRotations")
+	ret0, _ := ret[0].([]IdentityRotation)
+	return ret0
+}
+
+// IdentityRotations indicates an expected call of IdentityRotations.
+func (mr *MockStoreMockRecorder) IdentityRotations() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HasBinding", reflect.TypeOf((*MockStore)(nil).HasBinding), did)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IdentityRotations", reflect.TypeOf((*MockStore)(nil).IdentityRotations))
+}
+
+// Invitation mocks base method.
+func (m *MockStore) Invitation(nonce string) *Invitation {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Invitation", nonce)
+	ret0, _ := ret[0].(*Invitation)
+	return ret0
+}
+
+// Invitation indicates an expected call of Invitation.
+func (mr *MockStoreMockRecorder) Invitation(nonce interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Invitation", reflect.TypeOf((*MockStore)(nil).Invitation), nonce)
+}
+
+// Invitations mocks base method.
+func (m *MockStore) Invitations() []Invitation {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Invitations")
+	ret0, _ := ret[0].([]Invitation)
+	return ret0
+}
+
+// Invitations indicates an expected call of Invitations.
+func (mr *MockStoreMockRecorder) Invitations() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Invitations", reflect.TypeOf((*MockStore)(nil).Invitations))
+}
+
+// IsTrustedAddress mocks base method.
+func (m *MockStore) IsTrustedAddress(address string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsTrustedAddress", address)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsTrustedAddress indicates an expected call of IsTrustedAddress.
+func (mr *MockStoreMockRecorder) IsTrustedAddress(address interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsTrustedAddress", reflect.TypeOf((*MockStore)(nil).IsTrustedAddress), address)
+}
+
+// Member mocks base method.
+func (m *MockStore) Member(memberDID string) *Member {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Member", memberDID)
+	ret0, _ := ret[0].(*Member)
+	return ret0
+}
+
+// Member indicates an expected call of Member.
+func (mr *MockStoreMockRecorder) Member(memberDID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Member", reflect.TypeOf((*MockStore)(nil).Member), memberDID)
 }
 
 // MemberAccessMode mocks base method.
@@ -94,6 +334,149 @@ func (mr *MockStoreMockRecorder) MemberAccessMode(memberDID interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MemberAccessMode", reflect.TypeOf((*MockStore)(nil).MemberAccessMode), memberDID)
 }
 
+// MemberRPCPolicy mocks base method.
+func (m *MockStore) MemberRPCPolicy(memberDID string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MemberRPCPolicy", memberDID)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MemberRPCPolicy indicates an expected call of MemberRPCPolicy.
+func (mr *MockStoreMockRecorder) MemberRPCPolicy(memberDID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MemberRPCPolicy", reflect.TypeOf((*MockStore)(nil).MemberRPCPolicy), memberDID)
+}
+
+// Members mocks base method.
+func (m *MockStore) Members() []Member {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Members")
+	ret0, _ := ret[0].([]Member)
+	return ret0
+}
+
+// Members indicates an expected call of Members.
+func (mr *MockStoreMockRecorder) Members() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Members", reflect.TypeOf((*MockStore)(nil).Members))
+}
+
+// Owner mocks base method.
+func (m *MockStore) Owner() (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Owner")
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Owner indicates an expected call of Owner.
+func (mr *MockStoreMockRecorder) Owner() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Owner", reflect.TypeOf((*MockStore)(nil).Owner))
+}
+
+// OwnershipEvents mocks base method.
+func (m *MockStore) OwnershipEvents() []OwnershipEvent {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "OwnershipEvents")
+	ret0, _ := ret[0].([]OwnershipEvent)
+	return ret0
+}
+
+// OwnershipEvents indicates an expected call of OwnershipEvents.
+func (mr *MockStoreMockRecorder) OwnershipEvents() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OwnershipEvents", reflect.TypeOf((*MockStore)(nil).OwnershipEvents))
+}
+
+// PendingApproval mocks base method.
+func (m *MockStore) PendingApproval(txID string) *PendingApproval {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PendingApproval", txID)
+	ret0, _ := ret[0].(*PendingApproval)
+	return ret0
+}
+
+// PendingApproval indicates an expected call of PendingApproval.
+func (mr *MockStoreMockRecorder) PendingApproval(txID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PendingApproval", reflect.TypeOf((*MockStore)(nil).PendingApproval), txID)
+}
+
+// PendingApprovals mocks base method.
+func (m *MockStore) PendingApprovals() []PendingApproval {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PendingApprovals")
+	ret0, _ := ret[0].([]PendingApproval)
+	return ret0
+}
+
+// PendingApprovals indicates an expected call of PendingApprovals.
+func (mr *MockStoreMockRecorder) PendingApprovals() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PendingApprovals", reflect.TypeOf((*MockStore)(nil).PendingApprovals))
+}
+
+// PendingOwnershipTransfer mocks base method.
+func (m *MockStore) PendingOwnershipTransfer() *OwnershipTransfer {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PendingOwnershipTransfer")
+	ret0, _ := ret[0].(*OwnershipTransfer)
+	return ret0
+}
+
+// PendingOwnershipTransfer indicates an expected call of PendingOwnershipTransfer.
+func (mr *MockStoreMockRecorder) PendingOwnershipTransfer() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PendingOwnershipTransfer", reflect.TypeOf((*MockStore)(nil).PendingOwnershipTransfer))
+}
+
+// RemoveBinding mocks base method.
+func (m *MockStore) RemoveBinding(did string, device uint32) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveBinding", did, device)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveBinding indicates an expected call of RemoveBinding.
+func (mr *MockStoreMockRecorder) RemoveBinding(did, device interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveBinding", reflect.TypeOf((*MockStore)(nil).RemoveBinding), did, device)
+}
+
+// RemoveDelayedTransaction mocks base method.
+func (m *MockStore) RemoveDelayedTransaction(txID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveDelayedTransaction", txID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveDelayedTransaction indicates an expected call of RemoveDelayedTransaction.
+func (mr *MockStoreMockRecorder) RemoveDelayedTransaction(txID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveDelayedTransaction", reflect.TypeOf((*MockStore)(nil).RemoveDelayedTransaction), txID)
+}
+
+// RemoveExpiredMembers mocks base method.
+func (m *MockStore) RemoveExpiredMembers(now time.Time) ([]Member, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveExpiredMembers", now)
+	ret0, _ := ret[0].([]Member)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RemoveExpiredMembers indicates an expected call of RemoveExpiredMembers.
+func (mr *MockStoreMockRecorder) RemoveExpiredMembers(now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveExpiredMembers", reflect.TypeOf((*MockStore)(nil).RemoveExpiredMembers), now)
+}
+
 // RemoveMember mocks base method.
 func (m *MockStore) RemoveMember(memberDID string) error {
 	m.ctrl.T.Helper()
@@ -108,30 +491,299 @@ func (mr *MockStoreMockRecorder) RemoveMember(memberDID interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveMember", reflect.TypeOf((*MockStore)(nil).RemoveMember), memberDID)
 }
 
-// SetBinding mocks base method.
-func (m *MockStore) SetBinding(did, nonce string) error {
+// RemovePendingApproval mocks base method.
+func (m *MockStore) RemovePendingApproval(txID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemovePendingApproval", txID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemovePendingApproval indicates an expected call of RemovePendingApproval.
+func (mr *MockStoreMockRecorder) RemovePendingApproval(txID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemovePendingApproval", reflect.TypeOf((*MockStore)(nil).RemovePendingApproval), txID)
+}
+
+// RemovePendingOwnershipTransfer mocks base method.
+func (m *MockStore) RemovePendingOwnershipTransfer() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemovePendingOwnershipTransfer")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemovePendingOwnershipTransfer indicates an expected call of RemovePendingOwnershipTransfer.
+func (mr *MockStoreMockRecorder) RemovePendingOwnershipTransfer() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemovePendingOwnershipTransfer", reflect.TypeOf((*MockStore)(nil).RemovePendingOwnershipTransfer))
+}
+
+// RemoveSpending mocks base method.
+func (m *MockStore) RemoveSpending(did string, spentAt time.Time, txID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveSpending", did, spentAt, txID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveSpending indicates an expected call of RemoveSpending.
+func (mr *MockStoreMockRecorder) RemoveSpending(did, spentAt, txID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveSpending", reflect.TypeOf((*MockStore)(nil).RemoveSpending), did, spentAt, txID)
+}
+
+// RemoveTrustedAddress mocks base method.
+func (m *MockStore) RemoveTrustedAddress(address string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveTrustedAddress", address)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveTrustedAddress indicates an expected call of RemoveTrustedAddress.
+func (mr *MockStoreMockRecorder) RemoveTrustedAddress(address interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveTrustedAddress", reflect.TypeOf((*MockStore)(nil).RemoveTrustedAddress), address)
+}
+
+// RevokeBinding mocks base method.
+func (m *MockStore) RevokeBinding(did string, device uint32) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeBinding", did, device)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeBinding indicates an expected call of RevokeBinding.
+func (mr *MockStoreMockRecorder) RevokeBinding(did, device interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeBinding", reflect.TypeOf((*MockStore)(nil).RevokeBinding), did, device)
+}
+
+// RotateIdentity mocks base method.
+func (m *MockStore) RotateIdentity(rotation IdentityRotation, keyMaterial []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateIdentity", rotation, keyMaterial)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RotateIdentity indicates an expected call of RotateIdentity.
+func (mr *MockStoreMockRecorder) RotateIdentity(rotation, keyMaterial interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateIdentity", reflect.TypeOf((*MockStore)(nil).RotateIdentity), rotation, keyMaterial)
+}
+
+// SaveBindingSession mocks base method.
+func (m *MockStore) SaveBindingSession(did string, device uint32, session BindingSession) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveBindingSession", did, device, session)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveBindingSession indicates an expected call of SaveBindingSession.
+func (mr *MockStoreMockRecorder) SaveBindingSession(did, device, session interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveBindingSession", reflect.TypeOf((*MockStore)(nil).SaveBindingSession), did, device, session)
+}
+
+// SaveDelayedTransaction mocks base method.
+func (m *MockStore) SaveDelayedTransaction(tx DelayedTransaction) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveDelayedTransaction", tx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveDelayedTransaction indicates an expected call of SaveDelayedTransaction.
+func (mr *MockStoreMockRecorder) SaveDelayedTransaction(tx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveDelayedTransaction", reflect.TypeOf((*MockStore)(nil).SaveDelayedTransaction), tx)
+}
+
+// SaveInvitation mocks base method.
+func (m *MockStore) SaveInvitation(invitation Invitation) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveInvitation", invitation)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveInvitation indicates an expected call of SaveInvitation.
+func (mr *MockStoreMockRecorder) SaveInvitation(invitation interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveInvitation", reflect.TypeOf((*MockStore)(nil).SaveInvitation), invitation)
+}
+
+// SaveMember mocks base method.
+func (m *MockStore) SaveMember(member Member) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SetBinding", did, nonce)
+	ret := m.ctrl.Call(m, "SaveMember", member)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// SetBinding indicates an expected call of SetBinding.
-func (mr *MockStoreMockRecorder) SetBinding(did, nonce interface{}) *gomock.Call {
+// SaveMember indicates an expected call of SaveMember.
+func (mr *MockStoreMockRecorder) SaveMember(member interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveMember", reflect.TypeOf((*MockStore)(nil).SaveMember), member)
+}
+
+// SavePendingApproval mocks base method.
+func (m *MockStore) SavePendingApproval(approval PendingApproval) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SavePendingApproval", approval)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SavePendingApproval indicates an expected call of SavePendingApproval.
+func (mr *MockStoreMockRecorder) SavePendingApproval(approval interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SavePendingApproval", reflect.TypeOf((*MockStore)(nil).SavePendingApproval), approval)
+}
+
+// SetMemberRPCPolicy mocks base method.
+func (m *MockStore) SetMemberRPCPolicy(memberDID string, methods []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetMemberRPCPolicy", memberDID, methods)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetMemberRPCPolicy indicates an expected call of SetMemberRPCPolicy.
+func (mr *MockStoreMockRecorder) SetMemberRPCPolicy(memberDID, methods interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMemberRPCPolicy", reflect.TypeOf((*MockStore)(nil).SetMemberRPCPolicy), memberDID, methods)
+}
+
+// SetPendingOwnershipTransfer mocks base method.
+func (m *MockStore) SetPendingOwnershipTransfer(transfer OwnershipTransfer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetPendingOwnershipTransfer", transfer)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetPendingOwnershipTransfer indicates an expected call of SetPendingOwnershipTransfer.
+func (mr *MockStoreMockRecorder) SetPendingOwnershipTransfer(transfer interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPendingOwnershipTransfer", reflect.TypeOf((*MockStore)(nil).SetPendingOwnershipTransfer), transfer)
+}
+
+// SetSpendingLimit mocks base method.
+func (m *MockStore) SetSpendingLimit(did string, limit SpendingLimit) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetSpendingLimit", did, limit)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetSpendingLimit indicates an expected call of SetSpendingLimit.
+func (mr *MockStoreMockRecorder) SetSpendingLimit(did, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSpendingLimit", reflect.TypeOf((*MockStore)(nil).SetSpendingLimit), did, limit)
+}
+
+// SpendingLimit mocks base method.
+func (m *MockStore) SpendingLimit(did string) (SpendingLimit, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SpendingLimit", did)
+	ret0, _ := ret[0].(SpendingLimit)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SpendingLimit indicates an expected call of SpendingLimit.
+func (mr *MockStoreMockRecorder) SpendingLimit(did interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SpendingLimit", reflect.TypeOf((*MockStore)(nil).SpendingLimit), did)
+}
+
+// SpentSince mocks base method.
+func (m *MockStore) SpentSince(did string, since time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SpentSince", did, since)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SpentSince indicates an expected call of SpentSince.
+func (mr *MockStoreMockRecorder) SpentSince(did, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SpentSince", reflect.TypeOf((*MockStore)(nil).SpentSince), did, since)
+}
+
+// TouchMember mocks base method.
+func (m *MockStore) TouchMember(memberDID string, activeAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TouchMember", memberDID, activeAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TouchMember indicates an expected call of TouchMember.
+func (mr *MockStoreMockRecorder) TouchMember(memberDID, activeAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TouchMember", reflect.TypeOf((*MockStore)(nil).TouchMember), memberDID, activeAt)
+}
+
+// TransferOwnership mocks base method.
+func (m *MockStore) TransferOwnership(event OwnershipEvent) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransferOwnership", event)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TransferOwnership indicates an expected call of TransferOwnership.
+func (mr *MockStoreMockRecorder) TransferOwnership(event interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferOwnership", reflect.TypeOf((*MockStore)(nil).TransferOwnership), event)
+}
+
+// TrimAuditLog mocks base method.
+func (m *MockStore) TrimAuditLog(maxEntries int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TrimAuditLog", maxEntries)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TrimAuditLog indicates an expected call of TrimAuditLog.
+func (mr *MockStoreMockRecorder) TrimAuditLog(maxEntries interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TrimAuditLog", reflect.TypeOf((*MockStore)(nil).TrimAuditLog), maxEntries)
+}
+
+// TrustedAddresses mocks base method.
+func (m *MockStore) TrustedAddresses() []TrustedAddress {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TrustedAddresses")
+	ret0, _ := ret[0].([]TrustedAddress)
+	return ret0
+}
+
+// TrustedAddresses indicates an expected call of TrustedAddresses.
+func (mr *MockStoreMockRecorder) TrustedAddresses() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBinding", reflect.TypeOf((*MockStore)(nil).SetBinding), did, nonce)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TrustedAddresses", reflect.TypeOf((*MockStore)(nil).TrustedAddresses))
 }
 
-// UpdateMemberAccessMode mocks base method.
-func (m *MockStore) UpdateMemberAccessMode(memberDID string, accessMode AccessMode) error {
+// WriteSnapshot mocks base method.
+func (m *MockStore) WriteSnapshot(w io.Writer, maxAuditEntries int) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateMemberAccessMode", memberDID, accessMode)
+	ret := m.ctrl.Call(m, "WriteSnapshot", w, maxAuditEntries)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// UpdateMemberAccessMode indicates an expected call of UpdateMemberAccessMode.
-func (mr *MockStoreMockRecorder) UpdateMemberAccessMode(memberDID, accessMode interface{}) *gomock.Call {
+// WriteSnapshot indicates an expected call of WriteSnapshot.
+func (mr *MockStoreMockRecorder) WriteSnapshot(w, maxAuditEntries interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMemberAccessMode", reflect.TypeOf((*MockStore)(nil).UpdateMemberAccessMode), memberDID, accessMode)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteSnapshot", reflect.TypeOf((*MockStore)(nil).WriteSnapshot), w, maxAuditEntries)
 }
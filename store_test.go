@@ -6,52 +6,147 @@
 package main
 
 import (
-	"os"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
+// StoreTestSuite is the conformance suite which every Store implementation has to pass.
+// Each test runs against a new empty store.
 type StoreTestSuite struct {
 	suite.Suite
-	dbFile string
-	store  *BoltStore
+	newStore func(t *testing.T) Store
+	store    Store
 }
 
-func (s *StoreTestSuite) TearDownSuite() {
-	os.RemoveAll(s.dbFile)
+func (s *StoreTestSuite) SetupTest() {
+	s.store = s.newStore(s.T())
+}
+
+// memberRPCPolicy returns the custom allow list of a member and checks the store error
+func (s *StoreTestSuite) memberRPCPolicy(did string) []string {
+	methods, err := s.store.MemberRPCPolicy(did)
+	s.NoError(err)
+	return methods
+}
+
+// spendingLimit returns the spending limit of a DID and checks the store error
+func (s *StoreTestSuite) spendingLimit(did string) SpendingLimit {
+	limit, err := s.store.SpendingLimit(did)
+	s.NoError(err)
+	return limit
+}
+
+// spentSince returns the amount spent by a DID and checks the store error
+func (s *StoreTestSuite) spentSince(did string, since time.Time) int64 {
+	spent, err := s.store.SpentSince(did, since)
+	s.NoError(err)
+	return spent
+}
+
+// owner returns the owner of the store and checks the store error
+func (s *StoreTestSuite) owner() string {
+	owner, err := s.store.Owner()
+	s.NoError(err)
+	return owner
 }
 
 func (s *StoreTestSuite) TestBinding() {
 	did := "did:key:au-user"
 
-	bound := s.store.HasBinding(did)
+	bound := s.store.HasBinding(did, 1)
 	s.False(bound)
 
-	err := s.store.SetBinding(did, "123")
-	s.NoError(err)
+	s.Nil(s.store.BindingSession(did, 1))
 
-	nonce := s.store.BindingNonce(did)
-	s.Equal("123", nonce)
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	session := BindingSession{Label: "phone", Nonce: "123", CreatedAt: createdAt, TTL: bindingSessionTTL, TimestampWindow: bindingTimestampWindow}
+	err := s.store.SaveBindingSession(did, 1, session)
+	s.NoError(err)
+	s.Equal(&session, s.store.BindingSession(did, 1))
+	s.False(s.store.HasBinding(did, 1))
 
-	err = s.store.CompleteBinding(did)
+	session.Nonce = ""
+	session.Bound = true
+	session.BoundAt = &createdAt
+	err = s.store.SaveBindingSession(did, 1, session)
 	s.NoError(err)
 
-	bound = s.store.HasBinding(did)
+	bound = s.store.HasBinding(did, 1)
 	s.True(bound)
+
+	// bindings are kept for each device
+	s.False(s.store.HasBinding(did, 2))
+	s.NoError(s.store.SaveBindingSession(did, 12, BindingSession{Label: "tablet", Bound: true}))
+	s.True(s.store.HasBinding(did, 12))
+	s.Equal([]DeviceBinding{
+		{DID: did, Device: 1, BindingSession: session},
+		{DID: did, Device: 12, BindingSession: BindingSession{Label: "tablet", Bound: true}},
+	}, s.store.DeviceBindings(did))
+	s.Empty(s.store.DeviceBindings("did:key:au"))
+
+	s.NoError(s.store.RemoveBinding(did, 12))
+	s.False(s.store.HasBinding(did, 12))
+	s.True(s.store.HasBinding(did, 1))
+}
+
+func (s *StoreTestSuite) TestRevokeBinding() {
+	did := "did:key:lost-phone"
+	otherDID := "did:key:other-member"
+
+	s.NoError(s.store.SaveBindingSession(did, 1, BindingSession{Bound: true}))
+	s.NoError(s.store.SaveBindingSession(did, 2, BindingSession{Bound: true}))
+	s.NoError(s.store.SaveBindingSession(otherDID, 1, BindingSession{Bound: true}))
+	s.NoError(s.store.SaveMember(Member{DID: did, AccessMode: AccessModeLimited}))
+	s.NoError(s.store.SetMemberRPCPolicy(did, []string{"getbalances"}))
+
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	submitted := PendingApproval{TxID: "txid-submitted", Submitter: did, Approvals: []string{did}, Rejections: []string{}, CreatedAt: createdAt}
+	voted := PendingApproval{TxID: "txid-voted", Submitter: otherDID, Approvals: []string{otherDID, did}, Rejections: []string{}, CreatedAt: createdAt}
+	s.NoError(s.store.SavePendingApproval(submitted))
+	s.NoError(s.store.SavePendingApproval(voted))
+
+	s.Contains(s.store.Bindings(), DeviceBinding{DID: did, Device: 2, BindingSession: BindingSession{Bound: true}})
+	s.Contains(s.store.Bindings(), DeviceBinding{DID: otherDID, Device: 1, BindingSession: BindingSession{Bound: true}})
+
+	// the member record is kept while the DID has other devices
+	s.NoError(s.store.RevokeBinding(did, 1))
+	s.Nil(s.store.BindingSession(did, 1))
+	s.True(s.store.HasBinding(did, 2))
+	s.NotNil(s.store.Member(did))
+	s.NotNil(s.store.PendingApproval("txid-submitted"))
+
+	s.NoError(s.store.RevokeBinding(did, 0))
+	s.Nil(s.store.BindingSession(did, 2))
+	s.Nil(s.store.Member(did))
+	s.Empty(s.memberRPCPolicy(did))
+	s.Nil(s.store.PendingApproval("txid-submitted"))
+	s.Equal([]string{otherDID}, s.store.PendingApproval("txid-voted").Approvals)
+	s.True(s.store.HasBinding(otherDID, 1))
+
+	s.NoError(s.store.RemoveBinding(otherDID, 1))
+	s.Nil(s.store.BindingSession(otherDID, 1))
+	s.NoError(s.store.RemovePendingApproval("txid-voted"))
 }
 
 func (s *StoreTestSuite) TestMember() {
 	memberDID := "did:key:family-member"
 
 	// add the member with limited access
-	err := s.store.UpdateMemberAccessMode(memberDID, AccessModeLimited)
+	err := s.store.SaveMember(Member{DID: memberDID, AccessMode: AccessModeLimited})
 	s.NoError(err)
 	mode := s.store.MemberAccessMode(memberDID)
 	s.Equal(AccessModeLimited, mode)
 
 	// update its access to minimal
-	err = s.store.UpdateMemberAccessMode(memberDID, AccessModeMinimal)
+	err = s.store.SaveMember(Member{DID: memberDID, AccessMode: AccessModeMinimal})
 	s.NoError(err)
 	mode = s.store.MemberAccessMode(memberDID)
 	s.Equal(AccessModeMinimal, mode)
@@ -63,9 +158,527 @@ func (s *StoreTestSuite) TestMember() {
 	s.Equal(AccessModeNotApplicant, mode)
 }
 
-func TestStoreTestSuite(t *testing.T) {
+func (s *StoreTestSuite) TestMemberMetadata() {
+	memberDID := "did:key:family-member-with-metadata"
+	s.Nil(s.store.Member(memberDID))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	member := Member{
+		DID:        memberDID,
+		AccessMode: AccessModeLimited,
+		Label:      "Alice",
+		AddedBy:    "did:key:owner",
+		AddedAt:    now,
+	}
+	s.NoError(s.store.SaveMember(member))
+	s.Equal(&member, s.store.Member(memberDID))
+	s.Contains(s.store.Members(), member)
+
+	activeAt := now.Add(time.Hour)
+	s.NoError(s.store.TouchMember(memberDID, activeAt))
+	member.LastActiveAt = &activeAt
+	s.Equal(&member, s.store.Member(memberDID))
+
+	// touching an unknown member does not create it
+	s.NoError(s.store.TouchMember("did:key:unknown", activeAt))
+	s.Nil(s.store.Member("did:key:unknown"))
+
+	s.NoError(s.store.RemoveMember(memberDID))
+}
+
+func (s *StoreTestSuite) TestRemoveExpiredMembers() {
+	now := time.Now().UTC().Truncate(time.Second)
+	expiredAt := now.Add(-time.Minute)
+	expiresAt := now.Add(time.Hour)
+
+	expired := Member{DID: "did:key:expired-member", AccessMode: AccessModeLimited, ExpiresAt: &expiredAt}
+	active := Member{DID: "did:key:active-member", AccessMode: AccessModeLimited, ExpiresAt: &expiresAt}
+	s.NoError(s.store.SaveMember(expired))
+	s.NoError(s.store.SaveMember(active))
+	s.NoError(s.store.SetMemberRPCPolicy(expired.DID, []string{"getbalances"}))
+
+	removed, err := s.store.RemoveExpiredMembers(now)
+	s.NoError(err)
+	s.Equal([]Member{expired}, removed)
+	s.Nil(s.store.Member(expired.DID))
+	s.Nil(s.memberRPCPolicy(expired.DID))
+	s.Equal(&active, s.store.Member(active.DID))
+
+	s.NoError(s.store.RemoveMember(active.DID))
+}
+
+func (s *StoreTestSuite) TestMemberRPCPolicy() {
+	memberDID := "did:key:family-member-with-policy"
+
+	s.Nil(s.memberRPCPolicy(memberDID))
+
+	err := s.store.SetMemberRPCPolicy(memberDID, []string{"getbalances", "getnewaddress"})
+	s.NoError(err)
+	s.Equal([]string{"getbalances", "getnewaddress"}, s.memberRPCPolicy(memberDID))
+
+	// an empty list resets the policy
+	err = s.store.SetMemberRPCPolicy(memberDID, []string{})
+	s.NoError(err)
+	s.Nil(s.memberRPCPolicy(memberDID))
+
+	// removing a member also removes its policy
+	s.NoError(s.store.SaveMember(Member{DID: memberDID, AccessMode: AccessModeLimited}))
+	s.NoError(s.store.SetMemberRPCPolicy(memberDID, []string{"getbalances"}))
+	s.NoError(s.store.RemoveMember(memberDID))
+	s.Nil(s.memberRPCPolicy(memberDID))
+}
+
+func (s *StoreTestSuite) TestSpendingLimit() {
+	did := "did:key:spender"
+
+	s.Equal(SpendingLimit{}, s.spendingLimit(did))
+
+	limit := SpendingLimit{Daily: 100000, Weekly: 500000, PerTransaction: 50000}
+	s.NoError(s.store.SetSpendingLimit(did, limit))
+	s.Equal(limit, s.spendingLimit(did))
+}
+
+func (s *StoreTestSuite) TestSpending() {
+	did := "did:key:spender"
+	anotherDID := "did:key:spender-2"
+	now := time.Now()
+
+	s.Equal(int64(0), s.spentSince(did, now.Add(-time.Hour)))
+
+	s.NoError(s.store.AddSpending(did, 1000, now.Add(-8*24*time.Hour), "txid-1"))
+	s.NoError(s.store.AddSpending(did, 2000, now.Add(-2*24*time.Hour), "txid-2"))
+	s.NoError(s.store.AddSpending(did, 3000, now.Add(-time.Hour), "txid-3"))
+	s.NoError(s.store.AddSpending(anotherDID, 4000, now.Add(-time.Hour), "txid-4"))
+
+	s.Equal(int64(3000), s.spentSince(did, now.Add(-spendingDailyPeriod)))
+	s.Equal(int64(5000), s.spentSince(did, now.Add(-spendingWeeklyPeriod)))
+	// records older than the retention period are pruned
+	s.Equal(int64(5000), s.spentSince(did, now.Add(-30*24*time.Hour)))
+	s.Equal(int64(4000), s.spentSince(anotherDID, now.Add(-spendingDailyPeriod)))
+
+	// a removed record is no longer counted
+	s.NoError(s.store.RemoveSpending(did, now.Add(-time.Hour), "txid-3"))
+	s.Equal(int64(0), s.spentSince(did, now.Add(-spendingDailyPeriod)))
+	s.Equal(int64(4000), s.spentSince(anotherDID, now.Add(-spendingDailyPeriod)))
+
+	// transactions spent at the same time are refunded on their own
+	s.NoError(s.store.AddSpending(did, 500, now, "txid-5"))
+	s.NoError(s.store.AddSpending(did, 600, now, "txid-6"))
+	s.Equal(int64(1100), s.spentSince(did, now.Add(-spendingDailyPeriod)))
+	s.NoError(s.store.RemoveSpending(did, now, "txid-5"))
+	s.Equal(int64(600), s.spentSince(did, now.Add(-spendingDailyPeriod)))
+
+	// records added before they are keyed by txid are still refunded
+	s.NoError(s.store.AddSpending(did, 700, now.Add(-time.Minute), ""))
+	s.NoError(s.store.RemoveSpending(did, now.Add(-time.Minute), "txid-7"))
+	s.Equal(int64(600), s.spentSince(did, now.Add(-spendingDailyPeriod)))
+}
+
+func (s *StoreTestSuite) TestTrustedAddress() {
+	address := "tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh"
+
+	s.False(s.store.IsTrustedAddress(address))
+	s.Empty(s.store.TrustedAddresses())
+
+	s.NoError(s.store.AddTrustedAddress(TrustedAddress{Address: address, Label: "savings", AddedBy: "did:key:owner"}))
+	s.True(s.store.IsTrustedAddress(address))
+
+	addresses := s.store.TrustedAddresses()
+	s.Len(addresses, 1)
+	s.Equal(address, addresses[0].Address)
+	s.Equal("savings", addresses[0].Label)
+	s.Equal("did:key:owner", addresses[0].AddedBy)
+
+	s.NoError(s.store.RemoveTrustedAddress(address))
+	s.False(s.store.IsTrustedAddress(address))
+}
+
+func (s *StoreTestSuite) TestPendingApproval() {
+	s.Nil(s.store.PendingApproval("txid"))
+	s.Empty(s.store.PendingApprovals())
+
+	approval := PendingApproval{
+		TxID:       "txid",
+		PSBT:       "psbt",
+		Submitter:  "did:key:submitter",
+		Payments:   []Payment{{Address: "tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh", Amount: 1000}},
+		Approvals:  []string{"did:key:submitter"},
+		Rejections: []string{},
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	s.NoError(s.store.SavePendingApproval(approval))
+	s.Equal(&approval, s.store.PendingApproval("txid"))
+	s.Equal([]PendingApproval{approval}, s.store.PendingApprovals())
+
+	s.NoError(s.store.RemovePendingApproval("txid"))
+	s.Nil(s.store.PendingApproval("txid"))
+}
+
+func (s *StoreTestSuite) TestDelayedTransaction() {
+	s.Nil(s.store.DelayedTransaction("txid"))
+	s.Empty(s.store.DelayedTransactions())
+
+	now := time.Now().UTC().Truncate(time.Second)
+	delayedTx := DelayedTransaction{
+		TxID:        "txid",
+		Hex:         "0200000000",
+		Submitter:   "did:key:submitter",
+		Amount:      1000000,
+		CreatedAt:   now,
+		BroadcastAt: now.Add(24 * time.Hour),
+	}
+	s.NoError(s.store.SaveDelayedTransaction(delayedTx))
+	s.Equal(&delayedTx, s.store.DelayedTransaction("txid"))
+	s.Equal([]DelayedTransaction{delayedTx}, s.store.DelayedTransactions())
+
+	s.NoError(s.store.RemoveDelayedTransaction("txid"))
+	s.Nil(s.store.DelayedTransaction("txid"))
+}
+
+func (s *StoreTestSuite) TestOwnership() {
+	s.Equal("", s.owner())
+	s.Nil(s.store.PendingOwnershipTransfer())
+	s.Empty(s.store.OwnershipEvents())
+
+	now := time.Now().UTC().Truncate(time.Second)
+	transfer := OwnershipTransfer{
+		NewOwner:    "did:key:new-owner",
+		Nonce:       "1eba606e",
+		InitiatedBy: "did:key:owner",
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ownershipTransferTTL),
+	}
+	s.NoError(s.store.SetPendingOwnershipTransfer(transfer))
+	s.Equal(&transfer, s.store.PendingOwnershipTransfer())
+
+	initiated := OwnershipEvent{
+		Event:         ownershipEventInitiated,
+		PreviousOwner: "did:key:owner",
+		NewOwner:      "did:key:new-owner",
+		At:            now,
+	}
+	s.NoError(s.store.AddOwnershipEvent(initiated))
+
+	accepted := initiated
+	accepted.Event = ownershipEventAccepted
+	accepted.At = now.Add(time.Minute)
+	s.NoError(s.store.TransferOwnership(accepted))
+
+	s.Equal("did:key:new-owner", s.owner())
+	s.Nil(s.store.PendingOwnershipTransfer())
+	s.Equal([]OwnershipEvent{initiated, accepted}, s.store.OwnershipEvents())
+
+	s.NoError(s.store.SetPendingOwnershipTransfer(transfer))
+	s.NoError(s.store.RemovePendingOwnershipTransfer())
+	s.Nil(s.store.PendingOwnershipTransfer())
+}
+
+func (s *StoreTestSuite) TestInvitation() {
+	s.Nil(s.store.Invitation("nonce"))
+	s.Empty(s.store.Invitations())
+
+	now := time.Now().UTC().Truncate(time.Second)
+	invitation := Invitation{
+		Nonce:      "nonce",
+		AccessMode: AccessModeLimited,
+		CreatedBy:  "did:key:owner",
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(invitationDefaultTTL),
+	}
+	s.NoError(s.store.SaveInvitation(invitation))
+	s.Equal(&invitation, s.store.Invitation("nonce"))
+
+	invitation.RedeemedBy = "did:key:member"
+	invitation.RedeemedAt = &now
+	s.NoError(s.store.SaveInvitation(invitation))
+	s.Equal([]Invitation{invitation}, s.store.Invitations())
+}
+
+func (s *StoreTestSuite) TestCommandCounter() {
+	did := "did:key:signing-member"
+
+	s.Equal(uint64(0), s.store.CommandCounter(did, 1))
+	s.NoError(s.store.AdvanceCommandCounter(did, 1, 5))
+	s.Equal(uint64(5), s.store.CommandCounter(did, 1))
+	s.Equal(ErrStaleCommandCounter, s.store.AdvanceCommandCounter(did, 1, 5))
+	s.Equal(ErrStaleCommandCounter, s.store.AdvanceCommandCounter(did, 1, 4))
+	s.NoError(s.store.AdvanceCommandCounter(did, 1, 6))
+
+	// each device has its own counter
+	s.NoError(s.store.AdvanceCommandCounter(did, 2, 1))
+
+	// counters are reset once the binding is removed
+	s.NoError(s.store.RemoveBinding(did, 1))
+	s.Equal(uint64(0), s.store.CommandCounter(did, 1))
+	s.NoError(s.store.RevokeBinding(did, 0))
+	s.Equal(uint64(0), s.store.CommandCounter(did, 2))
+}
+
+func (s *StoreTestSuite) TestNotFound() {
+	did := "did:key:unknown"
+
+	s.Nil(s.store.BindingSession(did, 1))
+	s.False(s.store.HasBinding(did, 1))
+	s.Equal([]DeviceBinding{}, s.store.Bindings())
+	s.Equal([]DeviceBinding{}, s.store.DeviceBindings(did))
+	s.Nil(s.store.Member(did))
+	s.Equal([]Member{}, s.store.Members())
+	s.Equal(AccessModeNotApplicant, s.store.MemberAccessMode(did))
+	s.Nil(s.memberRPCPolicy(did))
+	s.Equal(SpendingLimit{}, s.spendingLimit(did))
+	s.Equal(int64(0), s.spentSince(did, time.Time{}))
+	s.False(s.store.IsTrustedAddress("tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh"))
+	s.Equal([]TrustedAddress{}, s.store.TrustedAddresses())
+	s.Nil(s.store.PendingApproval("txid"))
+	s.Equal([]PendingApproval{}, s.store.PendingApprovals())
+	s.Nil(s.store.DelayedTransaction("txid"))
+	s.Equal([]DelayedTransaction{}, s.store.DelayedTransactions())
+	s.Equal("", s.owner())
+	s.Nil(s.store.PendingOwnershipTransfer())
+	s.Equal([]OwnershipEvent{}, s.store.OwnershipEvents())
+	s.Nil(s.store.Invitation("nonce"))
+	s.Equal([]Invitation{}, s.store.Invitations())
+	s.Equal(uint64(0), s.store.CommandCounter(did, 1))
+	s.Equal([]AuditEntry{}, s.store.AuditEntries(AuditQuery{}))
+
+	// removing what does not exist is not an error
+	s.NoError(s.store.RemoveBinding(did, 1))
+	s.NoError(s.store.RevokeBinding(did, 0))
+	s.NoError(s.store.RemoveMember(did))
+	s.NoError(s.store.TouchMember(did, time.Now()))
+	s.NoError(s.store.SetMemberRPCPolicy(did, nil))
+	s.NoError(s.store.RemoveTrustedAddress("tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh"))
+	s.NoError(s.store.RemovePendingApproval("txid"))
+	s.NoError(s.store.RemoveDelayedTransaction("txid"))
+	s.NoError(s.store.RemovePendingOwnershipTransfer())
+
+	removed, err := s.store.RemoveExpiredMembers(time.Now())
+	s.NoError(err)
+	s.Empty(removed)
+	s.Nil(s.store.Member(did))
+}
+
+func (s *StoreTestSuite) TestOrder() {
+	// values are returned in the byte order of their keys
+	for _, did := range []string{"did:key:c", "did:key:a", "did:key:b"} {
+		s.NoError(s.store.SaveMember(Member{DID: did, AccessMode: AccessModeLimited}))
+	}
+	for _, device := range []uint32{2, 10, 1} {
+		s.NoError(s.store.SaveBindingSession("did:key:a", device, BindingSession{Bound: true}))
+	}
+	s.NoError(s.store.SaveBindingSession("did:key:a2", 1, BindingSession{Bound: true}))
+
+	dids := make([]string, 0)
+	for _, m := range s.store.Members() {
+		dids = append(dids, m.DID)
+	}
+	s.Equal([]string{"did:key:a", "did:key:b", "did:key:c"}, dids)
+
+	devices := make([]uint32, 0)
+	for _, b := range s.store.DeviceBindings("did:key:a") {
+		devices = append(devices, b.Device)
+	}
+	s.Equal([]uint32{1, 10, 2}, devices)
+	s.Len(s.store.Bindings(), 4)
+}
+
+func (s *StoreTestSuite) TestValuesAreCopied() {
+	approval := PendingApproval{TxID: "txid", Submitter: "did:key:submitter", Approvals: []string{"did:key:submitter"}, Rejections: []string{}}
+	s.NoError(s.store.SavePendingApproval(approval))
+
+	// modifying values does not change the store
+	approval.Approvals[0] = "did:key:someone-else"
+	saved := s.store.PendingApproval("txid")
+	s.Equal([]string{"did:key:submitter"}, saved.Approvals)
+
+	saved.Approvals = append(saved.Approvals, "did:key:approver")
+	s.Equal([]string{"did:key:submitter"}, s.store.PendingApproval("txid").Approvals)
+}
+
+func (s *StoreTestSuite) TestAuditLog() {
+	seal := func(e *AuditEntry) error {
+		e.Hash = fmt.Sprintf("hash-%d", e.Seq)
+		return nil
+	}
+	for _, command := range []string{"set_member", "finish_psbt", "list_members"} {
+		s.NoError(s.store.AppendAuditEntry(AuditEntry{DID: "did:key:owner", Command: command}, seal))
+	}
+
+	entries := s.store.AuditEntries(AuditQuery{})
+	s.Len(entries, 3)
+	s.Equal(uint64(1), entries[0].Seq)
+	s.Equal("", entries[0].PrevHash)
+	s.Equal("hash-1", entries[1].PrevHash)
+	s.Equal("hash-2", entries[2].PrevHash)
+
+	s.Equal(entries[1:2], s.store.AuditEntries(AuditQuery{AfterSeq: 1, Limit: 1}))
+	s.Equal(entries[1:2], s.store.AuditEntries(AuditQuery{Command: "finish_psbt"}))
+
+	// an entry is not appended if it fails to be sealed
+	s.EqualError(s.store.AppendAuditEntry(AuditEntry{}, func(*AuditEntry) error {
+		return fmt.Errorf("fail to sign")
+	}), "fail to sign")
+	s.Len(s.store.AuditEntries(AuditQuery{}), 3)
+}
+
+func (s *StoreTestSuite) TestIdentityRotation() {
+	s.Empty(s.store.IdentityRotations())
+
+	rotatedAt := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	first := IdentityRotation{OldDID: "did:key:pod-1", NewDID: "did:key:pod-2", RotatedAt: rotatedAt, GraceUntil: rotatedAt.Add(time.Hour)}
+	second := IdentityRotation{OldDID: "did:key:pod-2", NewDID: "did:key:pod-3", RotatedAt: rotatedAt.Add(2 * time.Hour), GraceUntil: rotatedAt.Add(3 * time.Hour)}
+	s.NoError(s.store.RotateIdentity(first, nil))
+	s.NoError(s.store.RotateIdentity(second, nil))
+
+	rotations := s.store.IdentityRotations()
+	s.Len(rotations, 2)
+	s.Equal("did:key:pod-2", rotations[0].NewDID)
+	s.Equal("did:key:pod-3", rotations[1].NewDID)
+	s.True(second.GraceUntil.Equal(rotations[1].GraceUntil))
+}
+
+func (s *StoreTestSuite) TestTrimAuditLog() {
+	seal := func(e *AuditEntry) error {
+		e.Hash = fmt.Sprintf("hash-%d", e.Seq)
+		return nil
+	}
+	removed, err := s.store.TrimAuditLog(2)
+	s.NoError(err)
+	s.Equal(0, removed)
+
+	for i := 0; i < 5; i++ {
+		s.NoError(s.store.AppendAuditEntry(AuditEntry{DID: "did:key:owner"}, seal))
+	}
+
+	removed, err = s.store.TrimAuditLog(2)
+	s.NoError(err)
+	s.Equal(3, removed)
+	s.Equal(AuditAnchor{Seq: 3, Hash: "hash-3"}, s.store.AuditLogAnchor())
+	s.Equal(AuditHead{Seq: 5, Hash: "hash-5"}, s.store.AuditLogHead())
+
+	entries := s.store.AuditEntries(AuditQuery{})
+	s.Len(entries, 2)
+	s.Equal(uint64(4), entries[0].Seq)
+	s.Equal("hash-3", entries[0].PrevHash)
+
+	removed, err = s.store.TrimAuditLog(2)
+	s.NoError(err)
+	s.Equal(0, removed)
+
+	// new entries keep the sequence after trimming
+	s.NoError(s.store.AppendAuditEntry(AuditEntry{DID: "did:key:owner"}, seal))
+	entries = s.store.AuditEntries(AuditQuery{AfterSeq: 5})
+	s.Len(entries, 1)
+	s.Equal(uint64(6), entries[0].Seq)
+	s.Equal("hash-5", entries[0].PrevHash)
+}
+
+func (s *StoreTestSuite) TestConcurrency() {
+	const workers = 8
+	const rounds = 20
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	stale := make([]int, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			did := fmt.Sprintf("did:key:member-%d", w)
+			for i := 0; i < rounds; i++ {
+				s.NoError(s.store.SaveMember(Member{DID: did, AccessMode: AccessModeLimited}))
+				s.NoError(s.store.SaveBindingSession(did, uint32(i%2+1), BindingSession{Bound: true}))
+				s.NoError(s.store.AddSpending("did:key:shared", 1, now.Add(time.Duration(w*rounds+i)*time.Second), fmt.Sprintf("txid-%d-%d", w, i)))
+				s.NoError(s.store.AppendAuditEntry(AuditEntry{DID: did}, func(*AuditEntry) error { return nil }))
+
+				// all workers race on the counter of a shared device
+				if s.store.AdvanceCommandCounter("did:key:shared", 1, uint64(i+1)) == ErrStaleCommandCounter {
+					stale[w]++
+				}
+				s.store.Members()
+				s.store.HasBinding(did, 1)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	s.Len(s.store.Members(), workers)
+	s.Len(s.store.Bindings(), workers*2)
+	s.Equal(int64(workers*rounds), s.spentSince("did:key:shared", now))
+	s.Equal(uint64(rounds), s.store.CommandCounter("did:key:shared", 1))
+
+	// each counter is accepted once at most
+	total := 0
+	for _, n := range stale {
+		total += n
+	}
+	s.GreaterOrEqual(total, (workers-1)*rounds)
+
+	// sequences of the audit log are unique and continuous
+	entries := s.store.AuditEntries(AuditQuery{})
+	s.Len(entries, workers*rounds)
+	for i, e := range entries {
+		s.Equal(uint64(i+1), e.Seq)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	suite.Run(t, &StoreTestSuite{
+		newStore: func(t *testing.T) Store {
+			s := NewBoltStore(filepath.Join(t.TempDir(), "test.db"), []byte("store key material"))
+			t.Cleanup(func() { s.db.Close() })
+			return s
+		},
+	})
+}
+
+func TestBoltStoreSnapshotTrimsAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	s := NewBoltStore(filepath.Join(dir, "test.db"), []byte("store key material"))
+	defer s.db.Close()
+
+	seal := func(e *AuditEntry) error {
+		e.Hash = fmt.Sprintf("hash-%d", e.Seq)
+		return nil
+	}
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, s.AppendAuditEntry(AuditEntry{DID: "did:key:owner"}, seal))
+	}
+	assert.NoError(t, s.SaveMember(Member{DID: "did:key:member", AccessMode: AccessModeLimited}))
+
+	open := func(maxAuditEntries int) *BoltStore {
+		var snapshot bytes.Buffer
+		assert.NoError(t, s.WriteSnapshot(&snapshot, maxAuditEntries))
+		path := filepath.Join(dir, fmt.Sprintf("snapshot-%d.db", maxAuditEntries))
+		assert.NoError(t, ioutil.WriteFile(path, snapshot.Bytes(), 0600))
+		copied, err := openBoltStore(path, []byte("store key material"))
+		assert.NoError(t, err)
+		t.Cleanup(func() { copied.db.Close() })
+		return copied
+	}
+
+	// the latest entries are kept and chained to the new anchor
+	copied := open(20)
+	entries := copied.AuditEntries(AuditQuery{})
+	assert.Len(t, entries, 20)
+	assert.Equal(t, uint64(31), entries[0].Seq)
+	assert.Equal(t, "hash-30", entries[0].PrevHash)
+	assert.Equal(t, AuditAnchor{Seq: 30, Hash: "hash-30"}, copied.AuditLogAnchor())
+	assert.Equal(t, AuditHead{Seq: 50, Hash: "hash-50"}, copied.AuditLogHead())
+	assert.Equal(t, AccessModeLimited, copied.MemberAccessMode("did:key:member"))
+
+	// the store itself is untouched
+	assert.Len(t, s.AuditEntries(AuditQuery{}), 50)
+	assert.Equal(t, AuditAnchor{}, s.AuditLogAnchor())
+
+	assert.Len(t, open(50).AuditEntries(AuditQuery{}), 50)
+	assert.Len(t, open(0).AuditEntries(AuditQuery{}), 50)
+}
+
+func TestMemoryStore(t *testing.T) {
 	suite.Run(t, &StoreTestSuite{
-		dbFile: "test.db",
-		store:  NewBoltStore("test.db"),
+		newStore: func(*testing.T) Store {
+			return NewMemoryStore()
+		},
 	})
 }
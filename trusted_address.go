@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// TrustedAddress is an entry of the address book which the pod is allowed to pay to
+type TrustedAddress struct {
+	Address string    `json:"address"`
+	Label   string    `json:"label"`
+	AddedBy string    `json:"added_by"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// UntrustedAddressError is returned if a transaction pays to addresses out of the address book
+type UntrustedAddressError struct {
+	Addresses []string
+}
+
+func (e *UntrustedAddressError) Error() string {
+	return "paying to untrusted addresses"
+}
+
+func (e *UntrustedAddressError) Code() string {
+	return "untrusted_address"
+}
+
+func (e *UntrustedAddressError) Details() interface{} {
+	return map[string]interface{}{
+		"addresses": e.Addresses,
+	}
+}
+
+// checkTrustedAddresses ensures every payment goes to an address in the address book
+func (c *Controller) checkTrustedAddresses(payments []Payment) error {
+	untrusted := make([]string, 0)
+	for _, p := range payments {
+		if p.Address == "" || !c.store.IsTrustedAddress(p.Address) {
+			untrusted = append(untrusted, p.Address)
+		}
+	}
+
+	if len(untrusted) > 0 {
+		return &UntrustedAddressError{Addresses: untrusted}
+	}
+	return nil
+}
+
+// addTrustedAddress adds an address into the address book
+func (c *Controller) addTrustedAddress(did, address, label string) (map[string]string, error) {
+	address, err := normalizeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.store.AddTrustedAddress(TrustedAddress{
+		Address: address,
+		Label:   label,
+		AddedBy: did,
+		AddedAt: c.now(),
+	}); err != nil {
+		return nil, err
+	}
+	return map[string]string{"status": "ok"}, nil
+}
+
+// removeTrustedAddress removes an address from the address book
+func (c *Controller) removeTrustedAddress(address string) (map[string]string, error) {
+	address, err := normalizeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.store.IsTrustedAddress(address) {
+		return nil, fmt.Errorf("address not found")
+	}
+
+	if err := c.store.RemoveTrustedAddress(address); err != nil {
+		return nil, err
+	}
+	return map[string]string{"status": "ok"}, nil
+}
+
+// listTrustedAddresses returns all addresses in the address book
+func (c *Controller) listTrustedAddresses() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"addresses": c.store.TrustedAddresses(),
+	}, nil
+}
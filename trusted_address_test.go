@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckTrustedAddresses(t *testing.T) {
+	trustedAddress := "tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh"
+	untrustedAddress := "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().IsTrustedAddress(trustedAddress).AnyTimes().Return(true)
+	mockedStore.EXPECT().IsTrustedAddress(untrustedAddress).AnyTimes().Return(false)
+
+	c := Controller{store: mockedStore}
+
+	assert.NoError(t, c.checkTrustedAddresses([]Payment{{Address: trustedAddress, Amount: 1000}}))
+
+	err := c.checkTrustedAddresses([]Payment{
+		{Address: trustedAddress, Amount: 1000},
+		{Address: untrustedAddress, Amount: 1000},
+		{Address: "", Amount: 1000},
+	})
+	assert.EqualError(t, err, "paying to untrusted addresses")
+	var untrustedErr *UntrustedAddressError
+	assert.True(t, errors.As(err, &untrustedErr))
+	assert.Equal(t, []string{untrustedAddress, ""}, untrustedErr.Addresses)
+}
+
+func TestAddTrustedAddress(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().AddTrustedAddress(gomock.Any()).Times(1).DoAndReturn(func(a TrustedAddress) error {
+		assert.Equal(t, "tb1q5g27r0rqs3da3ekhhep08ylxg7v6gcds3pgtrh", a.Address)
+		assert.Equal(t, "savings", a.Label)
+		assert.Equal(t, ownerDID, a.AddedBy)
+		return nil
+	})
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore}
+
+	_, err := c.addTrustedAddress(ownerDID, "TB1Q5G27R0RQS3DA3EKHHEP08YLXG7V6GCDS3PGTRH", "savings")
+	assert.NoError(t, err)
+
+	_, err = c.addTrustedAddress(ownerDID, "not-an-address", "savings")
+	assert.EqualError(t, err, "invalid address: not-an-address")
+}
+
+func TestFinishPSBTOverrideByNonOwner(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	c := Controller{ownerDID: ownerDID}
+
+	_, err := c.finishPSBT(memberDID, FinishPSBTRPCParams{PSBT: "cHNidP8A", AllowUntrustedAddresses: true})
+	assert.EqualError(t, err, "only the owner is allowed to pay to untrusted addresses")
+}
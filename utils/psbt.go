@@ -0,0 +1,22 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/psbt"
+)
+
+// DecodePSBTUnsignedTx extracts the unsigned transaction from a base64 encoded PSBT
+func DecodePSBTUnsignedTx(encoded string) (*wire.MsgTx, error) {
+	p, err := psbt.NewFromRawBytes(strings.NewReader(encoded), true)
+	if err != nil {
+		return nil, err
+	}
+	return p.UnsignedTx, nil
+}
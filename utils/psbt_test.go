@@ -0,0 +1,40 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPSBT = "cHNidP8BAH0CAAAAAUtbuwAXBenDq8soKdRpZVRcDx3om/g1s+/EUOlp1aw2AQAAAAD+////AooCAAAAAAAAIgAgptJpKonsWEFQBfZlFGIflekEgQhAs5wG3ESE0p3Vz5ftIwAAAAAAABYAFKIV4bxghFvY5te+QvOT5keZpGGwAAAAAAABAHECAAAAASAt8DNNC05TTcogbRwahlBvRaXG52a6sZJ549IkFKBlAQAAAAD+////AuHrRQAJAAAAFgAU7GjPiRbOfeES4pnRFuS3f466eCkQJwAAAAAAABYAFJz79oL5/lWICJ9Yfk7g1z/tKw671RoeAAEBHxAnAAAAAAAAFgAUnPv2gvn+VYgIn1h+TuDXP+0rDrsiBgOBuLfcCkFk/1B6LkCBn4uZuP0EV2cz+PhiYCSmSVNjthDMZttGAAAAgAAAAIACAACAAAAiAgPsIGy6eXigvHcW/9xgIVOJI2Ujj7/vWYtJg6noe8mgDhDMZttGAAAAgAEAAIABAACAAA=="
+
+func TestDecodePSBTUnsignedTx(t *testing.T) {
+	tx, err := DecodePSBTUnsignedTx(testPSBT)
+	assert.NoError(t, err)
+	assert.Equal(t, "dee5b21ef0e839c39f7ee1b690f1b0e63155af35ca85b6e1a50d7803b008b561", tx.TxHash().String())
+	assert.Len(t, tx.TxIn, 1)
+	assert.Len(t, tx.TxOut, 2)
+	assert.Equal(t, int64(650), tx.TxOut[0].Value)
+	assert.Equal(t, "0020a6d2692a89ec58415005f66514621f95e904810840b39c06dc4484d29dd5cf97", hex.EncodeToString(tx.TxOut[0].PkScript))
+	assert.Equal(t, int64(9197), tx.TxOut[1].Value)
+}
+
+func TestDecodePSBTUnsignedTxWithInvalidInput(t *testing.T) {
+	_, err := DecodePSBTUnsignedTx("not base64")
+	assert.Error(t, err)
+
+	// a valid base64 string without the psbt magic
+	_, err = DecodePSBTUnsignedTx("AAAAAAAA")
+	assert.Equal(t, psbt.ErrInvalidMagicBytes, err)
+
+	// magic followed by an empty global map
+	_, err = DecodePSBTUnsignedTx("cHNidP8A")
+	assert.Equal(t, psbt.ErrInvalidPsbtFormat, err)
+}
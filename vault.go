@@ -0,0 +1,237 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/bitmark-inc/autonomy-pod-controller/bitcoind"
+)
+
+// DelayedTransaction is a signed transaction kept in the vault until its broadcast time
+type DelayedTransaction struct {
+	TxID        string    `json:"txid"`
+	Hex         string    `json:"hex"`
+	Submitter   string    `json:"submitter"`
+	Amount      int64     `json:"amount"`
+	CreatedAt   time.Time `json:"created_at"`
+	BroadcastAt time.Time `json:"broadcast_at"`
+}
+
+// vaultDelay returns how long a transaction reaching the vault threshold is kept
+// before it is broadcast. It returns zero if the vault mode is disabled.
+func vaultDelay(amount int64) time.Duration {
+	threshold := viper.GetInt64("vault.threshold")
+	if threshold <= 0 || amount < threshold {
+		return 0
+	}
+	return time.Duration(viper.GetInt("vault.delay")) * time.Minute
+}
+
+// transactionID returns the txid of a raw transaction in hex
+func transactionID(txHex string) (string, error) {
+	b, err := hex.DecodeString(txHex)
+	if err != nil {
+		return "", err
+	}
+
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return "", err
+	}
+	return tx.TxHash().String(), nil
+}
+
+// releaseTransaction broadcasts a signed transaction immediately or keeps it in the vault
+// if the amount reaches the vault threshold. The amount is recorded as spent in both cases,
+// and the spending of a transaction in the vault is refunded if it is never broadcast.
+func (c *Controller) releaseTransaction(client *rpcclient.Client, submitter, txHex string, amount int64) (map[string]string, error) {
+	now := c.now()
+
+	if delay := vaultDelay(amount); delay > 0 {
+		txID, err := transactionID(txHex)
+		if err != nil {
+			return nil, err
+		}
+
+		tx := DelayedTransaction{
+			TxID:        txID,
+			Hex:         txHex,
+			Submitter:   submitter,
+			Amount:      amount,
+			CreatedAt:   now,
+			BroadcastAt: now.Add(delay),
+		}
+		if err := c.store.SaveDelayedTransaction(tx); err != nil {
+			return nil, err
+		}
+		c.recordSpending(submitter, amount, now, txID)
+		c.notifyDelayedTransaction(c.owner(), &tx, txStatusDelayed, nil)
+
+		return map[string]string{
+			"status":       txStatusDelayed,
+			"txid":         txID,
+			"broadcast_at": tx.BroadcastAt.UTC().Format(time.RFC3339),
+		}, nil
+	}
+
+	txID, err := c.broadcastTransaction(client, txHex)
+	if err != nil {
+		return nil, err
+	}
+	c.recordSpending(submitter, amount, now, txID)
+
+	return map[string]string{"status": txStatusBroadcast, "txid": txID}, nil
+}
+
+// recordSpending adds the amount to the spending records of a DID
+func (c *Controller) recordSpending(did string, amount int64, spentAt time.Time, txID string) {
+	if err := c.store.AddSpending(did, amount, spentAt, txID); err != nil {
+		log.WithError(err).WithField("txid", txID).Error("fail to record spending")
+	}
+}
+
+// refundSpending removes the spending recorded for a transaction in the vault which is
+// cancelled or rejected, so that it does not count against the limit of the submitter
+func (c *Controller) refundSpending(tx *DelayedTransaction) {
+	if err := c.store.RemoveSpending(tx.Submitter, tx.CreatedAt, tx.TxID); err != nil {
+		log.WithError(err).WithField("txid", tx.TxID).Error("fail to refund spending")
+	}
+}
+
+// broadcastDueTransactions broadcasts transactions in the vault of which the delay has passed
+func (c *Controller) broadcastDueTransactions(now time.Time) {
+	due := make([]DelayedTransaction, 0)
+	for _, tx := range c.store.DelayedTransactions() {
+		if !tx.BroadcastAt.After(now) {
+			due = append(due, tx)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	client, err := bitcoind.NewBtcdRPCClient()
+	if err != nil {
+		log.WithError(err).Error("fail to create bitcoind client for delayed transactions")
+		return
+	}
+	defer client.Shutdown()
+
+	c.vaultLock.Lock()
+	defer c.vaultLock.Unlock()
+
+	for i := range due {
+		tx := due[i]
+		logger := log.WithField("txid", tx.TxID)
+
+		// skip transactions which are cancelled in the meantime
+		if c.store.DelayedTransaction(tx.TxID) == nil {
+			continue
+		}
+
+		_, err := c.broadcastTransaction(client, tx.Hex)
+		if err != nil {
+			jerr, ok := err.(*btcjson.RPCError)
+			if !ok {
+				// bitcoind is not reachable. It may be suspended so we try to wake it
+				// up and the transaction will be broadcast in the next round.
+				logger.WithError(err).Warn("fail to broadcast delayed transaction")
+				if _, err := c.startBitcoind(); err != nil {
+					logger.WithError(err).Error("fail to start bitcoind for delayed transactions")
+				}
+				return
+			}
+
+			if jerr.Code != btcjson.ErrRPCVerifyAlreadyInChain {
+				logger.WithError(err).Error("delayed transaction rejected by bitcoind")
+				if err := c.store.RemoveDelayedTransaction(tx.TxID); err != nil {
+					logger.WithError(err).Error("fail to remove delayed transaction")
+				}
+				c.refundSpending(&tx)
+				c.notifyDelayedTransaction(tx.Submitter, &tx, txStatusFailed, err)
+				continue
+			}
+		}
+
+		if err := c.store.RemoveDelayedTransaction(tx.TxID); err != nil {
+			logger.WithError(err).Error("fail to remove delayed transaction")
+		}
+		logger.Info("delayed transaction broadcast")
+		c.notifyDelayedTransaction(tx.Submitter, &tx, txStatusBroadcast, nil)
+	}
+}
+
+// cancelPendingTx drops a transaction in the vault before it is broadcast and refunds
+// its spending. Only the owner is allowed to cancel it.
+func (c *Controller) cancelPendingTx(did, txID string) (map[string]string, error) {
+	if did != c.owner() {
+		return nil, fmt.Errorf("only the owner is allowed to cancel pending transactions")
+	}
+
+	c.vaultLock.Lock()
+	defer c.vaultLock.Unlock()
+
+	tx := c.store.DelayedTransaction(txID)
+	if tx == nil {
+		return nil, fmt.Errorf("pending transaction not found")
+	}
+
+	if err := c.store.RemoveDelayedTransaction(txID); err != nil {
+		return nil, err
+	}
+	c.refundSpending(tx)
+	c.notifyDelayedTransaction(tx.Submitter, tx, txStatusCancelled, nil)
+
+	return map[string]string{"status": txStatusCancelled, "txid": txID}, nil
+}
+
+// listPendingTxs returns transactions in the vault
+func (c *Controller) listPendingTxs() (map[string]interface{}, error) {
+	txs := make([]map[string]interface{}, 0)
+	for _, tx := range c.store.DelayedTransactions() {
+		txs = append(txs, map[string]interface{}{
+			"txid":         tx.TxID,
+			"submitter":    tx.Submitter,
+			"amount":       tx.Amount,
+			"created_at":   tx.CreatedAt,
+			"broadcast_at": tx.BroadcastAt,
+		})
+	}
+	return map[string]interface{}{"pending_txs": txs}, nil
+}
+
+// notifyDelayedTransaction notifies an account about the status of a transaction in the vault
+func (c *Controller) notifyDelayedTransaction(accountID string, tx *DelayedTransaction, status string, outcomeErr error) {
+	data := map[string]interface{}{
+		"event":        "delayed_transaction",
+		"txid":         tx.TxID,
+		"status":       status,
+		"submitter":    tx.Submitter,
+		"amount":       tx.Amount,
+		"broadcast_at": tx.BroadcastAt,
+	}
+	if outcomeErr != nil {
+		data["error"] = outcomeErr.Error()
+	}
+
+	contents := map[string]string{
+		"en": fmt.Sprintf("Transaction %s", status),
+	}
+
+	if err := c.sendNotification(accountID, contents, data); err != nil {
+		log.WithError(err).WithField("txid", tx.TxID).Error("fail to notify the delayed transaction")
+	}
+}
@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: ISC
+// Copyright (c) 2019-2021 Bitmark Inc.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/golang/mock/gomock"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultDelay(t *testing.T) {
+	defer viper.Set("vault.threshold", 0)
+	defer viper.Set("vault.delay", 0)
+
+	viper.Set("vault.threshold", 0)
+	viper.Set("vault.delay", 60)
+	assert.Equal(t, time.Duration(0), vaultDelay(100000000))
+
+	viper.Set("vault.threshold", 1000000)
+	assert.Equal(t, time.Duration(0), vaultDelay(999999))
+	assert.Equal(t, time.Hour, vaultDelay(1000000))
+	assert.Equal(t, time.Hour, vaultDelay(2000000))
+}
+
+func TestTransactionID(t *testing.T) {
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x01}, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x00, 0x14}))
+	var buf bytes.Buffer
+	assert.NoError(t, tx.Serialize(&buf))
+
+	txID, err := transactionID(hex.EncodeToString(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, tx.TxHash().String(), txID)
+
+	_, err = transactionID("zz")
+	assert.Error(t, err)
+}
+
+func TestCancelPendingTx(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	viper.Set("notification_url", server.URL)
+	defer viper.Set("notification_url", "")
+
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	createdAt := time.Now()
+	mockedStore.EXPECT().DelayedTransaction("txid").Times(1).Return(&DelayedTransaction{TxID: "txid", Submitter: memberDID, CreatedAt: createdAt})
+	mockedStore.EXPECT().DelayedTransaction("unknown-txid").Times(1).Return(nil)
+	mockedStore.EXPECT().RemoveDelayedTransaction("txid").Times(1).Return(nil)
+	mockedStore.EXPECT().RemoveSpending(memberDID, createdAt, "txid").Times(1).Return(nil)
+
+	c := Controller{ownerDID: ownerDID, store: mockedStore, Identity: i, httpClient: http.DefaultClient}
+
+	_, err = c.cancelPendingTx(memberDID, "txid")
+	assert.EqualError(t, err, "only the owner is allowed to cancel pending transactions")
+
+	_, err = c.cancelPendingTx(ownerDID, "unknown-txid")
+	assert.EqualError(t, err, "pending transaction not found")
+
+	r, err := c.cancelPendingTx(ownerDID, "txid")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"status": "cancelled", "txid": "txid"}, r)
+}
+
+func TestBroadcastDueTransactionsWithoutDueTransactions(t *testing.T) {
+	now := time.Now()
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	mockedStore := NewMockStore(mockCtl)
+	mockedStore.EXPECT().DelayedTransactions().Times(1).Return([]DelayedTransaction{
+		{TxID: "txid", BroadcastAt: now.Add(time.Minute)},
+	})
+
+	c := Controller{store: mockedStore}
+
+	// no bitcoind request is made if no transaction is due
+	c.broadcastDueTransactions(now)
+}
+
+func TestVaultRefundsSpending(t *testing.T) {
+	ownerDID := "did:key:zQ3shvD5cZSLggSCiu4jmF3jRY6GMUb7zvwChfhYQGJfQudJE"
+	memberDID := "did:key:zQ3shrG4MGtHFTq4BMaPtWRysMuTXVB5H2G4upbQzvk9PyANM"
+
+	notification := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer notification.Close()
+	// bitcoind rejects every transaction
+	bitcoind := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":1,"result":null,"error":{"code":-26,"message":"non-mandatory-script-verify-flag"}}`))
+	}))
+	defer bitcoind.Close()
+
+	viper.Set("notification_url", notification.URL)
+	viper.Set("bitcoind.rpcconnect", bitcoind.URL)
+	viper.Set("bitcoind.rpcuser", "user")
+	viper.Set("bitcoind.rpcpassword", "password")
+	viper.Set("vault.threshold", 1000)
+	viper.Set("vault.delay", 60)
+	defer func() {
+		for _, k := range []string{"notification_url", "bitcoind.rpcconnect", "bitcoind.rpcuser", "bitcoind.rpcpassword", "vault.threshold", "vault.delay"} {
+			viper.Set(k, nil)
+		}
+	}()
+
+	i, err := NewPodIdentity()
+	assert.NoError(t, err)
+	s := NewMemoryStore()
+	c := Controller{ownerDID: ownerDID, store: s, Identity: i, httpClient: http.DefaultClient}
+
+	newTxHex := func(n uint32) string {
+		tx := wire.NewMsgTx(2)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x01}, n), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(5000, []byte{0x00, 0x14}))
+		var buf bytes.Buffer
+		assert.NoError(t, tx.Serialize(&buf))
+		return hex.EncodeToString(buf.Bytes())
+	}
+	since := time.Now().Add(-time.Hour)
+	spent := func() int64 {
+		v, err := s.SpentSince(memberDID, since)
+		assert.NoError(t, err)
+		return v
+	}
+
+	// a cancelled transaction does not count against the limit
+	r, err := c.releaseTransaction(nil, memberDID, newTxHex(0), 5000)
+	assert.NoError(t, err)
+	assert.Equal(t, txStatusDelayed, r["status"])
+	assert.Equal(t, int64(5000), spent())
+
+	_, err = c.cancelPendingTx(ownerDID, r["txid"])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), spent())
+
+	// neither does a transaction rejected by bitcoind
+	r, err = c.releaseTransaction(nil, memberDID, newTxHex(1), 5000)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5000), spent())
+
+	c.broadcastDueTransactions(time.Now().Add(2 * time.Hour))
+	assert.Nil(t, s.DelayedTransaction(r["txid"]))
+	assert.Equal(t, int64(0), spent())
+}